@@ -0,0 +1,95 @@
+package cluster
+
+import (
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"dev.volix.ops/thor/pkg/slog"
+	"dev.volix.ops/thor/web"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+// errNoAuth is returned for clusters whose instances
+// can not authenticate to each other.
+var errNoAuth = errors.New("the cluster requires a bearer token or a client certificate")
+
+// Auth authenticates the instances of a cluster to each other. Every
+// instance sends the bearer token or the client certificate with its
+// requests, and the endpoints of the cluster require them.
+type Auth struct {
+	// BearerToken is shared by all instances.
+	BearerToken string
+	// TLSConfig is used for https URLs. If it contains a certificate,
+	// it is sent as client certificate.
+	TLSConfig *tls.Config
+}
+
+// hasClientCert returns true, if a client certificate is sent.
+func (a Auth) hasClientCert() bool {
+	return a.TLSConfig != nil && (len(a.TLSConfig.Certificates) > 0 || a.TLSConfig.GetClientCertificate != nil)
+}
+
+// validate checks that the instances can authenticate to each other.
+func (a Auth) validate() error {
+	if a.BearerToken == "" && !a.hasClientCert() {
+		return errNoAuth
+	}
+	return nil
+}
+
+// authenticated returns true, if the request carries the bearer token or,
+// without one, a verified client certificate.
+func (a Auth) authenticated(r *http.Request) bool {
+	if a.BearerToken == "" {
+		_, verified := web.ClientSubject(r)
+		return verified
+	}
+	auth := r.Header.Get("Authorization")
+	if len(auth) < len("Bearer ") || !strings.EqualFold(auth[:len("Bearer ")], "Bearer ") {
+		return false
+	}
+	token := strings.TrimSpace(auth[len("Bearer "):])
+	return subtle.ConstantTimeCompare([]byte(token), []byte(a.BearerToken)) == 1
+}
+
+// protect wraps the handler, so that only other instances reach it.
+func (a Auth) protect(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !a.authenticated(r) {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+
+			slog.Debug("unauthenticated cluster request from ", r.RemoteAddr)
+			return
+		}
+		h(w, r)
+	}
+}
+
+// LoadTLSConfig creates the TLS config of the requests to other instances
+// from the client certificate and key and the CA verifying the instances.
+// All of them are optional.
+func LoadTLSConfig(certFile, keyFile, caFile string) (*tls.Config, error) {
+	c := &tls.Config{MinVersion: tls.VersionTLS12}
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		c.Certificates = []tls.Certificate{cert}
+	}
+	if caFile != "" {
+		b, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		c.RootCAs = x509.NewCertPool()
+		if !c.RootCAs.AppendCertsFromPEM(b) {
+			return nil, fmt.Errorf("no certificates found in %s", caFile)
+		}
+	}
+	return c, nil
+}
@@ -0,0 +1,73 @@
+package cluster
+
+import (
+	"bytes"
+	"dev.volix.ops/thor/storage"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClusterRequiresAuth(t *testing.T) {
+	ms := storage.NewMetricStorage()
+	if _, err := NewReplicator(ms, nil, nil, Auth{}); err != errNoAuth {
+		t.Errorf("expected %v for replicator, got %v", errNoAuth, err)
+	}
+	if _, err := NewSharder(ms, nil, "http://thor-0:9091", nil, Auth{}); err != errNoAuth {
+		t.Errorf("expected %v for sharder, got %v", errNoAuth, err)
+	}
+	if _, err := NewGossip("http://thor-0:9091", nil, Auth{}, func([]string) {}); err != errNoAuth {
+		t.Errorf("expected %v for gossip, got %v", errNoAuth, err)
+	}
+}
+
+func TestGossipRejectsUnauthenticated(t *testing.T) {
+	g, err := NewGossip("http://thor-0:9091", nil, testAuth, func([]string) {})
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := json.Marshal([]Member{{Name: "http://evil:9091", State: StateAlive}})
+
+	for _, auth := range []string{"", "Bearer wrong", "Basic c2VjcmV0", "Bearer secret2"} {
+		req, _ := http.NewRequest("POST", GossipPath, bytes.NewReader(body))
+		if auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
+		w := httptest.NewRecorder()
+		g.Handler()(w, req)
+		if w.Code != http.StatusUnauthorized {
+			t.Errorf("expected status %d with %q, got %d", http.StatusUnauthorized, auth, w.Code)
+		}
+	}
+	if live := g.live(); len(live) != 1 {
+		t.Fatalf("expected only self as member, got %v", live)
+	}
+
+	// the other members can announce new ones.
+	req, _ := http.NewRequest("POST", GossipPath, bytes.NewReader(body))
+	req.Header.Set("Authorization", "Bearer "+testAuth.BearerToken)
+	w := httptest.NewRecorder()
+	g.Handler()(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d: %s", http.StatusOK, w.Code, w.Body)
+	}
+	if live := g.live(); len(live) != 2 {
+		t.Errorf("expected the announced member, got %v", live)
+	}
+}
+
+func TestForwardRejectsUnauthenticated(t *testing.T) {
+	ms := storage.NewMetricStorage()
+	s, err := NewSharder(ms, nil, "http://thor-0:9091", nil, testAuth)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := json.Marshal(wireRequest{Origin: "member", Sequence: 1, Labels: map[string]string{"job": "lobby"}})
+	req, _ := http.NewRequest("POST", ForwardPath, bytes.NewReader(body))
+	w := httptest.NewRecorder()
+	s.ForwardHandler()(w, req)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("expected status %d, got %d", http.StatusUnauthorized, w.Code)
+	}
+}
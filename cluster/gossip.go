@@ -0,0 +1,420 @@
+package cluster
+
+import (
+	"bytes"
+	"dev.volix.ops/thor/pkg/slog"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// Paths of the gossip endpoints.
+	GossipPath      = "/api/v1/cluster/gossip"
+	GossipProbePath = "/api/v1/cluster/gossip/probe"
+
+	// How often the members are exchanged with a random member.
+	gossipInterval = time.Second
+	// How long a member is suspected, before it is declared dead.
+	suspicionTimeout = 5 * time.Second
+	// How long dead members are remembered.
+	deadRetention = time.Minute
+	// How many members are asked to probe a member, which
+	// did not respond itself.
+	indirectProbes = 3
+)
+
+// The State of a Member. The order matters: with the same
+// incarnation, a higher state overrides a lower one.
+type State int
+
+const (
+	StateAlive State = iota
+	StateSuspect
+	StateDead
+)
+
+func (s State) String() string {
+	switch s {
+	case StateAlive:
+		return "alive"
+	case StateSuspect:
+		return "suspect"
+	case StateDead:
+		return "dead"
+	}
+	return "unknown"
+}
+
+func (s State) MarshalJSON() ([]byte, error) {
+	return json.Marshal(s.String())
+}
+
+func (s *State) UnmarshalJSON(b []byte) error {
+	var str string
+	if err := json.Unmarshal(b, &str); err != nil {
+		return err
+	}
+	for _, state := range []State{StateAlive, StateSuspect, StateDead} {
+		if state.String() == str {
+			*s = state
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown state %q", str)
+}
+
+// A Member of the cluster, named by its base URL. Only a member
+// itself increases its incarnation, to refute that it is suspected.
+type Member struct {
+	Name        string `json:"name"`
+	Incarnation uint64 `json:"incarnation"`
+	State       State  `json:"state"`
+	// Since is the local time of the last change of the state,
+	// it is not taken from other members.
+	Since time.Time `json:"since"`
+}
+
+// Gossip discovers the members of the cluster and detects their failures,
+// similar to SWIM: every interval, the members are exchanged with a random
+// member. If it does not respond, other members are asked to probe it. If
+// they can not reach it either, it is suspected and declared dead, unless
+// it refutes the suspicion in time.
+//
+// New instances join by exchanging the members with one of the seeds, e.g.
+// a DNS name resolving to any instance.
+type Gossip struct {
+	client
+	self     string
+	seeds    []string
+	onChange func(members []string)
+	changed  chan struct{}
+	probes   *http.Client
+
+	interval         time.Duration
+	suspicionTimeout time.Duration
+
+	mu       sync.Mutex
+	members  map[string]*Member
+	lastLive []string
+}
+
+// NewGossip creates a Gossip for the instance with the base URL self.
+// onChange is called with the live (alive or suspected) members, including
+// self, whenever they change. The members authenticate to each other with
+// the auth, so that only they can announce new members.
+func NewGossip(self string, seeds []string, auth Auth, onChange func(members []string)) (*Gossip, error) {
+	if err := auth.validate(); err != nil {
+		return nil, err
+	}
+	self, err := parseURL(self)
+	if err != nil {
+		return nil, fmt.Errorf("invalid advertise URL: %v", err)
+	}
+
+	g := &Gossip{
+		client:   newClient(auth),
+		self:     self,
+		onChange: onChange,
+		changed:  make(chan struct{}, 1),
+		probes:   newHTTPClient(auth, probeTimeout),
+
+		interval:         gossipInterval,
+		suspicionTimeout: suspicionTimeout,
+
+		members: map[string]*Member{
+			// the incarnation starts with the time, so that it is
+			// higher than the one of a previous start with this URL.
+			self: {Name: self, Incarnation: uint64(time.Now().UnixNano()), State: StateAlive, Since: time.Now()},
+		},
+	}
+	for _, s := range seeds {
+		u, err := parseURL(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid seed: %v", err)
+		}
+		g.seeds = append(g.seeds, u)
+	}
+	return g, nil
+}
+
+// Start joins the cluster and starts to gossip. The members are
+// exchanged with the seeds once, before Start returns.
+func (g *Gossip) Start() {
+	for _, seed := range g.seeds {
+		if err := g.exchange(seed); err != nil {
+			slog.Info(fmt.Sprintf("could not join with seed %s: %v", seed, err))
+		}
+	}
+	g.notify()
+
+	go func() {
+		for range g.changed {
+			g.onChange(g.live())
+		}
+	}()
+	go func() {
+		for range time.Tick(g.interval) {
+			g.round()
+		}
+	}()
+}
+
+// Members returns all known members, sorted by their name.
+func (g *Gossip) Members() []Member {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	result := make([]Member, 0, len(g.members))
+	for _, m := range g.members {
+		result = append(result, *m)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Name < result[j].Name })
+	return result
+}
+
+// live returns the sorted names of the alive and suspected members.
+func (g *Gossip) live() []string {
+	var names []string
+	for _, m := range g.Members() {
+		if m.State != StateDead {
+			names = append(names, m.Name)
+		}
+	}
+	return names
+}
+
+// notify signals a change of the live members to onChange.
+func (g *Gossip) notify() {
+	live := g.live()
+
+	g.mu.Lock()
+	changed := !equalStrings(live, g.lastLive)
+	g.lastLive = live
+	g.mu.Unlock()
+
+	if changed {
+		select {
+		case g.changed <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// round exchanges the members with a random member and
+// updates the suspected and dead members.
+func (g *Gossip) round() {
+	target, known := g.randomMember()
+	if target == "" {
+		return
+	}
+
+	if err := g.exchange(target); err != nil {
+		slog.Debug(fmt.Sprintf("gossip with %s failed: %v", target, err))
+		if known && !g.probeIndirect(target) {
+			g.suspect(target)
+		}
+	}
+	g.expire()
+	g.notify()
+}
+
+// randomMember returns a random live member other than self, or a
+// seed if there is none. known is false for seeds.
+func (g *Gossip) randomMember() (string, bool) {
+	g.mu.Lock()
+	var candidates []string
+	for name, m := range g.members {
+		if name != g.self && m.State != StateDead {
+			candidates = append(candidates, name)
+		}
+	}
+	g.mu.Unlock()
+
+	if len(candidates) > 0 {
+		return candidates[rand.Intn(len(candidates))], true
+	}
+	if len(g.seeds) > 0 {
+		// all other members are gone, try to join again.
+		return g.seeds[rand.Intn(len(g.seeds))], false
+	}
+	return "", false
+}
+
+// exchange sends the members to the target and merges the ones it responds with.
+func (g *Gossip) exchange(target string) error {
+	body, err := json.Marshal(g.Members())
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, target+GossipPath, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	var members []Member
+	if err := g.do(req, &members); err != nil {
+		return err
+	}
+	g.merge(members)
+	return nil
+}
+
+// probeIndirect asks other members to probe the target and
+// returns true, if one of them could reach it.
+func (g *Gossip) probeIndirect(target string) bool {
+	g.mu.Lock()
+	var helpers []string
+	for name, m := range g.members {
+		if name != g.self && name != target && m.State == StateAlive {
+			helpers = append(helpers, name)
+		}
+	}
+	g.mu.Unlock()
+
+	rand.Shuffle(len(helpers), func(i, j int) { helpers[i], helpers[j] = helpers[j], helpers[i] })
+	if len(helpers) > indirectProbes {
+		helpers = helpers[:indirectProbes]
+	}
+	for _, helper := range helpers {
+		req, err := http.NewRequest(http.MethodPost, helper+GossipProbePath+"?target="+url.QueryEscape(target), nil)
+		if err != nil {
+			continue
+		}
+		if err := g.do(req, nil); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// suspect marks the member as suspected, if it is alive.
+func (g *Gossip) suspect(name string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if m, ok := g.members[name]; ok && m.State == StateAlive {
+		slog.Info("suspecting member ", name)
+		m.State = StateSuspect
+		m.Since = time.Now()
+	}
+}
+
+// expire declares suspected members dead after the suspicion
+// timeout and forgets dead ones after the retention.
+func (g *Gossip) expire() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	now := time.Now()
+	for name, m := range g.members {
+		switch {
+		case m.State == StateSuspect && now.Sub(m.Since) >= g.suspicionTimeout:
+			slog.Info("member is dead: ", name)
+			m.State = StateDead
+			m.Since = now
+		case m.State == StateDead && now.Sub(m.Since) >= deadRetention:
+			delete(g.members, name)
+		}
+	}
+}
+
+// merge merges the members received from another member. The handler
+// only accepts authenticated members and exchange only contacts known
+// members and seeds, so no one else can announce new members.
+func (g *Gossip) merge(members []Member) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	now := time.Now()
+	for _, m := range members {
+		if _, err := parseURL(m.Name); err != nil {
+			continue
+		}
+
+		if m.Name == g.self {
+			self := g.members[g.self]
+			if m.State != StateAlive && m.Incarnation >= self.Incarnation {
+				// refute the suspicion with a higher incarnation.
+				self.Incarnation = m.Incarnation + 1
+				slog.Info(fmt.Sprintf("refuting being %s with incarnation %d", m.State, self.Incarnation))
+			}
+			continue
+		}
+
+		cur, ok := g.members[m.Name]
+		if !ok {
+			// dead members are not learned, otherwise
+			// they would be passed around forever.
+			if m.State != StateDead {
+				g.members[m.Name] = &Member{Name: m.Name, Incarnation: m.Incarnation, State: m.State, Since: now}
+			}
+			continue
+		}
+		if m.Incarnation > cur.Incarnation || (m.Incarnation == cur.Incarnation && m.State > cur.State) {
+			cur.Incarnation = m.Incarnation
+			if cur.State != m.State {
+				cur.State = m.State
+				cur.Since = now
+			}
+		}
+	}
+}
+
+// Handler returns a http.HandlerFunc exchanging the
+// members with another member.
+func (g *Gossip) Handler() http.HandlerFunc {
+	return g.auth.protect(func(w http.ResponseWriter, r *http.Request) {
+		var members []Member
+		if err := json.NewDecoder(r.Body).Decode(&members); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+
+			slog.Debug("invalid gossip from ", r.RemoteAddr)
+			slog.Debug(err.Error())
+			return
+		}
+		g.merge(members)
+		g.notify()
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(g.Members()); err != nil {
+			slog.Debug("failed to write gossip: ", err)
+		}
+	})
+}
+
+// ProbeHandler returns a http.HandlerFunc probing the member given by
+// the `target` parameter on behalf of another member. It responds with
+// http.StatusServiceUnavailable, if the target can not be reached.
+func (g *Gossip) ProbeHandler() http.HandlerFunc {
+	return g.auth.protect(func(w http.ResponseWriter, r *http.Request) {
+		target := r.FormValue("target")
+		g.mu.Lock()
+		_, ok := g.members[target]
+		g.mu.Unlock()
+		if !ok {
+			// only known members are probed, so that this
+			// can not be used to send requests anywhere.
+			http.Error(w, fmt.Sprintf("unknown member %q", target), http.StatusBadRequest)
+			return
+		}
+
+		resp, err := g.probes.Get(target + "/-/healthy")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			http.Error(w, resp.Status, http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
@@ -0,0 +1,118 @@
+package cluster
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// newGossips creates gossips served by test servers, which
+// join the cluster with the first one as seed.
+func newGossips(t *testing.T, n int) ([]*Gossip, []*httptest.Server) {
+	gossips := make([]*Gossip, n)
+	servers := make([]*httptest.Server, n)
+	for i := range gossips {
+		i := i
+		mux := http.NewServeMux()
+		mux.HandleFunc("/-/healthy", func(w http.ResponseWriter, r *http.Request) {})
+		mux.HandleFunc(GossipPath, func(w http.ResponseWriter, r *http.Request) { gossips[i].Handler()(w, r) })
+		mux.HandleFunc(GossipProbePath, func(w http.ResponseWriter, r *http.Request) { gossips[i].ProbeHandler()(w, r) })
+		servers[i] = httptest.NewServer(mux)
+	}
+
+	for i := range gossips {
+		var err error
+		gossips[i], err = NewGossip(servers[i].URL, []string{servers[0].URL}, testAuth, func([]string) {})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// join without starting the background rounds,
+	// which are run explicitly by the tests.
+	for _, g := range gossips {
+		for _, seed := range g.seeds {
+			if err := g.exchange(seed); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	return gossips, servers
+}
+
+func states(g *Gossip) map[string]State {
+	result := map[string]State{}
+	for _, m := range g.Members() {
+		result[m.Name] = m.State
+	}
+	return result
+}
+
+func TestGossipJoin(t *testing.T) {
+	gossips, servers := newGossips(t, 3)
+	for _, s := range servers {
+		defer s.Close()
+	}
+
+	for i := 0; i < 10; i++ {
+		for _, g := range gossips {
+			g.round()
+		}
+	}
+	for _, g := range gossips {
+		if live := g.live(); len(live) != 3 {
+			t.Errorf("expected %s to know 3 live members, got %v", g.self, live)
+		}
+	}
+}
+
+func TestGossipFailureDetection(t *testing.T) {
+	gossips, servers := newGossips(t, 3)
+	for _, s := range servers[:2] {
+		defer s.Close()
+	}
+	for i := 0; i < 10; i++ {
+		for _, g := range gossips {
+			g.round()
+		}
+	}
+
+	servers[2].Close()
+	failed := gossips[2].self
+	for _, g := range gossips[:2] {
+		g.suspicionTimeout = 0
+	}
+	for i := 0; i < 50 && (states(gossips[0])[failed] != StateDead || states(gossips[1])[failed] != StateDead); i++ {
+		for _, g := range gossips[:2] {
+			g.round()
+		}
+	}
+	for _, g := range gossips[:2] {
+		if state := states(g)[failed]; state != StateDead {
+			t.Errorf("expected %s to be dead for %s, got %s", failed, g.self, state)
+		}
+		if live := g.live(); len(live) != 2 {
+			t.Errorf("expected 2 live members for %s, got %v", g.self, live)
+		}
+	}
+}
+
+func TestGossipRefute(t *testing.T) {
+	gossips, servers := newGossips(t, 2)
+	for _, s := range servers {
+		defer s.Close()
+	}
+
+	// the second member suspects the first one, which is still alive.
+	gossips[1].suspect(gossips[0].self)
+	if state := states(gossips[1])[gossips[0].self]; state != StateSuspect {
+		t.Fatalf("expected suspect, got %s", state)
+	}
+
+	// the first one learns about it and refutes it.
+	if err := gossips[1].exchange(gossips[0].self); err != nil {
+		t.Fatal(err)
+	}
+	if state := states(gossips[1])[gossips[0].self]; state != StateAlive {
+		t.Errorf("expected the suspicion to be refuted, got %s", state)
+	}
+}
@@ -0,0 +1,417 @@
+// Package cluster lets multiple Thor instances work together.
+//
+// With replication, every instance sends the write requests it applied
+// to all of its peers, so that every instance converges on the same groups
+// and Prometheus can scrape any of them.
+//
+// With sharding, every group is owned by one instance instead, so that
+// the groups are spread over the instances.
+package cluster
+
+import (
+	"bytes"
+	"dev.volix.ops/thor/pkg/slog"
+	"dev.volix.ops/thor/storage"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// Paths of the replication endpoints.
+	ReplicatePath = "/api/v1/cluster/replicate"
+	SnapshotPath  = "/api/v1/cluster/snapshot"
+
+	// How many requests are queued per peer, before
+	// new requests are dropped.
+	maxQueueLength = 10000
+	// How many requests are sent to a peer at once.
+	maxBatchSize = 500
+
+	// Backoff of retries to send to a peer.
+	minBackoff = 100 * time.Millisecond
+	maxBackoff = 30 * time.Second
+)
+
+var (
+	replicationQueueLength = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "thor_replication_queue_length",
+		Help: "Number of write requests waiting to be replicated to a peer.",
+	}, []string{"peer"})
+	replicationErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "thor_replication_errors_total",
+		Help: "Total number of failed attempts to replicate write requests to a peer.",
+	}, []string{"peer"})
+	replicationDropped = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "thor_replication_dropped_total",
+		Help: "Total number of write requests not replicated to a peer, because its queue was full.",
+	}, []string{"peer"})
+	replicationRejected = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "thor_replication_rejected_total",
+		Help: "Total number of replicated write requests rejected as inconsistent.",
+	})
+	replicationGaps = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "thor_replication_gaps_total",
+		Help: "Total number of replicated batches rejected, because requests of their origin were missing.",
+	})
+)
+
+// A Replicator replicates the write requests of the storages
+// to statically configured peers, and applies the ones
+// replicated from its peers.
+//
+// Every instance numbers the requests it replicates. The peers
+// remember the last applied number of every instance and ignore
+// requests they already applied, so that a retried request never
+// increases a counter twice. If requests of an instance are missing,
+// e.g. because they were dropped from a full queue, its batches are
+// rejected and the storages are synced with a peer again.
+type Replicator struct {
+	client
+	origin  string
+	peers   []*peer
+	ms      *storage.MetricStorage
+	tenants *storage.Tenants
+
+	// syncing is 1, while the storages are resynced.
+	syncing int32
+}
+
+type peer struct {
+	url    string
+	notify chan struct{}
+
+	// sending is held while a batch is sent and dequeued,
+	// and while the storages are synced with the peer.
+	sending sync.Mutex
+
+	mu    sync.Mutex
+	queue []json.RawMessage
+}
+
+// A syncState contains the snapshots of all storages.
+type syncState struct {
+	Storage json.RawMessage            `json:"storage"`
+	Tenants map[string]json.RawMessage `json:"tenants,omitempty"`
+}
+
+// NewReplicator creates a Replicator for the storage ms and the storages
+// of the tenants, which may be nil. The peers are the base URLs of the
+// other instances, which authenticate to each other with the auth.
+func NewReplicator(ms *storage.MetricStorage, tenants *storage.Tenants, peers []string, auth Auth) (*Replicator, error) {
+	if err := auth.validate(); err != nil {
+		return nil, err
+	}
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "thor"
+	}
+
+	r := &Replicator{
+		// the origin is unique for every start, so that the peers never
+		// mistake new requests for ones of a previous start.
+		origin:  fmt.Sprintf("%s-%d", hostname, time.Now().UnixNano()),
+		client:  newClient(auth),
+		ms:      ms,
+		tenants: tenants,
+	}
+	for _, p := range peers {
+		u, err := parseURL(p)
+		if err != nil {
+			return nil, fmt.Errorf("invalid peer: %v", err)
+		}
+		r.peers = append(r.peers, &peer{
+			url:    u,
+			notify: make(chan struct{}, 1),
+		})
+	}
+	return r, nil
+}
+
+// Start enables the replication of the storages and starts
+// to send their requests to the peers.
+func (r *Replicator) Start() {
+	r.ms.EnableReplication(r.origin, func(wr storage.WriteRequest) { r.enqueue("", wr) })
+	if r.tenants != nil {
+		r.tenants.OnCreate(func(id string, ms *storage.MetricStorage) {
+			ms.EnableReplication(r.origin, func(wr storage.WriteRequest) { r.enqueue(id, wr) })
+		})
+	}
+
+	for _, p := range r.peers {
+		go r.send(p)
+	}
+}
+
+// enqueue encodes the request and adds it to the queues of all peers.
+func (r *Replicator) enqueue(tenant string, wr storage.WriteRequest) {
+	b, err := encodeRequest(tenant, wr)
+	if err != nil {
+		slog.Error("failed to encode write request for replication: ", err)
+		return
+	}
+
+	for _, p := range r.peers {
+		p.mu.Lock()
+		if len(p.queue) >= maxQueueLength {
+			p.mu.Unlock()
+			replicationDropped.WithLabelValues(p.url).Inc()
+			continue
+		}
+		p.queue = append(p.queue, b)
+		replicationQueueLength.WithLabelValues(p.url).Set(float64(len(p.queue)))
+		p.mu.Unlock()
+
+		select {
+		case p.notify <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// send sends the queued requests to the peer, until they are accepted.
+func (r *Replicator) send(p *peer) {
+	backoff := minBackoff
+	for range p.notify {
+		for {
+			p.sending.Lock()
+			p.mu.Lock()
+			n := len(p.queue)
+			if n > maxBatchSize {
+				n = maxBatchSize
+			}
+			batch := p.queue[:n:n]
+			p.mu.Unlock()
+			if n == 0 {
+				p.sending.Unlock()
+				break
+			}
+
+			if err := r.post(p, batch); err != nil {
+				p.sending.Unlock()
+				replicationErrors.WithLabelValues(p.url).Inc()
+				slog.Debug(fmt.Sprintf("failed to replicate to %s, retrying in %s: %v", p.url, backoff, err))
+
+				time.Sleep(backoff)
+				if backoff *= 2; backoff > maxBackoff {
+					backoff = maxBackoff
+				}
+				continue
+			}
+			backoff = minBackoff
+
+			p.mu.Lock()
+			p.queue = p.queue[n:]
+			replicationQueueLength.WithLabelValues(p.url).Set(float64(len(p.queue)))
+			p.mu.Unlock()
+			p.sending.Unlock()
+		}
+	}
+}
+
+// pending returns the queued requests of the tenant, which the peer
+// has not acknowledged yet. The sending lock has to be held.
+func (r *Replicator) pending(p *peer, tenant string) []storage.WriteRequest {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var result []storage.WriteRequest
+	for _, b := range p.queue {
+		var wire wireRequest
+		if err := json.Unmarshal(b, &wire); err != nil || wire.Tenant != tenant {
+			continue
+		}
+		wr, err := wire.writeRequest()
+		if err != nil {
+			continue
+		}
+		result = append(result, wr)
+	}
+	return result
+}
+
+func (r *Replicator) post(p *peer, batch []json.RawMessage) error {
+	body, err := json.Marshal(batch)
+	if err != nil {
+		return err
+	}
+	return r.client.post(p.url, ReplicatePath, body)
+}
+
+// Sync replaces the storages with the ones of the first peer, which
+// responds. It has to be called after Start, so that the versions of
+// the peer are restored as well. If no peer responds, the storages are
+// kept, as this is likely the first instance to start. Afterwards it is
+// only called again, if the storages diverged: the local requests, which
+// the peer has not applied yet, are applied again after the snapshot.
+func (r *Replicator) Sync() error {
+	for _, p := range r.peers {
+		synced, err := r.syncWith(p)
+		if err != nil {
+			return fmt.Errorf("invalid snapshot of %s: %v", p.url, err)
+		}
+		if synced {
+			slog.Info("synced storages with ", p.url)
+			return nil
+		}
+	}
+
+	slog.Info("no peer to sync with, starting empty")
+	return nil
+}
+
+// syncWith replaces the storages with the ones of the peer and returns
+// true, or false if the peer did not respond. Nothing is sent to the
+// peer meanwhile, so that its snapshot and the queue match each other.
+func (r *Replicator) syncWith(p *peer) (bool, error) {
+	p.sending.Lock()
+	defer p.sending.Unlock()
+
+	req, err := http.NewRequest(http.MethodGet, p.url+SnapshotPath, nil)
+	if err != nil {
+		return false, err
+	}
+	var state syncState
+	if err := r.do(req, &state); err != nil {
+		slog.Info(fmt.Sprintf("could not sync with %s: %v", p.url, err))
+		return false, nil
+	}
+	return true, r.restore(p, state)
+}
+
+// resync calls Sync, unless it is already running.
+func (r *Replicator) resync() {
+	if !atomic.CompareAndSwapInt32(&r.syncing, 0, 1) {
+		return
+	}
+	defer atomic.StoreInt32(&r.syncing, 0)
+
+	if err := r.Sync(); err != nil {
+		slog.Error("failed to sync diverged storages: ", err)
+	}
+}
+
+func (r *Replicator) restore(p *peer, state syncState) error {
+	pending := func(tenant string) func() []storage.WriteRequest {
+		return func() []storage.WriteRequest { return r.pending(p, tenant) }
+	}
+	if err := r.ms.Sync(bytes.NewReader(state.Storage), pending("")); err != nil {
+		return err
+	}
+	if len(state.Tenants) > 0 && r.tenants == nil {
+		return errors.New("peer has tenants, but multi-tenancy is disabled")
+	}
+	for id, snapshot := range state.Tenants {
+		ms, err := r.tenants.Get(id)
+		if err != nil {
+			return fmt.Errorf("tenant %q: %v", id, err)
+		}
+		if err := ms.Sync(bytes.NewReader(snapshot), pending(id)); err != nil {
+			return fmt.Errorf("tenant %q: %v", id, err)
+		}
+	}
+	return nil
+}
+
+// ReplicateHandler returns a http.HandlerFunc applying
+// the requests replicated by a peer.
+func (r *Replicator) ReplicateHandler() http.HandlerFunc {
+	return r.auth.protect(func(w http.ResponseWriter, req *http.Request) {
+		var batch []wireRequest
+		if err := json.NewDecoder(req.Body).Decode(&batch); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+
+			slog.Debug("invalid replication request from ", req.RemoteAddr)
+			slog.Debug(err.Error())
+			return
+		}
+
+		for _, wire := range batch {
+			ms, err := storageFor(r.ms, r.tenants, wire.Tenant)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+
+			wr, err := wire.writeRequest()
+			if err == nil && (wr.Origin == "" || wr.Sequence == 0 || wr.Stamp.IsZero()) {
+				err = errors.New("missing origin, sequence or stamp")
+			}
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+
+				slog.Debug("invalid replication request from ", req.RemoteAddr)
+				slog.Debug(err.Error())
+				return
+			}
+
+			if v := ms.Version(wr.Origin); wr.Sequence > v+1 {
+				// the requests in between are lost, so the
+				// storages diverged and have to be synced again.
+				err := fmt.Errorf("missing requests %d to %d of %s", v+1, wr.Sequence-1, wr.Origin)
+				http.Error(w, err.Error(), http.StatusConflict)
+
+				replicationGaps.Inc()
+				slog.Error(err.Error() + ", syncing again")
+				go r.resync()
+				return
+			}
+
+			wr.Done = make(chan error, 1)
+			ms.SubmitWriteRequest(wr)
+			if err := <-wr.Done; err != nil {
+				// the peers diverged, but the following
+				// requests can still be applied.
+				replicationRejected.Inc()
+				slog.Error(fmt.Sprintf("rejected request %d of %s: %v", wr.Sequence, wr.Origin, err))
+			}
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+// SnapshotHandler returns a http.HandlerFunc responding with
+// the snapshots of all storages, used by peers to Sync.
+func (r *Replicator) SnapshotHandler() http.HandlerFunc {
+	return r.auth.protect(func(w http.ResponseWriter, req *http.Request) {
+		var state syncState
+		var err error
+		if state.Storage, err = snapshot(r.ms); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if r.tenants != nil {
+			state.Tenants = map[string]json.RawMessage{}
+			for _, id := range r.tenants.IDs() {
+				ms, ok := r.tenants.Lookup(id)
+				if !ok {
+					continue
+				}
+				if state.Tenants[id], err = snapshot(ms); err != nil {
+					http.Error(w, err.Error(), http.StatusInternalServerError)
+					return
+				}
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(state); err != nil {
+			slog.Error("failed to write cluster snapshot: ", err)
+		}
+	})
+}
+
+func snapshot(ms *storage.MetricStorage) (json.RawMessage, error) {
+	var buf bytes.Buffer
+	if err := ms.WriteSnapshot(&buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,264 @@
+package cluster
+
+import (
+	"bytes"
+	"dev.volix.ops/thor/storage"
+	"encoding/json"
+	"github.com/golang/protobuf/proto"
+	dto "github.com/prometheus/client_model/go"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// testAuth authenticates the instances of the tests.
+var testAuth = Auth{BearerToken: "secret"}
+
+// node is a replicated storage served by a test server.
+type node struct {
+	ms     *storage.MetricStorage
+	r      *Replicator
+	server *httptest.Server
+}
+
+func newNodes(t *testing.T, n int) []*node {
+	nodes := make([]*node, n)
+	for i := range nodes {
+		nd := &node{ms: storage.NewMetricStorage()}
+		mux := http.NewServeMux()
+		mux.HandleFunc(ReplicatePath, func(w http.ResponseWriter, r *http.Request) { nd.r.ReplicateHandler()(w, r) })
+		mux.HandleFunc(SnapshotPath, func(w http.ResponseWriter, r *http.Request) { nd.r.SnapshotHandler()(w, r) })
+		nd.server = httptest.NewServer(mux)
+		nodes[i] = nd
+	}
+
+	for i, nd := range nodes {
+		var peers []string
+		for j, other := range nodes {
+			if i != j {
+				peers = append(peers, other.server.URL)
+			}
+		}
+		var err error
+		if nd.r, err = NewReplicator(nd.ms, nil, peers, testAuth); err != nil {
+			t.Fatal(err)
+		}
+		nd.r.Start()
+	}
+	return nodes
+}
+
+func pushCounter(t *testing.T, ms *storage.MetricStorage, value float64) {
+	done := make(chan error, 1)
+	ms.SubmitWriteRequest(storage.WriteRequest{
+		Labels:    map[string]string{"job": "lobby"},
+		Timestamp: time.Now(),
+		MetricFamilies: map[string]*dto.MetricFamily{
+			"logins_total": {
+				Name:   proto.String("logins_total"),
+				Type:   dto.MetricType_COUNTER.Enum(),
+				Metric: []*dto.Metric{{Counter: &dto.Counter{Value: proto.Float64(value)}}},
+			},
+		},
+		Done: done,
+	})
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func counterValue(ms *storage.MetricStorage) float64 {
+	for _, mf := range ms.GetMetricFamilies() {
+		if mf.GetName() == "logins_total" {
+			return mf.Metric[0].GetCounter().GetValue()
+		}
+	}
+	return 0
+}
+
+func waitForCounter(t *testing.T, ms *storage.MetricStorage, expected float64) {
+	deadline := time.Now().Add(5 * time.Second)
+	for counterValue(ms) != expected {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected counter %v, got %v", expected, counterValue(ms))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestReplication(t *testing.T) {
+	nodes := newNodes(t, 3)
+	for _, nd := range nodes {
+		defer nd.server.Close()
+	}
+
+	// pushes to different nodes are accumulated on every node.
+	pushCounter(t, nodes[0].ms, 2)
+	pushCounter(t, nodes[1].ms, 3)
+	for _, nd := range nodes {
+		waitForCounter(t, nd.ms, 5)
+	}
+}
+
+func TestReplicationWipe(t *testing.T) {
+	nodes := newNodes(t, 3)
+	for _, nd := range nodes {
+		defer nd.server.Close()
+	}
+
+	pushCounter(t, nodes[0].ms, 2)
+	for _, nd := range nodes {
+		waitForCounter(t, nd.ms, 2)
+	}
+
+	// a wipe of one node wipes every node, and
+	// later pushes are replicated as usual.
+	if n := nodes[1].ms.Wipe(); n != 1 {
+		t.Fatalf("expected 1 wiped group, got %d", n)
+	}
+	for _, nd := range nodes {
+		waitForCounter(t, nd.ms, 0)
+	}
+	pushCounter(t, nodes[2].ms, 3)
+	for _, nd := range nodes {
+		waitForCounter(t, nd.ms, 3)
+	}
+}
+
+func TestReplicationGap(t *testing.T) {
+	nodes := newNodes(t, 1)
+	defer nodes[0].server.Close()
+	pushCounter(t, nodes[0].ms, 2)
+
+	// the storage is not a peer of the node, so it misses its requests.
+	ms := storage.NewMetricStorage()
+	r, err := NewReplicator(ms, nil, []string{nodes[0].server.URL}, testAuth)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Start()
+
+	body, _ := json.Marshal([]wireRequest{{
+		Origin:   nodes[0].r.origin,
+		Sequence: 2,
+		Stamp:    time.Now(),
+		Labels:   map[string]string{"job": "lobby"},
+		Delete:   true,
+	}})
+	req, _ := http.NewRequest("POST", ReplicatePath, bytes.NewReader(body))
+	req.Header.Set("Authorization", "Bearer "+testAuth.BearerToken)
+	w := httptest.NewRecorder()
+	r.ReplicateHandler()(w, req)
+	if w.Code != http.StatusConflict {
+		t.Fatalf("expected status %d, got %d: %s", http.StatusConflict, w.Code, w.Body)
+	}
+
+	// the batch is rejected, and the storage syncs with the node.
+	waitForCounter(t, ms, 2)
+	deadline := time.Now().Add(5 * time.Second)
+	for ms.Version(nodes[0].r.origin) != 1 {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected version 1 of the node, got %d", ms.Version(nodes[0].r.origin))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", ReplicatePath, bytes.NewReader(body))
+	req.Header.Set("Authorization", "Bearer "+testAuth.BearerToken)
+	r.ReplicateHandler()(w, req)
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("expected status %d, got %d: %s", http.StatusNoContent, w.Code, w.Body)
+	}
+	waitForCounter(t, ms, 0)
+}
+
+func TestReplicationDuplicates(t *testing.T) {
+	ms := storage.NewMetricStorage()
+	r, err := NewReplicator(ms, nil, nil, testAuth)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Start()
+
+	b, _ := proto.Marshal(&dto.MetricFamily{
+		Name:   proto.String("logins_total"),
+		Type:   dto.MetricType_COUNTER.Enum(),
+		Metric: []*dto.Metric{{Counter: &dto.Counter{Value: proto.Float64(2)}}},
+	})
+	body, _ := json.Marshal([]wireRequest{{
+		Origin:   "peer",
+		Sequence: 1,
+		Stamp:    time.Now(),
+		Labels:   map[string]string{"job": "lobby"},
+		Families: [][]byte{b},
+	}})
+
+	// a peer retrying the request must not increase the counter twice.
+	for i := 0; i < 2; i++ {
+		req, _ := http.NewRequest("POST", ReplicatePath, bytes.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+testAuth.BearerToken)
+		w := httptest.NewRecorder()
+		r.ReplicateHandler()(w, req)
+		if w.Code != http.StatusNoContent {
+			t.Fatalf("expected status %d, got %d: %s", http.StatusNoContent, w.Code, w.Body)
+		}
+	}
+	if v := counterValue(ms); v != 2 {
+		t.Errorf("expected counter 2, got %v", v)
+	}
+}
+
+func TestSync(t *testing.T) {
+	nodes := newNodes(t, 1)
+	defer nodes[0].server.Close()
+	pushCounter(t, nodes[0].ms, 2)
+
+	ms := storage.NewMetricStorage()
+	r, err := NewReplicator(ms, nil, []string{"http://127.0.0.1:1", nodes[0].server.URL}, testAuth)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Start()
+	if err := r.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if v := counterValue(ms); v != 2 {
+		t.Fatalf("expected synced counter 2, got %v", v)
+	}
+
+	// the request of the snapshot is already applied and
+	// must be ignored, when it is replicated afterwards.
+	var snapshot bytes.Buffer
+	if err := nodes[0].ms.WriteSnapshot(&snapshot); err != nil {
+		t.Fatal(err)
+	}
+	_, versions, err := storage.ReadSnapshot(&snapshot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	ms.SubmitWriteRequest(storage.WriteRequest{
+		Labels: map[string]string{"job": "lobby"},
+		MetricFamilies: map[string]*dto.MetricFamily{
+			"logins_total": {
+				Name:   proto.String("logins_total"),
+				Type:   dto.MetricType_COUNTER.Enum(),
+				Metric: []*dto.Metric{{Counter: &dto.Counter{Value: proto.Float64(2)}}},
+			},
+		},
+		Origin:   nodes[0].r.origin,
+		Sequence: versions[nodes[0].r.origin],
+		Done:     done,
+	})
+	<-done
+	if v := counterValue(ms); v != 2 {
+		t.Errorf("expected counter 2, got %v", v)
+	}
+}
+
+func TestNewReplicatorInvalidPeer(t *testing.T) {
+	if _, err := NewReplicator(storage.NewMetricStorage(), nil, []string{"thor-1:9091"}, testAuth); err == nil {
+		t.Error("expected error for peer without scheme")
+	}
+}
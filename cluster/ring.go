@@ -0,0 +1,134 @@
+package cluster
+
+import (
+	"hash/fnv"
+	"math"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// How many points every member gets on the ring, so that
+// the keys are spread evenly over the members.
+const virtualNodes = 128
+
+// A Ring assigns keys to members with consistent hashing: every member
+// owns the keys, whose hashes follow the hashes of its virtual nodes.
+// If a member joins or leaves, only the keys of this member move.
+type Ring struct {
+	mu      sync.RWMutex
+	members []string
+	hashes  []uint64
+	owners  map[uint64]string
+}
+
+// NewRing creates a Ring with the members.
+func NewRing(members []string) *Ring {
+	r := &Ring{}
+	r.SetMembers(members)
+	return r
+}
+
+// SetMembers replaces the members of the ring and
+// returns true, if they have changed.
+func (r *Ring) SetMembers(members []string) bool {
+	sorted := append([]string(nil), members...)
+	sort.Strings(sorted)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if equalStrings(sorted, r.members) {
+		return false
+	}
+
+	r.members = sorted
+	r.hashes = make([]uint64, 0, len(sorted)*virtualNodes)
+	r.owners = make(map[uint64]string, len(sorted)*virtualNodes)
+	for _, m := range sorted {
+		for i := 0; i < virtualNodes; i++ {
+			h := hash(m + "#" + strconv.Itoa(i))
+			if _, ok := r.owners[h]; ok {
+				// collisions are unlikely, but the owner
+				// has to be the same on every instance.
+				continue
+			}
+			r.owners[h] = m
+			r.hashes = append(r.hashes, h)
+		}
+	}
+	sort.Slice(r.hashes, func(i, j int) bool { return r.hashes[i] < r.hashes[j] })
+	return true
+}
+
+// Members returns the sorted members of the ring.
+func (r *Ring) Members() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return append([]string(nil), r.members...)
+}
+
+// Owner returns the member owning the key,
+// or "" if the ring has no members.
+func (r *Ring) Owner(key string) string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if len(r.hashes) == 0 {
+		return ""
+	}
+	h := hash(key)
+	i := sort.Search(len(r.hashes), func(i int) bool { return r.hashes[i] >= h })
+	if i == len(r.hashes) {
+		i = 0
+	}
+	return r.owners[r.hashes[i]]
+}
+
+// Ownership returns the share of the keys owned by every member.
+func (r *Ring) Ownership() map[string]float64 {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	result := make(map[string]float64, len(r.members))
+	for i, h := range r.hashes {
+		// every virtual node owns the hashes since the previous one,
+		// the first one the ones after the last one as well.
+		var size uint64
+		if i == 0 {
+			size = h + (math.MaxUint64 - r.hashes[len(r.hashes)-1])
+		} else {
+			size = h - r.hashes[i-1]
+		}
+		result[r.owners[h]] += float64(size) / math.MaxUint64
+	}
+	return result
+}
+
+func hash(s string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+
+	// FNV barely changes the high bits for strings only differing
+	// at the end, so they are mixed like in the finalizer of murmur3.
+	x := h.Sum64()
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
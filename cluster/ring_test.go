@@ -0,0 +1,43 @@
+package cluster
+
+import (
+	"strconv"
+	"testing"
+)
+
+func TestRing(t *testing.T) {
+	r := NewRing(nil)
+	if owner := r.Owner("job\xfflobby"); owner != "" {
+		t.Errorf("expected no owner without members, got %q", owner)
+	}
+
+	members := []string{"http://thor-0:9091", "http://thor-1:9091", "http://thor-2:9091"}
+	if !r.SetMembers(members) {
+		t.Error("expected members to change")
+	}
+	if r.SetMembers([]string{members[2], members[0], members[1]}) {
+		t.Error("expected the same members in another order not to change")
+	}
+
+	owners := map[string]string{}
+	counts := map[string]int{}
+	for i := 0; i < 3000; i++ {
+		key := "job\xfflobby" + strconv.Itoa(i)
+		owners[key] = r.Owner(key)
+		counts[owners[key]]++
+	}
+	for _, m := range members {
+		// the keys are spread roughly evenly.
+		if counts[m] < 600 {
+			t.Errorf("expected about 1000 keys for %s, got %d", m, counts[m])
+		}
+	}
+
+	// only the keys of the leaving member move.
+	r.SetMembers(members[:2])
+	for key, owner := range owners {
+		if owner != members[2] && r.Owner(key) != owner {
+			t.Errorf("key %q moved from %s to %s", key, owner, r.Owner(key))
+		}
+	}
+}
@@ -0,0 +1,486 @@
+package cluster
+
+import (
+	"dev.volix.ops/thor/pkg/slog"
+	"dev.volix.ops/thor/storage"
+	"dev.volix.ops/thor/utils"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// Path of the endpoint receiving forwarded requests.
+	ForwardPath = "/api/v1/cluster/forward"
+
+	// How often and how long the members are probed.
+	probeInterval = 5 * time.Second
+	probeTimeout  = 2 * time.Second
+)
+
+var (
+	clusterMembers = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "thor_cluster_members",
+		Help: "Number of healthy members of the sharded cluster, including this one.",
+	})
+	forwardErrors = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "thor_cluster_forward_errors_total",
+		Help: "Total number of failed attempts to forward write requests to their owner.",
+	})
+	forwardQueueLength = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "thor_cluster_forward_queue_length",
+		Help: "Number of write requests waiting to be forwarded to a member.",
+	}, []string{"member"})
+	forwardFallbacks = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "thor_cluster_forward_fallbacks_total",
+		Help: "Total number of write requests applied locally, because the queue of their owner was full.",
+	})
+	handoffGroups = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "thor_cluster_handoff_groups_total",
+		Help: "Total number of groups handed off to their new owner.",
+	})
+)
+
+// A Sharder distributes the groups over the members of a cluster, so
+// that every member only holds a shard of them. Every group is owned by
+// one member, chosen on a Ring by the grouping key. Writes to groups owned
+// by another member are forwarded to it.
+//
+// The members are probed periodically and only healthy ones are on the
+// Ring. If the members change, every member hands off the groups it no
+// longer owns to their new owners.
+//
+// The forwarded requests are queued per member and numbered like the
+// replicated ones, so that a retried request is only applied once.
+type Sharder struct {
+	client
+	self    string
+	origin  string
+	members []string
+	ring    *Ring
+	ms      *storage.MetricStorage
+	tenants *storage.Tenants
+	probes  *http.Client
+	gossip  *Gossip
+
+	// only one handoff at a time.
+	handoffMu sync.Mutex
+	// stray is 1, if requests have been applied here, although
+	// another member owns them, see forward.
+	stray int32
+
+	queuesMu sync.Mutex
+	queues   map[string]*forwardQueue
+
+	// the sequence of the last forwarded request
+	// applied of every origin, see ForwardHandler.
+	receivedMu sync.Mutex
+	received   map[string]uint64
+}
+
+// A forwardQueue contains the requests forwarded to a member, which
+// are sent one after another, until the member applied or rejected them.
+type forwardQueue struct {
+	member string
+	notify chan struct{}
+
+	mu       sync.Mutex
+	queue    []forwarded
+	sequence uint64
+}
+
+// A forwarded request of the storage of a tenant.
+type forwarded struct {
+	ms       *storage.MetricStorage
+	tenant   string
+	wr       storage.WriteRequest
+	sequence uint64
+}
+
+// NewSharder creates a Sharder for the storage ms and the storages of the
+// tenants, which may be nil. The members are the base URLs of all instances
+// of the cluster, self is the one of this instance. The members authenticate
+// to each other with the auth.
+func NewSharder(ms *storage.MetricStorage, tenants *storage.Tenants, self string, members []string, auth Auth) (*Sharder, error) {
+	if err := auth.validate(); err != nil {
+		return nil, err
+	}
+	self, err := parseURL(self)
+	if err != nil {
+		return nil, fmt.Errorf("invalid advertise URL: %v", err)
+	}
+
+	s := &Sharder{
+		client: newClient(auth),
+		self:   self,
+		// unique for every start, like the origin of a Replicator.
+		origin:  fmt.Sprintf("%s-%d", self, time.Now().UnixNano()),
+		members: []string{self},
+		// only this instance is healthy, until the others are probed.
+		ring:     NewRing([]string{self}),
+		ms:       ms,
+		tenants:  tenants,
+		probes:   newHTTPClient(auth, probeTimeout),
+		queues:   make(map[string]*forwardQueue),
+		received: make(map[string]uint64),
+	}
+	for _, m := range members {
+		u, err := parseURL(m)
+		if err != nil {
+			return nil, fmt.Errorf("invalid member: %v", err)
+		}
+		if u != self {
+			s.members = append(s.members, u)
+		}
+	}
+	return s, nil
+}
+
+// EnableGossip discovers the members with gossip, starting with
+// the seeds, instead of probing the static members.
+func (s *Sharder) EnableGossip(seeds []string) error {
+	g, err := NewGossip(s.self, seeds, s.auth, s.SetMembers)
+	if err != nil {
+		return err
+	}
+	s.gossip = g
+	return nil
+}
+
+// Gossip returns the Gossip enabled by EnableGossip, or nil.
+func (s *Sharder) Gossip() *Gossip {
+	return s.gossip
+}
+
+// Start forwards the writes of the storages to their owners and
+// starts to probe the members, or to gossip. The members are probed
+// or exchanged with the seeds once before Start returns, so that
+// writes are forwarded from the beginning.
+func (s *Sharder) Start() {
+	s.ms.SetForwarder(func(wr storage.WriteRequest) bool { return s.forward(s.ms, "", wr) })
+	if s.tenants != nil {
+		s.tenants.OnCreate(func(id string, ms *storage.MetricStorage) {
+			ms.SetForwarder(func(wr storage.WriteRequest) bool { return s.forward(ms, id, wr) })
+		})
+	}
+
+	if s.gossip != nil {
+		s.gossip.Start()
+		return
+	}
+	if len(s.members) == 1 {
+		// there is nobody to probe.
+		return
+	}
+	s.probe()
+	go func() {
+		for range time.Tick(probeInterval) {
+			s.probe()
+		}
+	}()
+}
+
+// A MemberStatus is the state of a member and the share
+// of the groups it owns, as seen by this instance.
+type MemberStatus struct {
+	Member
+	Self bool `json:"self"`
+	// Ownership is the share of the grouping keys owned by the member.
+	Ownership float64 `json:"ownership"`
+	// Groups is the number of groups of the default storage,
+	// only known for this instance.
+	Groups *int `json:"groups,omitempty"`
+}
+
+// Status returns the status of all known members. Without gossip,
+// members are alive while they respond to health checks.
+func (s *Sharder) Status() []MemberStatus {
+	var members []Member
+	if s.gossip != nil {
+		members = s.gossip.Members()
+	} else {
+		live := map[string]bool{}
+		for _, m := range s.ring.Members() {
+			live[m] = true
+		}
+		for _, name := range s.members {
+			m := Member{Name: name, State: StateAlive}
+			if !live[name] {
+				m.State = StateDead
+			}
+			members = append(members, m)
+		}
+		sort.Slice(members, func(i, j int) bool { return members[i].Name < members[j].Name })
+	}
+
+	ownership := s.ring.Ownership()
+	result := make([]MemberStatus, 0, len(members))
+	for _, m := range members {
+		status := MemberStatus{Member: m, Self: m.Name == s.self, Ownership: ownership[m.Name]}
+		if status.Self {
+			groups := s.ms.GroupCount()
+			status.Groups = &groups
+		}
+		result = append(result, status)
+	}
+	return result
+}
+
+// Ring returns the Ring of the healthy members.
+func (s *Sharder) Ring() *Ring {
+	return s.ring
+}
+
+// SetMembers sets the healthy members. If they have changed,
+// the groups owned by other members are handed off.
+func (s *Sharder) SetMembers(members []string) {
+	clusterMembers.Set(float64(len(members)))
+	if !s.ring.SetMembers(members) {
+		return
+	}
+	slog.Info("cluster members changed: ", s.ring.Members())
+	s.handoff()
+}
+
+// probe sets the members, which respond to health checks.
+func (s *Sharder) probe() {
+	healthy := []string{s.self}
+	for _, m := range s.members {
+		if m == s.self {
+			continue
+		}
+		resp, err := s.probes.Get(m + "/-/healthy")
+		if err != nil {
+			slog.Debug(fmt.Sprintf("member %s is unhealthy: %v", m, err))
+			continue
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			slog.Debug(fmt.Sprintf("member %s is unhealthy: %s", m, resp.Status))
+			continue
+		}
+		healthy = append(healthy, m)
+	}
+	s.SetMembers(healthy)
+}
+
+// forward queues the request of the storage of the tenant for the owner
+// of its group and returns true, if it is not owned by this instance.
+// If the queue of the owner is full, the request is applied here
+// instead, until the queue is empty again and the group is handed off.
+func (s *Sharder) forward(ms *storage.MetricStorage, tenant string, wr storage.WriteRequest) bool {
+	owner := s.ring.Owner(utils.GroupingKeyFor(wr.Labels))
+	if owner == "" || owner == s.self {
+		return false
+	}
+
+	q := s.queue(owner)
+	q.mu.Lock()
+	if len(q.queue) >= maxQueueLength {
+		q.mu.Unlock()
+		forwardFallbacks.Inc()
+		atomic.StoreInt32(&s.stray, 1)
+		return false
+	}
+	q.sequence++
+	q.queue = append(q.queue, forwarded{ms: ms, tenant: tenant, wr: wr, sequence: q.sequence})
+	forwardQueueLength.WithLabelValues(owner).Set(float64(len(q.queue)))
+	q.mu.Unlock()
+
+	select {
+	case q.notify <- struct{}{}:
+	default:
+	}
+	return true
+}
+
+// queue returns the queue of the member, which is
+// created and started, if there is none.
+func (s *Sharder) queue(member string) *forwardQueue {
+	s.queuesMu.Lock()
+	defer s.queuesMu.Unlock()
+
+	q, ok := s.queues[member]
+	if !ok {
+		q = &forwardQueue{member: member, notify: make(chan struct{}, 1)}
+		s.queues[member] = q
+		go s.sendQueue(q)
+	}
+	return q
+}
+
+// sendQueue sends the queued requests to the member, until they are
+// applied or rejected. Requests of groups, which the member does not own
+// anymore, are submitted to their storage again instead.
+func (s *Sharder) sendQueue(q *forwardQueue) {
+	backoff := minBackoff
+	for range q.notify {
+		for {
+			q.mu.Lock()
+			if len(q.queue) == 0 {
+				q.mu.Unlock()
+				break
+			}
+			f := q.queue[0]
+			q.mu.Unlock()
+
+			if s.ring.Owner(utils.GroupingKeyFor(f.wr.Labels)) != q.member {
+				f.ms.SubmitWriteRequest(f.wr)
+			} else if retry, err := s.send(q.member, f); retry {
+				forwardErrors.Inc()
+				slog.Debug(fmt.Sprintf("failed to forward to %s, retrying in %s: %v", q.member, backoff, err))
+
+				time.Sleep(backoff)
+				if backoff *= 2; backoff > maxBackoff {
+					backoff = maxBackoff
+				}
+				continue
+			} else {
+				if err != nil && f.wr.Done == nil {
+					slog.Debug(err.Error())
+				}
+				if f.wr.Done != nil {
+					if err != nil {
+						f.wr.Done <- err
+					}
+					close(f.wr.Done)
+				}
+			}
+			backoff = minBackoff
+
+			q.mu.Lock()
+			q.queue = q.queue[1:]
+			forwardQueueLength.WithLabelValues(q.member).Set(float64(len(q.queue)))
+			q.mu.Unlock()
+		}
+
+		if atomic.CompareAndSwapInt32(&s.stray, 1, 0) {
+			// the requests applied here while the queue
+			// was full are handed off to their owners.
+			s.handoff()
+		}
+	}
+}
+
+// send sends the forwarded request to the member. It returns the error
+// and whether the request should be sent again, which is not the case
+// if the member rejected it.
+func (s *Sharder) send(member string, f forwarded) (bool, error) {
+	wr := f.wr
+	wr.Origin, wr.Sequence = s.origin, f.sequence
+	b, err := encodeRequest(f.tenant, wr)
+	if err != nil {
+		return false, err
+	}
+
+	err = s.post(member, ForwardPath, b)
+	var se *statusError
+	if errors.As(err, &se) && se.code == http.StatusBadRequest {
+		// the request was rejected by the storage of the member.
+		return false, errors.New(se.msg)
+	}
+	if err != nil {
+		return true, fmt.Errorf("could not forward to %s: %v", member, err)
+	}
+	return false, nil
+}
+
+// handoff sends the groups, which are owned by other members,
+// to their owners and deletes them.
+func (s *Sharder) handoff() {
+	s.handoffMu.Lock()
+	defer s.handoffMu.Unlock()
+
+	s.handoffStorage("", s.ms)
+	if s.tenants == nil {
+		return
+	}
+	for _, id := range s.tenants.IDs() {
+		if ms, ok := s.tenants.Lookup(id); ok {
+			s.handoffStorage(id, ms)
+		}
+	}
+}
+
+func (s *Sharder) handoffStorage(tenant string, ms *storage.MetricStorage) {
+	// the requests queued before are applied first, the later ones are
+	// forwarded to the new owners already. So the groups are complete,
+	// when they are taken, and nothing is written to them afterwards.
+	ms.Drain()
+	groups := ms.TakeGroups(func(key string) bool {
+		owner := s.ring.Owner(key)
+		return owner != "" && owner != s.self
+	})
+
+	for _, group := range groups {
+		// the owner may have received writes to the group in the
+		// meantime, which are kept, see storage.WriteRequest.
+		wr := storage.WriteRequest{
+			Labels:         group.Labels,
+			Timestamp:      group.Timestamp,
+			MetricFamilies: group.MetricFamilies,
+			Handoff:        true,
+		}
+		if !s.forward(ms, tenant, wr) {
+			// the members changed again, or the queue is full.
+			ms.SubmitLocalWriteRequest(wr)
+			continue
+		}
+		handoffGroups.Inc()
+	}
+}
+
+// ForwardHandler returns a http.HandlerFunc applying the
+// requests forwarded by other members.
+func (s *Sharder) ForwardHandler() http.HandlerFunc {
+	return s.auth.protect(func(w http.ResponseWriter, req *http.Request) {
+		var wire wireRequest
+		if err := json.NewDecoder(req.Body).Decode(&wire); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+
+			slog.Debug("invalid forwarded request from ", req.RemoteAddr)
+			slog.Debug(err.Error())
+			return
+		}
+
+		ms, err := storageFor(s.ms, s.tenants, wire.Tenant)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		wr, err := wire.writeRequest()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		// the numbers are only used to ignore retried requests.
+		wr.Origin, wr.Sequence = "", 0
+		if wire.Origin != "" {
+			s.receivedMu.Lock()
+			defer s.receivedMu.Unlock()
+			if wire.Sequence <= s.received[wire.Origin] {
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+			defer func() { s.received[wire.Origin] = wire.Sequence }()
+		}
+
+		// the request is applied here, even if this instance thinks
+		// another member owns it, so that it is never forwarded in
+		// circles while the members disagree.
+		wr.Done = make(chan error, 1)
+		ms.SubmitLocalWriteRequest(wr)
+		if err := <-wr.Done; err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
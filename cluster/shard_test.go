@@ -0,0 +1,233 @@
+package cluster
+
+import (
+	"bytes"
+	"dev.volix.ops/thor/storage"
+	"dev.volix.ops/thor/utils"
+	"encoding/json"
+	"github.com/golang/protobuf/proto"
+	dto "github.com/prometheus/client_model/go"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// member is a sharded storage served by a test server.
+type member struct {
+	ms     *storage.MetricStorage
+	s      *Sharder
+	server *httptest.Server
+}
+
+func newMembers(t *testing.T, n int) []*member {
+	members := make([]*member, n)
+	var urls []string
+	for i := range members {
+		m := &member{ms: storage.NewMetricStorage()}
+		mux := http.NewServeMux()
+		mux.HandleFunc("/-/healthy", func(w http.ResponseWriter, r *http.Request) {})
+		mux.HandleFunc(ForwardPath, func(w http.ResponseWriter, r *http.Request) { m.s.ForwardHandler()(w, r) })
+		m.server = httptest.NewServer(mux)
+		members[i] = m
+		urls = append(urls, m.server.URL)
+	}
+
+	for _, m := range members {
+		var err error
+		if m.s, err = NewSharder(m.ms, nil, m.server.URL, urls, testAuth); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, m := range members {
+		m.s.Start()
+	}
+	return members
+}
+
+func pushGroup(t *testing.T, ms *storage.MetricStorage, labels map[string]string) {
+	done := make(chan error, 1)
+	ms.SubmitWriteRequest(storage.WriteRequest{
+		Labels: labels,
+		MetricFamilies: map[string]*dto.MetricFamily{
+			"players": {
+				Name:   proto.String("players"),
+				Type:   dto.MetricType_GAUGE.Enum(),
+				Metric: []*dto.Metric{{Gauge: &dto.Gauge{Value: proto.Float64(1)}}},
+			},
+		},
+		Done: done,
+	})
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSharding(t *testing.T) {
+	members := newMembers(t, 2)
+	for _, m := range members {
+		defer m.server.Close()
+	}
+
+	// every group ends up at its owner, regardless of
+	// the member it has been pushed to.
+	for i := 0; i < 20; i++ {
+		pushGroup(t, members[i%2].ms, map[string]string{"job": "lobby", "instance": strconv.Itoa(i)})
+	}
+	total := 0
+	for _, m := range members {
+		for key := range m.ms.GetMetricGroups() {
+			if owner := m.s.Ring().Owner(key); owner != m.server.URL {
+				t.Errorf("group %q is owned by %s, but stored at %s", key, owner, m.server.URL)
+			}
+			total++
+		}
+	}
+	if total != 20 {
+		t.Errorf("expected 20 groups, got %d", total)
+	}
+
+	// when the second member leaves, it hands off its groups.
+	members[0].s.SetMembers([]string{members[0].server.URL})
+	members[1].s.SetMembers([]string{members[0].server.URL})
+	if n := len(members[1].ms.GetMetricGroups()); n != 0 {
+		t.Errorf("expected no groups left after handoff, got %d", n)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for len(members[0].ms.GetMetricGroups()) != 20 {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected 20 groups after handoff, got %d", len(members[0].ms.GetMetricGroups()))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestHandoffKeepsNewerWrites(t *testing.T) {
+	members := newMembers(t, 2)
+	for _, m := range members {
+		defer m.server.Close()
+	}
+	labels := map[string]string{"job": "lobby"}
+	key := utils.GroupingKeyFor(labels)
+	push := func(ms *storage.MetricStorage, players, logins float64) {
+		done := make(chan error, 1)
+		ms.SubmitLocalWriteRequest(storage.WriteRequest{
+			Labels: labels,
+			MetricFamilies: map[string]*dto.MetricFamily{
+				"players": {
+					Name:   proto.String("players"),
+					Type:   dto.MetricType_GAUGE.Enum(),
+					Metric: []*dto.Metric{{Gauge: &dto.Gauge{Value: proto.Float64(players)}}},
+				},
+				"logins_total": {
+					Name:   proto.String("logins_total"),
+					Type:   dto.MetricType_COUNTER.Enum(),
+					Metric: []*dto.Metric{{Counter: &dto.Counter{Value: proto.Float64(logins)}}},
+				},
+			},
+			Done: done,
+		})
+		if err := <-done; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the group has been written to the old owner first,
+	// and to the new owner after the members changed.
+	old, owner := members[0], members[1]
+	if members[0].s.Ring().Owner(key) == members[0].server.URL {
+		old, owner = members[1], members[0]
+	}
+	push(old.ms, 1, 2)
+	push(owner.ms, 5, 3)
+	old.s.handoff()
+
+	value := func(name string) float64 {
+		families, _ := owner.ms.GetGroupMetricFamilies(key)
+		for _, mf := range families {
+			if mf.GetName() == name {
+				m := mf.Metric[0]
+				return m.GetGauge().GetValue() + m.GetCounter().GetValue()
+			}
+		}
+		return 0
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for value("logins_total") != 5 {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the counters to be added, got %v", value("logins_total"))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if v := value("players"); v != 5 {
+		t.Errorf("expected the newer gauge of the owner, got %v", v)
+	}
+	if _, ok := old.ms.GetGroupMetricFamilies(key); ok {
+		t.Error("expected the group to be deleted after the handoff")
+	}
+}
+
+func TestForwardRetried(t *testing.T) {
+	members := newMembers(t, 1)
+	defer members[0].server.Close()
+
+	b, _ := proto.Marshal(&dto.MetricFamily{
+		Name:   proto.String("logins_total"),
+		Type:   dto.MetricType_COUNTER.Enum(),
+		Metric: []*dto.Metric{{Counter: &dto.Counter{Value: proto.Float64(2)}}},
+	})
+	body, _ := json.Marshal(wireRequest{
+		Origin:   "member",
+		Sequence: 1,
+		Labels:   map[string]string{"job": "lobby"},
+		Families: [][]byte{b},
+	})
+
+	// a member retrying the request must not increase the counter twice.
+	for i := 0; i < 2; i++ {
+		req, _ := http.NewRequest("POST", ForwardPath, bytes.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+testAuth.BearerToken)
+		w := httptest.NewRecorder()
+		members[0].s.ForwardHandler()(w, req)
+		if w.Code != http.StatusNoContent {
+			t.Fatalf("expected status %d, got %d: %s", http.StatusNoContent, w.Code, w.Body)
+		}
+	}
+	families, _ := members[0].ms.GetGroupMetricFamilies(utils.GroupingKeyFor(map[string]string{"job": "lobby"}))
+	if len(families) != 1 || families[0].Metric[0].GetCounter().GetValue() != 2 {
+		t.Errorf("expected counter 2, got %v", families)
+	}
+}
+
+func TestForwardRejected(t *testing.T) {
+	members := newMembers(t, 2)
+	for _, m := range members {
+		defer m.server.Close()
+	}
+
+	// find a group owned by the second member.
+	labels := map[string]string{"job": "lobby"}
+	for i := 0; members[0].s.Ring().Owner(utils.GroupingKeyFor(labels)) != members[1].server.URL; i++ {
+		labels["instance"] = strconv.Itoa(i)
+	}
+	pushGroup(t, members[0].ms, labels)
+
+	// the owner rejects the inconsistent type, which is
+	// reported to the member the request was sent to.
+	done := make(chan error, 1)
+	members[0].ms.SubmitWriteRequest(storage.WriteRequest{
+		Labels: labels,
+		MetricFamilies: map[string]*dto.MetricFamily{
+			"players": {
+				Name:   proto.String("players"),
+				Type:   dto.MetricType_COUNTER.Enum(),
+				Metric: []*dto.Metric{{Counter: &dto.Counter{Value: proto.Float64(1)}}},
+			},
+		},
+		Done: done,
+	})
+	if err := <-done; err == nil {
+		t.Error("expected error for inconsistent forwarded request")
+	}
+}
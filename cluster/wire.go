@@ -0,0 +1,202 @@
+package cluster
+
+import (
+	"bytes"
+	"dev.volix.ops/thor/pkg/selector"
+	"dev.volix.ops/thor/storage"
+	"encoding/json"
+	"fmt"
+	"github.com/golang/protobuf/proto"
+	dto "github.com/prometheus/client_model/go"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// A wireRequest is the JSON representation of a
+// storage.WriteRequest sent to other instances.
+type wireRequest struct {
+	Tenant    string            `json:"tenant,omitempty"`
+	Origin    string            `json:"origin,omitempty"`
+	Sequence  uint64            `json:"sequence,omitempty"`
+	Stamp     time.Time         `json:"stamp"`
+	Labels    map[string]string `json:"labels"`
+	Timestamp time.Time         `json:"timestamp"`
+	// Families are encoded with protobuf, as the merging of other
+	// instances has to result in exactly the same metrics.
+	Families       [][]byte `json:"families,omitempty"`
+	Delete         bool     `json:"delete,omitempty"`
+	Replace        bool     `json:"replace,omitempty"`
+	Absolute       bool     `json:"absolute,omitempty"`
+	Handoff        bool     `json:"handoff,omitempty"`
+	DeleteFamilies []string `json:"deleteFamilies,omitempty"`
+	DeleteSeries   []string `json:"deleteSeries,omitempty"`
+	Wipe           bool     `json:"wipe,omitempty"`
+}
+
+// encodeRequest converts the request of the tenant, which is
+// empty for the default storage, into its JSON representation.
+func encodeRequest(tenant string, wr storage.WriteRequest) ([]byte, error) {
+	wire := wireRequest{
+		Tenant:         tenant,
+		Origin:         wr.Origin,
+		Sequence:       wr.Sequence,
+		Stamp:          wr.Stamp,
+		Labels:         wr.Labels,
+		Timestamp:      wr.Timestamp,
+		Delete:         wr.MetricFamilies == nil,
+		Replace:        wr.Replace,
+		Absolute:       wr.Absolute,
+		Handoff:        wr.Handoff,
+		DeleteFamilies: wr.DeleteFamilies,
+		Wipe:           wr.Wipe,
+	}
+	for _, mf := range wr.MetricFamilies {
+		b, err := proto.Marshal(mf)
+		if err != nil {
+			return nil, err
+		}
+		wire.Families = append(wire.Families, b)
+	}
+	for _, matchers := range wr.DeleteSeries {
+		wire.DeleteSeries = append(wire.DeleteSeries, formatSelector(matchers))
+	}
+	return json.Marshal(wire)
+}
+
+// writeRequest converts the request back.
+func (wire wireRequest) writeRequest() (storage.WriteRequest, error) {
+	wr := storage.WriteRequest{
+		Labels:         wire.Labels,
+		Timestamp:      wire.Timestamp,
+		Replace:        wire.Replace,
+		Absolute:       wire.Absolute,
+		Handoff:        wire.Handoff,
+		DeleteFamilies: wire.DeleteFamilies,
+		Wipe:           wire.Wipe,
+		Origin:         wire.Origin,
+		Sequence:       wire.Sequence,
+		Stamp:          wire.Stamp,
+	}
+	if len(wire.Labels) == 0 && !wire.Wipe {
+		return wr, fmt.Errorf("missing labels")
+	}
+
+	if !wire.Delete {
+		wr.MetricFamilies = make(map[string]*dto.MetricFamily, len(wire.Families))
+		for _, b := range wire.Families {
+			mf := &dto.MetricFamily{}
+			if err := proto.Unmarshal(b, mf); err != nil {
+				return wr, err
+			}
+			wr.MetricFamilies[mf.GetName()] = mf
+		}
+	}
+	for _, s := range wire.DeleteSeries {
+		matchers, err := selector.Parse(s)
+		if err != nil {
+			return wr, err
+		}
+		wr.DeleteSeries = append(wr.DeleteSeries, matchers)
+	}
+	return wr, nil
+}
+
+// formatSelector formats the matchers, so that
+// they can be parsed by selector.Parse again.
+func formatSelector(matchers []*selector.Matcher) string {
+	s := make([]string, 0, len(matchers))
+	for _, m := range matchers {
+		s = append(s, m.String())
+	}
+	return "{" + strings.Join(s, ",") + "}"
+}
+
+// storageFor returns the storage of the tenant, which is the default
+// storage ms if tenant is empty.
+func storageFor(ms *storage.MetricStorage, tenants *storage.Tenants, tenant string) (*storage.MetricStorage, error) {
+	if tenant == "" {
+		return ms, nil
+	}
+	if tenants == nil {
+		return nil, fmt.Errorf("multi-tenancy is disabled")
+	}
+	return tenants.Get(tenant)
+}
+
+// parseURL checks that u is the base URL of another instance.
+func parseURL(u string) (string, error) {
+	parsed, err := url.Parse(u)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return "", fmt.Errorf("invalid URL %q", u)
+	}
+	return strings.TrimSuffix(u, "/"), nil
+}
+
+// A client sends requests to other instances.
+type client struct {
+	auth   Auth
+	client *http.Client
+}
+
+func newClient(auth Auth) client {
+	return client{
+		auth:   auth,
+		client: newHTTPClient(auth, 30*time.Second),
+	}
+}
+
+// newHTTPClient creates a http.Client connecting to https URLs
+// with the TLS config of the auth.
+func newHTTPClient(auth Auth, timeout time.Duration) *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = auth.TLSConfig
+	return &http.Client{Timeout: timeout, Transport: transport}
+}
+
+// A statusError is returned for responses without 2xx status.
+type statusError struct {
+	code int
+	msg  string
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("unexpected status %d: %s", e.code, e.msg)
+}
+
+// do sends the request to another instance and decodes
+// the response into v, if it is not nil.
+func (c client) do(req *http.Request, v interface{}) error {
+	if c.auth.BearerToken != "" {
+		req.Header.Set("Authorization", "Bearer "+c.auth.BearerToken)
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return &statusError{code: resp.StatusCode, msg: string(bytes.TrimSpace(msg))}
+	}
+	if v == nil {
+		_, err := io.Copy(ioutil.Discard, resp.Body)
+		return err
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// post sends the JSON body to the path of the instance.
+func (c client) post(base, path string, body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, base+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	return c.do(req, nil)
+}
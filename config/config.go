@@ -0,0 +1,191 @@
+// Package config loads the config file of thor, which can be reloaded
+// at runtime without losing the stored metrics.
+package config
+
+import (
+	"dev.volix.ops/thor/handler"
+	"dev.volix.ops/thor/pkg/ratelimit"
+	"dev.volix.ops/thor/pkg/relabel"
+	"dev.volix.ops/thor/web"
+	"dev.volix.ops/thor/webhook"
+	"errors"
+	"fmt"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"net"
+	"reflect"
+	"time"
+)
+
+// A Config is the content of the config file. Every section overrides the
+// corresponding flags and files, if it is given.
+//
+// Example:
+//  limits:
+//    max_body_bytes: 1048576
+//  tenant_limits:
+//    lobby-network:
+//      max_families: 100
+//  rate_limits:
+//    by: ip
+//    rate: 5
+//    burst: 10
+//  auth:
+//    bearer_tokens:
+//      ci: 2b5f3a...
+//    route_auth:
+//      admin: [ci]
+//  group_ttl: 10m
+//  webhooks:
+//  - url: https://bot.example.com/thor
+//  merge_strategies:
+//  - match: ['{job="lobby"}']
+//    strategy: absolute
+//  relabel_configs:
+//  - source_labels: [env]
+//    regex: dev
+//    action: drop
+//  listeners: [':9091', '127.0.0.1:9092']
+type Config struct {
+	// Limits of the pushes, the ones missing are taken from the flags.
+	Limits handler.Limits `yaml:"limits"`
+	// TenantLimits override the Limits for tenants.
+	TenantLimits map[string]handler.Limits `yaml:"-"`
+	// RateLimits throttle pushes, disabled if nil.
+	RateLimits *ratelimit.Config `yaml:"rate_limits"`
+	// Auth are the users, tokens and policies, like in the web config
+	// file. TLS can only be configured in the web config file.
+	Auth *web.Config `yaml:"auth"`
+	// GroupTTL is the time after which groups without pushes are
+	// deleted, 0 disables the expiry.
+	GroupTTL time.Duration `yaml:"group_ttl"`
+	// Webhooks notified about group changes.
+	Webhooks []webhook.Webhook `yaml:"webhooks"`
+	// MergeStrategies select how pushes with POST are merged
+	// into the groups, the first matching one is used.
+	MergeStrategies []handler.MergeRule `yaml:"merge_strategies"`
+	// RelabelConfigs are applied to the labels of the pushed metrics.
+	RelabelConfigs []*relabel.Config `yaml:"relabel_configs"`
+	// Listeners are the addresses the HTTP server listens on.
+	Listeners []string `yaml:"listeners"`
+}
+
+// file is the raw content of the config file.
+type file struct {
+	Limits       yaml.MapSlice            `yaml:"limits"`
+	TenantLimits map[string]yaml.MapSlice `yaml:"tenant_limits"`
+	RateLimits   *ratelimit.Config        `yaml:"rate_limits"`
+	Auth         *web.Config              `yaml:"auth"`
+	GroupTTL     *time.Duration           `yaml:"group_ttl"`
+	Webhooks     []webhook.Webhook        `yaml:"webhooks"`
+	Merge        []handler.MergeRule      `yaml:"merge_strategies"`
+	Relabel      []*relabel.Config        `yaml:"relabel_configs"`
+	Listeners    []string                 `yaml:"listeners"`
+}
+
+// Load reads the config file at path over a copy of base, which contains
+// the values of the flags and files, and validates the result.
+func Load(path string, base Config) (*Config, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	c, err := parse(b, base)
+	if err != nil {
+		return nil, fmt.Errorf("invalid config file %s: %v", path, err)
+	}
+	return c, nil
+}
+
+func parse(b []byte, base Config) (*Config, error) {
+	var f file
+	if err := yaml.UnmarshalStrict(b, &f); err != nil {
+		return nil, err
+	}
+
+	c := base
+	if f.Limits != nil {
+		// unmarshal the limits again, but this
+		// time over a copy of the ones of the flags.
+		b, err := yaml.Marshal(f.Limits)
+		if err != nil {
+			return nil, err
+		}
+		if err := yaml.UnmarshalStrict(b, &c.Limits); err != nil {
+			return nil, fmt.Errorf("invalid limits: %v", err)
+		}
+	}
+	if f.TenantLimits != nil {
+		limits, err := handler.ParseTenantLimits(f.TenantLimits, c.Limits)
+		if err != nil {
+			return nil, err
+		}
+		c.TenantLimits = limits
+	}
+	if f.RateLimits != nil {
+		c.RateLimits = f.RateLimits
+	}
+	if f.Auth != nil {
+		if !reflect.DeepEqual(f.Auth.TLSConfig, web.TLSServerConfig{}) {
+			return nil, errors.New("tls_server_config can only be set in the web config file")
+		}
+		// the identities of client certificates are
+		// allowed, if the web config file enables them.
+		if base.Auth != nil {
+			f.Auth.TLSConfig = base.Auth.TLSConfig
+		}
+		c.Auth = f.Auth
+	}
+	if f.GroupTTL != nil {
+		c.GroupTTL = *f.GroupTTL
+	}
+	if f.Webhooks != nil {
+		c.Webhooks = f.Webhooks
+	}
+	if f.Merge != nil {
+		c.MergeStrategies = f.Merge
+	}
+	if f.Relabel != nil {
+		c.RelabelConfigs = f.Relabel
+	}
+	if f.Listeners != nil {
+		if len(f.Listeners) == 0 {
+			return nil, errors.New("listeners must not be empty")
+		}
+		c.Listeners = f.Listeners
+	}
+
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+// Validate checks the config for invalid values.
+func (c *Config) Validate() error {
+	if c.RateLimits != nil {
+		if err := c.RateLimits.Validate(); err != nil {
+			return fmt.Errorf("invalid rate_limits: %v", err)
+		}
+	}
+	if c.Auth != nil {
+		if err := c.Auth.Validate(); err != nil {
+			return fmt.Errorf("invalid auth: %v", err)
+		}
+	}
+	if c.GroupTTL < 0 {
+		return errors.New("negative group_ttl")
+	}
+	if err := webhook.Validate(c.Webhooks); err != nil {
+		return fmt.Errorf("invalid webhooks: %v", err)
+	}
+	if _, err := handler.NewRules(c.MergeStrategies, c.RelabelConfigs); err != nil {
+		return err
+	}
+	for _, addr := range c.Listeners {
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			return fmt.Errorf("invalid listener %q: %v", addr, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,208 @@
+package config
+
+import (
+	"dev.volix.ops/thor/handler"
+	"dev.volix.ops/thor/pkg/ratelimit"
+	"dev.volix.ops/thor/web"
+	"errors"
+	dto "github.com/prometheus/client_model/go"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestParse(t *testing.T) {
+	base := Config{
+		Limits:   handler.Limits{MaxBodyBytes: 1024, MaxFamilies: 10},
+		GroupTTL: time.Hour,
+	}
+	c, err := parse([]byte(`
+limits:
+  max_families: 5
+tenant_limits:
+  lobby-network:
+    max_body_bytes: 512
+rate_limits:
+  by: ip
+  rate: 5
+  burst: 10
+auth:
+  bearer_tokens:
+    ci: secret
+  route_auth:
+    admin: [ci]
+webhooks:
+- url: http://localhost/thor
+merge_strategies:
+- match: ['{job="lobby"}']
+  strategy: absolute
+relabel_configs:
+- source_labels: [env]
+  regex: dev
+  action: drop
+listeners: [':9091', '127.0.0.1:9092']
+`), base)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// missing limits are taken from the flags, and the ones
+	// missing for a tenant from the limits of the file.
+	if expected := (handler.Limits{MaxBodyBytes: 1024, MaxFamilies: 5}); c.Limits != expected {
+		t.Errorf("wrong limits, got: %+v, expected: %+v", c.Limits, expected)
+	}
+	if expected := (handler.Limits{MaxBodyBytes: 512, MaxFamilies: 5}); c.TenantLimits["lobby-network"] != expected {
+		t.Errorf("wrong tenant limits, got: %+v, expected: %+v", c.TenantLimits["lobby-network"], expected)
+	}
+	if c.RateLimits == nil || c.RateLimits.Burst != 10 {
+		t.Errorf("wrong rate limits, got: %+v", c.RateLimits)
+	}
+	if c.Auth == nil || c.Auth.BearerTokens["ci"] != "secret" {
+		t.Errorf("wrong auth, got: %+v", c.Auth)
+	}
+	if c.GroupTTL != time.Hour {
+		t.Errorf("wrong group ttl, got: %v, expected: %v", c.GroupTTL, time.Hour)
+	}
+	if len(c.Webhooks) != 1 {
+		t.Errorf("wrong webhooks, got: %+v", c.Webhooks)
+	}
+	if len(c.MergeStrategies) != 1 || c.MergeStrategies[0].Strategy != handler.MergeAbsolute {
+		t.Errorf("wrong merge strategies, got: %+v", c.MergeStrategies)
+	}
+	// the defaults of the relabel configs are set.
+	if len(c.RelabelConfigs) != 1 || c.RelabelConfigs[0].Separator != ";" {
+		t.Errorf("wrong relabel configs, got: %+v", c.RelabelConfigs)
+	}
+	if len(c.Listeners) != 2 || c.Listeners[1] != "127.0.0.1:9092" {
+		t.Errorf("wrong listeners, got: %v", c.Listeners)
+	}
+	if base.Limits.MaxFamilies != 10 {
+		t.Errorf("base has been modified: %+v", base.Limits)
+	}
+}
+
+func TestParseInvalid(t *testing.T) {
+	for _, content := range []string{
+		"unknown: 1",
+		"limits:\n  max_bodies: 1",
+		"tenant_limits:\n  ../etc:\n    max_families: 1",
+		"rate_limits:\n  by: moon\n  rate: 1",
+		"auth:\n  route_auth:\n    everything: [ci]",
+		"auth:\n  tls_server_config:\n    cert_file: thor.crt",
+		"group_ttl: -1m",
+		"webhooks:\n- url: ''",
+		"merge_strategies:\n- match: ['{job=\"lobby\"}']\n  strategy: sum",
+		"relabel_configs:\n- action: replace",
+		"listeners: []",
+		"listeners: [lobby]",
+	} {
+		if _, err := parse([]byte(content), Config{}); err == nil {
+			t.Errorf("expected error for config: %q", content)
+		}
+	}
+}
+
+func gaugeValue(t *testing.T) float64 {
+	var m dto.Metric
+	if err := lastReloadSuccessful.Write(&m); err != nil {
+		t.Fatal(err)
+	}
+	return m.GetGauge().GetValue()
+}
+
+func TestReloader(t *testing.T) {
+	var loadErr error
+	var applied []*Config
+	r := NewReloader(func() (*Config, error) {
+		if loadErr != nil {
+			return nil, loadErr
+		}
+		return &Config{GroupTTL: time.Minute}, nil
+	}, func(c *Config) {
+		applied = append(applied, c)
+	})
+
+	r.Apply(&Config{})
+	if len(applied) != 1 || gaugeValue(t) != 1 {
+		t.Fatalf("expected initial config to be applied, got: %v, gauge: %v", applied, gaugeValue(t))
+	}
+
+	// a broken config keeps the previous one.
+	loadErr = errors.New("broken")
+	rr := httptest.NewRecorder()
+	r.Handler().ServeHTTP(rr, httptest.NewRequest("POST", "/-/reload", nil))
+	if rr.Code != http.StatusInternalServerError || !strings.Contains(rr.Body.String(), "broken") {
+		t.Errorf("wrong response, got: %d %s", rr.Code, rr.Body.String())
+	}
+	if len(applied) != 1 || gaugeValue(t) != 0 {
+		t.Errorf("expected broken config not to be applied, got: %v, gauge: %v", applied, gaugeValue(t))
+	}
+
+	loadErr = nil
+	rr = httptest.NewRecorder()
+	r.Handler().ServeHTTP(rr, httptest.NewRequest("POST", "/-/reload", nil))
+	if rr.Code != http.StatusNoContent {
+		t.Errorf("wrong status code, got: %d, expected: %d", rr.Code, http.StatusNoContent)
+	}
+	if len(applied) != 2 || applied[1].GroupTTL != time.Minute || gaugeValue(t) != 1 {
+		t.Errorf("expected config to be applied, got: %v, gauge: %v", applied, gaugeValue(t))
+	}
+}
+
+func TestReloaderSignals(t *testing.T) {
+	applied := make(chan *Config, 1)
+	r := NewReloader(func() (*Config, error) {
+		return &Config{}, nil
+	}, func(c *Config) {
+		applied <- c
+	})
+
+	// a signal received before watching reloads right away.
+	hup := make(chan os.Signal, 1)
+	hup <- syscall.SIGHUP
+	r.WatchSignals(hup)
+	select {
+	case <-applied:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected config to be reloaded")
+	}
+}
+
+func TestState(t *testing.T) {
+	rateLimits := func() *ratelimit.Config {
+		return &ratelimit.Config{By: ratelimit.ByIP, Rate: ratelimit.Rate{Rate: 1, Burst: 1}}
+	}
+	var s State
+	c := &Config{
+		RateLimits: rateLimits(),
+		Auth:       &web.Config{Authorization: web.Policies{{Identity: "ci"}}},
+	}
+	s.Update(c)
+	if s.Rules() == nil {
+		t.Error("expected rules")
+	}
+	rl := s.Limits().RateLimit
+	if rl == nil {
+		t.Fatal("expected rate limit")
+	}
+	if err := s.Authorize(httptest.NewRequest("POST", "/", nil), nil); err == nil {
+		t.Error("expected anonymous push to be forbidden")
+	}
+
+	// the limiter is kept, if the rate limits have not changed.
+	s.Update(&Config{RateLimits: rateLimits()})
+	if s.Limits().RateLimit != rl {
+		t.Error("expected rate limiter to be kept")
+	}
+	if err := s.Authorize(httptest.NewRequest("POST", "/", nil), nil); err != nil {
+		t.Errorf("expected push to be allowed without policies, got: %v", err)
+	}
+	s.Update(&Config{})
+	if s.Limits().RateLimit != nil {
+		t.Error("expected rate limit to be removed")
+	}
+}
@@ -0,0 +1,98 @@
+package config
+
+import (
+	"dev.volix.ops/thor/pkg/slog"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+var (
+	lastReloadSuccessful = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "thor_config_last_reload_successful",
+		Help: "Whether the last reload of the config was successful.",
+	})
+	lastReloadSuccess = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "thor_config_last_reload_success_timestamp_seconds",
+		Help: "Timestamp of the last successful reload of the config.",
+	})
+)
+
+// A Reloader loads the config and applies it. If the config can not be
+// loaded or is invalid, the previous one is kept.
+type Reloader struct {
+	load  func() (*Config, error)
+	apply func(c *Config)
+
+	// only one reload at a time.
+	mu sync.Mutex
+}
+
+// NewReloader creates a Reloader, which loads the config with load
+// and applies it with apply.
+func NewReloader(load func() (*Config, error), apply func(c *Config)) *Reloader {
+	return &Reloader{load: load, apply: apply}
+}
+
+// Reload loads the config and applies it, if it is valid.
+func (r *Reloader) Reload() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	c, err := r.load()
+	if err != nil {
+		lastReloadSuccessful.Set(0)
+		return err
+	}
+	r.applyLocked(c)
+	return nil
+}
+
+// Apply applies a config loaded before, e.g. the
+// initial one, like after a successful Reload.
+func (r *Reloader) Apply(c *Config) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.applyLocked(c)
+}
+
+func (r *Reloader) applyLocked(c *Config) {
+	r.apply(c)
+	lastReloadSuccessful.Set(1)
+	lastReloadSuccess.Set(float64(time.Now().Unix()))
+}
+
+// WatchSignals reloads the config on every signal received from hup,
+// which is registered for SIGHUP with signal.Notify. It should be
+// registered early, as SIGHUP terminates the process until then. A
+// signal received before WatchSignals is called reloads right away.
+func (r *Reloader) WatchSignals(hup <-chan os.Signal) {
+	go func() {
+		for range hup {
+			if err := r.Reload(); err != nil {
+				slog.Error("could not reload config: ", err)
+				continue
+			}
+			slog.Info("reloaded config")
+		}
+	}()
+}
+
+// Handler returns a http.HandlerFunc reloading the config. If it
+// fails, it responds with http.StatusInternalServerError.
+func (r *Reloader) Handler() http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if err := r.Reload(); err != nil {
+			http.Error(w, "could not reload config: "+err.Error(), http.StatusInternalServerError)
+
+			slog.Error("could not reload config: ", err)
+			return
+		}
+		slog.Info("reloaded config from ", req.RemoteAddr)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,95 @@
+package config
+
+import (
+	"dev.volix.ops/thor/handler"
+	"dev.volix.ops/thor/pkg/ratelimit"
+	"dev.volix.ops/thor/web"
+	"net/http"
+	"reflect"
+	"sync"
+	"time"
+)
+
+// State holds the parts of the applied Config, which are
+// read by the handlers for every request.
+type State struct {
+	mu           sync.RWMutex
+	limits       handler.Limits
+	tenantLimits map[string]handler.Limits
+	rateLimits   *ratelimit.Config
+	policies     web.Policies
+	groupTTL     time.Duration
+	rules        *handler.Rules
+}
+
+// Update applies the config. The rate limiter is kept, if its config
+// has not changed, so that the clients are not reset.
+func (s *State) Update(c *Config) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	rl := s.limits.RateLimit
+	if c.RateLimits == nil {
+		rl = nil
+	} else if rl == nil || !reflect.DeepEqual(c.RateLimits, s.rateLimits) {
+		rl = &handler.RateLimit{Limiter: ratelimit.New(c.RateLimits), Identity: web.Identity}
+	}
+
+	s.limits = c.Limits
+	s.limits.RateLimit = rl
+	s.tenantLimits = make(map[string]handler.Limits, len(c.TenantLimits))
+	for id, limits := range c.TenantLimits {
+		limits.RateLimit = rl
+		s.tenantLimits[id] = limits
+	}
+	s.rateLimits = c.RateLimits
+	s.policies = nil
+	if c.Auth != nil {
+		s.policies = c.Auth.Authorization
+	}
+	s.groupTTL = c.GroupTTL
+	// already validated with the config.
+	s.rules, _ = handler.NewRules(c.MergeStrategies, c.RelabelConfigs)
+}
+
+// Limits returns the limits of the pushes.
+func (s *State) Limits() handler.Limits {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.limits
+}
+
+// TenantLimits returns the limits of the tenants, which must not be modified.
+func (s *State) TenantLimits() map[string]handler.Limits {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.tenantLimits
+}
+
+// GroupTTL returns the time after which groups without pushes expire.
+func (s *State) GroupTTL() time.Duration {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.groupTTL
+}
+
+// Rules returns the merge strategies and relabel configs of the pushes.
+func (s *State) Rules() *handler.Rules {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.rules
+}
+
+// Authorize implements handler.Authorizer with the authorization
+// policies of the config.
+func (s *State) Authorize(r *http.Request, labels map[string]string) error {
+	s.mu.RLock()
+	policies := s.policies
+	s.mu.RUnlock()
+
+	return policies.Authorize(r, labels)
+}
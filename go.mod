@@ -4,9 +4,12 @@ go 1.13
 
 require (
 	github.com/golang/protobuf v1.4.3
-	github.com/matttproud/golang_protobuf_extensions v1.0.1
+	github.com/klauspost/compress v1.11.13
 	github.com/prometheus/client_golang v1.8.0
 	github.com/prometheus/client_model v0.2.0
 	github.com/prometheus/common v0.15.0
+	golang.org/x/crypto v0.0.0-20211117183948-ae814b36b871
+	google.golang.org/protobuf v1.23.0
 	gopkg.in/alecthomas/kingpin.v2 v2.2.6
+	gopkg.in/yaml.v2 v2.3.0
 )
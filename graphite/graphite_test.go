@@ -0,0 +1,162 @@
+package graphite
+
+import (
+	"dev.volix.ops/thor/storage"
+	"github.com/golang/protobuf/proto"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"testing"
+)
+
+func newTestListener(t *testing.T, dropUnmapped bool) *Listener {
+	mapper, err := NewMapper(MappingConfig{
+		Mappings: []Mapping{
+			{
+				Match: "servers.*.players",
+				Name:  "server_players",
+				Labels: map[string]string{
+					"server": "$1",
+				},
+			},
+			{
+				Match:     `servers\.([^.]+)\.tps\.(\w+)`,
+				MatchType: "regex",
+				Name:      "server_tps_$2",
+				Labels: map[string]string{
+					"job":    "proxy",
+					"server": "$1",
+				},
+			},
+			{
+				Match:  "internal.*",
+				Action: "drop",
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewListener(storage.NewSimpleMetricStorage(), mapper, dropUnmapped)
+}
+
+func TestGlobMapping(t *testing.T) {
+	l := newTestListener(t, false)
+
+	wr, ok, err := l.writeRequestFor("servers.lobby17.players 42 1609459200")
+	if err != nil || !ok {
+		t.Fatalf("expected line to be mapped, got: ok=%v, err=%v", ok, err)
+	}
+	if wr.Labels["job"] != defaultJob {
+		t.Errorf("wrong job label, got: %s, expected: %s", wr.Labels["job"], defaultJob)
+	}
+
+	mf, ok := wr.MetricFamilies["server_players"]
+	if !ok {
+		t.Fatalf("expected family server_players, got: %v", wr.MetricFamilies)
+	}
+	m := mf.Metric[0]
+	if m.GetGauge().GetValue() != 42 {
+		t.Errorf("wrong value, got: %v, expected: %v", m.GetGauge().GetValue(), 42)
+	}
+	if len(m.Label) != 1 || m.Label[0].GetName() != "server" || m.Label[0].GetValue() != "lobby17" {
+		t.Errorf("wrong labels, got: %v", m.Label)
+	}
+	if m.TimestampMs != nil {
+		t.Errorf("expected graphite timestamp to be dropped")
+	}
+}
+
+func TestRegexMapping(t *testing.T) {
+	l := newTestListener(t, false)
+
+	wr, ok, err := l.writeRequestFor("servers.lobby17.tps.avg 19.5")
+	if err != nil || !ok {
+		t.Fatalf("expected line to be mapped, got: ok=%v, err=%v", ok, err)
+	}
+	if wr.Labels["job"] != "proxy" {
+		t.Errorf("wrong job label, got: %s, expected: %s", wr.Labels["job"], "proxy")
+	}
+	if _, ok := wr.MetricFamilies["server_tps_avg"]; !ok {
+		t.Errorf("expected family server_tps_avg, got: %v", wr.MetricFamilies)
+	}
+}
+
+func TestUnmappedLines(t *testing.T) {
+	l := newTestListener(t, false)
+
+	wr, ok, err := l.writeRequestFor("proxy.uptime;dc=fra 3600")
+	if err != nil || !ok {
+		t.Fatalf("expected unmapped line to be kept, got: ok=%v, err=%v", ok, err)
+	}
+	mf, ok := wr.MetricFamilies["proxy_uptime"]
+	if !ok {
+		t.Fatalf("expected family proxy_uptime, got: %v", wr.MetricFamilies)
+	}
+	if mf.Metric[0].Label[0].GetName() != "dc" {
+		t.Errorf("expected tag to become a label, got: %v", mf.Metric[0].Label)
+	}
+
+	l = newTestListener(t, true)
+	if _, ok, _ := l.writeRequestFor("proxy.uptime 3600"); ok {
+		t.Errorf("expected unmapped line to be dropped, but it was not.")
+	}
+	if _, ok, _ := l.writeRequestFor("internal.gc 1"); ok {
+		t.Errorf("expected line to be dropped by mapping, but it was not.")
+	}
+}
+
+func TestInvalidLines(t *testing.T) {
+	l := newTestListener(t, false)
+
+	for _, line := range []string{
+		"servers.lobby17.players", "servers.lobby17.players abc", "a b c d", ";x=y 1",
+		"servers.lobby\xff.players 1", "proxy.uptime;dc=\xff 1",
+	} {
+		if _, _, err := l.writeRequestFor(line); err == nil {
+			t.Errorf("expected line %q to fail, but it did not.", line)
+		}
+	}
+}
+
+func TestRejectedLines(t *testing.T) {
+	l := newTestListener(t, false)
+	l.ms = storage.NewMetricStorage()
+
+	// the family exists as counter already.
+	done := make(chan error, 1)
+	l.ms.SubmitWriteRequest(storage.WriteRequest{
+		Labels: map[string]string{"job": "lobby"},
+		MetricFamilies: map[string]*dto.MetricFamily{
+			"server_players": {
+				Name:   proto.String("server_players"),
+				Type:   dto.MetricType_COUNTER.Enum(),
+				Metric: []*dto.Metric{{Counter: &dto.Counter{Value: proto.Float64(1)}}},
+			},
+		},
+		Done: done,
+	})
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	rejected := testutil.ToFloat64(rejectedLinesTotal)
+	l.processLine("servers.lobby17.players 42")
+	if v := testutil.ToFloat64(rejectedLinesTotal); v != rejected+1 {
+		t.Errorf("expected %v rejected lines, got %v", rejected+1, v)
+	}
+	if n := l.ms.GroupCount(); n != 1 {
+		t.Errorf("expected the line not to be stored, got %d groups", n)
+	}
+}
+
+func TestInvalidMapping(t *testing.T) {
+	_, err := NewMapper(MappingConfig{Mappings: []Mapping{{Match: "a.*", Name: "a", MatchType: "fuzzy"}}})
+	if err == nil {
+		t.Errorf("expected unknown match_type to fail, but it did not.")
+	}
+
+	_, err = NewMapper(MappingConfig{Mappings: []Mapping{{Match: "a.*"}}})
+	if err == nil {
+		t.Errorf("expected mapping without name to fail, but it did not.")
+	}
+}
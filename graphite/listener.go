@@ -0,0 +1,277 @@
+// Package graphite implements a listener for the Graphite
+// plaintext protocol, which maps the dotted Graphite paths
+// to Prometheus metrics and stores them as gauges.
+package graphite
+
+import (
+	"bufio"
+	"dev.volix.ops/thor/pkg/slog"
+	"dev.volix.ops/thor/storage"
+	"dev.volix.ops/thor/utils"
+	"fmt"
+	"github.com/golang/protobuf/proto"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/model"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	// Maximum size of a single UDP datagram we read.
+	maxDatagramSize = 65535
+)
+
+var (
+	linesTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "thor_graphite_lines_total",
+		Help: "Total number of Graphite lines received.",
+	})
+	invalidLinesTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "thor_graphite_invalid_lines_total",
+		Help: "Total number of Graphite lines which could not be parsed.",
+	})
+	unmappedLinesTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "thor_graphite_unmapped_lines_total",
+		Help: "Total number of Graphite lines without a matching mapping.",
+	})
+	droppedLinesTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "thor_graphite_dropped_lines_total",
+		Help: "Total number of Graphite lines dropped by a mapping or because they were unmapped.",
+	})
+	rejectedLinesTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "thor_graphite_rejected_lines_total",
+		Help: "Total number of Graphite lines rejected as inconsistent with the stored metrics.",
+	})
+)
+
+// A Listener accepts Graphite plaintext lines in the format
+//  <path>[;tag=value...] <value> [<timestamp>]
+// over TCP and UDP and writes them to the storage.MetricStorage.
+//
+// Graphite timestamps are ignored, as pushed metrics must not
+// have timestamps.
+//
+// Lines without a matching mapping are stored with the sanitized
+// path as metric name, unless dropUnmapped is true. Like pushes,
+// every line is checked for consistency with the stored metrics.
+type Listener struct {
+	ms           *storage.MetricStorage
+	mapper       *Mapper
+	dropUnmapped bool
+}
+
+func NewListener(ms *storage.MetricStorage, mapper *Mapper, dropUnmapped bool) *Listener {
+	return &Listener{
+		ms:           ms,
+		mapper:       mapper,
+		dropUnmapped: dropUnmapped,
+	}
+}
+
+// ListenAndServe listens on the given address for TCP
+// and UDP and serves both of them.
+// Blocks until one of the listeners stops.
+func (l *Listener) ListenAndServe(address string) error {
+	tcpListener, err := net.Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+	udpConn, err := net.ListenPacket("udp", address)
+	if err != nil {
+		_ = tcpListener.Close()
+		return err
+	}
+
+	errCh := make(chan error, 2)
+	go func() { errCh <- l.ServeTCP(tcpListener) }()
+	go func() { errCh <- l.ServeUDP(udpConn) }()
+
+	err = <-errCh
+	_ = tcpListener.Close()
+	_ = udpConn.Close()
+	return err
+}
+
+// ServeTCP accepts connections on the listener and
+// processes every line sent over them.
+func (l *Listener) ServeTCP(listener net.Listener) error {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		go l.handleConn(conn)
+	}
+}
+
+// ServeUDP reads datagrams from the connection, which
+// can contain multiple lines each.
+func (l *Listener) ServeUDP(conn net.PacketConn) error {
+	buf := make([]byte, maxDatagramSize)
+	for {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+		for _, line := range strings.Split(string(buf[:n]), "\n") {
+			l.processLine(line)
+		}
+	}
+}
+
+func (l *Listener) handleConn(conn net.Conn) {
+	defer conn.Close()
+
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		l.processLine(scanner.Text())
+	}
+	if err := scanner.Err(); err != nil {
+		slog.Debug("graphite connection from ", conn.RemoteAddr(), " failed: ", err)
+	}
+}
+
+func (l *Listener) processLine(line string) {
+	line = strings.TrimSpace(line)
+	if line == "" {
+		return
+	}
+	linesTotal.Inc()
+
+	wr, ok, err := l.writeRequestFor(line)
+	if err != nil {
+		invalidLinesTotal.Inc()
+
+		slog.Debug("invalid graphite line ", line)
+		slog.Debug(err.Error())
+		return
+	}
+	if !ok {
+		droppedLinesTotal.Inc()
+		return
+	}
+
+	// a line breaking the consistency would break every scrape.
+	done := make(chan error, 1)
+	wr.Done = done
+	l.ms.SubmitWriteRequest(wr)
+	if err := <-done; err != nil {
+		rejectedLinesTotal.Inc()
+
+		slog.Debug("rejected graphite line ", line)
+		slog.Debug(err.Error())
+	}
+}
+
+// writeRequestFor parses the line and maps it to a WriteRequest
+// containing a single gauge.
+// Returns false if the line should be dropped.
+func (l *Listener) writeRequestFor(line string) (storage.WriteRequest, bool, error) {
+	fields := strings.Fields(line)
+	if len(fields) != 2 && len(fields) != 3 {
+		return storage.WriteRequest{}, false, fmt.Errorf("expected 2 or 3 fields, got %d", len(fields))
+	}
+
+	value, err := strconv.ParseFloat(fields[1], 64)
+	if err != nil {
+		return storage.WriteRequest{}, false, fmt.Errorf("invalid value %q: %v", fields[1], err)
+	}
+
+	path, tags, err := parsePath(fields[0])
+	if err != nil {
+		return storage.WriteRequest{}, false, err
+	}
+
+	result, ok := l.mapper.Map(path)
+	if !ok {
+		unmappedLinesTotal.Inc()
+		if l.dropUnmapped {
+			return storage.WriteRequest{}, false, nil
+		}
+		result = l.mapper.Fallback(path)
+	}
+	if result.Drop {
+		return storage.WriteRequest{}, false, nil
+	}
+
+	// labels of the mapping win over the tags of the line.
+	for ln, lv := range tags {
+		if _, ok := result.Labels[ln]; !ok {
+			result.Labels[ln] = lv
+		}
+	}
+
+	// the names and values come from the line, and
+	// can be anything after expanding the mapping.
+	if !model.IsValidMetricName(model.LabelValue(result.Name)) {
+		return storage.WriteRequest{}, false, fmt.Errorf("invalid metric name %q", result.Name)
+	}
+	for ln, lv := range result.Labels {
+		if !model.LabelName(ln).IsValid() {
+			return storage.WriteRequest{}, false, fmt.Errorf("invalid label name %q", ln)
+		}
+		if !utf8.ValidString(lv) {
+			return storage.WriteRequest{}, false, fmt.Errorf("invalid utf-8 in value of label %q", ln)
+		}
+	}
+
+	// the job and the instance are used as grouping labels,
+	// every other label stays a label of the metric itself.
+	grouping := map[string]string{"job": result.Labels["job"]}
+	if instance, ok := result.Labels[model.InstanceLabel]; ok {
+		grouping[model.InstanceLabel] = instance
+	}
+
+	metric := &dto.Metric{
+		Gauge: &dto.Gauge{Value: proto.Float64(value)},
+	}
+	for ln, lv := range result.Labels {
+		if _, ok := grouping[ln]; ok {
+			continue
+		}
+		metric.Label = append(metric.Label, &dto.LabelPair{
+			Name:  proto.String(ln),
+			Value: proto.String(lv),
+		})
+	}
+
+	family := &dto.MetricFamily{
+		Name:   proto.String(result.Name),
+		Type:   dto.MetricType_GAUGE.Enum(),
+		Metric: []*dto.Metric{metric},
+	}
+	if result.Help != "" {
+		family.Help = proto.String(result.Help)
+	}
+
+	return storage.WriteRequest{
+		Labels:         grouping,
+		Timestamp:      time.Now(),
+		MetricFamilies: map[string]*dto.MetricFamily{result.Name: family},
+	}, true, nil
+}
+
+// parsePath splits the tags of a tagged Graphite path
+// (path;tag1=value1;tag2=value2) from the path itself.
+func parsePath(s string) (string, map[string]string, error) {
+	parts := strings.Split(s, ";")
+	path := parts[0]
+	if path == "" {
+		return "", nil, fmt.Errorf("empty path")
+	}
+
+	tags := make(map[string]string, len(parts)-1)
+	for _, tag := range parts[1:] {
+		i := strings.IndexByte(tag, '=')
+		if i <= 0 {
+			return "", nil, fmt.Errorf("invalid tag %q", tag)
+		}
+		tags[utils.SanitizeLabelName(tag[:i])] = tag[i+1:]
+	}
+	return path, tags, nil
+}
@@ -0,0 +1,202 @@
+package graphite
+
+import (
+	"dev.volix.ops/thor/utils"
+	"fmt"
+	"github.com/prometheus/common/model"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"regexp"
+	"strings"
+)
+
+const (
+	// Job name used for mapped metrics, if neither the mapping
+	// nor the defaults of the config define one.
+	defaultJob = "graphite"
+
+	matchTypeGlob  = "glob"
+	matchTypeRegex = "regex"
+
+	actionMap  = "map"
+	actionDrop = "drop"
+)
+
+// A MappingConfig is the content of the mapping file, similar
+// to the one of the graphite_exporter.
+//
+// Example:
+//  defaults:
+//    job: proxy
+//  mappings:
+//  - match: servers.*.players
+//    name: server_players
+//    labels:
+//      server: $1
+//  - match: 'servers\.([^.]+)\.tps\.(\w+)'
+//    match_type: regex
+//    name: server_tps_$2
+//    labels:
+//      server: $1
+type MappingConfig struct {
+	Defaults MappingDefaults `yaml:"defaults"`
+	Mappings []Mapping       `yaml:"mappings"`
+}
+
+// MappingDefaults are applied to every Mapping which
+// does not define the value itself.
+type MappingDefaults struct {
+	Job string `yaml:"job"`
+}
+
+// A Mapping turns a dotted Graphite path into a metric name
+// and labels. The Name and Labels can reference the captured
+// groups of the match with $1, ${2}, ...
+//
+// For globs every `*` captures a single path component.
+// If the Action is `drop`, matching lines are dropped silently.
+type Mapping struct {
+	Match     string            `yaml:"match"`
+	MatchType string            `yaml:"match_type"`
+	Action    string            `yaml:"action"`
+	Name      string            `yaml:"name"`
+	Help      string            `yaml:"help"`
+	Labels    map[string]string `yaml:"labels"`
+
+	regex *regexp.Regexp
+}
+
+// A Mapper holds the compiled mappings and maps
+// Graphite paths with the first matching rule.
+type Mapper struct {
+	defaults MappingDefaults
+	mappings []Mapping
+}
+
+// LoadMapper reads the mapping file at the given path
+// and creates a new Mapper from it.
+func LoadMapper(path string) (*Mapper, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var config MappingConfig
+	if err := yaml.UnmarshalStrict(b, &config); err != nil {
+		return nil, fmt.Errorf("invalid mapping file %s: %v", path, err)
+	}
+	return NewMapper(config)
+}
+
+// NewMapper validates and compiles the given config.
+// An empty config results in a Mapper which maps nothing.
+func NewMapper(config MappingConfig) (*Mapper, error) {
+	if config.Defaults.Job == "" {
+		config.Defaults.Job = defaultJob
+	}
+
+	mappings := make([]Mapping, 0, len(config.Mappings))
+	for i, m := range config.Mappings {
+		if m.Match == "" {
+			return nil, fmt.Errorf("mapping %d: match is required", i)
+		}
+		if m.Action == "" {
+			m.Action = actionMap
+		}
+		if m.Action != actionMap && m.Action != actionDrop {
+			return nil, fmt.Errorf("mapping %d: unknown action %q", i, m.Action)
+		}
+		if m.Action == actionMap && m.Name == "" {
+			return nil, fmt.Errorf("mapping %d: name is required", i)
+		}
+		for ln := range m.Labels {
+			if !model.LabelName(ln).IsValid() || strings.HasPrefix(ln, model.ReservedLabelPrefix) {
+				return nil, fmt.Errorf("mapping %d: improper label name %q", i, ln)
+			}
+		}
+
+		var expr string
+		switch m.MatchType {
+		case "", matchTypeGlob:
+			m.MatchType = matchTypeGlob
+			expr = globToRegex(m.Match)
+		case matchTypeRegex:
+			expr = "^" + m.Match + "$"
+		default:
+			return nil, fmt.Errorf("mapping %d: unknown match_type %q", i, m.MatchType)
+		}
+
+		regex, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, fmt.Errorf("mapping %d: invalid match %q: %v", i, m.Match, err)
+		}
+		m.regex = regex
+		mappings = append(mappings, m)
+	}
+
+	return &Mapper{
+		defaults: config.Defaults,
+		mappings: mappings,
+	}, nil
+}
+
+// A MappingResult is the outcome of mapping a single path.
+// The job label is always contained in Labels.
+type MappingResult struct {
+	Name   string
+	Help   string
+	Labels map[string]string
+	Drop   bool
+}
+
+// Map searches for the first mapping matching the path
+// and applies it. Returns false if no mapping matched.
+func (m *Mapper) Map(path string) (MappingResult, bool) {
+	for _, mapping := range m.mappings {
+		match := mapping.regex.FindStringSubmatchIndex(path)
+		if match == nil {
+			continue
+		}
+		if mapping.Action == actionDrop {
+			return MappingResult{Drop: true}, true
+		}
+
+		result := MappingResult{
+			Name:   utils.SanitizeMetricName(expand(mapping.regex, mapping.Name, path, match)),
+			Help:   mapping.Help,
+			Labels: make(map[string]string, len(mapping.Labels)+1),
+		}
+		for ln, lv := range mapping.Labels {
+			result.Labels[ln] = expand(mapping.regex, lv, path, match)
+		}
+		if result.Labels["job"] == "" {
+			result.Labels["job"] = m.defaults.Job
+		}
+		return result, true
+	}
+	return MappingResult{}, false
+}
+
+// Fallback returns the result for a path without any mapping,
+// which is simply the sanitized path with the default job.
+func (m *Mapper) Fallback(path string) MappingResult {
+	return MappingResult{
+		Name:   utils.SanitizeMetricName(path),
+		Labels: map[string]string{"job": m.defaults.Job},
+	}
+}
+
+// expand replaces the capture group references in the
+// template with the matched values of the path.
+func expand(regex *regexp.Regexp, template, path string, match []int) string {
+	return string(regex.ExpandString(nil, template, path, match))
+}
+
+// globToRegex converts a Graphite glob into an anchored regex,
+// where every `*` captures a single, non-empty path component.
+func globToRegex(glob string) string {
+	parts := strings.Split(glob, "*")
+	for i, part := range parts {
+		parts[i] = regexp.QuoteMeta(part)
+	}
+	return "^" + strings.Join(parts, "([^.]+)") + "$"
+}
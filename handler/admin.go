@@ -0,0 +1,157 @@
+package handler
+
+import (
+	"dev.volix.ops/thor/pkg/selector"
+	"dev.volix.ops/thor/pkg/slog"
+	"dev.volix.ops/thor/storage"
+	"dev.volix.ops/thor/utils"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// AdminDelete returns a http.HandlerFunc deleting every group whose
+// grouping labels match one of the selectors given by the `match[]`
+// parameters, e.g. `{job="lobby",dc=~"fra.*"}`.
+//
+// If the `dry_run` parameter is true, nothing is deleted, but the
+// response contains the groups which would have been deleted.
+func AdminDelete(ms *storage.MetricStorage) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// use the storage of the tenant, if there is one.
+		ms := storageFor(r, ms)
+
+		if err := r.ParseForm(); err != nil {
+			apiError(w, "bad_data", err, http.StatusBadRequest)
+			return
+		}
+		matcherSets, err := parseMatchParams(r.Form["match[]"])
+		if err != nil {
+			apiError(w, "bad_data", err, http.StatusBadRequest)
+			return
+		}
+		if len(matcherSets) == 0 {
+			apiError(w, "bad_data", errors.New("no match[] parameter provided"), http.StatusBadRequest)
+			return
+		}
+		dryRun := false
+		if s := r.Form.Get("dry_run"); s != "" {
+			if dryRun, err = strconv.ParseBool(s); err != nil {
+				apiError(w, "bad_data", fmt.Errorf("invalid dry_run %q", s), http.StatusBadRequest)
+				return
+			}
+		}
+
+		deleted := ms.DeleteGroups(func(labels map[string]string) bool {
+			return matchAny(matcherSets, labels)
+		}, dryRun)
+		sort.Slice(deleted, func(i, j int) bool {
+			return utils.GroupingKeyFor(deleted[i]) < utils.GroupingKeyFor(deleted[j])
+		})
+		if deleted == nil {
+			deleted = []map[string]string{}
+		}
+
+		if !dryRun {
+			slog.Info(fmt.Sprintf("deleted %d groups matching %v (%s)", len(deleted), r.Form["match[]"], r.RemoteAddr))
+		}
+		apiSuccess(w, struct {
+			DryRun bool                `json:"dryRun"`
+			Groups []map[string]string `json:"groups"`
+		}{DryRun: dryRun, Groups: deleted})
+	}
+}
+
+// parseMatchParams parses the selectors of `match[]` parameters.
+func parseMatchParams(params []string) ([][]*selector.Matcher, error) {
+	var matcherSets [][]*selector.Matcher
+	for _, s := range params {
+		matchers, err := selector.Parse(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid match[] %q: %v", s, err)
+		}
+		matcherSets = append(matcherSets, matchers)
+	}
+	return matcherSets, nil
+}
+
+// matchAny returns true, if one of the matcher sets matches the labels.
+func matchAny(matcherSets [][]*selector.Matcher, labels map[string]string) bool {
+	for _, matchers := range matcherSets {
+		if selector.MatchLabels(matchers, labels) {
+			return true
+		}
+	}
+	return false
+}
+
+// AdminWipe returns a http.HandlerFunc deleting all groups.
+func AdminWipe(ms *storage.MetricStorage) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// use the storage of the tenant, if there is one.
+		ms := storageFor(r, ms)
+
+		n := ms.Wipe()
+		slog.Info(fmt.Sprintf("wiped %d groups (%s)", n, r.RemoteAddr))
+		apiSuccess(w, struct {
+			Groups int `json:"groups"`
+		}{Groups: n})
+	}
+}
+
+// AdminSnapshot returns a http.HandlerFunc to download a snapshot
+// of all groups, see storage.Snapshot for the format.
+func AdminSnapshot(ms *storage.MetricStorage) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// use the storage of the tenant, if there is one.
+		ms := storageFor(r, ms)
+
+		filename := fmt.Sprintf("thor-snapshot-%s.json", time.Now().UTC().Format("20060102T150405Z"))
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+		if err := ms.WriteSnapshot(w); err != nil {
+			slog.Error("failed to write snapshot: ", err)
+		}
+	}
+}
+
+// AdminRestore returns a http.HandlerFunc replacing all groups with
+// the ones of the uploaded snapshot. The body may be compressed, just
+// like with Push. Invalid snapshots are rejected with
+// http.StatusBadRequest, without changing anything.
+func AdminRestore(ms *storage.MetricStorage, limits Limits) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// use the storage and limits of the tenant, if there is one.
+		ms := storageFor(r, ms)
+		limits := limitsFor(r, limits)
+
+		body, err := requestBody(r, limits)
+		if err != nil {
+			apiError(w, "bad_data", err, bodyErrorStatus(err))
+			return
+		}
+		defer body.Close()
+
+		// the versions of the replication are kept, as they
+		// belong to the storage and not to the snapshot.
+		groups, _, err := storage.ReadSnapshot(body)
+		if err == nil {
+			err = ms.Restore(groups)
+		}
+		if err != nil {
+			apiError(w, "bad_data", err, bodyErrorStatus(err))
+
+			slog.Debug("failed to restore snapshot from ", r.RemoteAddr)
+			slog.Debug(err.Error())
+			return
+		}
+
+		slog.Info(fmt.Sprintf("restored %d groups from snapshot (%s)", len(groups), r.RemoteAddr))
+		apiSuccess(w, struct {
+			Groups int `json:"groups"`
+		}{Groups: len(groups)})
+	}
+}
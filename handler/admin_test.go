@@ -0,0 +1,127 @@
+package handler
+
+import (
+	"dev.volix.ops/thor/storage"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// pushTestGroups pushes a gauge to a group for every set of labels.
+func pushTestGroups(t *testing.T, ms *storage.MetricStorage, groups ...map[string]string) {
+	for _, labels := range groups {
+		mfs, err := decodeMetricFamilies(&http.Request{Header: http.Header{}}, strings.NewReader("players 1\n"), Limits{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := submitWriteRequest(ms, storage.WriteRequest{Labels: labels, MetricFamilies: mfs}, false); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestAdminDelete(t *testing.T) {
+	ms := storage.NewMetricStorage()
+	pushTestGroups(t, ms,
+		map[string]string{"job": "lobby", "dc": "fra1"},
+		map[string]string{"job": "lobby", "dc": "fra2"},
+		map[string]string{"job": "lobby", "dc": "ams1"},
+		map[string]string{"job": "billing", "dc": "fra1"},
+	)
+
+	deleteGroups := func(dryRun bool) []map[string]string {
+		form := url.Values{"match[]": {`{job="lobby",dc=~"fra.*"}`}}
+		if dryRun {
+			form.Set("dry_run", "true")
+		}
+		req, _ := http.NewRequest("POST", "/api/v1/admin/delete", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+		rr := httptest.NewRecorder()
+		AdminDelete(ms).ServeHTTP(rr, req)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("handler returned wrong status code: got %v want %v, body: %s", rr.Code, http.StatusOK, rr.Body.String())
+		}
+
+		var resp struct {
+			Data struct {
+				Groups []map[string]string `json:"groups"`
+			} `json:"data"`
+		}
+		if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+			t.Fatal(err)
+		}
+		return resp.Data.Groups
+	}
+
+	if groups := deleteGroups(true); len(groups) != 2 || groups[0]["dc"] != "fra1" || groups[1]["dc"] != "fra2" {
+		t.Errorf("wrong groups of dry run, got: %v", groups)
+	}
+	if n := len(ms.GetMetricGroups()); n != 4 {
+		t.Errorf("expected dry run to keep all groups, got: %d", n)
+	}
+
+	if groups := deleteGroups(false); len(groups) != 2 {
+		t.Errorf("wrong deleted groups, got: %v", groups)
+	}
+	if n := len(ms.GetMetricGroups()); n != 2 {
+		t.Errorf("expected 2 groups to remain, got: %d", n)
+	}
+}
+
+func TestAdminDeleteInvalid(t *testing.T) {
+	for _, query := range []string{"", "match[]={job}", "match[]={job=%22a%22}&dry_run=maybe"} {
+		req, _ := http.NewRequest("POST", "/api/v1/admin/delete?"+query, nil)
+		rr := httptest.NewRecorder()
+		AdminDelete(storage.NewMetricStorage()).ServeHTTP(rr, req)
+		if rr.Code != http.StatusBadRequest {
+			t.Errorf("%q: handler returned wrong status code: got %v want %v", query, rr.Code, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestAdminSnapshot(t *testing.T) {
+	ms := storage.NewMetricStorage()
+	pushTestGroups(t, ms,
+		map[string]string{"job": "lobby", "dc": "fra1"},
+		map[string]string{"job": "billing", "dc": "fra1"},
+	)
+
+	req, _ := http.NewRequest("GET", "/api/v1/admin/snapshot", nil)
+	w := httptest.NewRecorder()
+	AdminSnapshot(ms)(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d: %s", http.StatusOK, w.Code, w.Body)
+	}
+	if !strings.HasPrefix(w.Header().Get("Content-Disposition"), "attachment") {
+		t.Errorf("expected attachment, got %q", w.Header().Get("Content-Disposition"))
+	}
+	snapshot := w.Body.String()
+
+	req, _ = http.NewRequest("POST", "/api/v1/admin/wipe", nil)
+	w = httptest.NewRecorder()
+	AdminWipe(ms)(w, req)
+	if w.Code != http.StatusOK || len(ms.GetMetricGroups()) != 0 {
+		t.Fatalf("expected all groups to be wiped, got status %d and %v", w.Code, ms.GetMetricGroups())
+	}
+
+	req, _ = http.NewRequest("POST", "/api/v1/admin/snapshot", strings.NewReader(`{"version": 1, "groups": [{}]}`))
+	w = httptest.NewRecorder()
+	AdminRestore(ms, Limits{})(w, req)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected status %d for an invalid snapshot, got %d", http.StatusBadRequest, w.Code)
+	}
+
+	req, _ = http.NewRequest("POST", "/api/v1/admin/snapshot", strings.NewReader(snapshot))
+	w = httptest.NewRecorder()
+	AdminRestore(ms, Limits{})(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d: %s", http.StatusOK, w.Code, w.Body)
+	}
+	if len(ms.GetMetricGroups()) != 2 {
+		t.Errorf("expected 2 restored groups, got %v", ms.GetMetricGroups())
+	}
+}
@@ -0,0 +1,31 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// apiResponse is the envelope of the responses of the `/api/v1`
+// endpoints, just like the one of the Prometheus HTTP API.
+type apiResponse struct {
+	Status    string      `json:"status"`
+	Data      interface{} `json:"data,omitempty"`
+	ErrorType string      `json:"errorType,omitempty"`
+	Error     string      `json:"error,omitempty"`
+}
+
+// apiSuccess writes the data as successful API response.
+func apiSuccess(w http.ResponseWriter, data interface{}) {
+	writeAPIResponse(w, http.StatusOK, apiResponse{Status: "success", Data: data})
+}
+
+// apiError writes the error as API response with the status code.
+func apiError(w http.ResponseWriter, errorType string, err error, code int) {
+	writeAPIResponse(w, code, apiResponse{Status: "error", ErrorType: errorType, Error: err.Error()})
+}
+
+func writeAPIResponse(w http.ResponseWriter, code int, resp apiResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(resp)
+}
@@ -0,0 +1,455 @@
+package handler
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/golang/protobuf/proto"
+	"github.com/klauspost/compress/snappy"
+	"github.com/klauspost/compress/zstd"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/model"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// Limits restrict the size and rate of the bodies
+// accepted by the handlers. A limit of 0 disables it.
+type Limits struct {
+	// Maximum number of bytes a body may have as sent by the client.
+	MaxBodyBytes int64 `yaml:"max_body_bytes"`
+	// Maximum number of bytes a body may have after decompression.
+	// Protects against decompression bombs.
+	MaxDecompressedBytes int64 `yaml:"max_decompressed_bytes"`
+	// Maximum number of metric families in a single body.
+	MaxFamilies int `yaml:"max_families"`
+	// Maximum number of metrics in a single metric family.
+	MaxMetricsPerFamily int `yaml:"max_metrics_per_family"`
+	// Maximum length of label names and values, in bytes.
+	MaxLabelLength int `yaml:"max_label_length"`
+
+	// RateLimit throttles pushes, disabled if nil.
+	RateLimit *RateLimit `yaml:"-"`
+}
+
+// A TooLargeError is returned while reading a body,
+// which exceeds one of the Limits.
+type TooLargeError struct {
+	What  string
+	Limit int64
+}
+
+func (e *TooLargeError) Error() string {
+	return fmt.Sprintf("%s exceeds the limit of %d", e.What, e.Limit)
+}
+
+// An UnsupportedEncodingError is returned for bodies
+// with an unknown Content-Encoding.
+type UnsupportedEncodingError struct {
+	Encoding string
+}
+
+func (e *UnsupportedEncodingError) Error() string {
+	return fmt.Sprintf("unsupported content encoding %q, supported are gzip, zstd, snappy and x-snappy-framed", e.Encoding)
+}
+
+// requestBody returns the body of the request, decompressed according to
+// its Content-Encoding. Supported are gzip, zstd, snappy (block format,
+// like Prometheus remote write uses it) and x-snappy-framed.
+//
+// Reading the returned body fails with a TooLargeError, as soon as it
+// exceeds Limits.MaxBodyBytes or Limits.MaxDecompressedBytes.
+// It has to be closed by the caller.
+func requestBody(r *http.Request, limits Limits) (io.ReadCloser, error) {
+	raw := r.Body
+	if limits.MaxBodyBytes > 0 {
+		// reject early, if the client already tells us the body is too large.
+		if r.ContentLength > limits.MaxBodyBytes {
+			return nil, &TooLargeError{What: "body", Limit: limits.MaxBodyBytes}
+		}
+		raw = &limitedReadCloser{
+			ReadCloser: r.Body,
+			remaining:  limits.MaxBodyBytes,
+			err:        &TooLargeError{What: "body", Limit: limits.MaxBodyBytes},
+		}
+	}
+
+	encoding := strings.ToLower(strings.TrimSpace(r.Header.Get("Content-Encoding")))
+
+	var body io.ReadCloser
+	switch encoding {
+	case "", "identity":
+		// not compressed, so the decompressed limit does not apply.
+		return raw, nil
+	case "gzip", "x-gzip":
+		gr, err := gzip.NewReader(raw)
+		if err != nil {
+			return nil, fmt.Errorf("invalid gzip body: %w", err)
+		}
+		body = gr
+	case "zstd":
+		options := []zstd.DOption{zstd.WithDecoderConcurrency(1)}
+		if limits.MaxDecompressedBytes > 0 {
+			options = append(options, zstd.WithDecoderMaxMemory(uint64(limits.MaxDecompressedBytes)))
+		}
+		zr, err := zstd.NewReader(raw, options...)
+		if err != nil {
+			return nil, fmt.Errorf("invalid zstd body: %w", err)
+		}
+		body = zstdReadCloser{zr}
+	case "snappy":
+		// the block format has no streaming support, but the decoded
+		// length is known beforehand, so we can check it early.
+		compressed, err := ioutil.ReadAll(raw)
+		if err != nil {
+			return nil, err
+		}
+		n, err := snappy.DecodedLen(compressed)
+		if err != nil {
+			return nil, fmt.Errorf("invalid snappy body: %v", err)
+		}
+		if limits.MaxDecompressedBytes > 0 && int64(n) > limits.MaxDecompressedBytes {
+			return nil, &TooLargeError{What: "decompressed body", Limit: limits.MaxDecompressedBytes}
+		}
+		decoded, err := snappy.Decode(nil, compressed)
+		if err != nil {
+			return nil, fmt.Errorf("invalid snappy body: %v", err)
+		}
+		return ioutil.NopCloser(bytes.NewReader(decoded)), nil
+	case "x-snappy-framed":
+		body = ioutil.NopCloser(snappy.NewReader(raw))
+	default:
+		return nil, &UnsupportedEncodingError{Encoding: encoding}
+	}
+
+	if limits.MaxDecompressedBytes <= 0 {
+		return body, nil
+	}
+	return &limitedReadCloser{
+		ReadCloser: body,
+		remaining:  limits.MaxDecompressedBytes,
+		err:        &TooLargeError{What: "decompressed body", Limit: limits.MaxDecompressedBytes},
+	}, nil
+}
+
+// checkMetricFamilies returns a TooLargeError, if the metric families
+// exceed the limits on the number of metrics or the length of labels.
+// The number of families is checked while decoding already.
+func checkMetricFamilies(mfs map[string]*dto.MetricFamily, limits Limits) error {
+	if limits.MaxFamilies > 0 && len(mfs) > limits.MaxFamilies {
+		return &TooLargeError{What: "number of metric families", Limit: int64(limits.MaxFamilies)}
+	}
+	for _, mf := range mfs {
+		if err := checkMetricFamily(mf, limits); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkMetricFamily checks a single metric family, see checkMetricFamilies.
+func checkMetricFamily(mf *dto.MetricFamily, limits Limits) error {
+	if limits.MaxMetricsPerFamily > 0 && len(mf.Metric) > limits.MaxMetricsPerFamily {
+		return &TooLargeError{
+			What:  fmt.Sprintf("number of metrics in family %q", mf.GetName()),
+			Limit: int64(limits.MaxMetricsPerFamily),
+		}
+	}
+	if limits.MaxLabelLength <= 0 {
+		return nil
+	}
+	for _, m := range mf.Metric {
+		for _, lp := range m.Label {
+			if err := checkLabelLength(lp.GetName(), lp.GetValue(), limits); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// checkLabels checks the length of the labels, e.g. the grouping labels.
+func checkLabels(labels map[string]string, limits Limits) error {
+	for ln, lv := range labels {
+		if err := checkLabelLength(ln, lv, limits); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func checkLabelLength(name, value string, limits Limits) error {
+	if limits.MaxLabelLength <= 0 {
+		return nil
+	}
+	if len(name) > limits.MaxLabelLength {
+		return &TooLargeError{What: "length of label name", Limit: int64(limits.MaxLabelLength)}
+	}
+	if len(value) > limits.MaxLabelLength {
+		return &TooLargeError{What: fmt.Sprintf("length of value of label %q", name), Limit: int64(limits.MaxLabelLength)}
+	}
+	return nil
+}
+
+// readDelimited reads a single varint length-delimited protobuf message.
+// Unlike pbutil.ReadDelimited it refuses messages larger than maxSize before
+// allocating a buffer for them. A maxSize of 0 disables the check.
+func readDelimited(r *bufio.Reader, m proto.Message, maxSize int64) error {
+	size, err := binary.ReadUvarint(r)
+	if err != nil {
+		return err
+	}
+	if maxSize > 0 && size > uint64(maxSize) {
+		return &TooLargeError{What: "protobuf message", Limit: maxSize}
+	}
+	buf := make([]byte, size)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	return proto.Unmarshal(buf, m)
+}
+
+// A textCounter counts the metric families and metrics of a body in the
+// text format while it is read by the expfmt.TextParser, and fails the read
+// with a TooLargeError as soon as they exceed the limits. The samples are
+// assigned to their families like the parser does it, so that histograms
+// and summaries are counted once per label set, not once per line.
+type textCounter struct {
+	r      io.Reader
+	limits Limits
+	// the incomplete line at the end of the last read.
+	line []byte
+	// the types of all families, including the ones without samples.
+	types map[string]string
+	// the number of metrics of the families with samples.
+	metrics map[string]int
+	// the label sets of the histograms and summaries.
+	series map[string]map[string]bool
+	err    error
+}
+
+func newTextCounter(r io.Reader, limits Limits) *textCounter {
+	return &textCounter{
+		r:       r,
+		limits:  limits,
+		types:   map[string]string{},
+		metrics: map[string]int{},
+		series:  map[string]map[string]bool{},
+	}
+}
+
+func (c *textCounter) Read(p []byte) (int, error) {
+	if c.err != nil {
+		return 0, c.err
+	}
+
+	n, err := c.r.Read(p)
+	data := p[:n]
+	for len(data) > 0 {
+		i := bytes.IndexByte(data, '\n')
+		if i < 0 {
+			c.line = append(c.line, data...)
+			break
+		}
+		c.line = append(c.line, data[:i]...)
+		c.err = c.countLine(string(c.line))
+		c.line = c.line[:0]
+		data = data[i+1:]
+		if c.err != nil {
+			return 0, c.err
+		}
+	}
+	if err == io.EOF && len(c.line) > 0 {
+		if c.err = c.countLine(string(c.line)); c.err != nil {
+			return 0, c.err
+		}
+		c.line = c.line[:0]
+	}
+	return n, err
+}
+
+func (c *textCounter) countLine(line string) error {
+	line = strings.TrimLeft(line, " \t")
+	if line == "" {
+		return nil
+	}
+	if line[0] == '#' {
+		fields := strings.Fields(line[1:])
+		if len(fields) < 2 || (fields[0] != "HELP" && fields[0] != "TYPE") {
+			return nil
+		}
+		if _, ok := c.types[fields[1]]; !ok {
+			c.types[fields[1]] = "untyped"
+		}
+		if fields[0] == "TYPE" && len(fields) > 2 {
+			c.types[fields[1]] = strings.ToLower(fields[2])
+		}
+		return nil
+	}
+
+	i := strings.IndexAny(line, "{ \t")
+	if i < 0 {
+		// a sample without value, which the parser rejects.
+		return nil
+	}
+	family, mt := c.family(line[:i])
+	if mt == "histogram" || mt == "summary" {
+		// the metric is identified by its labels, without le or quantile.
+		exclude := model.BucketLabel
+		if mt == "summary" {
+			exclude = model.QuantileLabel
+		}
+		key := ""
+		if rest := strings.TrimLeft(line[i:], " \t"); strings.HasPrefix(rest, "{") {
+			key = textLabelsKey(rest[1:], exclude)
+		}
+		if c.series[family] == nil {
+			c.series[family] = map[string]bool{}
+		}
+		if c.series[family][key] {
+			return nil
+		}
+		c.series[family][key] = true
+	}
+
+	c.metrics[family]++
+	if c.limits.MaxFamilies > 0 && len(c.metrics) > c.limits.MaxFamilies {
+		return &TooLargeError{What: "number of metric families", Limit: int64(c.limits.MaxFamilies)}
+	}
+	if c.limits.MaxMetricsPerFamily > 0 && c.metrics[family] > c.limits.MaxMetricsPerFamily {
+		return &TooLargeError{
+			What:  fmt.Sprintf("number of metrics in family %q", family),
+			Limit: int64(c.limits.MaxMetricsPerFamily),
+		}
+	}
+	return nil
+}
+
+// family returns the name and type of the family of the sample,
+// resolving the _bucket, _sum and _count suffixes of histograms
+// and summaries like the expfmt.TextParser.
+func (c *textCounter) family(name string) (string, string) {
+	if mt, ok := c.types[name]; ok {
+		return name, mt
+	}
+	for _, suffix := range []string{"_count", "_sum", "_bucket"} {
+		if !strings.HasSuffix(name, suffix) || len(name) == len(suffix) {
+			continue
+		}
+		base := strings.TrimSuffix(name, suffix)
+		if mt := c.types[base]; mt == "histogram" || (mt == "summary" && suffix != "_bucket") {
+			return base, mt
+		}
+	}
+	c.types[name] = "untyped"
+	return name, "untyped"
+}
+
+// textLabelsKey returns a key of the labels of a sample, without the
+// one named exclude. s is the part of the line after the opening brace.
+// Malformed labels, which the parser rejects anyway, end the key.
+func textLabelsKey(s string, exclude string) string {
+	var pairs []string
+	for {
+		s = strings.TrimLeft(s, " \t")
+		i := strings.IndexAny(s, "=} \t")
+		if i <= 0 {
+			break
+		}
+		name := s[:i]
+		s = strings.TrimLeft(s[i:], " \t")
+		if !strings.HasPrefix(s, "=") {
+			break
+		}
+		s = strings.TrimLeft(s[1:], " \t")
+		if !strings.HasPrefix(s, `"`) {
+			break
+		}
+		// the value ends at the first unescaped quote.
+		end := 1
+		for end < len(s) && s[end] != '"' {
+			if s[end] == '\\' {
+				end++
+			}
+			end++
+		}
+		if end >= len(s) {
+			break
+		}
+		if name != exclude {
+			pairs = append(pairs, name+"="+s[1:end])
+		}
+		s = strings.TrimLeft(s[end+1:], " \t")
+		if !strings.HasPrefix(s, ",") {
+			break
+		}
+		s = s[1:]
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, "\xff")
+}
+
+// bodyErrorStatus returns the http status code for errors
+// which occurred while reading or decoding a body.
+func bodyErrorStatus(err error) int {
+	var tooLarge *TooLargeError
+	var unsupported *UnsupportedEncodingError
+	switch {
+	case errors.As(err, &tooLarge):
+		return http.StatusRequestEntityTooLarge
+	case errors.As(err, &unsupported):
+		return http.StatusUnsupportedMediaType
+	}
+	return http.StatusBadRequest
+}
+
+// limitedReadCloser fails with err, as soon as more than
+// remaining bytes are read from the underlying reader.
+type limitedReadCloser struct {
+	io.ReadCloser
+	remaining int64
+	err       error
+	exceeded  bool
+}
+
+func (l *limitedReadCloser) Read(p []byte) (int, error) {
+	if l.exceeded {
+		return 0, l.err
+	}
+
+	// we read one byte more than allowed, to
+	// know if the limit is exceeded.
+	if int64(len(p)) > l.remaining+1 {
+		p = p[:l.remaining+1]
+	}
+	n, err := l.ReadCloser.Read(p)
+	if int64(n) <= l.remaining {
+		l.remaining -= int64(n)
+		return n, err
+	}
+
+	n = int(l.remaining)
+	l.remaining = 0
+	l.exceeded = true
+	return n, l.err
+}
+
+// zstdReadCloser wraps the zstd.Decoder, as its
+// Close method does not return an error.
+type zstdReadCloser struct {
+	*zstd.Decoder
+}
+
+func (z zstdReadCloser) Close() error {
+	z.Decoder.Close()
+	return nil
+}
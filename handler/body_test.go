@@ -0,0 +1,213 @@
+package handler
+
+import (
+	"bytes"
+	"compress/gzip"
+	"dev.volix.ops/thor/storage"
+	"encoding/binary"
+	"github.com/klauspost/compress/snappy"
+	"github.com/klauspost/compress/zstd"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+const compressedBody = "players{server=\"lobby17\"} 42\n"
+
+func TestPushCompressed(t *testing.T) {
+	var gzipped bytes.Buffer
+	gw := gzip.NewWriter(&gzipped)
+	_, _ = gw.Write([]byte(compressedBody))
+	_ = gw.Close()
+
+	zw, err := zstd.NewWriter(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zstdCompressed := zw.EncodeAll([]byte(compressedBody), nil)
+
+	var framed bytes.Buffer
+	sw := snappy.NewBufferedWriter(&framed)
+	_, _ = sw.Write([]byte(compressedBody))
+	_ = sw.Close()
+
+	bodies := map[string][]byte{
+		"gzip":            gzipped.Bytes(),
+		"zstd":            zstdCompressed,
+		"snappy":          snappy.Encode(nil, []byte(compressedBody)),
+		"x-snappy-framed": framed.Bytes(),
+	}
+	for encoding, body := range bodies {
+		ms := storage.NewMetricStorage()
+		req := newPushRequest(t, "lobby", "text/plain", bytes.NewReader(body))
+		req.Header.Set("Content-Encoding", encoding)
+
+		rr := httptest.NewRecorder()
+		Push(ms, false, false, false, Limits{MaxDecompressedBytes: 1024}, nil).ServeHTTP(rr, req)
+
+		if status := rr.Code; status != http.StatusOK {
+			t.Errorf("%s: handler returned wrong status code: got %v want %v, body: %s",
+				encoding, status, http.StatusOK, rr.Body.String())
+			continue
+		}
+		mfs := ms.GetMetricFamilies()
+		if len(mfs) != 1 || mfs[0].Metric[0].GetUntyped().GetValue() != 42 {
+			t.Errorf("%s: expected pushed metric, got: %v", encoding, mfs)
+		}
+	}
+}
+
+func TestPushDecompressionBomb(t *testing.T) {
+	// lots of zeros compress really well.
+	bomb := "players 0" + strings.Repeat("0", 1<<20) + "\n"
+
+	var gzipped bytes.Buffer
+	gw := gzip.NewWriter(&gzipped)
+	_, _ = gw.Write([]byte(bomb))
+	_ = gw.Close()
+
+	for encoding, body := range map[string][]byte{
+		"gzip":   gzipped.Bytes(),
+		"snappy": snappy.Encode(nil, []byte(bomb)),
+	} {
+		req := newPushRequest(t, "lobby", "text/plain", bytes.NewReader(body))
+		req.Header.Set("Content-Encoding", encoding)
+
+		rr := httptest.NewRecorder()
+		Push(storage.NewMetricStorage(), false, false, false, Limits{MaxDecompressedBytes: 1024}, nil).ServeHTTP(rr, req)
+
+		if status := rr.Code; status != http.StatusRequestEntityTooLarge {
+			t.Errorf("%s: handler returned wrong status code: got %v want %v",
+				encoding, status, http.StatusRequestEntityTooLarge)
+		}
+	}
+}
+
+func TestPushUnsupportedEncoding(t *testing.T) {
+	req := newPushRequest(t, "lobby", "text/plain", strings.NewReader(compressedBody))
+	req.Header.Set("Content-Encoding", "br")
+
+	rr := httptest.NewRecorder()
+	Push(storage.NewMetricStorage(), false, false, false, Limits{}, nil).ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusUnsupportedMediaType {
+		t.Errorf("handler returned wrong status code: got %v want %v",
+			status, http.StatusUnsupportedMediaType)
+	}
+}
+
+func TestPushLimits(t *testing.T) {
+	limits := Limits{
+		MaxBodyBytes:        256,
+		MaxFamilies:         2,
+		MaxMetricsPerFamily: 2,
+		MaxLabelLength:      16,
+	}
+	tests := map[string]string{
+		"body":       "players " + strings.Repeat("0", 512) + "\n",
+		"families":   "a 1\nb 2\nc 3\n",
+		"metrics":    "players{server=\"a\"} 1\nplayers{server=\"b\"} 2\nplayers{server=\"c\"} 3\n",
+		"label size": "players{server=\"" + strings.Repeat("a", 17) + "\"} 1\n",
+	}
+	for name, body := range tests {
+		// the multi reader hides the length of the body,
+		// so it is only limited while reading.
+		req := newPushRequest(t, "lobby", "text/plain", io.MultiReader(strings.NewReader(body)))
+
+		rr := httptest.NewRecorder()
+		Push(storage.NewMetricStorage(), false, false, false, limits, nil).ServeHTTP(rr, req)
+
+		if status := rr.Code; status != http.StatusRequestEntityTooLarge {
+			t.Errorf("%s: handler returned wrong status code: got %v want %v, body: %s",
+				name, status, http.StatusRequestEntityTooLarge, rr.Body.String())
+		}
+	}
+
+	req := newPushRequest(t, "lobby", "text/plain", strings.NewReader(compressedBody))
+	rr := httptest.NewRecorder()
+	Push(storage.NewMetricStorage(), false, false, false, limits, nil).ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusOK {
+		t.Errorf("handler returned wrong status code: got %v want %v, body: %s",
+			status, http.StatusOK, rr.Body.String())
+	}
+}
+
+func TestPushProtobufMessageTooLarge(t *testing.T) {
+	// a single message claiming to be 1 GiB large must
+	// be rejected before allocating a buffer for it.
+	body := make([]byte, binary.MaxVarintLen64)
+	body = body[:binary.PutUvarint(body, 1<<30)]
+	req := newPushRequest(t, "lobby",
+		"application/vnd.google.protobuf; proto=io.prometheus.client.MetricFamily; encoding=delimited",
+		io.MultiReader(bytes.NewReader(body)))
+
+	rr := httptest.NewRecorder()
+	Push(storage.NewMetricStorage(), false, false, false, Limits{MaxBodyBytes: 1024}, nil).ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusRequestEntityTooLarge {
+		t.Errorf("handler returned wrong status code: got %v want %v",
+			status, http.StatusRequestEntityTooLarge)
+	}
+}
+
+// unreadable fails the test, if the body is read after the limits
+// have been exceeded already.
+type unreadable struct {
+	t *testing.T
+}
+
+func (u unreadable) Read([]byte) (int, error) {
+	u.t.Error("body read after exceeding the limits")
+	return 0, io.ErrUnexpectedEOF
+}
+
+func TestPushLimitsWhileDecoding(t *testing.T) {
+	limits := Limits{MaxFamilies: 2, MaxMetricsPerFamily: 2}
+	tests := []struct {
+		contentType string
+		body        string
+	}{
+		{"text/plain", "a 1\nb 2\nc 3\n"},
+		{"text/plain", "# TYPE players gauge\nplayers{server=\"a\"} 1\nplayers{server=\"b\"} 2\nplayers{server=\"c\"} 3\n"},
+		{"text/plain", "# TYPE tick histogram\ntick_bucket{le=\"1\",server=\"a\"} 1\ntick_bucket{le=\"1\",server=\"b\"} 1\ntick_bucket{server=\"c\",le=\"1\"} 1\n"},
+		{"application/json", `[{"name": "a", "type": "gauge", "metrics": [{"value": 1}]},
+			{"name": "b", "type": "gauge", "metrics": [{"value": 1}]},
+			{"name": "c", "type": "gauge", "metrics": [{"value": 1}]},`},
+		{"application/json", `[{"name": "a", "type": "gauge", "metrics": [{"value": 1}, {"labels": {"x": "1"}, "value": 1}, {"labels": {"x": "2"}, "value": 1}]},`},
+	}
+	for _, test := range tests {
+		req := newPushRequest(t, "lobby", test.contentType, io.MultiReader(strings.NewReader(test.body), unreadable{t}))
+		rr := httptest.NewRecorder()
+		Push(storage.NewMetricStorage(), false, false, false, limits, nil).ServeHTTP(rr, req)
+
+		if status := rr.Code; status != http.StatusRequestEntityTooLarge {
+			t.Errorf("%q: handler returned wrong status code: got %v want %v, body: %s",
+				test.body, status, http.StatusRequestEntityTooLarge, rr.Body.String())
+		}
+	}
+
+	// every line of a histogram or summary is no metric on its own.
+	body := `# TYPE tick histogram
+tick_bucket{server="a",le="0.1"} 1
+tick_bucket{server="a",le="1"} 2
+tick_bucket{server="a",le="+Inf"} 3
+tick_sum{server="a"} 1.5
+tick_count{server="a"} 3
+# TYPE ping summary
+ping{quantile="0.5"} 0.1
+ping{quantile="0.9"} 0.2
+ping_sum 3
+ping_count 20
+`
+	req := newPushRequest(t, "lobby", "text/plain", strings.NewReader(body))
+	rr := httptest.NewRecorder()
+	Push(storage.NewMetricStorage(), false, false, false, Limits{MaxFamilies: 2, MaxMetricsPerFamily: 1}, nil).ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusOK {
+		t.Errorf("handler returned wrong status code: got %v want %v, body: %s",
+			status, http.StatusOK, rr.Body.String())
+	}
+}
@@ -0,0 +1,16 @@
+package handler
+
+import (
+	"dev.volix.ops/thor/cluster"
+	"net/http"
+)
+
+// Cluster returns a http.HandlerFunc listing the members of
+// the sharded cluster, their state and their share of the groups.
+func Cluster(s *cluster.Sharder) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		apiSuccess(w, struct {
+			Members []cluster.MemberStatus `json:"members"`
+		}{Members: s.Status()})
+	}
+}
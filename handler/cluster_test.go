@@ -0,0 +1,49 @@
+package handler
+
+import (
+	"dev.volix.ops/thor/cluster"
+	"dev.volix.ops/thor/storage"
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCluster(t *testing.T) {
+	ms := storage.NewMetricStorage()
+	pushTestGroups(t, ms, map[string]string{"job": "lobby"})
+	s, err := cluster.NewSharder(ms, nil, "http://thor-0:9091", nil, cluster.Auth{BearerToken: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req, _ := http.NewRequest("GET", "/api/v1/cluster", nil)
+	w := httptest.NewRecorder()
+	Cluster(s)(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d", http.StatusOK, w.Code)
+	}
+
+	var resp struct {
+		Data struct {
+			Members []struct {
+				Name      string  `json:"name"`
+				State     string  `json:"state"`
+				Self      bool    `json:"self"`
+				Ownership float64 `json:"ownership"`
+				Groups    int     `json:"groups"`
+			} `json:"members"`
+		} `json:"data"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Data.Members) != 1 {
+		t.Fatalf("expected 1 member, got %v", resp.Data.Members)
+	}
+	m := resp.Data.Members[0]
+	if m.Name != "http://thor-0:9091" || m.State != "alive" || !m.Self || math.Abs(m.Ownership-1) > 1e-9 || m.Groups != 1 {
+		t.Errorf("unexpected member %+v", m)
+	}
+}
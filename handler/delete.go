@@ -15,19 +15,30 @@ import (
 //
 // Will return a http.StatusAccepted immediately, as it should
 // be clear that the delete action is in any case consistent.
-func Delete(ms *storage.MetricStorage, base64 bool) http.HandlerFunc {
+// Deletes the Authorizer does not allow are rejected with
+// http.StatusForbidden.
+//
+// Instead of the whole group, only some families can be deleted by
+// passing their names as `family` parameters, or only some series by
+// passing selectors as `match[]` parameters, e.g. `{map="castle"}`.
+func Delete(ms *storage.MetricStorage, base64 bool, authz Authorizer) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
+		// use the storage of the tenant, if there is one.
+		ms := storageFor(r, ms)
+
 		job := route.Param(r.Context(), "job")
 		if base64 {
 			// we try to decode the job name with base64
 			// if it fails, error.
-			if job, err := utils.DecodeBase64(job); err != nil {
+			decoded, err := utils.DecodeBase64(job)
+			if err != nil {
 				http.Error(w, fmt.Sprintf("invalid base64 encoding in job name %q: %v", job, err), http.StatusBadRequest)
 
 				slog.Debug("invalid base64 encoding in job name ", job)
 				slog.Debug(err.Error())
 				return
 			}
+			job = decoded
 		}
 		if job == "" {
 			http.Error(w, "job name is required", http.StatusBadRequest)
@@ -48,10 +59,26 @@ func Delete(ms *storage.MetricStorage, base64 bool) http.HandlerFunc {
 			return
 		}
 		labels["job"] = job
+		if err := authorize(authz, r, labels); err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+
+		query := r.URL.Query()
+		series, err := parseMatchParams(query["match[]"])
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+
+			slog.Debug("invalid match[] parameter from ", r.RemoteAddr)
+			slog.Debug(err.Error())
+			return
+		}
 
 		ms.SubmitWriteRequest(storage.WriteRequest{
-			Labels: labels,
-			Timestamp: time.Now(),
+			Labels:         labels,
+			Timestamp:      time.Now(),
+			DeleteFamilies: query["family"],
+			DeleteSeries:   series,
 		})
 		w.WriteHeader(http.StatusAccepted)
 	}
@@ -0,0 +1,134 @@
+package handler
+
+import (
+	"dev.volix.ops/thor/pkg/metricjson"
+	"dev.volix.ops/thor/pkg/selector"
+	"dev.volix.ops/thor/pkg/slog"
+	"dev.volix.ops/thor/storage"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+const (
+	// How many events are buffered for every client,
+	// before they are dropped.
+	eventBuffer = 256
+	// How often a comment is sent to keep idle streams open.
+	eventKeepAlive = 15 * time.Second
+)
+
+// event is the JSON representation of a storage.Event.
+type event struct {
+	Labels          map[string]string   `json:"labels"`
+	Time            time.Time           `json:"time"`
+	Families        []metricjson.Family `json:"families,omitempty"`
+	DeletedFamilies []string            `json:"deletedFamilies,omitempty"`
+}
+
+// Events returns a http.HandlerFunc streaming the changes of the groups
+// as Server-Sent Events. Every event is named after its storage.EventType
+// (push, replace, delete or expire) and contains the grouping labels and either
+// the written families with their values or the names of the deleted ones.
+//
+// With `match[]` parameters, only the series matching one of the selectors
+// are streamed, like with Metrics. Deletes and expiries are matched by the grouping labels
+// and the names of the deleted families.
+//
+// Events are dropped for clients which can not keep up. The streams
+// are not limited by the write timeout of the server.
+func Events(ms *storage.MetricStorage) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// use the storage of the tenant, if there is one.
+		ms := storageFor(r, ms)
+
+		if err := r.ParseForm(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		matcherSets, err := parseMatchParams(r.Form["match[]"])
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			http.Error(w, "streaming is not supported", http.StatusInternalServerError)
+			return
+		}
+
+		// the write timeout of the server would close the stream.
+		if err := http.NewResponseController(w).SetWriteDeadline(time.Time{}); err != nil {
+			slog.Debug("failed to clear the write deadline of the event stream: ", err)
+		}
+
+		events, cancel := ms.Subscribe(eventBuffer)
+		defer cancel()
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.WriteHeader(http.StatusOK)
+		flusher.Flush()
+
+		keepAlive := time.NewTicker(eventKeepAlive)
+		defer keepAlive.Stop()
+		for {
+			select {
+			case <-r.Context().Done():
+				return
+			case <-keepAlive.C:
+				if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+					return
+				}
+				flusher.Flush()
+			case e := <-events:
+				data, ok := filterEvent(e, matcherSets)
+				if !ok {
+					continue
+				}
+				b, err := json.Marshal(data)
+				if err != nil {
+					slog.Debug("failed to encode event: ", err)
+					continue
+				}
+				if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", e.Type, b); err != nil {
+					slog.Debug("failed to write event: ", err)
+					return
+				}
+				flusher.Flush()
+			}
+		}
+	}
+}
+
+// filterEvent returns the JSON representation of the event with only the
+// families and series matching one of the matcher sets, or false if nothing
+// matches.
+func filterEvent(e storage.Event, matcherSets [][]*selector.Matcher) (event, bool) {
+	data := event{Labels: e.Labels, Time: e.Time}
+	if e.Type == storage.EventPush || e.Type == storage.EventReplace {
+		mfs := e.MetricFamilies
+		if len(matcherSets) > 0 {
+			mfs = filterMetricFamilies(mfs, matcherSets)
+		}
+		data.Families = metricjson.FromMetricFamilies(mfs)
+		return data, len(data.Families) > 0
+	}
+
+	if len(matcherSets) == 0 {
+		data.DeletedFamilies = e.DeletedFamilies
+		return data, true
+	}
+	labels := make(map[string]string, len(e.Labels)+1)
+	for name, value := range e.Labels {
+		labels[name] = value
+	}
+	for _, name := range e.DeletedFamilies {
+		labels["__name__"] = name
+		if matchAny(matcherSets, labels) {
+			data.DeletedFamilies = append(data.DeletedFamilies, name)
+		}
+	}
+	return data, len(data.DeletedFamilies) > 0
+}
@@ -0,0 +1,92 @@
+package handler
+
+import (
+	"bufio"
+	"dev.volix.ops/thor/storage"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEvents(t *testing.T) {
+	ms := storage.NewMetricStorage()
+	server := httptest.NewServer(Events(ms))
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "?" + url.Values{"match[]": {`{job="lobby"}`}}.Encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("expected event stream, got %q", ct)
+	}
+
+	pushTestGroups(t, ms,
+		map[string]string{"job": "billing"},
+		map[string]string{"job": "lobby", "instance": "lobby-17"},
+	)
+	if err := submitWriteRequest(ms, storage.WriteRequest{Labels: map[string]string{"job": "lobby", "instance": "lobby-17"}}, false); err != nil {
+		t.Fatal(err)
+	}
+
+	scanner := bufio.NewScanner(resp.Body)
+	next := func() (string, event) {
+		var name string
+		for scanner.Scan() {
+			line := scanner.Text()
+			switch {
+			case strings.HasPrefix(line, "event: "):
+				name = strings.TrimPrefix(line, "event: ")
+			case strings.HasPrefix(line, "data: "):
+				var e event
+				if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &e); err != nil {
+					t.Fatal(err)
+				}
+				return name, e
+			}
+		}
+		t.Fatalf("stream ended: %v", scanner.Err())
+		return "", event{}
+	}
+
+	// the push to the billing job is filtered.
+	name, e := next()
+	if name != "push" || e.Labels["instance"] != "lobby-17" || len(e.Families) != 1 || e.Families[0].Name != "players" {
+		t.Errorf("expected push of players, got %s: %+v", name, e)
+	}
+	name, e = next()
+	if name != "delete" || len(e.DeletedFamilies) != 1 || e.DeletedFamilies[0] != "players" {
+		t.Errorf("expected delete of players, got %s: %+v", name, e)
+	}
+}
+
+func TestEventsWriteTimeout(t *testing.T) {
+	ms := storage.NewMetricStorage()
+	server := httptest.NewUnstartedServer(Events(ms))
+	server.Config.WriteTimeout = 100 * time.Millisecond
+	server.Start()
+	defer server.Close()
+
+	resp, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	// the stream is still open after the write timeout.
+	time.Sleep(3 * server.Config.WriteTimeout)
+	pushTestGroups(t, ms, map[string]string{"job": "lobby"})
+
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		if scanner.Text() == "event: push" {
+			return
+		}
+	}
+	t.Fatalf("stream ended: %v", scanner.Err())
+}
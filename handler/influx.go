@@ -0,0 +1,129 @@
+package handler
+
+import (
+	"dev.volix.ops/thor/influx"
+	"dev.volix.ops/thor/pkg/slog"
+	"dev.volix.ops/thor/storage"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Influx returns a http.HandlerFunc compatible with the `/write` API
+// of InfluxDB 1.x and the `/api/v2/write` API of InfluxDB 2.x.
+// The points of the line protocol body are converted with
+// influx.ParseMetricFamilies and merged into the group of the job named
+// after the database (or bucket for 2.x). The relabel configs of the
+// Rules are applied like with Push.
+//
+// Just like with Push, inconsistent metrics are rejected with
+// http.StatusBadRequest, unless unchecked is true.
+// Errors are written as JSON, just like InfluxDB does.
+func Influx(ms *storage.MetricStorage, unchecked bool, limits Limits, authz Authorizer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// use the storage and limits of the tenant, if there is one.
+		ms := storageFor(r, ms)
+		limits := limitsFor(r, limits)
+
+		query := r.URL.Query()
+
+		job := query.Get("db")
+		if job == "" {
+			job = query.Get("bucket")
+		}
+		if job == "" {
+			influxError(w, "database is required", http.StatusBadRequest)
+
+			slog.Debug("database is required")
+			return
+		}
+		if err := authorize(authz, r, map[string]string{"job": job}); err != nil {
+			influxError(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		if throttled, retryAfter := limits.RateLimit.throttle(r, job); throttled {
+			setRetryAfter(w, retryAfter)
+			influxError(w, "rate limit exceeded", http.StatusTooManyRequests)
+			return
+		}
+		precision := query.Get("precision")
+		if !influx.ValidPrecision(precision) {
+			influxError(w, fmt.Sprintf("invalid precision %q", precision), http.StatusBadRequest)
+
+			slog.Debug("invalid precision ", precision)
+			return
+		}
+
+		body, err := requestBody(r, limits)
+		if err != nil {
+			influxError(w, err.Error(), bodyErrorStatus(err))
+
+			slog.Debug("failed to read body from ", r.RemoteAddr)
+			slog.Debug(err.Error())
+			return
+		}
+		defer body.Close()
+
+		// the limits are enforced while parsing, as
+		// the points are much larger than the body.
+		metricFamilies, err := influx.ParseMetricFamilies(body, limits.MaxFamilies, limits.MaxMetricsPerFamily)
+		if le, ok := err.(*influx.LimitError); ok {
+			err = &TooLargeError{What: le.What, Limit: int64(le.Limit)}
+		}
+		if err != nil {
+			influxError(w, err.Error(), bodyErrorStatus(err))
+
+			slog.Debug("failed to parse line protocol from ", r.RemoteAddr)
+			slog.Debug(err.Error())
+			return
+		}
+
+		labels := map[string]string{"job": job}
+		rulesFor(r).relabelFamilies(metricFamilies)
+		err = checkLabels(labels, limits)
+		if err == nil {
+			err = checkMetricFamilies(metricFamilies, limits)
+		}
+		if err != nil {
+			influxError(w, err.Error(), bodyErrorStatus(err))
+
+			slog.Debug("line protocol exceeds limits from ", r.RemoteAddr)
+			slog.Debug(err.Error())
+			return
+		}
+
+		err = submitWriteRequest(ms, storage.WriteRequest{
+			Labels:         labels,
+			Timestamp:      time.Now(),
+			MetricFamilies: metricFamilies,
+		}, unchecked)
+		if err != nil {
+			influxError(
+				w,
+				fmt.Sprintf("pushed metrics are invalid or inconsistent with existing metrics: %v", err),
+				http.StatusBadRequest,
+			)
+			slog.Error(fmt.Sprintf("pushed metrics are invalid or inconsistent with existing metrics (%s, %s): %s",
+				r.Method, r.RemoteAddr, err.Error()))
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// InfluxPing returns a http.HandlerFunc for the `/ping` API
+// of InfluxDB, which is used by clients to check availability.
+func InfluxPing() http.HandlerFunc {
+	return func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// influxError writes the error in the JSON format of InfluxDB.
+func influxError(w http.ResponseWriter, msg string, code int) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Influxdb-Error", msg)
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(map[string]string{"error": msg})
+}
@@ -0,0 +1,54 @@
+package handler
+
+import (
+	"dev.volix.ops/thor/storage"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestInflux(t *testing.T) {
+	ms := storage.NewMetricStorage()
+
+	req, err := http.NewRequest("POST", "/write?db=proxy", strings.NewReader("players,server=lobby17 value=42i"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	Influx(ms, false, Limits{}, nil).ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusNoContent {
+		t.Errorf("handler returned wrong status code: got %v want %v",
+			status, http.StatusNoContent)
+	}
+	if groups := ms.GetMetricGroups(); len(groups) != 1 {
+		t.Errorf("expected one group, got: %v", groups)
+	}
+
+	// writing without a database has to fail.
+	req, err = http.NewRequest("POST", "/write", strings.NewReader("players value=1i"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr = httptest.NewRecorder()
+	Influx(ms, false, Limits{}, nil).ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusBadRequest {
+		t.Errorf("handler returned wrong status code for missing database: got %v want %v",
+			status, http.StatusBadRequest)
+	}
+
+	// the limits are enforced while parsing.
+	req, err = http.NewRequest("POST", "/write?db=proxy", strings.NewReader("players a=1i,b=2i,c=3i"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr = httptest.NewRecorder()
+	Influx(ms, false, Limits{MaxFamilies: 2}, nil).ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusRequestEntityTooLarge {
+		t.Errorf("handler returned wrong status code for too many families: got %v want %v",
+			status, http.StatusRequestEntityTooLarge)
+	}
+}
@@ -0,0 +1,128 @@
+package handler
+
+import (
+	"dev.volix.ops/thor/pkg/selector"
+	"dev.volix.ops/thor/pkg/slog"
+	"dev.volix.ops/thor/storage"
+	"dev.volix.ops/thor/utils"
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/route"
+	"net/http"
+)
+
+// Metrics returns a http.HandlerFunc exposing the metric families of
+// the gatherer. With `match[]` parameters only the series matching one
+// of the selectors are exposed, like with the `/federate` endpoint of
+// Prometheus. The selectors match the labels of the series and the
+// name of its family as `__name__`.
+func Metrics(g prometheus.Gatherer, opts promhttp.HandlerOpts) http.HandlerFunc {
+	all := promhttp.HandlerFor(g, opts)
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		matcherSets, err := parseMatchParams(r.Form["match[]"])
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if len(matcherSets) == 0 {
+			all.ServeHTTP(w, r)
+			return
+		}
+
+		filtered := prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+			mfs, err := g.Gather()
+			return filterMetricFamilies(mfs, matcherSets), err
+		})
+		promhttp.HandlerFor(filtered, opts).ServeHTTP(w, r)
+	}
+}
+
+// GroupMetrics returns a http.HandlerFunc exposing the metrics of a single
+// group, given by the same path as for Push, so that every group can be
+// scraped as a separate target. If base64 is true, it will try to decode
+// the jobname as base64. Unknown groups are answered with
+// http.StatusNotFound, like Metrics it accepts `match[]` parameters.
+func GroupMetrics(ms *storage.MetricStorage, base64 bool, opts promhttp.HandlerOpts) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// use the storage of the tenant, if there is one.
+		ms := storageFor(r, ms)
+
+		job := route.Param(r.Context(), "job")
+		if base64 {
+			// we try to decode the job name with base64
+			// if it fails, error.
+			decoded, err := utils.DecodeBase64(job)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("invalid base64 encoding in job name %q: %v", job, err), http.StatusBadRequest)
+
+				slog.Debug("invalid base64 encoding in job name ", job)
+				slog.Debug(err.Error())
+				return
+			}
+			job = decoded
+		}
+		if job == "" {
+			http.Error(w, "job name is required", http.StatusBadRequest)
+
+			slog.Debug("job name is required")
+			return
+		}
+
+		// split labels to get a key,value map for
+		// each label.
+		labelsString := route.Param(r.Context(), "labels")
+		labels, err := utils.SplitLabels(labelsString, Base64JobSuffix)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+
+			slog.Debug("failed to parse url ", labelsString)
+			slog.Debug(err.Error())
+			return
+		}
+		labels["job"] = job
+
+		key := utils.GroupingKeyFor(labels)
+		if _, ok := ms.GetGroupMetricFamilies(key); !ok {
+			http.Error(w, fmt.Sprintf("unknown group %v", labels), http.StatusNotFound)
+			return
+		}
+		g := prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+			// the group may be deleted in the meantime,
+			// which results in an empty response.
+			mfs, _ := ms.GetGroupMetricFamilies(key)
+			return mfs, nil
+		})
+		Metrics(g, opts)(w, r)
+	}
+}
+
+// filterMetricFamilies returns the families with only the series matching
+// one of the matcher sets, leaving out families without series. The
+// families are not modified.
+func filterMetricFamilies(mfs []*dto.MetricFamily, matcherSets [][]*selector.Matcher) []*dto.MetricFamily {
+	var result []*dto.MetricFamily
+	for _, mf := range mfs {
+		var metrics []*dto.Metric
+		for _, m := range mf.Metric {
+			labels := make(map[string]string, len(m.Label)+1)
+			for _, lp := range m.Label {
+				labels[lp.GetName()] = lp.GetValue()
+			}
+			labels["__name__"] = mf.GetName()
+
+			if matchAny(matcherSets, labels) {
+				metrics = append(metrics, m)
+			}
+		}
+		if len(metrics) > 0 {
+			result = append(result, &dto.MetricFamily{Name: mf.Name, Help: mf.Help, Type: mf.Type, Metric: metrics})
+		}
+	}
+	return result
+}
@@ -0,0 +1,129 @@
+package handler
+
+import (
+	"compress/gzip"
+	"dev.volix.ops/thor/storage"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/route"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMetricsMatch(t *testing.T) {
+	ms := storage.NewMetricStorage()
+	pushTestGroups(t, ms,
+		map[string]string{"job": "lobby", "dc": "fra1"},
+		map[string]string{"job": "lobby", "dc": "ams1"},
+		map[string]string{"job": "billing", "dc": "fra1"},
+	)
+	g := prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) { return ms.GetMetricFamilies(), nil })
+	handler := Metrics(g, promhttp.HandlerOpts{})
+
+	scrape := func(query string) (int, string) {
+		req, _ := http.NewRequest("GET", "/metrics?"+query, nil)
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr.Code, rr.Body.String()
+	}
+
+	code, body := scrape("")
+	if code != http.StatusOK || strings.Count(body, "players{") != 3 {
+		t.Errorf("expected all series without match[], got %d: %s", code, body)
+	}
+
+	code, body = scrape(`match[]={job="lobby",dc="fra1"}&match[]={job="billing"}`)
+	if code != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v, body: %s", code, http.StatusOK, body)
+	}
+	if strings.Count(body, "players{") != 2 || strings.Contains(body, `dc="ams1"`) {
+		t.Errorf("expected the fra1 series only, got: %s", body)
+	}
+
+	if _, body = scrape(`match[]=players{dc="fra1"}`); strings.Count(body, "players{") != 2 {
+		t.Errorf("expected the metric name to be matched, got: %s", body)
+	}
+	if _, body = scrape(`match[]=other`); strings.Contains(body, "players") {
+		t.Errorf("expected empty families to be dropped, got: %s", body)
+	}
+	if code, _ = scrape(`match[]={job=~"("}`); code != http.StatusBadRequest {
+		t.Errorf("expected %d for an invalid selector, got %d", http.StatusBadRequest, code)
+	}
+}
+
+func TestMetricsGzip(t *testing.T) {
+	ms := storage.NewMetricStorage()
+	pushTestGroups(t, ms, map[string]string{"job": "lobby"})
+	g := prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) { return ms.GetMetricFamilies(), nil })
+
+	for _, query := range []string{"", `match[]={job="lobby"}`} {
+		req, _ := http.NewRequest("GET", "/metrics?"+query, nil)
+		req.Header.Set("Accept-Encoding", "gzip")
+		rr := httptest.NewRecorder()
+		Metrics(g, promhttp.HandlerOpts{}).ServeHTTP(rr, req)
+
+		if encoding := rr.Header().Get("Content-Encoding"); encoding != "gzip" {
+			t.Errorf("expected gzipped response for %q, got Content-Encoding: %q", query, encoding)
+		}
+		zr, err := gzip.NewReader(rr.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := ioutil.ReadAll(zr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(string(body), "players") {
+			t.Errorf("expected pushed metrics, got: %s", body)
+		}
+	}
+}
+
+func TestGroupMetrics(t *testing.T) {
+	ms := storage.NewMetricStorage()
+	pushTestGroups(t, ms,
+		map[string]string{"job": "lobby", "instance": "lobby-17"},
+		map[string]string{"job": "lobby", "instance": "lobby-18"},
+	)
+	tenancy := &Tenancy{Tenants: storage.NewTenants(0), Header: "X-Thor-Tenant"}
+	handler := tenancy.HandleExisting(GroupMetrics(ms, false, promhttp.HandlerOpts{}))
+
+	scrape := func(labels, tenant string) (int, string) {
+		req, _ := http.NewRequest("GET", "/metrics/job/lobby"+labels, nil)
+		if tenant != "" {
+			req.Header.Set("X-Thor-Tenant", tenant)
+		}
+		ctx := route.WithParam(req.Context(), "job", "lobby")
+		req = req.WithContext(route.WithParam(ctx, "labels", labels))
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr.Code, rr.Body.String()
+	}
+
+	code, body := scrape("/instance/lobby-17", "")
+	if code != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v, body: %s", code, http.StatusOK, body)
+	}
+	if strings.Count(body, "players{") != 1 || !strings.Contains(body, `instance="lobby-17"`) {
+		t.Errorf("expected the series of the group only, got: %s", body)
+	}
+
+	if code, _ = scrape("", ""); code != http.StatusNotFound {
+		t.Errorf("expected %d for an unknown group, got %d", http.StatusNotFound, code)
+	}
+	if code, _ = scrape("/instance", ""); code != http.StatusBadRequest {
+		t.Errorf("expected %d for invalid labels, got %d", http.StatusBadRequest, code)
+	}
+
+	// scraping does not create tenants.
+	if code, _ = scrape("/instance/lobby-17", "net1"); code != http.StatusNotFound {
+		t.Errorf("expected %d for an unknown tenant, got %d", http.StatusNotFound, code)
+	}
+	if ids := tenancy.Tenants.IDs(); len(ids) != 0 {
+		t.Errorf("expected no tenants to be created, got %v", ids)
+	}
+}
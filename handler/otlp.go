@@ -0,0 +1,153 @@
+package handler
+
+import (
+	"dev.volix.ops/thor/otlp"
+	"dev.volix.ops/thor/pkg/slog"
+	"dev.volix.ops/thor/storage"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"time"
+)
+
+const (
+	// Content type of OTLP/HTTP with binary protobuf encoding.
+	otlpContentType = "application/x-protobuf"
+
+	// gRPC status code used for rejected exports.
+	grpcInvalidArgument = 3
+)
+
+// OTLP returns a http.HandlerFunc accepting OTLP/HTTP metric exports
+// with protobuf encoding. Every resource is translated with otlp.Translate
+// into a group, whose labels are the mapped resource attributes.
+//
+// Cumulative metrics and gauges overwrite the existing values, while
+// metrics with delta temporality are accumulated onto them. The
+// relabel configs of the Rules are applied like with Push.
+//
+// Just like with Push, inconsistent metrics are rejected with
+// http.StatusBadRequest, unless unchecked is true. All groups are
+// checked before the first one is written, so if one of them is
+// rejected or not allowed by the Authorizer, nothing is written.
+func OTLP(ms *storage.MetricStorage, unchecked bool, limits Limits, authz Authorizer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// use the storage and limits of the tenant, if there is one.
+		ms := storageFor(r, ms)
+		limits := limitsFor(r, limits)
+
+		ctMediatype, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		if err != nil || ctMediatype != otlpContentType {
+			otlpError(w, fmt.Sprintf("unsupported content type %q, only %s is supported",
+				r.Header.Get("Content-Type"), otlpContentType), http.StatusUnsupportedMediaType)
+
+			slog.Debug("unsupported otlp content type ", r.Header.Get("Content-Type"))
+			return
+		}
+
+		reader, err := requestBody(r, limits)
+		if err != nil {
+			otlpError(w, err.Error(), bodyErrorStatus(err))
+
+			slog.Debug("failed to read body from ", r.RemoteAddr)
+			slog.Debug(err.Error())
+			return
+		}
+		defer reader.Close()
+
+		body, err := ioutil.ReadAll(reader)
+		if err != nil {
+			otlpError(w, err.Error(), bodyErrorStatus(err))
+
+			slog.Debug("failed to read otlp export from ", r.RemoteAddr)
+			slog.Debug(err.Error())
+			return
+		}
+		groups, err := otlp.Translate(body)
+		if err != nil {
+			otlpError(w, err.Error(), http.StatusBadRequest)
+
+			slog.Debug("failed to decode otlp export from ", r.RemoteAddr)
+			slog.Debug(err.Error())
+			return
+		}
+		rules := rulesFor(r)
+		for _, group := range groups {
+			// the relabeled labels have to be within the limits too.
+			rules.relabelFamilies(group.Absolute)
+			rules.relabelFamilies(group.Delta)
+			if err := authorize(authz, r, group.Labels); err != nil {
+				otlpError(w, err.Error(), http.StatusForbidden)
+				return
+			}
+			err := checkLabels(group.Labels, limits)
+			if err == nil {
+				err = checkMetricFamilies(group.Absolute, limits)
+			}
+			if err == nil {
+				err = checkMetricFamilies(group.Delta, limits)
+			}
+			if err != nil {
+				otlpError(w, err.Error(), bodyErrorStatus(err))
+
+				slog.Debug("otlp export exceeds limits from ", r.RemoteAddr)
+				slog.Debug(err.Error())
+				return
+			}
+		}
+
+		// like every other push, the export takes a single token,
+		// the job of its first resource is used for the job limits.
+		if len(groups) > 0 {
+			if throttled, retryAfter := limits.RateLimit.throttle(r, groups[0].Labels["job"]); throttled {
+				setRetryAfter(w, retryAfter)
+				otlpError(w, "rate limit exceeded", http.StatusTooManyRequests)
+				return
+			}
+		}
+
+		now := time.Now()
+		var wrs []storage.WriteRequest
+		for _, group := range groups {
+			if len(group.Absolute) > 0 {
+				wrs = append(wrs, storage.WriteRequest{Labels: group.Labels, Timestamp: now, MetricFamilies: group.Absolute, Absolute: true})
+			}
+			if len(group.Delta) > 0 {
+				wrs = append(wrs, storage.WriteRequest{Labels: group.Labels, Timestamp: now, MetricFamilies: group.Delta})
+			}
+		}
+
+		// all groups are checked before the first one is written, so
+		// that a rejected export is not partially applied. Otherwise
+		// the retry of the client would accumulate the deltas twice.
+		if !unchecked {
+			err = ms.ValidateWriteRequests(wrs)
+		}
+		for i := 0; err == nil && i < len(wrs); i++ {
+			err = submitWriteRequest(ms, wrs[i], unchecked)
+		}
+		if err != nil {
+			otlpError(
+				w,
+				fmt.Sprintf("pushed metrics are invalid or inconsistent with existing metrics: %v", err),
+				http.StatusBadRequest,
+			)
+			slog.Error(fmt.Sprintf("pushed metrics are invalid or inconsistent with existing metrics (%s, %s): %s",
+				r.Method, r.RemoteAddr, err.Error()))
+			return
+		}
+
+		// the response is an empty ExportMetricsServiceResponse.
+		w.Header().Set("Content-Type", otlpContentType)
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+// otlpError writes the error as google.rpc.Status, as
+// required by the OTLP/HTTP specification.
+func otlpError(w http.ResponseWriter, msg string, code int) {
+	w.Header().Set("Content-Type", otlpContentType)
+	w.WriteHeader(code)
+	_, _ = w.Write(otlp.EncodeStatus(grpcInvalidArgument, msg))
+}
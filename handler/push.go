@@ -1,17 +1,19 @@
 package handler
 
 import (
+	"bufio"
+	"dev.volix.ops/thor/pkg/metricjson"
 	"dev.volix.ops/thor/pkg/slog"
 	"dev.volix.ops/thor/storage"
 	"dev.volix.ops/thor/utils"
 	"fmt"
-	"github.com/matttproud/golang_protobuf_extensions/pbutil"
 	dto "github.com/prometheus/client_model/go"
 	"github.com/prometheus/common/expfmt"
 	"github.com/prometheus/common/route"
 	"io"
 	"mime"
 	"net/http"
+	"strings"
 	"time"
 )
 
@@ -28,26 +30,40 @@ const (
 // otherwise not.
 // If replace is true, it will remove everything with the grouping key, which is
 // just the job name as default, before storing it. Otherwise it will be merged
-// with the existing data.
+// with the existing data, as the Rules of the request select.
+//
+// Compressed bodies are decompressed according to their Content-Encoding,
+// bodies exceeding the limits are rejected with http.StatusRequestEntityTooLarge.
+// Pushes exceeding the rate limit are rejected with http.StatusTooManyRequests
+// and a Retry-After header.
+//
+// Writes to groups which the Authorizer does not allow are rejected
+// with http.StatusForbidden. authz may be nil to allow everything.
 //
 // An inconsistent or invalid metric will be rejected with http.StatusBadRequest.
 // To skip the slower inconsistency check, unchecked has to be true. This is
 // very dangerous though.
 //
 // Source: github.com/prometheus/pushgateway
-func Push(ms *storage.MetricStorage, base64 bool, unchecked bool, replace bool) http.HandlerFunc {
+func Push(ms *storage.MetricStorage, base64 bool, unchecked bool, replace bool, limits Limits, authz Authorizer) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
+		// use the storage and limits of the tenant, if there is one.
+		ms := storageFor(r, ms)
+		limits := limitsFor(r, limits)
+
 		job := route.Param(r.Context(), "job")
 		if base64 {
 			// we try to decode the job name with base64
 			// if it fails, error.
-			if job, err := utils.DecodeBase64(job); err != nil {
+			decoded, err := utils.DecodeBase64(job)
+			if err != nil {
 				http.Error(w, fmt.Sprintf("invalid base64 encoding in job name %q: %v", job, err), http.StatusBadRequest)
 
 				slog.Debug("invalid base64 encoding in job name ", job)
 				slog.Debug(err.Error())
 				return
 			}
+			job = decoded
 		}
 		if job == "" {
 			http.Error(w, "job name is required", http.StatusBadRequest)
@@ -68,64 +84,65 @@ func Push(ms *storage.MetricStorage, base64 bool, unchecked bool, replace bool)
 			return
 		}
 		labels["job"] = job
+		if err := authorize(authz, r, labels); err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		if throttled, retryAfter := limits.RateLimit.throttle(r, job); throttled {
+			setRetryAfter(w, retryAfter)
+			http.Error(w, "rate limit exceeded", http.StatusTooManyRequests)
+			return
+		}
+		if err := checkLabels(labels, limits); err != nil {
+			http.Error(w, err.Error(), bodyErrorStatus(err))
 
-		var metricFamilies map[string]*dto.MetricFamily
-		ctMediatype, ctParams, ctErr := mime.ParseMediaType(r.Header.Get("Content-Type"))
-		if ctErr == nil && ctMediatype == "application/vnd.google.protobuf" &&
-			ctParams["encoding"] == "delimited" &&
-			ctParams["proto"] == "io.prometheus.client.MetricFamily" {
-			// if the body is encoded with protobuf, we can simply
-			// decode it and use that.
-			metricFamilies = map[string]*dto.MetricFamily{}
-			for {
-				mf := &dto.MetricFamily{}
-				if _, err = pbutil.ReadDelimited(r.Body, mf); err != nil {
-					if err == io.EOF {
-						err = nil
-					}
-					break
-				}
-				metricFamilies[mf.GetName()] = mf
-			}
-		} else {
-			// fallback is a plain/text body.
-			var parser expfmt.TextParser
-			metricFamilies, err = parser.TextToMetricFamilies(r.Body)
+			slog.Debug("grouping labels too large from ", r.RemoteAddr)
+			return
 		}
+
+		body, err := requestBody(r, limits)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusBadRequest)
+			http.Error(w, err.Error(), bodyErrorStatus(err))
 
-			slog.Debug("failed to parse text from ", r.RemoteAddr)
+			slog.Debug("failed to read body from ", r.RemoteAddr)
 			slog.Debug(err.Error())
 			return
 		}
+		defer body.Close()
 
-		now := time.Now()
-		errCh := make(chan error, 1)
+		rules := rulesFor(r)
+		metricFamilies, err := decodeMetricFamilies(r, body, limits)
+		if err == nil {
+			// the relabeled labels have to be within the limits too.
+			rules.relabelFamilies(metricFamilies)
+			err = checkMetricFamilies(metricFamilies, limits)
+		}
+		if err != nil {
+			http.Error(w, err.Error(), bodyErrorStatus(err))
 
-		if unchecked {
-			ms.SubmitWriteRequest(storage.WriteRequest{
-				Labels:         labels,
-				Timestamp:      now,
-				MetricFamilies: metricFamilies,
-				Replace:        replace,
-			})
-			w.WriteHeader(http.StatusAccepted)
+			slog.Debug("failed to parse text from ", r.RemoteAddr)
+			slog.Debug(err.Error())
 			return
 		}
-		// submit write request and consume data which gets send
-		// to the Done channel.
-		ms.SubmitWriteRequest(storage.WriteRequest{
+
+		wr := storage.WriteRequest{
 			Labels:         labels,
-			Timestamp:      now,
+			Timestamp:      time.Now(),
 			MetricFamilies: metricFamilies,
 			Replace:        replace,
-			Done:           errCh,
-		})
-
-		// if an error occurs, we do not want to accept
-		// the metric. We only want consistent and valid metrics.
-		for err := range errCh {
+		}
+		if !replace {
+			switch rules.strategy(labels) {
+			case MergeAbsolute:
+				wr.Absolute = true
+			case MergeReplace:
+				wr.Replace = true
+			}
+		}
+		err = submitWriteRequest(ms, wr, unchecked)
+		if err != nil {
+			// if an error occurs, we do not want to accept
+			// the metric. We only want consistent and valid metrics.
 			http.Error(
 				w,
 				fmt.Sprintf("pushed metrics are invalid or inconsistent with existing metrics: %v", err),
@@ -133,7 +150,118 @@ func Push(ms *storage.MetricStorage, base64 bool, unchecked bool, replace bool)
 			)
 			slog.Error(fmt.Sprintf("pushed metrics are invalid or inconsistent with existing metrics (%s, %s): %s",
 				r.Method, r.RemoteAddr, err.Error()))
-			break
+			return
+		}
+		if unchecked {
+			w.WriteHeader(http.StatusAccepted)
 		}
 	}
 }
+
+// decodeMetricFamilies decodes the body of the request depending on its
+// Content-Type. Supported are delimited protobuf, JSON as described by
+// the metricjson package and the text format as fallback.
+//
+// The number of families and metrics are checked against the limits while
+// the body is decoded, so decoding stops at the first family exceeding them.
+func decodeMetricFamilies(r *http.Request, body io.Reader, limits Limits) (map[string]*dto.MetricFamily, error) {
+	ctMediatype, ctParams, ctErr := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if ctErr == nil && ctMediatype == "application/vnd.google.protobuf" &&
+		ctParams["encoding"] == "delimited" &&
+		ctParams["proto"] == "io.prometheus.client.MetricFamily" {
+		// if the body is encoded with protobuf, we can simply
+		// decode it and use that.
+		metricFamilies := map[string]*dto.MetricFamily{}
+		br := bufio.NewReader(body)
+		for {
+			mf := &dto.MetricFamily{}
+			if err := readDelimited(br, mf, maxMessageSize(r, limits)); err != nil {
+				if err == io.EOF {
+					return metricFamilies, nil
+				}
+				return nil, err
+			}
+			if err := checkMetricFamily(mf, limits); err != nil {
+				return nil, err
+			}
+			metricFamilies[mf.GetName()] = mf
+			if limits.MaxFamilies > 0 && len(metricFamilies) > limits.MaxFamilies {
+				return nil, &TooLargeError{What: "number of metric families", Limit: int64(limits.MaxFamilies)}
+			}
+		}
+	}
+	if ctErr == nil && ctMediatype == "application/json" {
+		families := 0
+		return metricjson.DecodeChecked(body, func(name string, metrics int) error {
+			families++
+			if limits.MaxFamilies > 0 && families > limits.MaxFamilies {
+				return &TooLargeError{What: "number of metric families", Limit: int64(limits.MaxFamilies)}
+			}
+			if limits.MaxMetricsPerFamily > 0 && metrics > limits.MaxMetricsPerFamily {
+				return &TooLargeError{
+					What:  fmt.Sprintf("number of metrics in family %q", name),
+					Limit: int64(limits.MaxMetricsPerFamily),
+				}
+			}
+			return nil
+		})
+	}
+
+	// fallback is a plain/text body.
+	var parser expfmt.TextParser
+	if limits.MaxFamilies <= 0 && limits.MaxMetricsPerFamily <= 0 {
+		return parser.TextToMetricFamilies(body)
+	}
+	counter := newTextCounter(body, limits)
+	metricFamilies, err := parser.TextToMetricFamilies(counter)
+	if counter.err != nil {
+		// the parser takes a failed read at the start
+		// of a line for the end of the body.
+		return nil, counter.err
+	}
+	return metricFamilies, err
+}
+
+// maxMessageSize returns the maximum size of a single protobuf message,
+// which can not be larger than the whole (decompressed) body.
+func maxMessageSize(r *http.Request, limits Limits) int64 {
+	switch strings.ToLower(strings.TrimSpace(r.Header.Get("Content-Encoding"))) {
+	case "", "identity":
+		return limits.MaxBodyBytes
+	}
+	return limits.MaxDecompressedBytes
+}
+
+// An Authorizer decides if the request may write to
+// the group with the grouping labels.
+type Authorizer interface {
+	Authorize(r *http.Request, labels map[string]string) error
+}
+
+// authorize returns the error of the Authorizer, which may be nil
+// to allow every write.
+func authorize(authz Authorizer, r *http.Request, labels map[string]string) error {
+	if authz == nil {
+		return nil
+	}
+	return authz.Authorize(r, labels)
+}
+
+// submitWriteRequest submits the WriteRequest to the storage.MetricStorage.
+// If unchecked is false, it waits for the consistency check and returns
+// its error. Otherwise it returns immediately with <nil>.
+func submitWriteRequest(ms *storage.MetricStorage, wr storage.WriteRequest, unchecked bool) error {
+	if unchecked {
+		ms.SubmitWriteRequest(wr)
+		return nil
+	}
+
+	// submit write request and consume data which gets send
+	// to the Done channel. If the channel gets closed without
+	// an error, we receive <nil>.
+	errCh := make(chan error, 1)
+	wr.Done = errCh
+	ms.SubmitWriteRequest(wr)
+
+	return <-errCh
+}
@@ -0,0 +1,174 @@
+package handler
+
+import (
+	"dev.volix.ops/thor/pkg/ratelimit"
+	"dev.volix.ops/thor/pkg/relabel"
+	"dev.volix.ops/thor/storage"
+	"dev.volix.ops/thor/utils"
+	"errors"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/common/route"
+	"gopkg.in/yaml.v2"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func newPushRequest(t *testing.T, job string, contentType string, body io.Reader) *http.Request {
+	req, err := http.NewRequest("POST", "/metrics/job/"+job, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", contentType)
+	return req.WithContext(route.WithParam(req.Context(), "job", job))
+}
+
+func TestPushJSON(t *testing.T) {
+	ms := storage.NewMetricStorage()
+
+	body := `[{"name": "players", "type": "gauge", "metrics": [{"labels": {"server": "lobby17"}, "value": 42}]}]`
+	rr := httptest.NewRecorder()
+	Push(ms, false, false, false, Limits{}, nil).ServeHTTP(rr, newPushRequest(t, "lobby", "application/json", strings.NewReader(body)))
+
+	if status := rr.Code; status != http.StatusOK {
+		t.Errorf("handler returned wrong status code: got %v want %v, body: %s",
+			status, http.StatusOK, rr.Body.String())
+	}
+	mfs := ms.GetMetricFamilies()
+	if len(mfs) != 1 || mfs[0].Metric[0].GetGauge().GetValue() != 42 {
+		t.Errorf("expected pushed gauge, got: %v", mfs)
+	}
+
+	body = `[{"name": "players", "type": "gauge", "metrics": [{"value": "many"}]}]`
+	rr = httptest.NewRecorder()
+	Push(ms, false, false, false, Limits{}, nil).ServeHTTP(rr, newPushRequest(t, "lobby", "application/json", strings.NewReader(body)))
+
+	if status := rr.Code; status != http.StatusBadRequest {
+		t.Errorf("handler returned wrong status code: got %v want %v",
+			status, http.StatusBadRequest)
+	}
+	if !strings.Contains(rr.Body.String(), "families[0].metrics[0].value") {
+		t.Errorf("expected error to point to the field, got: %s", rr.Body.String())
+	}
+}
+
+type denyAll struct{}
+
+func (denyAll) Authorize(*http.Request, map[string]string) error {
+	return errors.New("forbidden")
+}
+
+func TestPushForbidden(t *testing.T) {
+	ms := storage.NewMetricStorage()
+
+	rr := httptest.NewRecorder()
+	Push(ms, false, false, false, Limits{}, denyAll{}).ServeHTTP(rr, newPushRequest(t, "billing", "text/plain", strings.NewReader("players 42\n")))
+
+	if status := rr.Code; status != http.StatusForbidden {
+		t.Errorf("handler returned wrong status code: got %v want %v",
+			status, http.StatusForbidden)
+	}
+	if mfs := ms.GetMetricFamilies(); len(mfs) != 0 {
+		t.Errorf("expected nothing to be stored, got: %v", mfs)
+	}
+}
+
+func TestPushRateLimit(t *testing.T) {
+	ms := storage.NewMetricStorage()
+	limits := Limits{RateLimit: &RateLimit{Limiter: ratelimit.New(&ratelimit.Config{
+		By:   ratelimit.ByJob,
+		Rate: ratelimit.Rate{Rate: 0.1, Burst: 1},
+	})}}
+	push := Push(ms, false, false, false, limits, nil)
+	others := testutil.ToFloat64(throttledPushes.WithLabelValues(otherJobs))
+
+	rr := httptest.NewRecorder()
+	push.ServeHTTP(rr, newPushRequest(t, "lobby", "text/plain", strings.NewReader("players 42\n")))
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v", status, http.StatusOK)
+	}
+
+	rr = httptest.NewRecorder()
+	push.ServeHTTP(rr, newPushRequest(t, "lobby", "text/plain", strings.NewReader("players 43\n")))
+	if status := rr.Code; status != http.StatusTooManyRequests {
+		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusTooManyRequests)
+	}
+	if retryAfter := rr.Header().Get("Retry-After"); retryAfter != "10" {
+		t.Errorf("wrong Retry-After header, got: %q, expected: %q", retryAfter, "10")
+	}
+	// the job has no rate of its own, so it is counted as other.
+	if v := testutil.ToFloat64(throttledPushes.WithLabelValues(otherJobs)); v != others+1 {
+		t.Errorf("expected %v throttled pushes of other jobs, got %v", others+1, v)
+	}
+	if throttledPushes.DeleteLabelValues("lobby") {
+		t.Error("expected no series for the job")
+	}
+}
+
+func TestPushRules(t *testing.T) {
+	var relabelConfigs []*relabel.Config
+	err := yaml.UnmarshalStrict([]byte(`
+- source_labels: [__name__, env]
+  regex: players;dev
+  action: drop
+- regex: tmp
+  action: labeldrop
+`), &relabelConfigs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rules, err := NewRules([]MergeRule{{Match: []string{`{job="lobby"}`}, Strategy: MergeAbsolute}}, relabelConfigs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ms := storage.NewMetricStorage()
+	push := WithRules(func() *Rules { return rules }, Push(ms, false, false, false, Limits{}, nil))
+	for _, job := range []string{"lobby", "lobby", "arena", "arena"} {
+		rr := httptest.NewRecorder()
+		body := "# TYPE logins_total counter\nlogins_total 2\nplayers{env=\"dev\"} 1\nplayers{env=\"prod\",tmp=\"x\"} 2\n"
+		push.ServeHTTP(rr, newPushRequest(t, job, "text/plain", strings.NewReader(body)))
+		if rr.Code != http.StatusOK {
+			t.Fatalf("handler returned wrong status code: got %v want %v, body: %s", rr.Code, http.StatusOK, rr.Body.String())
+		}
+	}
+
+	// the counter of the lobby is overwritten, the one of the arena accumulated.
+	groups := ms.GetMetricGroups()
+	for job, expected := range map[string]float64{"lobby": 2, "arena": 4} {
+		group := groups[utils.GroupingKeyFor(map[string]string{"job": job})]
+		if v := group.MetricFamilies["logins_total"].Metric[0].GetCounter().GetValue(); v != expected {
+			t.Errorf("expected counter %v of %s, got %v", expected, job, v)
+		}
+		players := group.MetricFamilies["players"].Metric
+		// the grouping labels are added, but tmp is dropped.
+		if len(players) != 1 || len(players[0].Label) != 3 || players[0].Label[0].GetName() != "env" || players[0].Label[0].GetValue() != "prod" {
+			t.Errorf("expected relabeled players of %s, got %v", job, players)
+		}
+	}
+
+	// labels created by relabeling are checked against the limits.
+	long := &relabel.Config{Separator: ";", Regex: "(.*)", TargetLabel: "host", Replacement: "lobby-17.example.com", Action: relabel.Replace}
+	rules, err = NewRules(nil, []*relabel.Config{long})
+	if err != nil {
+		t.Fatal(err)
+	}
+	push = WithRules(func() *Rules { return rules }, Push(ms, false, false, false, Limits{MaxLabelLength: 10}, nil))
+	rr := httptest.NewRecorder()
+	push.ServeHTTP(rr, newPushRequest(t, "lobby", "text/plain", strings.NewReader("players 1\n")))
+	if rr.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusRequestEntityTooLarge)
+	}
+
+	for _, mr := range []MergeRule{
+		{Match: []string{`{job="lobby"}`}, Strategy: "sum"},
+		{Strategy: MergeReplace},
+		{Match: []string{`{job=}`}, Strategy: MergeReplace},
+	} {
+		if _, err := NewRules([]MergeRule{mr}, nil); err == nil {
+			t.Errorf("expected error for merge rule %+v", mr)
+		}
+	}
+}
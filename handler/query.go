@@ -0,0 +1,57 @@
+package handler
+
+import (
+	"dev.volix.ops/thor/pkg/query"
+	"dev.volix.ops/thor/storage"
+	"github.com/prometheus/common/model"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// vectorSample is a sample of an instant vector
+// in the format of the Prometheus HTTP API.
+type vectorSample struct {
+	Metric model.LabelSet `json:"metric"`
+	Value  [2]interface{} `json:"value"`
+}
+
+// Query returns a http.HandlerFunc evaluating the expression of the `query`
+// parameter against the current values of the storage, like an instant
+// query of the Prometheus HTTP API. Only the subset of PromQL of package
+// query is supported. As there are no older values, the `time` parameter
+// is ignored.
+func Query(ms *storage.MetricStorage) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// use the storage of the tenant, if there is one.
+		ms := storageFor(r, ms)
+
+		if err := r.ParseForm(); err != nil {
+			apiError(w, "bad_data", err, http.StatusBadRequest)
+			return
+		}
+		expr, err := query.Parse(r.Form.Get("query"))
+		if err != nil {
+			apiError(w, "bad_data", err, http.StatusBadRequest)
+			return
+		}
+
+		// the timestamp in seconds with millisecond precision.
+		ts := float64(time.Now().UnixNano()/int64(time.Millisecond)) / 1000
+		samples := expr.Eval(query.Series(ms.GetMetricFamilies()))
+		result := make([]vectorSample, 0, len(samples))
+		for _, s := range samples {
+			metric := make(model.LabelSet, len(s.Labels))
+			for name, value := range s.Labels {
+				metric[model.LabelName(name)] = model.LabelValue(value)
+			}
+			result = append(result, vectorSample{Metric: metric, Value: [2]interface{}{ts, query.FormatValue(s.Value)}})
+		}
+		sort.Slice(result, func(i, j int) bool { return result[i].Metric.Before(result[j].Metric) })
+
+		apiSuccess(w, struct {
+			ResultType string         `json:"resultType"`
+			Result     []vectorSample `json:"result"`
+		}{ResultType: "vector", Result: result})
+	}
+}
@@ -0,0 +1,58 @@
+package handler
+
+import (
+	"dev.volix.ops/thor/storage"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestQuery(t *testing.T) {
+	ms := storage.NewMetricStorage()
+	pushTestGroups(t, ms,
+		map[string]string{"job": "lobby", "instance": "lobby-1"},
+		map[string]string{"job": "lobby", "instance": "lobby-2"},
+		map[string]string{"job": "bedwars", "instance": "bedwars-1"},
+	)
+
+	query := func(q string) (int, []byte) {
+		req, _ := http.NewRequest("GET", "/api/v1/query?"+url.Values{"query": {q}}.Encode(), nil)
+		rr := httptest.NewRecorder()
+		Query(ms).ServeHTTP(rr, req)
+		return rr.Code, rr.Body.Bytes()
+	}
+
+	code, body := query(`sum by (job) (players)`)
+	if code != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v, body: %s", code, http.StatusOK, body)
+	}
+	var resp struct {
+		Status string `json:"status"`
+		Data   struct {
+			ResultType string `json:"resultType"`
+			Result     []struct {
+				Metric map[string]string `json:"metric"`
+				Value  []interface{}     `json:"value"`
+			} `json:"result"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(body, &resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Status != "success" || resp.Data.ResultType != "vector" || len(resp.Data.Result) != 2 {
+		t.Fatalf("unexpected response: %s", body)
+	}
+	// the result is sorted by the labels.
+	for i, exp := range []struct{ job, value string }{{"bedwars", "1"}, {"lobby", "2"}} {
+		s := resp.Data.Result[i]
+		if s.Metric["job"] != exp.job || len(s.Value) != 2 || s.Value[1] != exp.value {
+			t.Errorf("expected %s=%s, got %v", exp.job, exp.value, s)
+		}
+	}
+
+	if code, body = query(`sum by (job (players)`); code != http.StatusBadRequest {
+		t.Errorf("expected %d for invalid query, got %d: %s", http.StatusBadRequest, code, body)
+	}
+}
@@ -0,0 +1,81 @@
+package handler
+
+import (
+	"context"
+	"dev.volix.ops/thor/pkg/ratelimit"
+	"dev.volix.ops/thor/pkg/slog"
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+var throttledPushes = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "thor_push_throttled_total",
+	Help: "Total number of pushes rejected by the rate limit, by job with its own rate, all others are counted as other.",
+}, []string{"job"})
+
+// The job label of throttled pushes to jobs without their own rate,
+// so that clients can not create arbitrarily many series.
+const otherJobs = "other"
+
+// A RateLimit throttles pushes with the token buckets of the Limiter.
+type RateLimit struct {
+	Limiter *ratelimit.Limiter
+	// Identity returns the authenticated identity, used if
+	// the Limiter is keyed by identity.
+	Identity func(ctx context.Context) (string, bool)
+}
+
+// throttle returns true and the duration the client should wait,
+// if the push to the job exceeds the rate limit. rl may be nil
+// to disable rate limiting.
+func (rl *RateLimit) throttle(r *http.Request, job string) (bool, time.Duration) {
+	if rl == nil || rl.Limiter == nil {
+		return false, 0
+	}
+
+	var key string
+	switch rl.Limiter.By() {
+	case ratelimit.ByIP:
+		key = r.RemoteAddr
+		if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+			key = host
+		}
+	case ratelimit.ByIdentity:
+		if rl.Identity != nil {
+			key, _ = rl.Identity(r.Context())
+		}
+	case ratelimit.ByJob:
+		key = job
+	}
+	// tenants share the limiter, but not the buckets.
+	if tenant, ok := Tenant(r.Context()); ok {
+		key = tenant + "/" + key
+	}
+
+	allowed, retryAfter := rl.Limiter.Allow(key, job)
+	if allowed {
+		return false, 0
+	}
+	if rl.Limiter.HasJob(job) {
+		throttledPushes.WithLabelValues(job).Inc()
+	} else {
+		throttledPushes.WithLabelValues(otherJobs).Inc()
+	}
+	slog.Debug(fmt.Sprintf("throttled push to job %s from %s", job, r.RemoteAddr))
+	return true, retryAfter
+}
+
+// setRetryAfter sets the Retry-After header in whole seconds.
+func setRetryAfter(w http.ResponseWriter, d time.Duration) {
+	seconds := int(math.Ceil(d.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+}
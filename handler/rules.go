@@ -0,0 +1,138 @@
+package handler
+
+import (
+	"context"
+	"dev.volix.ops/thor/pkg/relabel"
+	"dev.volix.ops/thor/pkg/selector"
+	"fmt"
+	"github.com/golang/protobuf/proto"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/model"
+	"net/http"
+	"sort"
+)
+
+const (
+	// How a push with POST is merged into an existing group.
+	// Accumulate adds counters, histograms and summaries to the
+	// existing values, Absolute overwrites them and Replace
+	// replaces the whole group, like a push with PUT.
+	MergeAccumulate = "accumulate"
+	MergeAbsolute   = "absolute"
+	MergeReplace    = "replace"
+)
+
+// A MergeRule applies the Strategy to the pushes to the groups,
+// whose grouping labels match one of the Match selectors.
+type MergeRule struct {
+	Match    []string `yaml:"match"`
+	Strategy string   `yaml:"strategy"`
+}
+
+type mergeRule struct {
+	matcherSets [][]*selector.Matcher
+	strategy    string
+}
+
+// Rules change the pushes before they are written: the relabel configs
+// are applied to the labels of every pushed metric, and the strategy of
+// the first matching MergeRule is used to merge pushes with POST.
+type Rules struct {
+	merge   []mergeRule
+	relabel []*relabel.Config
+}
+
+// NewRules validates the merge rules and relabel configs.
+func NewRules(mergeRules []MergeRule, relabelConfigs []*relabel.Config) (*Rules, error) {
+	rules := &Rules{relabel: relabelConfigs}
+	for i, mr := range mergeRules {
+		switch mr.Strategy {
+		case MergeAccumulate, MergeAbsolute, MergeReplace:
+		default:
+			return nil, fmt.Errorf("unknown strategy %q of merge rule %d", mr.Strategy, i)
+		}
+		if len(mr.Match) == 0 {
+			return nil, fmt.Errorf("missing match of merge rule %d", i)
+		}
+		matcherSets, err := parseMatchParams(mr.Match)
+		if err != nil {
+			return nil, fmt.Errorf("invalid match of merge rule %d: %v", i, err)
+		}
+		rules.merge = append(rules.merge, mergeRule{matcherSets: matcherSets, strategy: mr.Strategy})
+	}
+	for i, c := range relabelConfigs {
+		if err := c.Validate(); err != nil {
+			return nil, fmt.Errorf("invalid relabel config %d: %v", i, err)
+		}
+	}
+	return rules, nil
+}
+
+// strategy returns the merge strategy for pushes with POST to the group
+// with the labels. rules may be nil, which always accumulates.
+func (rules *Rules) strategy(labels map[string]string) string {
+	if rules == nil {
+		return MergeAccumulate
+	}
+	for _, mr := range rules.merge {
+		if matchAny(mr.matcherSets, labels) {
+			return mr.strategy
+		}
+	}
+	return MergeAccumulate
+}
+
+// relabelFamilies applies the relabel configs to every metric of the
+// families, which are modified in place. The name of the family is
+// available as __name__, but can not be changed. Dropped metrics are
+// removed, and so are the families left without metrics. rules may be
+// nil, which keeps the families as they are.
+func (rules *Rules) relabelFamilies(mfs map[string]*dto.MetricFamily) {
+	if rules == nil || len(rules.relabel) == 0 {
+		return
+	}
+	for name, mf := range mfs {
+		metrics := mf.Metric[:0]
+		for _, m := range mf.Metric {
+			labels := make(map[string]string, len(m.Label)+1)
+			for _, lp := range m.Label {
+				labels[lp.GetName()] = lp.GetValue()
+			}
+			labels[model.MetricNameLabel] = name
+
+			labels, keep := relabel.Process(labels, rules.relabel)
+			if !keep {
+				continue
+			}
+			delete(labels, model.MetricNameLabel)
+
+			m.Label = make([]*dto.LabelPair, 0, len(labels))
+			for n, v := range labels {
+				m.Label = append(m.Label, &dto.LabelPair{Name: proto.String(n), Value: proto.String(v)})
+			}
+			sort.Slice(m.Label, func(i, j int) bool { return m.Label[i].GetName() < m.Label[j].GetName() })
+			metrics = append(metrics, m)
+		}
+		if len(metrics) == 0 {
+			delete(mfs, name)
+			continue
+		}
+		mf.Metric = metrics
+	}
+}
+
+type rulesKey struct{}
+
+// rulesFor returns the rules of the request, or nil if there are none.
+func rulesFor(r *http.Request) *Rules {
+	rules, _ := r.Context().Value(rulesKey{}).(*Rules)
+	return rules
+}
+
+// WithRules wraps the handler, so that it applies the rules returned by
+// get to the pushes. This allows to change the rules at runtime.
+func WithRules(get func() *Rules, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		h(w, r.WithContext(context.WithValue(r.Context(), rulesKey{}, get())))
+	}
+}
@@ -0,0 +1,116 @@
+package handler
+
+import (
+	"dev.volix.ops/thor/pkg/slog"
+	"dev.volix.ops/thor/storage"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// A TargetGroup is a target group of the Prometheus HTTP service discovery.
+type TargetGroup struct {
+	Targets []string          `json:"targets"`
+	Labels  map[string]string `json:"labels"`
+}
+
+// ServiceDiscovery returns a http.HandlerFunc listing the groups as targets
+// for the `http_sd_configs` of Prometheus. Every group is a target with its
+// grouping labels as target labels and its path below metricsPath as
+// `__metrics_path__`, so that it is scraped like with GroupMetrics.
+//
+// With `per=job`, there is one target per job instead, which is scraped on
+// metricsPath with a `match[]` parameter selecting the job.
+//
+// The targets are addressed by the host of the request.
+func ServiceDiscovery(ms *storage.MetricStorage, metricsPath string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// use the storage of the tenant, if there is one.
+		ms := storageFor(r, ms)
+
+		per := r.FormValue("per")
+		if per != "" && per != "group" && per != "job" {
+			http.Error(w, fmt.Sprintf("invalid per parameter %q, must be group or job", per), http.StatusBadRequest)
+			return
+		}
+
+		// the groups of a tenant are scraped below its path prefix.
+		path := metricsPath
+		if id, ok := Tenant(r.Context()); ok {
+			path = "/tenants/" + id + metricsPath
+		}
+
+		groups := ms.GetMetricGroups()
+		keys := make([]string, 0, len(groups))
+		for key := range groups {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		result := []TargetGroup{}
+		jobs := map[string]bool{}
+		for _, key := range keys {
+			labels := groups[key].Labels
+			if per == "job" {
+				job := labels["job"]
+				if jobs[job] {
+					continue
+				}
+				jobs[job] = true
+				result = append(result, TargetGroup{
+					Targets: []string{r.Host},
+					Labels: map[string]string{
+						"job":              job,
+						"__metrics_path__": path,
+						"__param_match[]":  fmt.Sprintf("{job=%q}", job),
+					},
+				})
+				continue
+			}
+
+			targetLabels := make(map[string]string, len(labels)+1)
+			for name, value := range labels {
+				targetLabels[name] = value
+			}
+			targetLabels["__metrics_path__"] = groupPath(path, labels)
+			result = append(result, TargetGroup{Targets: []string{r.Host}, Labels: targetLabels})
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(result); err != nil {
+			slog.Debug("failed to write targets: ", err)
+		}
+	}
+}
+
+// groupPath returns the path of the group with the labels below metricsPath,
+// e.g. `/metrics/job/lobby/instance/lobby-17`. Values which can not be part
+// of the path are encoded with base64.
+func groupPath(metricsPath string, labels map[string]string) string {
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		if name != "job" {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	b.WriteString(metricsPath)
+	for _, name := range append([]string{"job"}, names...) {
+		value := labels[name]
+		if value == "" || strings.Contains(value, "/") {
+			// "=" is decoded to the empty value.
+			name += Base64JobSuffix
+			value = base64.RawURLEncoding.EncodeToString([]byte(value))
+			if value == "" {
+				value = "="
+			}
+		}
+		b.WriteString("/" + name + "/" + value)
+	}
+	return b.String()
+}
@@ -0,0 +1,68 @@
+package handler
+
+import (
+	"dev.volix.ops/thor/storage"
+	"encoding/json"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/common/route"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestServiceDiscovery(t *testing.T) {
+	ms := storage.NewMetricStorage()
+	pushTestGroups(t, ms,
+		map[string]string{"job": "lobby", "instance": "lobby-17"},
+		map[string]string{"job": "lobby", "instance": "lobby-18"},
+		map[string]string{"job": "games/bedwars", "map": "castle/2"},
+	)
+
+	discover := func(query string) []TargetGroup {
+		req, _ := http.NewRequest("GET", "/api/v1/sd?"+query, nil)
+		req.Host = "thor:9091"
+		rr := httptest.NewRecorder()
+		ServiceDiscovery(ms, "/metrics").ServeHTTP(rr, req)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("handler returned wrong status code: got %v want %v, body: %s", rr.Code, http.StatusOK, rr.Body.String())
+		}
+		var targets []TargetGroup
+		if err := json.Unmarshal(rr.Body.Bytes(), &targets); err != nil {
+			t.Fatal(err)
+		}
+		return targets
+	}
+
+	// every target can be scraped on its path, including
+	// the ones with values encoded with base64.
+	r := route.New()
+	for _, suffix := range []string{"", Base64JobSuffix} {
+		r.Get("/metrics/job"+suffix+"/:job/*labels", GroupMetrics(ms, suffix != "", promhttp.HandlerOpts{}))
+	}
+	targets := discover("")
+	if len(targets) != 3 {
+		t.Fatalf("expected 3 targets, got %v", targets)
+	}
+	for _, tg := range targets {
+		if len(tg.Targets) != 1 || tg.Targets[0] != "thor:9091" {
+			t.Errorf("expected the host as target, got %v", tg.Targets)
+		}
+		req, _ := http.NewRequest("GET", tg.Labels["__metrics_path__"], nil)
+		rr := httptest.NewRecorder()
+		r.ServeHTTP(rr, req)
+		if rr.Code != http.StatusOK || strings.Count(rr.Body.String(), "players{") != 1 {
+			t.Errorf("could not scrape target %v: %d %s", tg.Labels, rr.Code, rr.Body.String())
+		}
+	}
+
+	targets = discover("per=job")
+	if len(targets) != 2 {
+		t.Fatalf("expected a target per job, got %v", targets)
+	}
+	for _, tg := range targets {
+		if job := tg.Labels["job"]; tg.Labels["__metrics_path__"] != "/metrics" || tg.Labels["__param_match[]"] != `{job="`+job+`"}` {
+			t.Errorf("unexpected target for job, got %v", tg.Labels)
+		}
+	}
+}
@@ -0,0 +1,254 @@
+package handler
+
+import (
+	"context"
+	"dev.volix.ops/thor/pkg/slog"
+	"dev.volix.ops/thor/storage"
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/route"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"net/http"
+	"sync"
+)
+
+// A Tenancy selects the isolated storage.MetricStorage of a tenant for
+// every request. The tenant ID is taken from the `tenant` route parameter,
+// e.g. of the `/tenants/:tenant/...` routes, or the Header, in this order.
+// Requests without tenant ID use the default storage passed to the handlers.
+//
+// If Identity is set, the authenticated identity is the tenant ID, so that
+// clients can only access their own tenant. Requests selecting another
+// tenant, or any tenant without identity, are rejected.
+type Tenancy struct {
+	Tenants *storage.Tenants
+	// Header containing the tenant ID, disabled if empty.
+	Header string
+	// Identity returns the authenticated identity, which is used
+	// as tenant ID. Disabled if nil.
+	Identity func(ctx context.Context) (string, bool)
+	// Limits of the tenants, overriding the ones of the handlers.
+	// They may be replaced at runtime with SetLimits.
+	Limits map[string]Limits
+
+	limitsMu sync.RWMutex
+}
+
+// SetLimits replaces the Limits of the tenants, e.g. after reloading them.
+func (t *Tenancy) SetLimits(limits map[string]Limits) {
+	t.limitsMu.Lock()
+	defer t.limitsMu.Unlock()
+
+	t.Limits = limits
+}
+
+type tenantKey struct{}
+
+type tenantContext struct {
+	id     string
+	ms     *storage.MetricStorage
+	limits *Limits
+}
+
+// Tenant returns the ID of the tenant selected by the Tenancy.
+func Tenant(ctx context.Context) (string, bool) {
+	tc, ok := ctx.Value(tenantKey{}).(tenantContext)
+	return tc.id, ok
+}
+
+// tenantID returns the tenant ID of the request, or "" if there is none.
+// It returns an error, if the request selects a tenant it may not access.
+func (t *Tenancy) tenantID(r *http.Request) (string, error) {
+	requested := route.Param(r.Context(), "tenant")
+	if requested == "" && t.Header != "" {
+		requested = r.Header.Get(t.Header)
+	}
+	if t.Identity == nil {
+		return requested, nil
+	}
+
+	identity, ok := t.Identity(r.Context())
+	if !ok {
+		if requested != "" {
+			return "", fmt.Errorf("tenant %q requires authentication", requested)
+		}
+		return "", nil
+	}
+	if requested != "" && requested != identity {
+		return "", fmt.Errorf("tenant %q not allowed for identity %q", requested, identity)
+	}
+	return identity, nil
+}
+
+// forbidden rejects a request selecting a tenant it may not access.
+func forbidden(w http.ResponseWriter, r *http.Request, err error) {
+	http.Error(w, err.Error(), http.StatusForbidden)
+
+	slog.Debug("rejected tenant of ", r.RemoteAddr)
+	slog.Debug(err.Error())
+}
+
+// Handle wraps the handler, so that it uses the storage and limits
+// of the tenant. Invalid tenant IDs are rejected with http.StatusBadRequest,
+// tenants which may not be accessed with http.StatusForbidden and new
+// tenants exceeding the maximum with http.StatusTooManyRequests.
+func (t *Tenancy) Handle(h http.HandlerFunc) http.HandlerFunc {
+	return t.handle(h, true)
+}
+
+// HandleExisting is like Handle, but it does not create new tenants,
+// unknown ones are answered with http.StatusNotFound. It is meant
+// for read-only routes.
+func (t *Tenancy) HandleExisting(h http.HandlerFunc) http.HandlerFunc {
+	return t.handle(h, false)
+}
+
+func (t *Tenancy) handle(h http.HandlerFunc, create bool) http.HandlerFunc {
+	if t == nil {
+		return h
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := t.tenantID(r)
+		if err != nil {
+			forbidden(w, r, err)
+			return
+		}
+		if id == "" {
+			h(w, r)
+			return
+		}
+
+		if !create {
+			if _, ok := t.Tenants.Lookup(id); !ok {
+				http.Error(w, fmt.Sprintf("unknown tenant %q", id), http.StatusNotFound)
+				return
+			}
+		}
+		ms, err := t.Tenants.Get(id)
+		if err == storage.ErrTooManyTenants {
+			http.Error(w, err.Error(), http.StatusTooManyRequests)
+
+			slog.Error(fmt.Sprintf("rejected new tenant %q from %s: %v", id, r.RemoteAddr, err))
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+
+			slog.Debug("invalid tenant from ", r.RemoteAddr)
+			slog.Debug(err.Error())
+			return
+		}
+
+		tc := tenantContext{id: id, ms: ms}
+		t.limitsMu.RLock()
+		if limits, ok := t.Limits[id]; ok {
+			tc.limits = &limits
+		}
+		t.limitsMu.RUnlock()
+		h(w, r.WithContext(context.WithValue(r.Context(), tenantKey{}, tc)))
+	}
+}
+
+// Metrics returns a http.HandlerFunc exposing the metrics of the
+// tenant given by the `tenant` route parameter, filtered like with
+// Metrics. Unknown tenants are answered with http.StatusNotFound,
+// the ones which may not be accessed with http.StatusForbidden.
+func (t *Tenancy) Metrics(opts promhttp.HandlerOpts) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := t.tenantID(r)
+		if err != nil {
+			forbidden(w, r, err)
+			return
+		}
+		ms, ok := t.Tenants.Lookup(id)
+		if !ok {
+			http.Error(w, fmt.Sprintf("unknown tenant %q", id), http.StatusNotFound)
+			return
+		}
+		g := prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) { return ms.GetMetricFamilies(), nil })
+		Metrics(g, opts)(w, r)
+	}
+}
+
+// LoadTenantLimits reads the limits of the tenants from the file at path.
+// Limits missing for a tenant are taken from the defaults.
+//
+// Example:
+//  lobby-network:
+//    max_body_bytes: 1048576
+//    max_families: 100
+func LoadTenantLimits(path string, defaults Limits) (map[string]Limits, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	raw := map[string]yaml.MapSlice{}
+	if err := yaml.UnmarshalStrict(b, &raw); err != nil {
+		return nil, fmt.Errorf("invalid tenant limits %s: %v", path, err)
+	}
+	result, err := ParseTenantLimits(raw, defaults)
+	if err != nil {
+		return nil, fmt.Errorf("invalid tenant limits %s: %v", path, err)
+	}
+	return result, nil
+}
+
+// ParseTenantLimits returns the limits of the tenants from their raw YAML
+// values, like in the file read by LoadTenantLimits.
+func ParseTenantLimits(raw map[string]yaml.MapSlice, defaults Limits) (map[string]Limits, error) {
+	result := make(map[string]Limits, len(raw))
+	for id, values := range raw {
+		if !storage.TenantIDRE.MatchString(id) {
+			return nil, fmt.Errorf("invalid tenant id %q", id)
+		}
+
+		// unmarshal the values of the tenant again, but
+		// this time over a copy of the defaults.
+		b, err := yaml.Marshal(values)
+		if err != nil {
+			return nil, err
+		}
+		limits := defaults
+		if err := yaml.UnmarshalStrict(b, &limits); err != nil {
+			return nil, fmt.Errorf("invalid limits for tenant %q: %v", id, err)
+		}
+		result[id] = limits
+	}
+	return result, nil
+}
+
+// storageFor returns the storage of the tenant of the
+// request, or ms if the request has no tenant.
+func storageFor(r *http.Request, ms *storage.MetricStorage) *storage.MetricStorage {
+	if tc, ok := r.Context().Value(tenantKey{}).(tenantContext); ok {
+		return tc.ms
+	}
+	return ms
+}
+
+// limitsFor returns the limits of the tenant of the request, the ones
+// set by WithLimits or limits, in this order.
+func limitsFor(r *http.Request, limits Limits) Limits {
+	if tc, ok := r.Context().Value(tenantKey{}).(tenantContext); ok && tc.limits != nil {
+		return *tc.limits
+	}
+	if l, ok := r.Context().Value(limitsKey{}).(Limits); ok {
+		return l
+	}
+	return limits
+}
+
+type limitsKey struct{}
+
+// WithLimits wraps the handler, so that it uses the limits returned by
+// get instead of the ones it has been created with, unless the tenant
+// has its own. This allows to change the limits at runtime.
+func WithLimits(get func() Limits, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		h(w, r.WithContext(context.WithValue(r.Context(), limitsKey{}, get())))
+	}
+}
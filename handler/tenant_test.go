@@ -0,0 +1,161 @@
+package handler
+
+import (
+	"context"
+	"dev.volix.ops/thor/storage"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/common/route"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestTenancy(t *testing.T) {
+	ms := storage.NewMetricStorage()
+	tenancy := &Tenancy{
+		Tenants: storage.NewTenants(0),
+		Header:  "X-Thor-Tenant",
+		Limits:  map[string]Limits{"small": {MaxFamilies: 1}},
+	}
+	push := tenancy.Handle(Push(ms, false, false, false, Limits{}, nil))
+
+	req := newPushRequest(t, "lobby", "text/plain", strings.NewReader("players 42\n"))
+	req.Header.Set("X-Thor-Tenant", "net1")
+	rr := httptest.NewRecorder()
+	push.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v, body: %s", rr.Code, http.StatusOK, rr.Body.String())
+	}
+	if mfs := ms.GetMetricFamilies(); len(mfs) != 0 {
+		t.Errorf("expected default storage to be empty, got: %v", mfs)
+	}
+
+	// the limits of the tenant apply instead of the ones of the handler.
+	req = newPushRequest(t, "lobby", "text/plain", strings.NewReader("a 1\nb 2\n"))
+	req.Header.Set("X-Thor-Tenant", "small")
+	rr = httptest.NewRecorder()
+	push.ServeHTTP(rr, req)
+	if rr.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusRequestEntityTooLarge)
+	}
+
+	req, _ = http.NewRequest("GET", "/tenants/net1/metrics", nil)
+	req = req.WithContext(route.WithParam(req.Context(), "tenant", "net1"))
+	rr = httptest.NewRecorder()
+	tenancy.Metrics(promhttp.HandlerOpts{}).ServeHTTP(rr, req)
+	if !strings.Contains(rr.Body.String(), "players") {
+		t.Errorf("expected metrics of tenant, got: %s", rr.Body.String())
+	}
+}
+
+func TestTenancyFromIdentity(t *testing.T) {
+	ms := storage.NewMetricStorage()
+	tenancy := &Tenancy{
+		Tenants: storage.NewTenants(0),
+		Header:  "X-Thor-Tenant",
+		Identity: func(ctx context.Context) (string, bool) {
+			identity, ok := ctx.Value(identityKey{}).(string)
+			return identity, ok
+		},
+	}
+	push := tenancy.Handle(Push(ms, false, false, false, Limits{}, nil))
+
+	tests := []struct {
+		identity, header, param string
+		status                  int
+		tenant                  string
+	}{
+		{identity: "net1", status: http.StatusOK, tenant: "net1"},
+		{identity: "net1", header: "net1", param: "net1", status: http.StatusOK, tenant: "net1"},
+		{identity: "net1", header: "net2", status: http.StatusForbidden},
+		{identity: "net1", param: "net2", status: http.StatusForbidden},
+		{header: "net2", status: http.StatusForbidden},
+		// anonymous requests without tenant use the default storage.
+		{status: http.StatusOK},
+	}
+	for _, test := range tests {
+		req := newPushRequest(t, "lobby", "text/plain", strings.NewReader("players 42\n"))
+		req.Header.Set("X-Thor-Tenant", test.header)
+		ctx := req.Context()
+		if test.identity != "" {
+			ctx = context.WithValue(ctx, identityKey{}, test.identity)
+		}
+		if test.param != "" {
+			ctx = route.WithParam(ctx, "tenant", test.param)
+		}
+		rr := httptest.NewRecorder()
+		push.ServeHTTP(rr, req.WithContext(ctx))
+
+		if rr.Code != test.status {
+			t.Errorf("%+v: handler returned wrong status code: got %v want %v", test, rr.Code, test.status)
+		}
+	}
+
+	if ids := tenancy.Tenants.IDs(); len(ids) != 1 || ids[0] != "net1" {
+		t.Errorf("expected only the tenant of the identity, got: %v", ids)
+	}
+	if n := ms.GroupCount(); n != 1 {
+		t.Errorf("expected anonymous push to the default storage, got %d groups", n)
+	}
+
+	req, _ := http.NewRequest("GET", "/tenants/net1/metrics", nil)
+	req = req.WithContext(route.WithParam(context.WithValue(req.Context(), identityKey{}, "net2"), "tenant", "net1"))
+	rr := httptest.NewRecorder()
+	tenancy.Metrics(promhttp.HandlerOpts{}).ServeHTTP(rr, req)
+	if rr.Code != http.StatusForbidden {
+		t.Errorf("expected metrics of other tenant to be forbidden, got %v", rr.Code)
+	}
+}
+
+type identityKey struct{}
+
+func TestWithLimits(t *testing.T) {
+	ms := storage.NewMetricStorage()
+	limits := Limits{}
+	tenancy := &Tenancy{Tenants: storage.NewTenants(0), Header: "X-Thor-Tenant"}
+	push := tenancy.Handle(WithLimits(func() Limits { return limits }, Push(ms, false, false, false, Limits{}, nil)))
+	request := func(tenant string) int {
+		req := newPushRequest(t, "lobby", "text/plain", strings.NewReader("a 1\nb 2\n"))
+		req.Header.Set("X-Thor-Tenant", tenant)
+		rr := httptest.NewRecorder()
+		push.ServeHTTP(rr, req)
+		return rr.Code
+	}
+
+	if status := request(""); status != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v", status, http.StatusOK)
+	}
+
+	// the changed limits apply without creating the handler again.
+	limits = Limits{MaxFamilies: 1}
+	if status := request(""); status != http.StatusRequestEntityTooLarge {
+		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusRequestEntityTooLarge)
+	}
+
+	// and the ones of the tenant take precedence.
+	tenancy.SetLimits(map[string]Limits{"big": {}})
+	if status := request("big"); status != http.StatusOK {
+		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusOK)
+	}
+}
+
+func TestLoadTenantLimits(t *testing.T) {
+	f, err := ioutil.TempFile("", "thor-limits")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	_, _ = f.WriteString("net1:\n  max_families: 5\n")
+	_ = f.Close()
+
+	limits, err := LoadTenantLimits(f.Name(), Limits{MaxFamilies: 10, MaxLabelLength: 20})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l := limits["net1"]; l.MaxFamilies != 5 || l.MaxLabelLength != 20 {
+		t.Errorf("expected overridden families and default label length, got: %+v", l)
+	}
+}
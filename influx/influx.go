@@ -0,0 +1,325 @@
+// Package influx parses the InfluxDB line protocol and
+// converts the points into Prometheus metric families.
+//
+// Source: https://docs.influxdata.com/influxdb/v1.8/write_protocols/line_protocol_reference/
+package influx
+
+import (
+	"bufio"
+	"bytes"
+	"dev.volix.ops/thor/utils"
+	"fmt"
+	"github.com/golang/protobuf/proto"
+	dto "github.com/prometheus/client_model/go"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// A Point is a single parsed line of the line protocol.
+// The timestamp is validated but not kept, as pushed metrics
+// must not have timestamps anyway.
+type Point struct {
+	Measurement string
+	Tags        map[string]string
+	Fields      []Field
+}
+
+// A Field of a Point. String fields can not be represented
+// in Prometheus, so only numeric and boolean fields are
+// kept, booleans as 0 or 1.
+type Field struct {
+	Key   string
+	Value float64
+}
+
+// ValidPrecision returns if the precision is one
+// of the precisions of the `/write` API.
+func ValidPrecision(precision string) bool {
+	switch precision {
+	case "", "n", "ns", "u", "us", "ms", "s", "m", "h":
+		return true
+	}
+	return false
+}
+
+// ParsePoints reads every line of the reader and parses it
+// into a Point. Empty lines and comments are skipped.
+// The returned error contains the line number of the bad line.
+func ParsePoints(r io.Reader) ([]Point, error) {
+	var points []Point
+	err := scanPoints(r, func(point Point) error {
+		points = append(points, point)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return points, nil
+}
+
+// A LimitError is returned by ParseMetricFamilies,
+// if the points exceed one of the limits.
+type LimitError struct {
+	What  string
+	Limit int
+}
+
+func (e *LimitError) Error() string {
+	return fmt.Sprintf("%s exceeds the limit of %d", e.What, e.Limit)
+}
+
+// ParseMetricFamilies reads the points of the reader like ParsePoints
+// and converts them like ToMetricFamilies, without keeping all points
+// in memory. It stops with a *LimitError as soon as there are more
+// than maxFamilies families or more than maxMetrics metrics in one
+// family. Limits less or equal to zero are disabled.
+func ParseMetricFamilies(r io.Reader, maxFamilies, maxMetrics int) (map[string]*dto.MetricFamily, error) {
+	c := newConverter()
+	err := scanPoints(r, func(point Point) error {
+		for _, name := range c.add(point) {
+			if maxFamilies > 0 && len(c.result) > maxFamilies {
+				return &LimitError{What: "number of metric families", Limit: maxFamilies}
+			}
+			if maxMetrics > 0 && len(c.result[name].Metric) > maxMetrics {
+				return &LimitError{What: fmt.Sprintf("number of metrics in family %q", name), Limit: maxMetrics}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return c.result, nil
+}
+
+// scanPoints parses every line of the reader and calls fn
+// with the point, stopping at the first error.
+func scanPoints(r io.Reader, fn func(Point) error) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for n := 1; scanner.Scan(); n++ {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+
+		point, err := parseLine(string(line))
+		if err != nil {
+			return fmt.Errorf("unable to parse line %d: %v", n, err)
+		}
+		if err := fn(point); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+// parseLine parses a single line in the format
+//  measurement[,tag=value...] field=value[,field=value...] [timestamp]
+func parseLine(line string) (Point, error) {
+	key, rest, err := splitUnescaped(line, ' ', false)
+	if err != nil {
+		return Point{}, err
+	}
+	fieldsString, timestamp, err := splitUnescaped(rest, ' ', true)
+	if err != nil {
+		return Point{}, err
+	}
+	if fieldsString == "" {
+		return Point{}, fmt.Errorf("missing fields")
+	}
+	if timestamp != "" {
+		if _, err := strconv.ParseInt(timestamp, 10, 64); err != nil {
+			return Point{}, fmt.Errorf("invalid timestamp %q", timestamp)
+		}
+	}
+
+	components, err := splitAllUnescaped(key, ',', false)
+	if err != nil {
+		return Point{}, err
+	}
+	point := Point{
+		Measurement: unescape(components[0]),
+		Tags:        make(map[string]string, len(components)-1),
+	}
+	if point.Measurement == "" {
+		return Point{}, fmt.Errorf("missing measurement")
+	}
+	for _, tag := range components[1:] {
+		k, v, err := splitUnescaped(tag, '=', false)
+		if err != nil || k == "" || v == "" {
+			return Point{}, fmt.Errorf("invalid tag %q", tag)
+		}
+		point.Tags[unescape(k)] = unescape(v)
+	}
+
+	fields, err := splitAllUnescaped(fieldsString, ',', true)
+	if err != nil {
+		return Point{}, err
+	}
+	for _, field := range fields {
+		k, v, err := splitUnescaped(field, '=', true)
+		if err != nil || k == "" || v == "" {
+			return Point{}, fmt.Errorf("invalid field %q", field)
+		}
+
+		value, ok, err := parseFieldValue(v)
+		if err != nil {
+			return Point{}, fmt.Errorf("invalid value of field %q: %v", unescape(k), err)
+		}
+		if ok {
+			point.Fields = append(point.Fields, Field{Key: unescape(k), Value: value})
+		}
+	}
+	return point, nil
+}
+
+// parseFieldValue parses a field value. Returns false if
+// the value is valid, but can not be represented as float.
+func parseFieldValue(v string) (float64, bool, error) {
+	switch v {
+	case "t", "T", "true", "True", "TRUE":
+		return 1, true, nil
+	case "f", "F", "false", "False", "FALSE":
+		return 0, true, nil
+	}
+
+	if v[0] == '"' {
+		if len(v) < 2 || v[len(v)-1] != '"' {
+			return 0, false, fmt.Errorf("unterminated string %s", v)
+		}
+		return 0, false, nil
+	}
+
+	switch v[len(v)-1] {
+	case 'i':
+		i, err := strconv.ParseInt(v[:len(v)-1], 10, 64)
+		return float64(i), err == nil, err
+	case 'u':
+		u, err := strconv.ParseUint(v[:len(v)-1], 10, 64)
+		return float64(u), err == nil, err
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	return f, err == nil, err
+}
+
+// splitUnescaped splits s at the first occurrence of sep,
+// which is not escaped with a backslash. If quotes is true,
+// separators within double quotes are ignored as well.
+// The second string is empty if sep does not occur.
+func splitUnescaped(s string, sep byte, quotes bool) (string, string, error) {
+	inQuotes := false
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] == '\\':
+			i++
+		case quotes && s[i] == '"':
+			inQuotes = !inQuotes
+		case s[i] == sep && !inQuotes:
+			return s[:i], s[i+1:], nil
+		}
+	}
+	if inQuotes {
+		return "", "", fmt.Errorf("unterminated string")
+	}
+	return s, "", nil
+}
+
+func splitAllUnescaped(s string, sep byte, quotes bool) ([]string, error) {
+	var result []string
+	for {
+		head, tail, err := splitUnescaped(s, sep, quotes)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, head)
+		if len(head) == len(s) {
+			return result, nil
+		}
+		s = tail
+	}
+}
+
+// unescape removes the backslashes of escaped characters.
+func unescape(s string) string {
+	if strings.IndexByte(s, '\\') < 0 {
+		return s
+	}
+
+	sb := strings.Builder{}
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+1 < len(s) {
+			i++
+		}
+		sb.WriteByte(s[i])
+	}
+	return sb.String()
+}
+
+// ToMetricFamilies converts the points into gauges. Every field
+// becomes its own family called `<measurement>_<field>`, and the
+// tags are used as labels.
+//
+// If the same series occurs multiple times, the last one wins.
+func ToMetricFamilies(points []Point) map[string]*dto.MetricFamily {
+	c := newConverter()
+	for _, point := range points {
+		c.add(point)
+	}
+	return c.result
+}
+
+// converter converts points into gauges one after another.
+type converter struct {
+	result map[string]*dto.MetricFamily
+	series map[string]*dto.Metric
+}
+
+func newConverter() *converter {
+	return &converter{
+		result: make(map[string]*dto.MetricFamily),
+		series: make(map[string]*dto.Metric),
+	}
+}
+
+// add converts the fields of the point and
+// returns the names of the families it added to.
+func (c *converter) add(point Point) []string {
+	names := make([]string, 0, len(point.Fields))
+	for _, field := range point.Fields {
+		name := utils.SanitizeMetricName(point.Measurement + "_" + field.Key)
+		names = append(names, name)
+
+		mf, ok := c.result[name]
+		if !ok {
+			mf = &dto.MetricFamily{
+				Name: proto.String(name),
+				Type: dto.MetricType_GAUGE.Enum(),
+			}
+			c.result[name] = mf
+		}
+
+		labels := make([]*dto.LabelPair, 0, len(point.Tags))
+		for k, v := range point.Tags {
+			labels = append(labels, &dto.LabelPair{
+				Name:  proto.String(utils.SanitizeLabelName(k)),
+				Value: proto.String(v),
+			})
+		}
+
+		key := name + "\xff" + utils.GroupingKeyForLabelPair(labels)
+		if m, ok := c.series[key]; ok {
+			m.Gauge.Value = proto.Float64(field.Value)
+			continue
+		}
+
+		m := &dto.Metric{
+			Label: labels,
+			Gauge: &dto.Gauge{Value: proto.Float64(field.Value)},
+		}
+		c.series[key] = m
+		mf.Metric = append(mf.Metric, m)
+	}
+	return names
+}
@@ -0,0 +1,108 @@
+package influx
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParsePoints(t *testing.T) {
+	body := `
+# comment
+players,server=lobby17,region=eu value=42i,max=100i 1609459200000000000
+tps,server=lobby\ 18 avg=19.5,healthy=t,motd="hello, world"
+`
+	points, err := ParsePoints(strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(points) != 2 {
+		t.Fatalf("wrong number of points, got: %d, expected: %d", len(points), 2)
+	}
+
+	if points[0].Measurement != "players" || points[0].Tags["region"] != "eu" {
+		t.Errorf("could not parse measurement and tags, got: %v", points[0])
+	}
+	if len(points[0].Fields) != 2 || points[0].Fields[0].Value != 42 {
+		t.Errorf("could not parse fields, got: %v", points[0].Fields)
+	}
+
+	if points[1].Tags["server"] != "lobby 18" {
+		t.Errorf("could not unescape tag value, got: %q, expected: %q", points[1].Tags["server"], "lobby 18")
+	}
+	// the string field has to be skipped.
+	if len(points[1].Fields) != 2 || points[1].Fields[1].Value != 1 {
+		t.Errorf("could not parse fields, got: %v", points[1].Fields)
+	}
+}
+
+func TestParseInvalidPoints(t *testing.T) {
+	for _, line := range []string{
+		"players",
+		"players value=abc",
+		"players,server value=1",
+		"players value=1 yesterday",
+		`players motd="unterminated`,
+	} {
+		if _, err := ParsePoints(strings.NewReader(line)); err == nil {
+			t.Errorf("expected line %q to fail, but it did not.", line)
+		}
+	}
+}
+
+func TestToMetricFamilies(t *testing.T) {
+	points, err := ParsePoints(strings.NewReader("players,server=lobby17 value=42i,max=100i\nplayers,server=lobby17 value=43i"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mfs := ToMetricFamilies(points)
+	if len(mfs) != 2 {
+		t.Fatalf("wrong number of families, got: %d, expected: %d", len(mfs), 2)
+	}
+
+	players, ok := mfs["players_value"]
+	if !ok {
+		t.Fatalf("expected family players_value, got: %v", mfs)
+	}
+	if len(players.Metric) != 1 || players.Metric[0].GetGauge().GetValue() != 43 {
+		t.Errorf("expected last value to win, got: %v", players.Metric)
+	}
+	if _, ok := mfs["players_max"]; !ok {
+		t.Errorf("expected family players_max, got: %v", mfs)
+	}
+}
+
+func TestToMetricFamiliesNaming(t *testing.T) {
+	// fields called value are not special, so they
+	// can not collide with a field named like the measurement.
+	points, err := ParsePoints(strings.NewReader("cpu value=1\ncpu,x=y cpu=2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mfs := ToMetricFamilies(points)
+	for _, name := range []string{"cpu_value", "cpu_cpu"} {
+		if mf, ok := mfs[name]; !ok || len(mf.Metric) != 1 {
+			t.Errorf("expected family %s with one metric, got: %v", name, mfs)
+		}
+	}
+}
+
+func TestParseMetricFamilies(t *testing.T) {
+	body := "players,server=lobby17 value=42i,max=100i\nplayers,server=lobby18 value=43i"
+
+	mfs, err := ParseMetricFamilies(strings.NewReader(body), 2, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mfs) != 2 || len(mfs["players_value"].Metric) != 2 {
+		t.Errorf("wrong families, got: %v", mfs)
+	}
+
+	for _, limits := range [][2]int{{1, 0}, {0, 1}} {
+		_, err := ParseMetricFamilies(strings.NewReader(body), limits[0], limits[1])
+		if _, ok := err.(*LimitError); !ok {
+			t.Errorf("expected limit error for limits %v, got: %v", limits, err)
+		}
+	}
+}
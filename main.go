@@ -1,31 +1,86 @@
 package main
 
 import (
+	"dev.volix.ops/thor/cluster"
+	"dev.volix.ops/thor/config"
+	"dev.volix.ops/thor/graphite"
 	"dev.volix.ops/thor/handler"
+	"dev.volix.ops/thor/pkg/ratelimit"
 	"dev.volix.ops/thor/pkg/slog"
 	"dev.volix.ops/thor/pkg/version"
+	"dev.volix.ops/thor/pushgateway"
 	"dev.volix.ops/thor/storage"
+	"dev.volix.ops/thor/web"
+	"dev.volix.ops/thor/webhook"
+	"fmt"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	dto "github.com/prometheus/client_model/go"
 	"github.com/prometheus/common/route"
 	"gopkg.in/alecthomas/kingpin.v2"
+	"io/ioutil"
 	"net/http"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 )
 
 func main() {
 	var (
 		app = kingpin.New("thor", "A Prometheus push and aggregation gateway.")
 
-		verbose = app.Flag("verbose", "Enable verbose/debug output.").Default("false").Bool()
+		verbose    = app.Flag("verbose", "Enable verbose/debug output.").Default("false").Bool()
+		configFile = app.Flag("config.file", "Path to the config file, which is reloaded on SIGHUP and POST /-/reload. Disabled if empty.").Default("").String()
 
-		listenAddress        = app.Flag("web.listen-address", "Address and port to listen on.").Default(":9091").String()
+		listenAddress        = app.Flag("web.listen-address", "Address and port to listen on, unless the config file sets the listeners.").Default(":9091").String()
 		metricsPath          = app.Flag("web.metrics-path", "Path under which to expose metrics.").Default("/metrics").String()
+		telemetryPath        = app.Flag("web.telemetry-path", "Path under which to expose the metrics of thor itself.").Default("/-/metrics").String()
+		webConfigFile        = app.Flag("web.config.file", "Path to the web config file enabling TLS and client certificate verification.").Default("").String()
+		readTimeout          = app.Flag("web.read-timeout", "Maximum duration for reading an entire request, including the body. 0 disables the timeout.").Default("30s").Duration()
+		writeTimeout         = app.Flag("web.write-timeout", "Maximum duration before timing out writes of the response. 0 disables the timeout.").Default("30s").Duration()
+		idleTimeout          = app.Flag("web.idle-timeout", "Maximum duration to wait for the next request on keep-alive connections. 0 disables the timeout.").Default("2m").Duration()
 		skipConsistencyCheck = app.Flag("push.skip-consistency-check", "Skip consistency check, dangerous but faster.").Default("false").Bool()
+		maxBodyBytes         = app.Flag("push.max-body-bytes", "Maximum size of a push body as sent by the client. 0 disables the limit.").Default("16777216").Int64()
+		maxDecompressedBytes = app.Flag("push.max-decompressed-bytes", "Maximum size of a compressed push body after decompression. 0 disables the limit.").Default("67108864").Int64()
+		maxFamilies          = app.Flag("push.max-families", "Maximum number of metric families in a single push. 0 disables the limit.").Default("10000").Int()
+		maxMetricsPerFamily  = app.Flag("push.max-metrics-per-family", "Maximum number of metrics per metric family in a single push. 0 disables the limit.").Default("100000").Int()
+		maxLabelLength       = app.Flag("push.max-label-length", "Maximum length of label names and values in bytes. 0 disables the limit.").Default("4096").Int()
+		rateLimitConfig      = app.Flag("push.rate-limit-config", "Path to the file with the rate limits of pushes. Disabled if empty.").Default("").String()
+
+		tenantEnable       = app.Flag("tenant.enable", "Enable multi-tenancy with an isolated storage per tenant.").Default("false").Bool()
+		tenantHeader       = app.Flag("tenant.header", "Header containing the tenant ID, e.g. X-Thor-Tenant. Disabled if empty.").Default("").String()
+		tenantFromIdentity = app.Flag("tenant.from-identity", "Use the authenticated identity as tenant ID and reject requests selecting other tenants.").Default("false").Bool()
+		tenantMax          = app.Flag("tenant.max", "Maximum number of tenants. 0 disables the limit.").Default("100").Int()
+		tenantLimitsFile   = app.Flag("tenant.limits-file", "Path to the file with the push limits of the tenants.").Default("").String()
+		tenantLabel        = app.Flag("tenant.label", "Expose the metrics of all tenants on the global metrics path with this label. Disabled if empty.").Default("").String()
+
+		graphiteListenAddress = app.Flag("graphite.listen-address", "Address and port to accept Graphite plaintext lines on (TCP and UDP). Disabled if empty.").Default("").String()
+		graphiteMappingConfig = app.Flag("graphite.mapping-config", "Path to the file with the Graphite mapping rules.").Default("").String()
+		graphiteDropUnmapped  = app.Flag("graphite.drop-unmapped", "Drop Graphite lines without a matching mapping instead of storing them with their sanitized path.").Default("false").Bool()
+
+		clusterPeers           = app.Flag("cluster.peer", "Base URL of a peer to replicate writes to, e.g. http://thor-1:9091. Can be repeated.").Strings()
+		clusterMembers         = app.Flag("cluster.member", "Base URL of a member of the sharded cluster, e.g. http://thor-1:9091. Can be repeated.").Strings()
+		clusterJoin            = app.Flag("cluster.join", "Base URL of an instance to join the sharded cluster with, discovering the other members with gossip. Can be repeated.").Strings()
+		clusterAdvertiseURL    = app.Flag("cluster.advertise-url", "Base URL under which the other members of the sharded cluster reach this instance.").Default("").String()
+		clusterBearerTokenFile = app.Flag("cluster.bearer-token-file", "Path to the file with the bearer token the instances of the cluster authenticate with.").Default("").String()
+		clusterTLSCertFile     = app.Flag("cluster.tls-cert-file", "Path to the client certificate sent to the other instances of the cluster.").Default("").String()
+		clusterTLSKeyFile      = app.Flag("cluster.tls-key-file", "Path to the key of the client certificate sent to the other instances of the cluster.").Default("").String()
+		clusterTLSCAFile       = app.Flag("cluster.tls-ca-file", "Path to the CA file verifying the other instances of the cluster.").Default("").String()
+
+		pushgatewayImportFile = app.Flag("pushgateway.import-file", "Path to a persistence file of the Prometheus Pushgateway, whose groups are imported on startup.").Default("").String()
+
+		groupTTL          = app.Flag("storage.group-ttl", "Delete groups which have not been pushed to for this duration. 0 disables the expiry.").Default("0s").Duration()
+		webhookConfigFile = app.Flag("webhook.config-file", "Path to the file with the webhooks notified about group changes. Disabled if empty.").Default("").String()
 	)
 	kingpin.MustParse(app.Parse(os.Args[1:]))
 
+	// SIGHUP would terminate thor, until the signals are handled. So they
+	// are caught right away, but only reload the config once it is served.
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
 	if *verbose {
 		// we only support verbose or !verbose, as we don't need
 		// a more specific setting like debug, info, warn, ... level.
@@ -39,37 +94,366 @@ func main() {
 	slog.Debug("metrics path=", *metricsPath)
 
 	ms := storage.NewMetricStorage()
+	var tenants *storage.Tenants
+	if *tenantEnable {
+		tenants = storage.NewTenants(*tenantMax)
+		if *tenantLabel != "" {
+			// the families of all storages are exposed together.
+			tenants.ShareTypes(ms)
+		}
+	}
+
+	// the limits, auth, group TTL, webhooks and listeners are taken
+	// from the flags and files, and can be overridden by the config
+	// file. All of them are reloaded by the Reloader.
+	loadConfig := func() (*config.Config, error) {
+		base := config.Config{
+			Limits: handler.Limits{
+				MaxBodyBytes:         *maxBodyBytes,
+				MaxDecompressedBytes: *maxDecompressedBytes,
+				MaxFamilies:          *maxFamilies,
+				MaxMetricsPerFamily:  *maxMetricsPerFamily,
+				MaxLabelLength:       *maxLabelLength,
+			},
+			GroupTTL:  *groupTTL,
+			Listeners: []string{*listenAddress},
+		}
+		var err error
+		if *webConfigFile != "" {
+			if base.Auth, err = web.LoadConfig(*webConfigFile); err != nil {
+				return nil, err
+			}
+		}
+		if *rateLimitConfig != "" {
+			if base.RateLimits, err = ratelimit.LoadConfig(*rateLimitConfig); err != nil {
+				return nil, err
+			}
+		}
+		if *tenantLimitsFile != "" {
+			if base.TenantLimits, err = handler.LoadTenantLimits(*tenantLimitsFile, base.Limits); err != nil {
+				return nil, err
+			}
+		}
+		if *webhookConfigFile != "" {
+			c, err := webhook.LoadConfig(*webhookConfigFile)
+			if err != nil {
+				return nil, err
+			}
+			base.Webhooks = c.Webhooks
+		}
+
+		if *configFile == "" {
+			return &base, base.Validate()
+		}
+		return config.Load(*configFile, base)
+	}
+	initialConfig, err := loadConfig()
+	if err != nil {
+		slog.Fatal("could not load config: ", err)
+	}
+
+	var clusterToken string
+	if *clusterBearerTokenFile != "" {
+		b, err := ioutil.ReadFile(*clusterBearerTokenFile)
+		if err != nil {
+			slog.Fatal("could not read cluster bearer token: ", err)
+		}
+		if clusterToken = strings.TrimSpace(string(b)); clusterToken == "" {
+			slog.Fatal("empty cluster bearer token in ", *clusterBearerTokenFile)
+		}
+	}
+	clusterAuth := cluster.Auth{BearerToken: clusterToken}
+	if *clusterTLSCertFile != "" || *clusterTLSKeyFile != "" || *clusterTLSCAFile != "" {
+		if clusterAuth.TLSConfig, err = cluster.LoadTLSConfig(*clusterTLSCertFile, *clusterTLSKeyFile, *clusterTLSCAFile); err != nil {
+			slog.Fatal("could not load cluster tls config: ", err)
+		}
+	}
+	sharding := len(*clusterMembers) > 0 || len(*clusterJoin) > 0
+	if len(*clusterPeers) > 0 && sharding {
+		slog.Fatal("replication with --cluster.peer and sharding with --cluster.member or --cluster.join can not be combined")
+	}
+	if len(*clusterMembers) > 0 && len(*clusterJoin) > 0 {
+		slog.Fatal("static members with --cluster.member and gossip with --cluster.join can not be combined")
+	}
+	if (len(*clusterPeers) > 0 || sharding) && clusterToken == "" {
+		// without a token, the instances authenticate with their client
+		// certificates, which have to be verified and restricted to them.
+		c := initialConfig.Auth
+		if c == nil || !c.TLSConfig.VerifiesClients() || len(c.RouteAuth[web.RouteCluster]) == 0 {
+			slog.Fatal("clustering requires --cluster.bearer-token-file, or client certificates verified by the web config and a cluster entry in its route_auth")
+		}
+	}
+
+	var replicator *cluster.Replicator
+	if len(*clusterPeers) > 0 {
+		var err error
+		if replicator, err = cluster.NewReplicator(ms, tenants, *clusterPeers, clusterAuth); err != nil {
+			slog.Fatal("could not create replicator: ", err)
+		}
+		// sync before anything is written, so that the
+		// writes are not lost by replacing the storages.
+		replicator.Start()
+		if err := replicator.Sync(); err != nil {
+			slog.Fatal("could not sync with peers: ", err)
+		}
+	}
+
+	var sharder *cluster.Sharder
+	if sharding {
+		var err error
+		if sharder, err = cluster.NewSharder(ms, tenants, *clusterAdvertiseURL, *clusterMembers, clusterAuth); err != nil {
+			slog.Fatal("could not create sharder: ", err)
+		}
+		if len(*clusterJoin) > 0 {
+			if err := sharder.EnableGossip(*clusterJoin); err != nil {
+				slog.Fatal("could not enable gossip: ", err)
+			}
+		}
+		sharder.Start()
+	}
+
+	if *pushgatewayImportFile != "" {
+		n, err := pushgateway.Import(ms, *pushgatewayImportFile)
+		if err != nil {
+			slog.Fatal("could not import pushgateway persistence file: ", err)
+		}
+		slog.Info(fmt.Sprintf("imported %d groups from %s", n, *pushgatewayImportFile))
+	}
+
+	if *graphiteListenAddress != "" {
+		mapper, err := graphite.NewMapper(graphite.MappingConfig{})
+		if *graphiteMappingConfig != "" {
+			mapper, err = graphite.LoadMapper(*graphiteMappingConfig)
+		}
+		if err != nil {
+			slog.Fatal("could not load graphite mapping config: ", err)
+		}
+
+		slog.Debug("graphite listen address=", *graphiteListenAddress)
+		go func() {
+			err := graphite.NewListener(ms, mapper, *graphiteDropUnmapped).ListenAndServe(*graphiteListenAddress)
+			slog.Error("graphite listener stopped: ", err)
+		}()
+	}
+
+	state := &config.State{}
+	auth := web.NewAuthenticator(nil)
+	var tenancy *handler.Tenancy
+	if *tenantEnable {
+		tenancy = &handler.Tenancy{
+			Tenants: tenants,
+			Header:  *tenantHeader,
+		}
+		if *tenantFromIdentity {
+			tenancy.Identity = web.Identity
+		}
+	}
+	var listeners *web.Listeners
+	var dispatcher *webhook.Dispatcher
+	if *webhookConfigFile != "" || *configFile != "" {
+		// the dispatcher also exists without webhooks, so that they
+		// can be added by reloading. It only subscribes to the
+		// storages while there are webhooks.
+		dispatcher, _ = webhook.NewDispatcher(webhook.Config{})
+		dispatcher.Watch("", ms)
+		if tenants != nil {
+			tenants.OnCreate(dispatcher.Watch)
+			// the tenants synced from the peers already exist.
+			for _, id := range tenants.IDs() {
+				if tms, ok := tenants.Lookup(id); ok {
+					dispatcher.Watch(id, tms)
+				}
+			}
+		}
+	}
+
+	applyConfig := func(c *config.Config) {
+		state.Update(c)
+		auth.Update(c.Auth)
+		if tenancy != nil {
+			tenancy.SetLimits(state.TenantLimits())
+		}
+		if dispatcher != nil {
+			if err := dispatcher.SetWebhooks(c.Webhooks); err != nil {
+				// not possible, as the config is validated.
+				slog.Error("could not set webhooks: ", err)
+			}
+		}
+		// nil until the server is started.
+		if listeners != nil {
+			if err := listeners.Update(c.Listeners); err != nil {
+				slog.Error("could not listen: ", err)
+			}
+		}
+	}
+	reloader := config.NewReloader(loadConfig, applyConfig)
+	reloader.Apply(initialConfig)
+
+	go expireGroups(ms, tenants, state.GroupTTL)
+
+	limits := state.Limits()
+	var authz handler.Authorizer = state
+
+	// write routes are protected and use the storage of the tenant
+	// and the current limits.
+	push := func(h http.HandlerFunc) http.HandlerFunc {
+		return auth.Protect(web.RoutePush, tenancy.Handle(handler.WithLimits(state.Limits, handler.WithRules(state.Rules, h))))
+	}
+	del := func(h http.HandlerFunc) http.HandlerFunc {
+		return auth.Protect(web.RouteDelete, tenancy.Handle(h))
+	}
+	// scraping does not create tenants.
+	scrape := func(h http.HandlerFunc) http.HandlerFunc {
+		return auth.Protect(web.RouteScrape, tenancy.HandleExisting(h))
+	}
 
 	r := route.New()
 	r.Get("/-/healthy", handler.Health(ms))
 	r.Get("/lore", handler.Lore())
 
-	// POST merges and adds to it and PUT replaces
-	for _, suffix := range []string{"", handler.Base64JobSuffix} {
-		isBase64 := suffix == handler.Base64JobSuffix
+	// the write routes are available for the default storage and,
+	// with multi-tenancy, below the path prefix of every tenant.
+	prefixes := []string{""}
+	if tenancy != nil {
+		prefixes = append(prefixes, "/tenants/:tenant")
+	}
+	for _, prefix := range prefixes {
+		// POST merges and adds to it and PUT replaces
+		for _, suffix := range []string{"", handler.Base64JobSuffix} {
+			isBase64 := suffix == handler.Base64JobSuffix
+			path := prefix + *metricsPath + "/job" + suffix
+
+			r.Post(path+"/:job/*labels", push(handler.Push(ms, isBase64, *skipConsistencyCheck, false, limits, authz)))
+			r.Put(path+"/:job/*labels", push(handler.Push(ms, isBase64, *skipConsistencyCheck, true, limits, authz)))
+			r.Del(path+"/:job/*labels", del(handler.Delete(ms, isBase64, authz)))
+
+			r.Post(path+"/:job", push(handler.Push(ms, isBase64, *skipConsistencyCheck, false, limits, authz)))
+			r.Put(path+"/:job", push(handler.Push(ms, isBase64, *skipConsistencyCheck, true, limits, authz)))
+			r.Del(path+"/:job", del(handler.Delete(ms, isBase64, authz)))
+
+			// every group can be scraped on its own.
+			r.Get(path+"/:job/*labels", scrape(handler.GroupMetrics(ms, isBase64, promhttp.HandlerOpts{})))
+			r.Get(path+"/:job", scrape(handler.GroupMetrics(ms, isBase64, promhttp.HandlerOpts{})))
+		}
+
+		// InfluxDB line protocol, compatible with the 1.x and 2.x write APIs.
+		r.Post(prefix+"/write", push(handler.Influx(ms, *skipConsistencyCheck, limits, authz)))
+		r.Post(prefix+"/api/v2/write", push(handler.Influx(ms, *skipConsistencyCheck, limits, authz)))
 
-		r.Post(*metricsPath+"/job"+suffix+"/:job/*labels", handler.Push(ms, isBase64, *skipConsistencyCheck, false))
-		r.Put(*metricsPath+"/job"+suffix+"/:job/*labels", handler.Push(ms, isBase64, *skipConsistencyCheck, true))
-		r.Del(*metricsPath+"/job"+suffix+"/:job/*labels", handler.Delete(ms, isBase64))
+		// OpenTelemetry metric exports over OTLP/HTTP.
+		r.Post(prefix+"/v1/metrics", push(handler.OTLP(ms, *skipConsistencyCheck, limits, authz)))
+	}
+	r.Get("/ping", handler.InfluxPing())
+
+	// admin API, working on the storage of the tenant as well.
+	admin := func(h http.HandlerFunc) http.HandlerFunc {
+		return auth.Protect(web.RouteAdmin, tenancy.Handle(handler.WithLimits(state.Limits, h)))
+	}
+	r.Post("/api/v1/admin/delete", admin(handler.AdminDelete(ms)))
+	r.Post("/api/v1/admin/wipe", admin(handler.AdminWipe(ms)))
+	r.Get("/api/v1/admin/snapshot", admin(handler.AdminSnapshot(ms)))
+	r.Post("/api/v1/admin/snapshot", admin(handler.AdminRestore(ms, limits)))
+	r.Post("/-/reload", auth.Protect(web.RouteAdmin, reloader.Handler()))
+
+	// the cluster endpoints only accept the token or the client
+	// certificates of the instances. Without a token, the route
+	// auth restricts which certificates those are.
+	clusterRoute := func(h http.HandlerFunc) http.HandlerFunc {
+		if clusterToken != "" {
+			return h
+		}
+		return auth.Protect(web.RouteCluster, h)
+	}
+	// replication between the peers of a cluster.
+	if replicator != nil {
+		r.Post(cluster.ReplicatePath, clusterRoute(replicator.ReplicateHandler()))
+		r.Get(cluster.SnapshotPath, clusterRoute(replicator.SnapshotHandler()))
+	}
+	if sharder != nil {
+		r.Post(cluster.ForwardPath, clusterRoute(sharder.ForwardHandler()))
+		if g := sharder.Gossip(); g != nil {
+			r.Post(cluster.GossipPath, clusterRoute(g.Handler()))
+			r.Post(cluster.GossipProbePath, clusterRoute(g.ProbeHandler()))
+		}
+		r.Get("/api/v1/cluster", auth.Protect(web.RouteAdmin, handler.Cluster(sharder)))
+	}
 
-		r.Post(*metricsPath+"/job"+suffix+"/:job", handler.Push(ms, isBase64, *skipConsistencyCheck,false))
-		r.Put(*metricsPath+"/job"+suffix+"/:job", handler.Push(ms, isBase64, *skipConsistencyCheck,true))
-		r.Del(*metricsPath+"/job"+suffix+"/:job", handler.Delete(ms, isBase64))
+	// create gatherer to serve /metrics page. The metrics of thor
+	// itself are served separately, so that pushed families can
+	// not collide with them.
+	g := prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) { return ms.GetMetricFamilies(), nil })
+	if tenancy != nil && *tenantLabel != "" {
+		// the metrics of all tenants, distinguished by their label.
+		g = func() ([]*dto.MetricFamily, error) {
+			return tenancy.Tenants.GetAllMetricFamilies(ms, *tenantLabel), nil
+		}
+	}
+	r.Get(*metricsPath, auth.Protect(web.RouteScrape, handler.Metrics(g, promhttp.HandlerOpts{})))
+	r.Get(*telemetryPath, auth.Protect(web.RouteScrape, handler.Metrics(prometheus.DefaultGatherer, promhttp.HandlerOpts{})))
+	if tenancy != nil {
+		r.Get("/tenants/:tenant"+*metricsPath, auth.Protect(web.RouteScrape, tenancy.Metrics(promhttp.HandlerOpts{})))
 	}
 
-	// create gatherer to serve /metrics page
-	g := prometheus.Gatherers{
-		prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) { return ms.GetMetricFamilies(), nil }),
+	// the groups as targets for the Prometheus HTTP service
+	// discovery, the stream of their changes and queries.
+	for _, prefix := range prefixes {
+		r.Get(prefix+"/api/v1/sd", scrape(handler.ServiceDiscovery(ms, *metricsPath)))
+		r.Get(prefix+"/api/v1/events", scrape(handler.Events(ms)))
+		r.Get(prefix+"/api/v1/query", scrape(handler.Query(ms)))
+		r.Post(prefix+"/api/v1/query", scrape(handler.Query(ms)))
 	}
-	r.Get(*metricsPath, promhttp.HandlerFor(g, promhttp.HandlerOpts{}).ServeHTTP)
 
 	mux := http.NewServeMux()
 	mux.Handle("/", r)
 
 	server := &http.Server{
-		Addr:    *listenAddress,
-		Handler: mux,
+		Handler:      mux,
+		ReadTimeout:  *readTimeout,
+		WriteTimeout: *writeTimeout,
+		IdleTimeout:  *idleTimeout,
+	}
+	// the TLS config is not reloaded, but the listeners are.
+	if listeners, err = web.NewListeners(server, initialConfig.Auth); err != nil {
+		slog.Fatal("could not configure tls: ", err)
 	}
-	err := server.ListenAndServe()
+	if err := listeners.Update(initialConfig.Listeners); err != nil {
+		slog.Fatal("could not listen: ", err)
+	}
+	// signals are only handled now, so that the
+	// listeners are not updated concurrently.
+	reloader.WatchSignals(hup)
+	err = listeners.Wait()
 	slog.Error("http server stopped: ", err)
 }
+
+// expireGroups periodically deletes the groups of the storage and of the
+// tenants, which may be nil, which have not been pushed to within the ttl.
+// The ttl is read on every run, so that it can be reloaded. 0 disables it.
+func expireGroups(ms *storage.MetricStorage, tenants *storage.Tenants, ttl func() time.Duration) {
+	for {
+		// a reloaded ttl is applied within a minute.
+		interval := ttl() / 10
+		if interval < time.Second {
+			interval = time.Second
+		} else if interval > time.Minute {
+			interval = time.Minute
+		}
+		time.Sleep(interval)
+
+		current := ttl()
+		if current <= 0 {
+			continue
+		}
+		n := len(ms.Expire(current))
+		if tenants != nil {
+			for _, id := range tenants.IDs() {
+				if tms, ok := tenants.Lookup(id); ok {
+					n += len(tms.Expire(current))
+				}
+			}
+		}
+		if n > 0 {
+			slog.Debug(fmt.Sprintf("expired %d groups", n))
+		}
+	}
+}
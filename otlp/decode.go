@@ -0,0 +1,531 @@
+package otlp
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"google.golang.org/protobuf/encoding/protowire"
+	"math"
+	"strconv"
+)
+
+// The messages below are a subset of the OTLP metrics protocol,
+// only containing the fields we need for the translation. Every
+// other field is skipped while decoding.
+//
+// Source: https://github.com/open-telemetry/opentelemetry-proto/blob/main/opentelemetry/proto/metrics/v1/metrics.proto
+
+type metricType int
+
+const (
+	typeUnknown metricType = iota
+	typeGauge
+	typeSum
+	typeHistogram
+	typeExponentialHistogram
+	typeSummary
+)
+
+type temporality uint64
+
+const (
+	temporalityUnspecified temporality = 0
+	temporalityDelta       temporality = 1
+	temporalityCumulative  temporality = 2
+)
+
+const (
+	// Data point flag marking a point without a recorded
+	// value, e.g. because the series became stale.
+	flagNoRecordedValue = 1
+)
+
+type attribute struct {
+	key   string
+	value string
+}
+
+type resourceMetrics struct {
+	resource     []attribute
+	scopeMetrics []scopeMetrics
+}
+
+type scopeMetrics struct {
+	scopeName    string
+	scopeVersion string
+	metrics      []metric
+}
+
+type metric struct {
+	name        string
+	description string
+	unit        string
+	typ         metricType
+	temporality temporality
+	monotonic   bool
+
+	numberPoints               []numberDataPoint
+	histogramPoints            []histogramDataPoint
+	exponentialHistogramPoints []exponentialHistogramDataPoint
+	summaryPoints              []summaryDataPoint
+}
+
+type numberDataPoint struct {
+	attributes []attribute
+	value      float64
+	flags      uint64
+}
+
+type histogramDataPoint struct {
+	attributes     []attribute
+	count          uint64
+	sum            float64
+	bucketCounts   []uint64
+	explicitBounds []float64
+	flags          uint64
+}
+
+type exponentialHistogramDataPoint struct {
+	attributes    []attribute
+	count         uint64
+	sum           float64
+	scale         int32
+	zeroCount     uint64
+	zeroThreshold float64
+	positive      buckets
+	negative      buckets
+	flags         uint64
+}
+
+type buckets struct {
+	offset int32
+	counts []uint64
+}
+
+type summaryDataPoint struct {
+	attributes []attribute
+	count      uint64
+	sum        float64
+	quantiles  []quantile
+	flags      uint64
+}
+
+type quantile struct {
+	quantile float64
+	value    float64
+}
+
+// A field is a single decoded field of a protobuf message.
+// Scalars are stored in num, length-delimited values in bytes.
+type field struct {
+	number protowire.Number
+	typ    protowire.Type
+	num    uint64
+	bytes  []byte
+}
+
+func (f field) double() float64 {
+	return math.Float64frombits(f.num)
+}
+
+func (f field) string() string {
+	return string(f.bytes)
+}
+
+// forEachField calls fn for every field of the encoded message.
+func forEachField(b []byte, fn func(f field) error) error {
+	for len(b) > 0 {
+		number, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+
+		f := field{number: number, typ: typ}
+		switch typ {
+		case protowire.VarintType:
+			f.num, n = protowire.ConsumeVarint(b)
+		case protowire.Fixed64Type:
+			f.num, n = protowire.ConsumeFixed64(b)
+		case protowire.Fixed32Type:
+			var v uint32
+			v, n = protowire.ConsumeFixed32(b)
+			f.num = uint64(v)
+		case protowire.BytesType:
+			f.bytes, n = protowire.ConsumeBytes(b)
+		default:
+			n = protowire.ConsumeFieldValue(number, typ, b)
+		}
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+
+		if err := fn(f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// repeatedFixed64 decodes a repeated fixed64 (or double) field,
+// which can either be packed or not.
+func repeatedFixed64(f field, values []uint64) ([]uint64, error) {
+	if f.typ != protowire.BytesType {
+		return append(values, f.num), nil
+	}
+	b := f.bytes
+	for len(b) > 0 {
+		v, n := protowire.ConsumeFixed64(b)
+		if n < 0 {
+			return nil, protowire.ParseError(n)
+		}
+		values = append(values, v)
+		b = b[n:]
+	}
+	return values, nil
+}
+
+// repeatedVarint decodes a repeated varint field,
+// which can either be packed or not.
+func repeatedVarint(f field, values []uint64) ([]uint64, error) {
+	if f.typ != protowire.BytesType {
+		return append(values, f.num), nil
+	}
+	b := f.bytes
+	for len(b) > 0 {
+		v, n := protowire.ConsumeVarint(b)
+		if n < 0 {
+			return nil, protowire.ParseError(n)
+		}
+		values = append(values, v)
+		b = b[n:]
+	}
+	return values, nil
+}
+
+// decodeRequest decodes an ExportMetricsServiceRequest.
+func decodeRequest(b []byte) ([]resourceMetrics, error) {
+	var result []resourceMetrics
+	err := forEachField(b, func(f field) error {
+		if f.number != 1 {
+			return nil
+		}
+		rm, err := decodeResourceMetrics(f.bytes)
+		if err != nil {
+			return err
+		}
+		result = append(result, rm)
+		return nil
+	})
+	return result, err
+}
+
+func decodeResourceMetrics(b []byte) (resourceMetrics, error) {
+	var rm resourceMetrics
+	err := forEachField(b, func(f field) error {
+		switch f.number {
+		case 1: // resource
+			return forEachField(f.bytes, func(f field) error {
+				if f.number != 1 {
+					return nil
+				}
+				attr, err := decodeAttribute(f.bytes)
+				rm.resource = append(rm.resource, attr)
+				return err
+			})
+		case 2: // scope_metrics
+			sm, err := decodeScopeMetrics(f.bytes)
+			rm.scopeMetrics = append(rm.scopeMetrics, sm)
+			return err
+		}
+		return nil
+	})
+	return rm, err
+}
+
+func decodeScopeMetrics(b []byte) (scopeMetrics, error) {
+	var sm scopeMetrics
+	err := forEachField(b, func(f field) error {
+		switch f.number {
+		case 1: // scope
+			return forEachField(f.bytes, func(f field) error {
+				switch f.number {
+				case 1:
+					sm.scopeName = f.string()
+				case 2:
+					sm.scopeVersion = f.string()
+				}
+				return nil
+			})
+		case 2: // metrics
+			m, err := decodeMetric(f.bytes)
+			sm.metrics = append(sm.metrics, m)
+			return err
+		}
+		return nil
+	})
+	return sm, err
+}
+
+func decodeMetric(b []byte) (metric, error) {
+	var m metric
+	err := forEachField(b, func(f field) error {
+		switch f.number {
+		case 1:
+			m.name = f.string()
+		case 2:
+			m.description = f.string()
+		case 3:
+			m.unit = f.string()
+		case 5:
+			m.typ = typeGauge
+			return decodeData(f.bytes, &m)
+		case 7:
+			m.typ = typeSum
+			return decodeData(f.bytes, &m)
+		case 9:
+			m.typ = typeHistogram
+			return decodeData(f.bytes, &m)
+		case 10:
+			m.typ = typeExponentialHistogram
+			return decodeData(f.bytes, &m)
+		case 11:
+			m.typ = typeSummary
+			return decodeData(f.bytes, &m)
+		}
+		return nil
+	})
+	if err != nil {
+		return m, fmt.Errorf("invalid metric %q: %v", m.name, err)
+	}
+	return m, nil
+}
+
+// decodeData decodes the Gauge, Sum, Histogram, ExponentialHistogram
+// or Summary message, depending on the type of the metric.
+func decodeData(b []byte, m *metric) error {
+	return forEachField(b, func(f field) error {
+		switch {
+		case f.number == 1:
+			return decodeDataPoint(f.bytes, m)
+		case f.number == 2 && m.typ != typeGauge && m.typ != typeSummary:
+			m.temporality = temporality(f.num)
+		case f.number == 3 && m.typ == typeSum:
+			m.monotonic = protowire.DecodeBool(f.num)
+		}
+		return nil
+	})
+}
+
+func decodeDataPoint(b []byte, m *metric) error {
+	switch m.typ {
+	case typeGauge, typeSum:
+		var dp numberDataPoint
+		err := forEachField(b, func(f field) (err error) {
+			switch f.number {
+			case 4: // as_double
+				dp.value = f.double()
+			case 6: // as_int
+				dp.value = float64(int64(f.num))
+			case 7:
+				var attr attribute
+				attr, err = decodeAttribute(f.bytes)
+				dp.attributes = append(dp.attributes, attr)
+			case 8:
+				dp.flags = f.num
+			}
+			return err
+		})
+		m.numberPoints = append(m.numberPoints, dp)
+		return err
+	case typeHistogram:
+		var dp histogramDataPoint
+		var bounds []uint64
+		err := forEachField(b, func(f field) (err error) {
+			switch f.number {
+			case 4:
+				dp.count = f.num
+			case 5:
+				dp.sum = f.double()
+			case 6:
+				dp.bucketCounts, err = repeatedFixed64(f, dp.bucketCounts)
+			case 7:
+				bounds, err = repeatedFixed64(f, bounds)
+			case 9:
+				var attr attribute
+				attr, err = decodeAttribute(f.bytes)
+				dp.attributes = append(dp.attributes, attr)
+			case 10:
+				dp.flags = f.num
+			}
+			return err
+		})
+		for _, bound := range bounds {
+			dp.explicitBounds = append(dp.explicitBounds, math.Float64frombits(bound))
+		}
+		m.histogramPoints = append(m.histogramPoints, dp)
+		return err
+	case typeExponentialHistogram:
+		var dp exponentialHistogramDataPoint
+		err := forEachField(b, func(f field) (err error) {
+			switch f.number {
+			case 1:
+				var attr attribute
+				attr, err = decodeAttribute(f.bytes)
+				dp.attributes = append(dp.attributes, attr)
+			case 4:
+				dp.count = f.num
+			case 5:
+				dp.sum = f.double()
+			case 6:
+				dp.scale = int32(protowire.DecodeZigZag(f.num))
+			case 7:
+				dp.zeroCount = f.num
+			case 8:
+				dp.positive, err = decodeBuckets(f.bytes)
+			case 9:
+				dp.negative, err = decodeBuckets(f.bytes)
+			case 10:
+				dp.flags = f.num
+			case 14:
+				dp.zeroThreshold = f.double()
+			}
+			return err
+		})
+		m.exponentialHistogramPoints = append(m.exponentialHistogramPoints, dp)
+		return err
+	case typeSummary:
+		var dp summaryDataPoint
+		err := forEachField(b, func(f field) (err error) {
+			switch f.number {
+			case 4:
+				dp.count = f.num
+			case 5:
+				dp.sum = f.double()
+			case 6:
+				var q quantile
+				err = forEachField(f.bytes, func(f field) error {
+					switch f.number {
+					case 1:
+						q.quantile = f.double()
+					case 2:
+						q.value = f.double()
+					}
+					return nil
+				})
+				dp.quantiles = append(dp.quantiles, q)
+			case 7:
+				var attr attribute
+				attr, err = decodeAttribute(f.bytes)
+				dp.attributes = append(dp.attributes, attr)
+			case 8:
+				dp.flags = f.num
+			}
+			return err
+		})
+		m.summaryPoints = append(m.summaryPoints, dp)
+		return err
+	}
+	return nil
+}
+
+func decodeBuckets(b []byte) (buckets, error) {
+	var result buckets
+	err := forEachField(b, func(f field) (err error) {
+		switch f.number {
+		case 1:
+			result.offset = int32(protowire.DecodeZigZag(f.num))
+		case 2:
+			result.counts, err = repeatedVarint(f, result.counts)
+		}
+		return err
+	})
+	return result, err
+}
+
+// decodeAttribute decodes a KeyValue, whose value is
+// converted into a string. Non-string values are
+// rendered as JSON.
+func decodeAttribute(b []byte) (attribute, error) {
+	var attr attribute
+	err := forEachField(b, func(f field) error {
+		switch f.number {
+		case 1:
+			attr.key = f.string()
+		case 2:
+			v, err := decodeAnyValue(f.bytes)
+			if err != nil {
+				return err
+			}
+			if s, ok := v.(string); ok {
+				attr.value = s
+				return nil
+			}
+			j, err := json.Marshal(v)
+			attr.value = string(j)
+			return err
+		}
+		return nil
+	})
+	return attr, err
+}
+
+func decodeAnyValue(b []byte) (interface{}, error) {
+	var result interface{}
+	err := forEachField(b, func(f field) error {
+		switch f.number {
+		case 1:
+			result = f.string()
+		case 2:
+			result = protowire.DecodeBool(f.num)
+		case 3:
+			result = int64(f.num)
+		case 4:
+			result = strconv.FormatFloat(f.double(), 'g', -1, 64)
+		case 5: // array_value
+			values := []interface{}{}
+			err := forEachField(f.bytes, func(f field) error {
+				v, err := decodeAnyValue(f.bytes)
+				values = append(values, v)
+				return err
+			})
+			result = values
+			return err
+		case 6: // kvlist_value
+			values := map[string]interface{}{}
+			err := forEachField(f.bytes, func(f field) error {
+				var key string
+				var value interface{}
+				err := forEachField(f.bytes, func(f field) (err error) {
+					switch f.number {
+					case 1:
+						key = f.string()
+					case 2:
+						value, err = decodeAnyValue(f.bytes)
+					}
+					return err
+				})
+				values[key] = value
+				return err
+			})
+			result = values
+			return err
+		case 7:
+			result = base64.StdEncoding.EncodeToString(f.bytes)
+		}
+		return nil
+	})
+	return result, err
+}
+
+// EncodeStatus encodes a google.rpc.Status message, which is
+// the body of failed OTLP/HTTP responses.
+func EncodeStatus(code int32, message string) []byte {
+	var b []byte
+	b = protowire.AppendTag(b, 1, protowire.VarintType)
+	b = protowire.AppendVarint(b, uint64(code))
+	b = protowire.AppendTag(b, 2, protowire.BytesType)
+	b = protowire.AppendString(b, message)
+	return b
+}
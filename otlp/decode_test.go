@@ -0,0 +1,356 @@
+package otlp
+
+import (
+	"fmt"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// The OTLP metrics protocol, copied from the official proto files
+// of opentelemetry-proto v1.0.0, without the oneofs and comments.
+// The messages are encoded with the official protobuf encoder,
+// to check the decoder against real messages.
+var otlpMessages = map[string]string{
+	"ExportMetricsServiceRequest": "repeated ResourceMetrics resource_metrics = 1;",
+	"ResourceMetrics":             "Resource resource = 1; repeated ScopeMetrics scope_metrics = 2; string schema_url = 3;",
+	"Resource":                    "repeated KeyValue attributes = 1; uint32 dropped_attributes_count = 2;",
+	"ScopeMetrics":                "InstrumentationScope scope = 1; repeated Metric metrics = 2; string schema_url = 3;",
+	"InstrumentationScope":        "string name = 1; string version = 2; repeated KeyValue attributes = 3; uint32 dropped_attributes_count = 4;",
+	"KeyValue":                    "string key = 1; AnyValue value = 2;",
+	"AnyValue": "string string_value = 1; bool bool_value = 2; int64 int_value = 3; double double_value = 4; " +
+		"ArrayValue array_value = 5; KeyValueList kvlist_value = 6; bytes bytes_value = 7;",
+	"ArrayValue":   "repeated AnyValue values = 1;",
+	"KeyValueList": "repeated KeyValue values = 1;",
+	"Metric": "string name = 1; string description = 2; string unit = 3; Gauge gauge = 5; Sum sum = 7; " +
+		"Histogram histogram = 9; ExponentialHistogram exponential_histogram = 10; Summary summary = 11; " +
+		"repeated KeyValue metadata = 12;",
+	"Gauge": "repeated NumberDataPoint data_points = 1;",
+	"Sum": "repeated NumberDataPoint data_points = 1; AggregationTemporality aggregation_temporality = 2; " +
+		"bool is_monotonic = 3;",
+	"Histogram":            "repeated HistogramDataPoint data_points = 1; AggregationTemporality aggregation_temporality = 2;",
+	"ExponentialHistogram": "repeated ExponentialHistogramDataPoint data_points = 1; AggregationTemporality aggregation_temporality = 2;",
+	"Summary":              "repeated SummaryDataPoint data_points = 1;",
+	"NumberDataPoint": "repeated KeyValue attributes = 7; fixed64 start_time_unix_nano = 2; fixed64 time_unix_nano = 3; " +
+		"double as_double = 4; sfixed64 as_int = 6; repeated Exemplar exemplars = 5; uint32 flags = 8;",
+	"HistogramDataPoint": "repeated KeyValue attributes = 9; fixed64 start_time_unix_nano = 2; fixed64 time_unix_nano = 3; " +
+		"fixed64 count = 4; double sum = 5; repeated fixed64 bucket_counts = 6; repeated double explicit_bounds = 7; " +
+		"repeated Exemplar exemplars = 8; uint32 flags = 10; double min = 11; double max = 12;",
+	"ExponentialHistogramDataPoint": "repeated KeyValue attributes = 1; fixed64 start_time_unix_nano = 2; " +
+		"fixed64 time_unix_nano = 3; fixed64 count = 4; double sum = 5; sint32 scale = 6; fixed64 zero_count = 7; " +
+		"Buckets positive = 8; Buckets negative = 9; uint32 flags = 10; repeated Exemplar exemplars = 11; " +
+		"double min = 12; double max = 13; double zero_threshold = 14;",
+	"Buckets": "sint32 offset = 1; repeated uint64 bucket_counts = 2;",
+	"SummaryDataPoint": "repeated KeyValue attributes = 7; fixed64 start_time_unix_nano = 2; fixed64 time_unix_nano = 3; " +
+		"fixed64 count = 4; double sum = 5; repeated ValueAtQuantile quantile_values = 6; uint32 flags = 8;",
+	"ValueAtQuantile": "double quantile = 1; double value = 2;",
+	"Exemplar": "repeated KeyValue filtered_attributes = 7; fixed64 time_unix_nano = 2; double as_double = 3; " +
+		"sfixed64 as_int = 6; bytes span_id = 4; bytes trace_id = 5;",
+}
+
+var scalarTypes = map[string]descriptorpb.FieldDescriptorProto_Type{
+	"string":   descriptorpb.FieldDescriptorProto_TYPE_STRING,
+	"bytes":    descriptorpb.FieldDescriptorProto_TYPE_BYTES,
+	"bool":     descriptorpb.FieldDescriptorProto_TYPE_BOOL,
+	"int64":    descriptorpb.FieldDescriptorProto_TYPE_INT64,
+	"uint32":   descriptorpb.FieldDescriptorProto_TYPE_UINT32,
+	"uint64":   descriptorpb.FieldDescriptorProto_TYPE_UINT64,
+	"sint32":   descriptorpb.FieldDescriptorProto_TYPE_SINT32,
+	"double":   descriptorpb.FieldDescriptorProto_TYPE_DOUBLE,
+	"fixed64":  descriptorpb.FieldDescriptorProto_TYPE_FIXED64,
+	"sfixed64": descriptorpb.FieldDescriptorProto_TYPE_SFIXED64,
+}
+
+// otlpRequestType builds the descriptor of the ExportMetricsServiceRequest.
+// If packed is false, repeated scalars are encoded unpacked, as
+// proto2 encoders and some hand-written exporters do.
+func otlpRequestType(t testing.TB, packed bool) protoreflect.MessageType {
+	file := &descriptorpb.FileDescriptorProto{
+		Name:    proto.String(fmt.Sprintf("otlp_packed_%v.proto", packed)),
+		Package: proto.String("otlp"),
+		Syntax:  proto.String("proto3"),
+		EnumType: []*descriptorpb.EnumDescriptorProto{{
+			Name: proto.String("AggregationTemporality"),
+			Value: []*descriptorpb.EnumValueDescriptorProto{
+				{Name: proto.String("AGGREGATION_TEMPORALITY_UNSPECIFIED"), Number: proto.Int32(0)},
+				{Name: proto.String("AGGREGATION_TEMPORALITY_DELTA"), Number: proto.Int32(1)},
+				{Name: proto.String("AGGREGATION_TEMPORALITY_CUMULATIVE"), Number: proto.Int32(2)},
+			},
+		}},
+	}
+	for name, fields := range otlpMessages {
+		message := &descriptorpb.DescriptorProto{Name: proto.String(name)}
+		for _, f := range strings.Split(strings.TrimSuffix(fields, ";"), ";") {
+			parts := strings.Fields(f)
+			label := descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL.Enum()
+			if parts[0] == "repeated" {
+				label = descriptorpb.FieldDescriptorProto_LABEL_REPEATED.Enum()
+				parts = parts[1:]
+			}
+			number, err := strconv.Atoi(parts[3])
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			field := &descriptorpb.FieldDescriptorProto{
+				Name:   proto.String(parts[1]),
+				Number: proto.Int32(int32(number)),
+				Label:  label,
+			}
+			switch typ, ok := scalarTypes[parts[0]]; {
+			case ok:
+				field.Type = typ.Enum()
+				if *label == descriptorpb.FieldDescriptorProto_LABEL_REPEATED && !packed {
+					field.Options = &descriptorpb.FieldOptions{Packed: proto.Bool(false)}
+				}
+			case parts[0] == "AggregationTemporality":
+				field.Type = descriptorpb.FieldDescriptorProto_TYPE_ENUM.Enum()
+				field.TypeName = proto.String(".otlp." + parts[0])
+			default:
+				field.Type = descriptorpb.FieldDescriptorProto_TYPE_MESSAGE.Enum()
+				field.TypeName = proto.String(".otlp." + parts[0])
+			}
+			message.Field = append(message.Field, field)
+		}
+		file.MessageType = append(file.MessageType, message)
+	}
+
+	fd, err := protodesc.NewFile(file, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dynamicpb.NewMessageType(fd.Messages().ByName("ExportMetricsServiceRequest"))
+}
+
+// encodeRequest encodes the request given in the JSON encoding of OTLP.
+func encodeRequest(t testing.TB, packed bool, request string) []byte {
+	m := otlpRequestType(t, packed).New().Interface()
+	if err := protojson.Unmarshal([]byte(request), m); err != nil {
+		t.Fatal(err)
+	}
+	b, err := proto.Marshal(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// A request using every field of the protocol, including
+// the ones which are skipped by the decoder.
+const roundTripRequest = `{
+  "resourceMetrics": [{
+    "resource": {
+      "attributes": [
+        {"key": "service.name", "value": {"stringValue": "lobby"}},
+        {"key": "slots", "value": {"intValue": "-64"}},
+        {"key": "ratio", "value": {"doubleValue": 0.5}},
+        {"key": "public", "value": {"boolValue": true}},
+        {"key": "maps", "value": {"arrayValue": {"values": [{"stringValue": "castle"}, {"intValue": "2"}]}}},
+        {"key": "owner", "value": {"kvlistValue": {"values": [{"key": "team", "value": {"stringValue": "ops"}}]}}},
+        {"key": "id", "value": {"bytesValue": "AQI="}}
+      ],
+      "droppedAttributesCount": 3
+    },
+    "scopeMetrics": [{
+      "scope": {"name": "game", "version": "1.0", "attributes": [{"key": "x", "value": {"stringValue": "y"}}]},
+      "metrics": [
+        {
+          "name": "arena.joins", "description": "Joins.", "unit": "{joins}",
+          "metadata": [{"key": "m", "value": {"stringValue": "n"}}],
+          "sum": {
+            "dataPoints": [{
+              "attributes": [{"key": "arena", "value": {"stringValue": "castle"}}],
+              "startTimeUnixNano": "1", "timeUnixNano": "2", "asInt": "-7", "flags": 1,
+              "exemplars": [{
+                "filteredAttributes": [{"key": "user", "value": {"stringValue": "steve"}}],
+                "timeUnixNano": "2", "asDouble": 1.5, "spanId": "AQIDBAUGBwg=", "traceId": "AQIDBAUGBwgJCgsMDQ4PEA=="
+              }]
+            }],
+            "aggregationTemporality": "AGGREGATION_TEMPORALITY_DELTA",
+            "isMonotonic": true
+          }
+        },
+        {
+          "name": "players",
+          "gauge": {"dataPoints": [{"asDouble": 17.5, "exemplars": [{"asInt": "3"}]}]}
+        },
+        {
+          "name": "tick.duration", "unit": "ms",
+          "histogram": {
+            "dataPoints": [{
+              "count": "6", "sum": 120, "bucketCounts": ["1", "2", "3"], "explicitBounds": [10, 50],
+              "exemplars": [{"asDouble": 12}], "min": 1, "max": 80
+            }],
+            "aggregationTemporality": "AGGREGATION_TEMPORALITY_CUMULATIVE"
+          }
+        },
+        {
+          "name": "latency",
+          "exponentialHistogram": {
+            "dataPoints": [{
+              "attributes": [{"key": "region", "value": {"stringValue": "eu"}}],
+              "count": "4", "sum": 10, "scale": -2, "zeroCount": "1", "zeroThreshold": 0.001,
+              "positive": {"offset": -1, "bucketCounts": ["2", "300"]},
+              "negative": {"offset": 5, "bucketCounts": ["1"]},
+              "exemplars": [{"asDouble": 3}], "min": 0, "max": 9
+            }],
+            "aggregationTemporality": "AGGREGATION_TEMPORALITY_CUMULATIVE"
+          }
+        },
+        {
+          "name": "rpc.duration",
+          "summary": {
+            "dataPoints": [{
+              "attributes": [{"key": "method", "value": {"stringValue": "join"}}],
+              "count": "3", "sum": 1.5,
+              "quantileValues": [{"quantile": 0.5, "value": 0.25}, {"quantile": 0.99, "value": 1}]
+            }]
+          }
+        }
+      ],
+      "schemaUrl": "https://opentelemetry.io/schemas/1.21.0"
+    }],
+    "schemaUrl": "https://opentelemetry.io/schemas/1.21.0"
+  }]
+}`
+
+func TestDecodeRoundTrip(t *testing.T) {
+	expected := []resourceMetrics{{
+		resource: []attribute{
+			{key: "service.name", value: "lobby"},
+			{key: "slots", value: "-64"},
+			{key: "ratio", value: "0.5"},
+			{key: "public", value: "true"},
+			{key: "maps", value: `["castle",2]`},
+			{key: "owner", value: `{"team":"ops"}`},
+			{key: "id", value: "AQI="},
+		},
+		scopeMetrics: []scopeMetrics{{
+			scopeName:    "game",
+			scopeVersion: "1.0",
+			metrics: []metric{
+				{
+					name: "arena.joins", description: "Joins.", unit: "{joins}",
+					typ: typeSum, temporality: temporalityDelta, monotonic: true,
+					numberPoints: []numberDataPoint{{
+						attributes: []attribute{{key: "arena", value: "castle"}},
+						value:      -7,
+						flags:      1,
+					}},
+				},
+				{
+					name: "players", typ: typeGauge,
+					numberPoints: []numberDataPoint{{value: 17.5}},
+				},
+				{
+					name: "tick.duration", unit: "ms",
+					typ: typeHistogram, temporality: temporalityCumulative,
+					histogramPoints: []histogramDataPoint{{
+						count: 6, sum: 120, bucketCounts: []uint64{1, 2, 3}, explicitBounds: []float64{10, 50},
+					}},
+				},
+				{
+					name: "latency",
+					typ:  typeExponentialHistogram, temporality: temporalityCumulative,
+					exponentialHistogramPoints: []exponentialHistogramDataPoint{{
+						attributes: []attribute{{key: "region", value: "eu"}},
+						count:      4, sum: 10, scale: -2, zeroCount: 1, zeroThreshold: 0.001,
+						positive: buckets{offset: -1, counts: []uint64{2, 300}},
+						negative: buckets{offset: 5, counts: []uint64{1}},
+					}},
+				},
+				{
+					name: "rpc.duration",
+					typ:  typeSummary,
+					summaryPoints: []summaryDataPoint{{
+						attributes: []attribute{{key: "method", value: "join"}},
+						count:      3, sum: 1.5,
+						quantiles: []quantile{{quantile: 0.5, value: 0.25}, {quantile: 0.99, value: 1}},
+					}},
+				},
+			},
+		}},
+	}}
+
+	for _, packed := range []bool{true, false} {
+		result, err := decodeRequest(encodeRequest(t, packed, roundTripRequest))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(result, expected) {
+			t.Errorf("wrong result for packed %v, got: %+v, expected: %+v", packed, result, expected)
+		}
+	}
+}
+
+func TestDecodeUnknownFields(t *testing.T) {
+	request := encodeRequest(t, true, roundTripRequest)
+	expected, err := decodeRequest(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// fields of a newer protocol version, with every wire type.
+	var unknown []byte
+	unknown = protowire.AppendTag(unknown, 100, protowire.VarintType)
+	unknown = protowire.AppendVarint(unknown, 1<<40)
+	unknown = protowire.AppendTag(unknown, 101, protowire.Fixed32Type)
+	unknown = protowire.AppendFixed32(unknown, 7)
+	unknown = protowire.AppendTag(unknown, 102, protowire.Fixed64Type)
+	unknown = protowire.AppendFixed64(unknown, 7)
+	unknown = protowire.AppendTag(unknown, 103, protowire.BytesType)
+	unknown = protowire.AppendString(unknown, "new")
+	unknown = protowire.AppendTag(unknown, 104, protowire.StartGroupType)
+	unknown = protowire.AppendTag(unknown, 1, protowire.VarintType)
+	unknown = protowire.AppendVarint(unknown, 1)
+	unknown = protowire.AppendTag(unknown, 104, protowire.EndGroupType)
+
+	result, err := decodeRequest(append(unknown, append(request, unknown...)...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(result, expected) {
+		t.Errorf("unknown fields changed the result, got: %+v, expected: %+v", result, expected)
+	}
+}
+
+func TestDecodeMalformed(t *testing.T) {
+	request := encodeRequest(t, true, roundTripRequest)
+
+	tests := map[string][]byte{
+		"truncated varint":     {0x08, 0xff},
+		"overlong varint":      {0x08, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01},
+		"truncated tag":        {0xff},
+		"field number zero":    {0x00, 0x01},
+		"invalid wire type":    {0x0f},
+		"truncated length":     {0x0a, 0x05, 0x01},
+		"unterminated group":   {0x0b, 0x08, 0x01},
+		"truncated fixed64":    {0x11, 0x01, 0x02},
+		"truncated request":    request[:len(request)-1],
+		"packed bucket counts": message(1, message(2, message(2, message(9, message(1, message(6, []byte{0x01, 0x02})))))),
+		"packed varints":       message(1, message(2, message(2, message(10, message(1, message(8, message(2, []byte{0x80}))))))),
+	}
+	for name, b := range tests {
+		if _, err := decodeRequest(b); err == nil {
+			t.Errorf("expected %s to fail, but it did not.", name)
+		}
+	}
+}
+
+func FuzzTranslate(f *testing.F) {
+	f.Add(testRequest())
+	f.Add(encodeRequest(f, true, roundTripRequest))
+	f.Add(encodeRequest(f, false, roundTripRequest))
+	f.Fuzz(func(t *testing.T, b []byte) {
+		// must neither panic nor hang.
+		_, _ = Translate(b)
+	})
+}
@@ -0,0 +1,189 @@
+package otlp
+
+import (
+	"google.golang.org/protobuf/encoding/protowire"
+	"math"
+	"testing"
+)
+
+// helpers to encode the OTLP messages for the tests.
+
+func message(num protowire.Number, fields ...[]byte) []byte {
+	var content []byte
+	for _, f := range fields {
+		content = append(content, f...)
+	}
+	b := protowire.AppendTag(nil, num, protowire.BytesType)
+	return protowire.AppendBytes(b, content)
+}
+
+func stringField(num protowire.Number, s string) []byte {
+	b := protowire.AppendTag(nil, num, protowire.BytesType)
+	return protowire.AppendString(b, s)
+}
+
+func varintField(num protowire.Number, v uint64) []byte {
+	b := protowire.AppendTag(nil, num, protowire.VarintType)
+	return protowire.AppendVarint(b, v)
+}
+
+func fixed64Field(num protowire.Number, v uint64) []byte {
+	b := protowire.AppendTag(nil, num, protowire.Fixed64Type)
+	return protowire.AppendFixed64(b, v)
+}
+
+func doubleField(num protowire.Number, v float64) []byte {
+	return fixed64Field(num, math.Float64bits(v))
+}
+
+func keyValue(num protowire.Number, key, value string) []byte {
+	return message(num, stringField(1, key), message(2, stringField(1, value)))
+}
+
+func testRequest() []byte {
+	resource := message(1,
+		keyValue(1, "service.name", "lobby"),
+		keyValue(1, "service.instance.id", "lobby-17"),
+		keyValue(1, "deployment.environment", "prod"),
+	)
+
+	cumulativeSum := message(2,
+		stringField(1, "arena.joins"),
+		stringField(3, "{joins}"),
+		message(7,
+			message(1, keyValue(7, "arena", "castle"), doubleField(4, 42)),
+			varintField(2, uint64(temporalityCumulative)),
+			varintField(3, 1),
+		),
+	)
+	deltaSum := message(2,
+		stringField(1, "chat.messages"),
+		message(7,
+			message(1, fixed64Field(6, 5)),
+			varintField(2, uint64(temporalityDelta)),
+			varintField(3, 1),
+		),
+	)
+	gauge := message(2,
+		stringField(1, "players"),
+		message(5, message(1, doubleField(4, 17))),
+	)
+	histogram := message(2,
+		stringField(1, "tick.duration"),
+		stringField(3, "ms"),
+		message(9,
+			message(1,
+				fixed64Field(4, 6),
+				doubleField(5, 120),
+				message(6, protowire.AppendFixed64(protowire.AppendFixed64(protowire.AppendFixed64(nil, 1), 2), 3)),
+				message(7, protowire.AppendFixed64(protowire.AppendFixed64(nil, math.Float64bits(10)), math.Float64bits(50))),
+			),
+			varintField(2, uint64(temporalityCumulative)),
+		),
+	)
+	exponentialHistogram := message(2,
+		stringField(1, "latency"),
+		message(10,
+			message(1,
+				fixed64Field(4, 4),
+				doubleField(5, 10),
+				varintField(6, protowire.EncodeZigZag(0)),
+				fixed64Field(7, 1),
+				message(8, varintField(1, protowire.EncodeZigZag(1)), message(2, protowire.AppendVarint(protowire.AppendVarint(nil, 2), 1))),
+			),
+			varintField(2, uint64(temporalityCumulative)),
+		),
+	)
+
+	scope := message(2,
+		message(1, stringField(1, "game"), stringField(2, "1.0")),
+		cumulativeSum, deltaSum, gauge, histogram, exponentialHistogram,
+	)
+	return message(1, resource, scope)
+}
+
+func TestTranslate(t *testing.T) {
+	groups, err := Translate(testRequest())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(groups) != 1 {
+		t.Fatalf("wrong number of groups, got: %d, expected: %d", len(groups), 1)
+	}
+	group := groups[0]
+
+	expectedLabels := map[string]string{"job": "lobby", "instance": "lobby-17", "deployment_environment": "prod"}
+	for ln, lv := range expectedLabels {
+		if group.Labels[ln] != lv {
+			t.Errorf("wrong grouping label %s, got: %q, expected: %q", ln, group.Labels[ln], lv)
+		}
+	}
+
+	joins, ok := group.Absolute["arena_joins_total"]
+	if !ok {
+		t.Fatalf("expected cumulative counter arena_joins_total, got: %v", group.Absolute)
+	}
+	if joins.Metric[0].GetCounter().GetValue() != 42 {
+		t.Errorf("wrong counter value, got: %v, expected: %v", joins.Metric[0].GetCounter().GetValue(), 42)
+	}
+	labels := map[string]string{}
+	for _, lp := range joins.Metric[0].Label {
+		labels[lp.GetName()] = lp.GetValue()
+	}
+	if labels["arena"] != "castle" || labels["otel_scope_name"] != "game" {
+		t.Errorf("wrong metric labels, got: %v", labels)
+	}
+
+	messages, ok := group.Delta["chat_messages_total"]
+	if !ok {
+		t.Fatalf("expected delta counter chat_messages_total, got: %v", group.Delta)
+	}
+	if messages.Metric[0].GetCounter().GetValue() != 5 {
+		t.Errorf("wrong counter value, got: %v, expected: %v", messages.Metric[0].GetCounter().GetValue(), 5)
+	}
+
+	if _, ok := group.Absolute["players"]; !ok {
+		t.Errorf("expected gauge players, got: %v", group.Absolute)
+	}
+
+	tick, ok := group.Absolute["tick_duration_milliseconds"]
+	if !ok {
+		t.Fatalf("expected histogram tick_duration_milliseconds, got: %v", group.Absolute)
+	}
+	buckets := tick.Metric[0].GetHistogram().GetBucket()
+	if len(buckets) != 2 || buckets[0].GetCumulativeCount() != 1 || buckets[1].GetCumulativeCount() != 3 {
+		t.Errorf("wrong histogram buckets, got: %v", buckets)
+	}
+
+	latency, ok := group.Absolute["latency"]
+	if !ok {
+		t.Fatalf("expected histogram latency, got: %v", group.Absolute)
+	}
+	buckets = latency.Metric[0].GetHistogram().GetBucket()
+	// zero bucket, (2,4] and (4,8]
+	if len(buckets) != 3 || buckets[1].GetUpperBound() != 4 || buckets[2].GetUpperBound() != 8 || buckets[2].GetCumulativeCount() != 4 {
+		t.Errorf("wrong exponential histogram buckets, got: %v", buckets)
+	}
+}
+
+func TestTranslateInvalid(t *testing.T) {
+	if _, err := Translate([]byte{0x0a, 0xff}); err == nil {
+		t.Errorf("expected truncated message to fail, but it did not.")
+	}
+}
+
+func TestUnitSuffix(t *testing.T) {
+	tests := map[string]string{
+		"s":        "seconds",
+		"By":       "bytes",
+		"{joins}":  "",
+		"m/s":      "meters_per_second",
+		"1":        "ratio",
+		"requests": "requests",
+	}
+	for unit, expected := range tests {
+		if suffix := unitSuffix(unit); suffix != expected {
+			t.Errorf("wrong suffix for unit %q, got: %q, expected: %q", unit, suffix, expected)
+		}
+	}
+}
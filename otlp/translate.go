@@ -0,0 +1,389 @@
+// Package otlp translates OTLP metric exports into Prometheus
+// metric families, following the Prometheus and OpenMetrics
+// compatibility specification of OpenTelemetry.
+//
+// Source: https://opentelemetry.io/docs/specs/otel/compatibility/prometheus_and_openmetrics/
+package otlp
+
+import (
+	"dev.volix.ops/thor/utils"
+	"github.com/golang/protobuf/proto"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/model"
+	"math"
+	"sort"
+	"strings"
+)
+
+const (
+	// Default job of resources without `service.name`, just
+	// like the OpenTelemetry SDKs default it.
+	unknownService = "unknown_service"
+)
+
+// A Group contains all translated metrics of a single resource.
+// The resource attributes become the grouping Labels, with
+// `service.name` as job and `service.instance.id` as instance.
+//
+// Absolute contains gauges and cumulative metrics, which already
+// carry their total values. Delta contains metrics with delta
+// temporality, whose values have to be accumulated.
+type Group struct {
+	Labels   map[string]string
+	Absolute map[string]*dto.MetricFamily
+	Delta    map[string]*dto.MetricFamily
+}
+
+// Translate decodes the body of an OTLP/HTTP protobuf export
+// request and translates every resource into a Group.
+//
+// Non-monotonic sums with delta temporality can not be represented
+// and are dropped, just like data points without a recorded value.
+func Translate(body []byte) ([]Group, error) {
+	resources, err := decodeRequest(body)
+	if err != nil {
+		return nil, err
+	}
+
+	groups := make([]Group, 0, len(resources))
+	for _, rm := range resources {
+		group := Group{
+			Labels:   groupingLabels(rm.resource),
+			Absolute: make(map[string]*dto.MetricFamily),
+			Delta:    make(map[string]*dto.MetricFamily),
+		}
+
+		for _, sm := range rm.scopeMetrics {
+			var scopeLabels []attribute
+			if sm.scopeName != "" {
+				scopeLabels = append(scopeLabels, attribute{key: "otel_scope_name", value: sm.scopeName})
+			}
+			if sm.scopeVersion != "" {
+				scopeLabels = append(scopeLabels, attribute{key: "otel_scope_version", value: sm.scopeVersion})
+			}
+
+			for _, m := range sm.metrics {
+				mf := translateMetric(m, scopeLabels)
+				if mf == nil || len(mf.Metric) == 0 {
+					continue
+				}
+
+				families := group.Absolute
+				if m.temporality == temporalityDelta {
+					families = group.Delta
+				}
+				if prev, ok := families[mf.GetName()]; ok && prev.GetType() == mf.GetType() {
+					// the same metric can be exported by multiple scopes.
+					prev.Metric = append(prev.Metric, mf.Metric...)
+					continue
+				}
+				families[mf.GetName()] = mf
+			}
+		}
+		groups = append(groups, group)
+	}
+	return groups, nil
+}
+
+// groupingLabels maps the resource attributes to labels.
+func groupingLabels(resource []attribute) map[string]string {
+	labels := make(map[string]string, len(resource))
+
+	var serviceName, serviceNamespace string
+	for _, attr := range resource {
+		switch attr.key {
+		case "service.name":
+			serviceName = attr.value
+		case "service.namespace":
+			serviceNamespace = attr.value
+		case "service.instance.id":
+			labels[model.InstanceLabel] = attr.value
+		default:
+			name := utils.SanitizeLabelName(attr.key)
+			if strings.HasPrefix(name, model.ReservedLabelPrefix) || name == model.JobLabel || name == model.InstanceLabel {
+				continue
+			}
+			labels[name] = attr.value
+		}
+	}
+
+	if serviceName == "" {
+		serviceName = unknownService
+	}
+	if serviceNamespace != "" {
+		serviceName = serviceNamespace + "/" + serviceName
+	}
+	labels[model.JobLabel] = serviceName
+	return labels
+}
+
+// translateMetric converts the metric into a family.
+// Returns nil if the metric can not be represented.
+func translateMetric(m metric, scopeLabels []attribute) *dto.MetricFamily {
+	mf := &dto.MetricFamily{}
+	if m.description != "" {
+		mf.Help = proto.String(m.description)
+	}
+
+	switch m.typ {
+	case typeGauge:
+		mf.Type = dto.MetricType_GAUGE.Enum()
+		for _, dp := range m.numberPoints {
+			if dp.flags&flagNoRecordedValue != 0 {
+				continue
+			}
+			mf.Metric = append(mf.Metric, &dto.Metric{
+				Label: labelPairs(dp.attributes, scopeLabels),
+				Gauge: &dto.Gauge{Value: proto.Float64(dp.value)},
+			})
+		}
+	case typeSum:
+		if !m.monotonic {
+			if m.temporality == temporalityDelta {
+				return nil
+			}
+			// non-monotonic cumulative sums are just gauges.
+			mf.Type = dto.MetricType_GAUGE.Enum()
+			for _, dp := range m.numberPoints {
+				if dp.flags&flagNoRecordedValue != 0 {
+					continue
+				}
+				mf.Metric = append(mf.Metric, &dto.Metric{
+					Label: labelPairs(dp.attributes, scopeLabels),
+					Gauge: &dto.Gauge{Value: proto.Float64(dp.value)},
+				})
+			}
+			break
+		}
+
+		mf.Type = dto.MetricType_COUNTER.Enum()
+		for _, dp := range m.numberPoints {
+			if dp.flags&flagNoRecordedValue != 0 {
+				continue
+			}
+			mf.Metric = append(mf.Metric, &dto.Metric{
+				Label:   labelPairs(dp.attributes, scopeLabels),
+				Counter: &dto.Counter{Value: proto.Float64(dp.value)},
+			})
+		}
+	case typeHistogram:
+		mf.Type = dto.MetricType_HISTOGRAM.Enum()
+		for _, dp := range m.histogramPoints {
+			if dp.flags&flagNoRecordedValue != 0 {
+				continue
+			}
+			mf.Metric = append(mf.Metric, &dto.Metric{
+				Label:     labelPairs(dp.attributes, scopeLabels),
+				Histogram: explicitHistogram(dp),
+			})
+		}
+	case typeExponentialHistogram:
+		mf.Type = dto.MetricType_HISTOGRAM.Enum()
+		for _, dp := range m.exponentialHistogramPoints {
+			if dp.flags&flagNoRecordedValue != 0 {
+				continue
+			}
+			mf.Metric = append(mf.Metric, &dto.Metric{
+				Label:     labelPairs(dp.attributes, scopeLabels),
+				Histogram: exponentialHistogram(dp),
+			})
+		}
+	case typeSummary:
+		mf.Type = dto.MetricType_SUMMARY.Enum()
+		for _, dp := range m.summaryPoints {
+			if dp.flags&flagNoRecordedValue != 0 {
+				continue
+			}
+			summary := &dto.Summary{
+				SampleCount: proto.Uint64(dp.count),
+				SampleSum:   proto.Float64(dp.sum),
+			}
+			for _, q := range dp.quantiles {
+				summary.Quantile = append(summary.Quantile, &dto.Quantile{
+					Quantile: proto.Float64(q.quantile),
+					Value:    proto.Float64(q.value),
+				})
+			}
+			mf.Metric = append(mf.Metric, &dto.Metric{
+				Label:   labelPairs(dp.attributes, scopeLabels),
+				Summary: summary,
+			})
+		}
+	default:
+		return nil
+	}
+
+	mf.Name = proto.String(metricName(m))
+	return mf
+}
+
+// explicitHistogram converts the bucket counts of the explicit
+// bounds into cumulative buckets. The last bucket count is the
+// +Inf bucket, which is given by the sample count.
+func explicitHistogram(dp histogramDataPoint) *dto.Histogram {
+	h := &dto.Histogram{
+		SampleCount: proto.Uint64(dp.count),
+		SampleSum:   proto.Float64(dp.sum),
+	}
+
+	var cumulative uint64
+	for i, bound := range dp.explicitBounds {
+		if i < len(dp.bucketCounts) {
+			cumulative += dp.bucketCounts[i]
+		}
+		h.Bucket = append(h.Bucket, &dto.Bucket{
+			UpperBound:      proto.Float64(bound),
+			CumulativeCount: proto.Uint64(cumulative),
+		})
+	}
+	return h
+}
+
+// exponentialHistogram converts the exponential buckets into
+// cumulative buckets with explicit bounds. The positive bucket
+// with index i has the upper bound base^(i+1), the negative one
+// the upper bound -base^i, where base = 2^(2^-scale).
+// The zero bucket uses the zero threshold as upper bound.
+func exponentialHistogram(dp exponentialHistogramDataPoint) *dto.Histogram {
+	h := &dto.Histogram{
+		SampleCount: proto.Uint64(dp.count),
+		SampleSum:   proto.Float64(dp.sum),
+	}
+	base := math.Pow(2, math.Pow(2, -float64(dp.scale)))
+
+	var cumulative uint64
+	// negative buckets go from the highest index, which is
+	// the lowest bound, to the lowest index.
+	for i := len(dp.negative.counts) - 1; i >= 0; i-- {
+		cumulative += dp.negative.counts[i]
+		h.Bucket = append(h.Bucket, &dto.Bucket{
+			UpperBound:      proto.Float64(-math.Pow(base, float64(int(dp.negative.offset)+i))),
+			CumulativeCount: proto.Uint64(cumulative),
+		})
+	}
+
+	cumulative += dp.zeroCount
+	h.Bucket = append(h.Bucket, &dto.Bucket{
+		UpperBound:      proto.Float64(dp.zeroThreshold),
+		CumulativeCount: proto.Uint64(cumulative),
+	})
+
+	for i, count := range dp.positive.counts {
+		cumulative += count
+		h.Bucket = append(h.Bucket, &dto.Bucket{
+			UpperBound:      proto.Float64(math.Pow(base, float64(int(dp.positive.offset)+i+1))),
+			CumulativeCount: proto.Uint64(cumulative),
+		})
+	}
+	return h
+}
+
+// labelPairs converts the attributes of a data point into sorted
+// label pairs, with the sanitized attribute keys as label names.
+func labelPairs(attributes []attribute, scopeLabels []attribute) []*dto.LabelPair {
+	labels := make(map[string]string, len(attributes)+len(scopeLabels))
+	for _, attr := range scopeLabels {
+		labels[attr.key] = attr.value
+	}
+	for _, attr := range attributes {
+		name := utils.SanitizeLabelName(attr.key)
+		if strings.HasPrefix(name, model.ReservedLabelPrefix) {
+			continue
+		}
+		labels[name] = attr.value
+	}
+
+	result := make([]*dto.LabelPair, 0, len(labels))
+	for ln, lv := range labels {
+		result = append(result, &dto.LabelPair{
+			Name:  proto.String(ln),
+			Value: proto.String(lv),
+		})
+	}
+	sort.Sort(utils.LabelPairs(result))
+	return result
+}
+
+// Units of the UCUM (case sensitive) and their names
+// which are appended to the metric name.
+var units = map[string]string{
+	"d":    "days",
+	"h":    "hours",
+	"min":  "minutes",
+	"s":    "seconds",
+	"ms":   "milliseconds",
+	"us":   "microseconds",
+	"ns":   "nanoseconds",
+	"By":   "bytes",
+	"KiBy": "kibibytes",
+	"MiBy": "mebibytes",
+	"GiBy": "gibibytes",
+	"TiBy": "tibibytes",
+	"KBy":  "kilobytes",
+	"MBy":  "megabytes",
+	"GBy":  "gigabytes",
+	"TBy":  "terabytes",
+	"m":    "meters",
+	"V":    "volts",
+	"A":    "amperes",
+	"J":    "joules",
+	"W":    "watts",
+	"g":    "grams",
+	"Cel":  "celsius",
+	"Hz":   "hertz",
+	"%":    "percent",
+}
+
+// metricName builds the Prometheus name of the metric: the name
+// is sanitized and suffixed with the unit, and counters get the
+// `_total` suffix.
+func metricName(m metric) string {
+	name := utils.SanitizeMetricName(m.name)
+	isCounter := m.typ == typeSum && m.monotonic
+	if isCounter {
+		name = strings.TrimSuffix(name, "_total")
+	}
+
+	unit := unitSuffix(m.unit)
+	if unit == "ratio" && m.typ != typeGauge {
+		unit = ""
+	}
+	if unit != "" && !strings.HasSuffix(name, "_"+unit) {
+		name += "_" + unit
+	}
+
+	if isCounter {
+		name += "_total"
+	}
+	return name
+}
+
+// unitSuffix converts the UCUM unit into its name. Annotations
+// in curly braces are dropped and `x/y` is converted to `x_per_y`.
+func unitSuffix(unit string) string {
+	if i := strings.IndexByte(unit, '{'); i >= 0 {
+		unit = unit[:i]
+	}
+	if unit == "" {
+		return ""
+	}
+	if unit == "1" {
+		return "ratio"
+	}
+
+	parts := strings.SplitN(unit, "/", 2)
+	for i, part := range parts {
+		if name, ok := units[part]; ok {
+			parts[i] = name
+		}
+	}
+	if len(parts) == 2 {
+		// seconds -> second, hours -> hour, ...
+		perUnit := strings.TrimSuffix(parts[1], "s")
+		if parts[0] == "" {
+			return "per_" + utils.SanitizeMetricName(perUnit)
+		}
+		return utils.SanitizeMetricName(parts[0] + "_per_" + perUnit)
+	}
+	return strings.Trim(utils.SanitizeMetricName(parts[0]), "_")
+}
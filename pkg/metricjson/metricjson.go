@@ -0,0 +1,570 @@
+// Package metricjson implements a JSON representation of metric
+// families, which is easier to write by hand (or by scripts without
+// a client library) than the text exposition format.
+//
+// Example:
+//  [
+//    {
+//      "name": "players",
+//      "type": "gauge",
+//      "help": "Players currently online.",
+//      "metrics": [
+//        {"labels": {"server": "lobby17"}, "value": 42}
+//      ]
+//    },
+//    {
+//      "name": "tick_duration_seconds",
+//      "type": "histogram",
+//      "metrics": [
+//        {
+//          "count": 20,
+//          "sum": 1.2,
+//          "buckets": [{"le": 0.05, "count": 18}, {"le": "+Inf", "count": 20}]
+//        }
+//      ]
+//    }
+//  ]
+package metricjson
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/golang/protobuf/proto"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/model"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// A Family is the JSON representation of a dto.MetricFamily.
+// Type is one of counter, gauge, untyped, histogram or summary.
+type Family struct {
+	Name    string   `json:"name"`
+	Type    string   `json:"type"`
+	Help    string   `json:"help,omitempty"`
+	Metrics []Metric `json:"metrics"`
+}
+
+// A Metric is the JSON representation of a dto.Metric.
+// Value is used for counters, gauges and untyped metrics,
+// Count and Sum for histograms and summaries, and Buckets
+// or Quantiles for histograms or summaries respectively.
+type Metric struct {
+	Labels    map[string]string `json:"labels,omitempty"`
+	Value     *Float            `json:"value,omitempty"`
+	Count     *uint64           `json:"count,omitempty"`
+	Sum       *Float            `json:"sum,omitempty"`
+	Buckets   []Bucket          `json:"buckets,omitempty"`
+	Quantiles []Quantile        `json:"quantiles,omitempty"`
+}
+
+// A Bucket of a histogram with its upper bound
+// and the cumulative count.
+type Bucket struct {
+	UpperBound Float  `json:"le"`
+	Count      uint64 `json:"count"`
+}
+
+// A Quantile of a summary.
+type Quantile struct {
+	Quantile Float `json:"quantile"`
+	Value    Float `json:"value"`
+}
+
+// Float is a float64, which can also be written as string
+// to support the special values "+Inf", "-Inf" and "NaN",
+// which JSON numbers can not represent.
+type Float float64
+
+func (f Float) MarshalJSON() ([]byte, error) {
+	v := float64(f)
+	if math.IsInf(v, 0) || math.IsNaN(v) {
+		return json.Marshal(model.SampleValue(v).String())
+	}
+	return json.Marshal(v)
+}
+
+func (f *Float) UnmarshalJSON(b []byte) error {
+	var s string
+	if len(b) > 0 && b[0] == '"' {
+		if err := json.Unmarshal(b, &s); err != nil {
+			return err
+		}
+	} else {
+		s = string(b)
+	}
+
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return fmt.Errorf("invalid number %s", b)
+	}
+	*f = Float(v)
+	return nil
+}
+
+var (
+	types = map[string]dto.MetricType{
+		"counter":   dto.MetricType_COUNTER,
+		"gauge":     dto.MetricType_GAUGE,
+		"untyped":   dto.MetricType_UNTYPED,
+		"histogram": dto.MetricType_HISTOGRAM,
+		"summary":   dto.MetricType_SUMMARY,
+	}
+)
+
+// Decode reads a JSON array of families from the reader and
+// converts them into metric families. Unknown fields are rejected.
+//
+// Every error points to the offending field, e.g.
+//  families[0].metrics[2].buckets[1].le: upper bounds must be increasing
+func Decode(r io.Reader) (map[string]*dto.MetricFamily, error) {
+	return DecodeChecked(r, nil)
+}
+
+// DecodeChecked is like Decode, but the families are read one after
+// another and check is called for every family with its name and the
+// number of its metrics, before the metrics are decoded. Decoding stops
+// at the first error returned by check, which is returned as is.
+// check may be nil.
+func DecodeChecked(r io.Reader, check func(name string, metrics int) error) (map[string]*dto.MetricFamily, error) {
+	dec := json.NewDecoder(r)
+	tok, err := dec.Token()
+	if err != nil {
+		return nil, fmt.Errorf("invalid json: %w", err)
+	}
+	if tok != nil && tok != json.Delim('[') {
+		return nil, fmt.Errorf("families: expected array, got %s", tokenName(tok))
+	}
+
+	// we decode every object on its own, so that every error
+	// can point to the exact field which caused it.
+	var families []Family
+	for i := 0; tok != nil && dec.More(); i++ {
+		path := fmt.Sprintf("families[%d]", i)
+
+		var rawFamily json.RawMessage
+		if err := dec.Decode(&rawFamily); err != nil {
+			return nil, fmt.Errorf("invalid json: %w", err)
+		}
+		var family Family
+		var rawMetrics []json.RawMessage
+		err := unmarshalObject(rawFamily, path, map[string]interface{}{
+			"name":    &family.Name,
+			"type":    &family.Type,
+			"help":    &family.Help,
+			"metrics": &rawMetrics,
+		})
+		if err != nil {
+			return nil, err
+		}
+		if check != nil {
+			if err := check(family.Name, len(rawMetrics)); err != nil {
+				return nil, err
+			}
+		}
+
+		family.Metrics = make([]Metric, len(rawMetrics))
+		for j, rawMetric := range rawMetrics {
+			if err := decodeMetric(rawMetric, fmt.Sprintf("%s.metrics[%d]", path, j), &family.Metrics[j]); err != nil {
+				return nil, err
+			}
+		}
+		families = append(families, family)
+	}
+	if tok != nil {
+		// the closing bracket of the array.
+		if _, err := dec.Token(); err != nil {
+			return nil, fmt.Errorf("invalid json: %w", err)
+		}
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return nil, fmt.Errorf("invalid json: unexpected data after the families array")
+	}
+	return ToMetricFamilies(families)
+}
+
+// tokenName returns the JSON type of the first token of a value,
+// which is not an array.
+func tokenName(tok json.Token) string {
+	switch tok.(type) {
+	case json.Delim:
+		return "object"
+	case string:
+		return "string"
+	case bool:
+		return "bool"
+	}
+	return "number"
+}
+
+func decodeMetric(raw json.RawMessage, path string, m *Metric) error {
+	var rawBuckets, rawQuantiles []json.RawMessage
+	err := unmarshalObject(raw, path, map[string]interface{}{
+		"labels":    &m.Labels,
+		"value":     &m.Value,
+		"count":     &m.Count,
+		"sum":       &m.Sum,
+		"buckets":   &rawBuckets,
+		"quantiles": &rawQuantiles,
+	})
+	if err != nil {
+		return err
+	}
+
+	if rawBuckets != nil {
+		m.Buckets = make([]Bucket, len(rawBuckets))
+	}
+	for k, rawBucket := range rawBuckets {
+		err := unmarshalObject(rawBucket, fmt.Sprintf("%s.buckets[%d]", path, k), map[string]interface{}{
+			"le":    &m.Buckets[k].UpperBound,
+			"count": &m.Buckets[k].Count,
+		}, "le", "count")
+		if err != nil {
+			return err
+		}
+	}
+
+	if rawQuantiles != nil {
+		m.Quantiles = make([]Quantile, len(rawQuantiles))
+	}
+	for k, rawQuantile := range rawQuantiles {
+		err := unmarshalObject(rawQuantile, fmt.Sprintf("%s.quantiles[%d]", path, k), map[string]interface{}{
+			"quantile": &m.Quantiles[k].Quantile,
+			"value":    &m.Quantiles[k].Value,
+		}, "quantile", "value")
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// unmarshalObject decodes the JSON object field by field into the
+// given targets. Unknown fields and missing required fields are
+// rejected with an error pointing to the field.
+func unmarshalObject(raw json.RawMessage, path string, targets map[string]interface{}, required ...string) error {
+	var obj map[string]json.RawMessage
+	if err := unmarshal(raw, &obj, path); err != nil {
+		return err
+	}
+
+	keys := make([]string, 0, len(obj))
+	for key := range obj {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		target, ok := targets[key]
+		if !ok {
+			return fmt.Errorf("%s.%s: unknown field", path, key)
+		}
+		if err := unmarshal(obj[key], target, path+"."+key); err != nil {
+			return err
+		}
+	}
+	for _, key := range required {
+		if _, ok := obj[key]; !ok {
+			return fmt.Errorf("%s.%s: required", path, key)
+		}
+	}
+	return nil
+}
+
+func unmarshal(raw json.RawMessage, target interface{}, path string) error {
+	err := json.Unmarshal(raw, target)
+	if e, ok := err.(*json.UnmarshalTypeError); ok {
+		return fmt.Errorf("%s: expected %s, got %s", path, typeName(e.Type.String()), e.Value)
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	return nil
+}
+
+// typeName returns a readable name of the Go type
+// encoding/json failed to decode into.
+func typeName(t string) string {
+	switch {
+	case strings.HasPrefix(t, "[]"):
+		return "array"
+	case strings.HasPrefix(t, "map["):
+		return "object"
+	case strings.Contains(t, "int"):
+		return "non-negative integer"
+	case strings.Contains(t, "float"):
+		return "number"
+	}
+	return t
+}
+
+// ToMetricFamilies validates the families and converts
+// them into metric families.
+func ToMetricFamilies(families []Family) (map[string]*dto.MetricFamily, error) {
+	result := make(map[string]*dto.MetricFamily, len(families))
+	for i, f := range families {
+		path := fmt.Sprintf("families[%d]", i)
+
+		if !model.IsValidMetricName(model.LabelValue(f.Name)) {
+			return nil, fmt.Errorf("%s.name: invalid metric name %q", path, f.Name)
+		}
+		if _, ok := result[f.Name]; ok {
+			return nil, fmt.Errorf("%s.name: duplicate family %q", path, f.Name)
+		}
+		mt, ok := types[f.Type]
+		if !ok {
+			return nil, fmt.Errorf("%s.type: unknown type %q, expected one of counter, gauge, untyped, histogram or summary", path, f.Type)
+		}
+
+		mf := &dto.MetricFamily{
+			Name: proto.String(f.Name),
+			Type: mt.Enum(),
+		}
+		if f.Help != "" {
+			mf.Help = proto.String(f.Help)
+		}
+
+		series := make(map[string]bool, len(f.Metrics))
+		for j, m := range f.Metrics {
+			metricPath := fmt.Sprintf("%s.metrics[%d]", path, j)
+
+			metric, err := toMetric(mt, m, metricPath)
+			if err != nil {
+				return nil, err
+			}
+
+			key := labelsKey(m.Labels)
+			if series[key] {
+				return nil, fmt.Errorf("%s.labels: duplicate series %v", metricPath, m.Labels)
+			}
+			series[key] = true
+
+			mf.Metric = append(mf.Metric, metric)
+		}
+		result[f.Name] = mf
+	}
+	return result, nil
+}
+
+func toMetric(mt dto.MetricType, m Metric, path string) (*dto.Metric, error) {
+	metric := &dto.Metric{}
+	for ln, lv := range m.Labels {
+		if !model.LabelName(ln).IsValid() || strings.HasPrefix(ln, model.ReservedLabelPrefix) {
+			return nil, fmt.Errorf("%s.labels: invalid label name %q", path, ln)
+		}
+		if (mt == dto.MetricType_HISTOGRAM && ln == model.BucketLabel) ||
+			(mt == dto.MetricType_SUMMARY && ln == model.QuantileLabel) {
+			return nil, fmt.Errorf("%s.labels: label name %q is reserved for %s", path, ln, strings.ToLower(mt.String()))
+		}
+		metric.Label = append(metric.Label, &dto.LabelPair{
+			Name:  proto.String(ln),
+			Value: proto.String(lv),
+		})
+	}
+	sort.Slice(metric.Label, func(i, j int) bool {
+		return metric.Label[i].GetName() < metric.Label[j].GetName()
+	})
+
+	switch mt {
+	case dto.MetricType_COUNTER, dto.MetricType_GAUGE, dto.MetricType_UNTYPED:
+		if err := onlyFields(m, path, "value"); err != nil {
+			return nil, err
+		}
+		if m.Value == nil {
+			return nil, fmt.Errorf("%s.value: required for %s", path, strings.ToLower(mt.String()))
+		}
+		v := float64(*m.Value)
+
+		switch mt {
+		case dto.MetricType_COUNTER:
+			if v < 0 || math.IsNaN(v) {
+				return nil, fmt.Errorf("%s.value: counters must not be negative or NaN, got %v", path, v)
+			}
+			metric.Counter = &dto.Counter{Value: proto.Float64(v)}
+		case dto.MetricType_GAUGE:
+			metric.Gauge = &dto.Gauge{Value: proto.Float64(v)}
+		default:
+			metric.Untyped = &dto.Untyped{Value: proto.Float64(v)}
+		}
+	case dto.MetricType_HISTOGRAM:
+		if err := onlyFields(m, path, "count", "sum", "buckets"); err != nil {
+			return nil, err
+		}
+		if m.Count == nil {
+			return nil, fmt.Errorf("%s.count: required for histogram", path)
+		}
+		h := &dto.Histogram{
+			SampleCount: proto.Uint64(*m.Count),
+			SampleSum:   proto.Float64(floatOrZero(m.Sum)),
+		}
+		for k, b := range m.Buckets {
+			bucketPath := fmt.Sprintf("%s.buckets[%d]", path, k)
+			bound := float64(b.UpperBound)
+			if math.IsNaN(bound) {
+				return nil, fmt.Errorf("%s.le: must not be NaN", bucketPath)
+			}
+			if k > 0 {
+				prev := m.Buckets[k-1]
+				if bound <= float64(prev.UpperBound) {
+					return nil, fmt.Errorf("%s.le: upper bounds must be increasing", bucketPath)
+				}
+				if b.Count < prev.Count {
+					return nil, fmt.Errorf("%s.count: counts must be cumulative and not decrease", bucketPath)
+				}
+			}
+			if b.Count > *m.Count || (math.IsInf(bound, 1) && b.Count != *m.Count) {
+				return nil, fmt.Errorf("%s.count: does not match the count of %d", bucketPath, *m.Count)
+			}
+			if math.IsInf(bound, 1) {
+				// the +Inf bucket is given by the sample count.
+				continue
+			}
+			h.Bucket = append(h.Bucket, &dto.Bucket{
+				UpperBound:      proto.Float64(bound),
+				CumulativeCount: proto.Uint64(b.Count),
+			})
+		}
+		metric.Histogram = h
+	case dto.MetricType_SUMMARY:
+		if err := onlyFields(m, path, "count", "sum", "quantiles"); err != nil {
+			return nil, err
+		}
+		if m.Count == nil {
+			return nil, fmt.Errorf("%s.count: required for summary", path)
+		}
+		s := &dto.Summary{
+			SampleCount: proto.Uint64(*m.Count),
+			SampleSum:   proto.Float64(floatOrZero(m.Sum)),
+		}
+		for k, q := range m.Quantiles {
+			if q.Quantile < 0 || q.Quantile > 1 {
+				return nil, fmt.Errorf("%s.quantiles[%d].quantile: must be between 0 and 1, got %v", path, k, float64(q.Quantile))
+			}
+			s.Quantile = append(s.Quantile, &dto.Quantile{
+				Quantile: proto.Float64(float64(q.Quantile)),
+				Value:    proto.Float64(float64(q.Value)),
+			})
+		}
+		metric.Summary = s
+	}
+	return metric, nil
+}
+
+// onlyFields returns an error if any of the value
+// fields not listed in allowed is set.
+func onlyFields(m Metric, path string, allowed ...string) error {
+	set := map[string]bool{
+		"value":     m.Value != nil,
+		"count":     m.Count != nil,
+		"sum":       m.Sum != nil,
+		"buckets":   m.Buckets != nil,
+		"quantiles": m.Quantiles != nil,
+	}
+	for _, field := range allowed {
+		delete(set, field)
+	}
+	for _, field := range []string{"value", "count", "sum", "buckets", "quantiles"} {
+		if set[field] {
+			return fmt.Errorf("%s.%s: not allowed, only %s can be set for this type", path, field, strings.Join(allowed, ", "))
+		}
+	}
+	return nil
+}
+
+func floatOrZero(f *Float) float64 {
+	if f == nil {
+		return 0
+	}
+	return float64(*f)
+}
+
+func labelsKey(labels map[string]string) string {
+	names := make([]string, 0, len(labels))
+	for ln := range labels {
+		names = append(names, ln)
+	}
+	sort.Strings(names)
+
+	sb := strings.Builder{}
+	for _, ln := range names {
+		sb.WriteString(ln)
+		sb.WriteByte(model.SeparatorByte)
+		sb.WriteString(labels[ln])
+		sb.WriteByte(model.SeparatorByte)
+	}
+	return sb.String()
+}
+
+// FromMetricFamilies converts the metric families into their
+// JSON representation. The +Inf bucket of histograms is added
+// explicitly. Timestamps are not kept.
+func FromMetricFamilies(mfs []*dto.MetricFamily) []Family {
+	result := make([]Family, 0, len(mfs))
+	for _, mf := range mfs {
+		f := Family{
+			Name:    mf.GetName(),
+			Type:    strings.ToLower(mf.GetType().String()),
+			Help:    mf.GetHelp(),
+			Metrics: make([]Metric, 0, len(mf.Metric)),
+		}
+
+		for _, m := range mf.Metric {
+			metric := Metric{}
+			if len(m.Label) > 0 {
+				metric.Labels = make(map[string]string, len(m.Label))
+				for _, lp := range m.Label {
+					metric.Labels[lp.GetName()] = lp.GetValue()
+				}
+			}
+
+			switch mf.GetType() {
+			case dto.MetricType_COUNTER:
+				metric.Value = floatPtr(m.GetCounter().GetValue())
+			case dto.MetricType_GAUGE:
+				metric.Value = floatPtr(m.GetGauge().GetValue())
+			case dto.MetricType_UNTYPED:
+				metric.Value = floatPtr(m.GetUntyped().GetValue())
+			case dto.MetricType_HISTOGRAM:
+				h := m.GetHistogram()
+				metric.Count = proto.Uint64(h.GetSampleCount())
+				metric.Sum = floatPtr(h.GetSampleSum())
+				metric.Buckets = make([]Bucket, 0, len(h.Bucket)+1)
+				for _, b := range h.Bucket {
+					if math.IsInf(b.GetUpperBound(), 1) {
+						continue
+					}
+					metric.Buckets = append(metric.Buckets, Bucket{
+						UpperBound: Float(b.GetUpperBound()),
+						Count:      b.GetCumulativeCount(),
+					})
+				}
+				metric.Buckets = append(metric.Buckets, Bucket{
+					UpperBound: Float(math.Inf(1)),
+					Count:      h.GetSampleCount(),
+				})
+			case dto.MetricType_SUMMARY:
+				s := m.GetSummary()
+				metric.Count = proto.Uint64(s.GetSampleCount())
+				metric.Sum = floatPtr(s.GetSampleSum())
+				metric.Quantiles = make([]Quantile, 0, len(s.Quantile))
+				for _, q := range s.Quantile {
+					metric.Quantiles = append(metric.Quantiles, Quantile{
+						Quantile: Float(q.GetQuantile()),
+						Value:    Float(q.GetValue()),
+					})
+				}
+			}
+			f.Metrics = append(f.Metrics, metric)
+		}
+		result = append(result, f)
+	}
+	return result
+}
+
+func floatPtr(v float64) *Float {
+	f := Float(v)
+	return &f
+}
@@ -0,0 +1,146 @@
+package metricjson
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	dto "github.com/prometheus/client_model/go"
+	"strings"
+	"testing"
+)
+
+const testBody = `[
+  {
+    "name": "players",
+    "type": "gauge",
+    "help": "Players currently online.",
+    "metrics": [
+      {"labels": {"server": "lobby17"}, "value": 42},
+      {"labels": {"server": "lobby18"}, "value": "NaN"}
+    ]
+  },
+  {
+    "name": "tick_duration_seconds",
+    "type": "histogram",
+    "metrics": [
+      {"count": 20, "sum": 1.2, "buckets": [{"le": 0.05, "count": 18}, {"le": "+Inf", "count": 20}]}
+    ]
+  },
+  {
+    "name": "ping_seconds",
+    "type": "summary",
+    "metrics": [
+      {"count": 3, "sum": 0.3, "quantiles": [{"quantile": 0.5, "value": 0.1}]}
+    ]
+  }
+]`
+
+func TestDecode(t *testing.T) {
+	mfs, err := Decode(strings.NewReader(testBody))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mfs) != 3 {
+		t.Fatalf("wrong number of families, got: %d, expected: %d", len(mfs), 3)
+	}
+
+	players := mfs["players"]
+	if len(players.Metric) != 2 || players.Metric[0].GetGauge().GetValue() != 42 {
+		t.Errorf("could not decode gauge, got: %v", players)
+	}
+
+	hist := mfs["tick_duration_seconds"].Metric[0].GetHistogram()
+	if hist.GetSampleCount() != 20 || len(hist.Bucket) != 1 || hist.Bucket[0].GetCumulativeCount() != 18 {
+		t.Errorf("could not decode histogram, got: %v", hist)
+	}
+
+	summary := mfs["ping_seconds"].Metric[0].GetSummary()
+	if summary.GetSampleCount() != 3 || len(summary.Quantile) != 1 {
+		t.Errorf("could not decode summary, got: %v", summary)
+	}
+}
+
+func TestDecodeChecked(t *testing.T) {
+	var checked []string
+	tooMany := errors.New("too many metrics")
+	check := func(name string, metrics int) error {
+		checked = append(checked, name)
+		if metrics > 1 {
+			return tooMany
+		}
+		return nil
+	}
+
+	// decoding stops at the first family, which fails the check,
+	// so the invalid family after it is never decoded.
+	body := `[{"name": "a", "type": "gauge", "metrics": [{"value": 1}]},
+		{"name": "b", "type": "gauge", "metrics": [{"value": 1}, {"labels": {"x": "y"}, "value": 2}]},
+		{"name": "c", "type": "meter"}]`
+	if _, err := DecodeChecked(strings.NewReader(body), check); err != tooMany {
+		t.Errorf("expected the error of the check, got: %v", err)
+	}
+	if len(checked) != 2 || checked[1] != "b" {
+		t.Errorf("expected families a and b to be checked, got: %v", checked)
+	}
+
+	checked = nil
+	mfs, err := DecodeChecked(strings.NewReader(`[{"name": "a", "type": "gauge", "metrics": [{"value": 1}]}]`), check)
+	if err != nil || len(mfs) != 1 || len(checked) != 1 {
+		t.Errorf("expected a single family, got: %v, %v", mfs, err)
+	}
+}
+
+func TestDecodeErrors(t *testing.T) {
+	tests := map[string]string{
+		`{}`:        "families: expected array",
+		`"players"`: "families: expected array",
+		`[]]`:       "invalid json: unexpected data",
+		`[] []`:     "invalid json: unexpected data",
+		`[{"name": "a", "type": "gauge", "metrics": []}`:                                                                             "invalid json",
+		`[{"name": "a", "type": "gauge", "metrics": [{"value": 1, "timestamp": 0}]}]`:                                                "families[0].metrics[0].timestamp: unknown field",
+		`[{"name": "a", "type": "gauge", "metrics": [{}]}]`:                                                                          "families[0].metrics[0].value: required",
+		`[{"name": "a", "type": "gauge", "metrics": [{"value": "x"}]}]`:                                                              "families[0].metrics[0].value:",
+		`[{"name": "a", "type": "gauge", "metrics": [{"value": 1, "count": 1}]}]`:                                                    "families[0].metrics[0].count: not allowed",
+		`[{"name": "a", "type": "counter", "metrics": [{"value": -1}]}]`:                                                             "families[0].metrics[0].value: counters must not be negative",
+		`[{"name": "a-b", "type": "gauge", "metrics": []}]`:                                                                          "families[0].name: invalid metric name",
+		`[{"name": "a", "type": "meter", "metrics": []}]`:                                                                            "families[0].type: unknown type",
+		`[{"name": "a", "type": "gauge", "metrics": [{"labels": {"x": 1}, "value": 1}]}]`:                                            "families[0].metrics[0].labels: expected string, got number",
+		`[{"name": "a", "type": "gauge", "metrics": [{"value": 1}, {"value": 2}]}]`:                                                  "families[0].metrics[1].labels: duplicate series",
+		`[{"name": "a", "type": "histogram", "metrics": [{"count": 2, "buckets": [{"le": 1, "count": 3}]}]}]`:                        "families[0].metrics[0].buckets[0].count: does not match",
+		`[{"name": "a", "type": "histogram", "metrics": [{"count": 2, "buckets": [{"le": 1}]}]}]`:                                    "families[0].metrics[0].buckets[0].count: required",
+		`[{"name": "a", "type": "histogram", "metrics": [{"count": 2, "buckets": [{"le": 1, "count": 1}, {"le": 1, "count": 1}]}]}]`: "families[0].metrics[0].buckets[1].le: upper bounds must be increasing",
+	}
+	for body, expected := range tests {
+		_, err := Decode(strings.NewReader(body))
+		if err == nil {
+			t.Errorf("expected %s to fail, but it did not.", body)
+			continue
+		}
+		if !strings.HasPrefix(err.Error(), expected) {
+			t.Errorf("wrong error for %s, got: %q, expected prefix: %q", body, err.Error(), expected)
+		}
+	}
+}
+
+func TestEncodeDecode(t *testing.T) {
+	mfs, err := Decode(strings.NewReader(testBody))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var list []*dto.MetricFamily
+	for _, mf := range mfs {
+		list = append(list, mf)
+	}
+
+	b, err := json.Marshal(FromMetricFamilies(list))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mfs2, err := Decode(bytes.NewReader(b))
+	if err != nil {
+		t.Fatalf("could not decode encoded families: %v", err)
+	}
+	if len(mfs2) != len(mfs) {
+		t.Errorf("wrong number of families after encoding, got: %d, expected: %d", len(mfs2), len(mfs))
+	}
+}
@@ -0,0 +1,274 @@
+// Package query evaluates a small subset of PromQL against the current
+// values of metric families: series selectors like `players{job="lobby"}`
+// and the aggregations sum, min, max, avg and count, optionally with
+// `by` or `without` clauses, e.g. `sum by (job) (players)`.
+package query
+
+import (
+	"dev.volix.ops/thor/pkg/selector"
+	"fmt"
+	"github.com/prometheus/common/model"
+	"math"
+	"sort"
+	"strings"
+)
+
+// A Sample is the current value of a series.
+type Sample struct {
+	Labels map[string]string
+	Value  float64
+}
+
+// An Expr is a parsed expression.
+type Expr interface {
+	// Eval evaluates the expression over all series.
+	Eval(series []Sample) []Sample
+	String() string
+}
+
+// The supported aggregation operators.
+var aggregations = map[string]func(values []float64) float64{
+	"sum": func(values []float64) float64 {
+		var sum float64
+		for _, v := range values {
+			sum += v
+		}
+		return sum
+	},
+	"min": func(values []float64) float64 {
+		min := values[0]
+		for _, v := range values[1:] {
+			if v < min || math.IsNaN(min) {
+				min = v
+			}
+		}
+		return min
+	},
+	"max": func(values []float64) float64 {
+		max := values[0]
+		for _, v := range values[1:] {
+			if v > max || math.IsNaN(max) {
+				max = v
+			}
+		}
+		return max
+	},
+	"avg": func(values []float64) float64 {
+		var sum float64
+		for _, v := range values {
+			sum += v
+		}
+		return sum / float64(len(values))
+	},
+	"count": func(values []float64) float64 {
+		return float64(len(values))
+	},
+}
+
+// Parse parses the expression.
+func Parse(s string) (Expr, error) {
+	p := selector.NewParser(s)
+	e, err := parseExpr(p)
+	if err != nil {
+		return nil, err
+	}
+	p.SkipSpace()
+	if !p.Done() {
+		return nil, p.Errorf("unexpected %q", s[p.Pos():])
+	}
+	return e, nil
+}
+
+func parseExpr(p *selector.Parser) (Expr, error) {
+	// the operators are no reserved words, so
+	// `sum{job="lobby"}` is still a selector.
+	saved := *p
+	if op := p.Identifier(); aggregations[op] != nil {
+		p.SkipSpace()
+		if c := p.Peek(); c == '(' || c == 'b' || c == 'w' {
+			return parseAggregation(p, op)
+		}
+	}
+	*p = saved
+
+	matchers, err := p.ParseSelector()
+	if err != nil {
+		return nil, err
+	}
+	return &selectorExpr{matchers: matchers}, nil
+}
+
+// parseAggregation parses an aggregation after its operator. The
+// clause may be given before or after the parameter, like in PromQL.
+func parseAggregation(p *selector.Parser, op string) (Expr, error) {
+	a := &aggregateExpr{op: op}
+	clause, err := parseClause(p, a)
+	if err != nil {
+		return nil, err
+	}
+
+	if !p.Consume("(") {
+		return nil, p.Errorf("expected '(' after %s", op)
+	}
+	if a.expr, err = parseExpr(p); err != nil {
+		return nil, err
+	}
+	if !p.Consume(")") {
+		return nil, p.Errorf("expected ')'")
+	}
+
+	if !clause {
+		if _, err := parseClause(p, a); err != nil {
+			return nil, err
+		}
+	}
+	return a, nil
+}
+
+// parseClause parses an optional `by` or `without` clause into the
+// aggregation and returns true, if there was one.
+func parseClause(p *selector.Parser, a *aggregateExpr) (bool, error) {
+	saved := *p
+	switch p.Identifier() {
+	case "by":
+	case "without":
+		a.without = true
+	default:
+		*p = saved
+		return false, nil
+	}
+
+	if !p.Consume("(") {
+		return false, p.Errorf("expected '(' after by or without")
+	}
+	if p.Consume(")") {
+		return true, nil
+	}
+	for {
+		name := p.Identifier()
+		if !model.LabelName(name).IsValid() {
+			return false, p.Errorf("expected label name")
+		}
+		a.labels = append(a.labels, name)
+
+		if p.Consume(",") {
+			if p.Consume(")") {
+				break
+			}
+			continue
+		}
+		if !p.Consume(")") {
+			return false, p.Errorf("expected ',' or ')'")
+		}
+		break
+	}
+	return true, nil
+}
+
+type selectorExpr struct {
+	matchers []*selector.Matcher
+}
+
+func (e *selectorExpr) Eval(series []Sample) []Sample {
+	var result []Sample
+	for _, s := range series {
+		if selector.MatchLabels(e.matchers, s.Labels) {
+			result = append(result, s)
+		}
+	}
+	return result
+}
+
+func (e *selectorExpr) String() string {
+	matchers := make([]string, 0, len(e.matchers))
+	for _, m := range e.matchers {
+		matchers = append(matchers, m.String())
+	}
+	return "{" + strings.Join(matchers, ",") + "}"
+}
+
+type aggregateExpr struct {
+	op      string
+	without bool
+	labels  []string
+	expr    Expr
+}
+
+// Eval aggregates the samples of the expression by their labels
+// remaining after the `by` or `without` clause. The metric name is
+// dropped, like in Prometheus.
+func (e *aggregateExpr) Eval(series []Sample) []Sample {
+	groups := map[string]*struct {
+		labels map[string]string
+		values []float64
+	}{}
+	var keys []string
+	for _, s := range e.expr.Eval(series) {
+		labels := e.groupLabels(s.Labels)
+		key := labelsKey(labels)
+		g, ok := groups[key]
+		if !ok {
+			g = &struct {
+				labels map[string]string
+				values []float64
+			}{labels: labels}
+			groups[key] = g
+			keys = append(keys, key)
+		}
+		g.values = append(g.values, s.Value)
+	}
+
+	result := make([]Sample, 0, len(keys))
+	for _, key := range keys {
+		g := groups[key]
+		result = append(result, Sample{Labels: g.labels, Value: aggregations[e.op](g.values)})
+	}
+	return result
+}
+
+// groupLabels returns the labels of the group of the sample.
+func (e *aggregateExpr) groupLabels(labels map[string]string) map[string]string {
+	result := map[string]string{}
+	if e.without {
+		for name, value := range labels {
+			result[name] = value
+		}
+		delete(result, model.MetricNameLabel)
+		for _, name := range e.labels {
+			delete(result, name)
+		}
+		return result
+	}
+	for _, name := range e.labels {
+		if value, ok := labels[name]; ok && name != model.MetricNameLabel {
+			result[name] = value
+		}
+	}
+	return result
+}
+
+func (e *aggregateExpr) String() string {
+	clause := "by"
+	if e.without {
+		clause = "without"
+	}
+	return fmt.Sprintf("%s %s (%s) (%s)", e.op, clause, strings.Join(e.labels, ", "), e.expr)
+}
+
+// labelsKey returns a string identifying the labels.
+func labelsKey(labels map[string]string) string {
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	for _, name := range names {
+		b.WriteString(name)
+		b.WriteByte(0)
+		b.WriteString(labels[name])
+		b.WriteByte(0)
+	}
+	return b.String()
+}
@@ -0,0 +1,98 @@
+package query
+
+import (
+	"github.com/golang/protobuf/proto"
+	dto "github.com/prometheus/client_model/go"
+	"testing"
+)
+
+func gauge(name string, value float64, labels ...string) *dto.MetricFamily {
+	m := &dto.Metric{Gauge: &dto.Gauge{Value: proto.Float64(value)}}
+	for i := 0; i+1 < len(labels); i += 2 {
+		m.Label = append(m.Label, &dto.LabelPair{Name: proto.String(labels[i]), Value: proto.String(labels[i+1])})
+	}
+	return &dto.MetricFamily{Name: proto.String(name), Type: dto.MetricType_GAUGE.Enum(), Metric: []*dto.Metric{m}}
+}
+
+func TestEval(t *testing.T) {
+	series := Series([]*dto.MetricFamily{
+		gauge("players", 10, "job", "lobby", "instance", "lobby-1"),
+		gauge("players", 20, "job", "lobby", "instance", "lobby-2"),
+		gauge("players", 5, "job", "bedwars", "instance", "bedwars-1"),
+		gauge("sum", 1, "job", "lobby"),
+	})
+
+	for _, tc := range []struct {
+		query    string
+		expected map[string]float64
+	}{
+		{`players{job="lobby"}`, map[string]float64{"lobby-1": 10, "lobby-2": 20}},
+		{`sum(players)`, map[string]float64{"": 35}},
+		{`sum by (job) (players)`, map[string]float64{"lobby": 30, "bedwars": 5}},
+		{`max(players) by (job)`, map[string]float64{"lobby": 20, "bedwars": 5}},
+		{`min without (instance) (players)`, map[string]float64{"lobby": 10, "bedwars": 5}},
+		{`avg by (job,) (players{job=~"lob.*"})`, map[string]float64{"lobby": 15}},
+		{`count(players)`, map[string]float64{"": 3}},
+		{`max(sum by (job) (players))`, map[string]float64{"": 30}},
+		// the operators are no reserved words.
+		{`sum{job="lobby"}`, map[string]float64{"lobby": 1}},
+	} {
+		expr, err := Parse(tc.query)
+		if err != nil {
+			t.Errorf("could not parse %q: %v", tc.query, err)
+			continue
+		}
+		result := expr.Eval(series)
+		if len(result) != len(tc.expected) {
+			t.Errorf("expected %d samples for %q, got %v", len(tc.expected), tc.query, result)
+			continue
+		}
+		for _, s := range result {
+			key := s.Labels["instance"]
+			if key == "" {
+				key = s.Labels["job"]
+			}
+			if v, ok := tc.expected[key]; !ok || v != s.Value {
+				t.Errorf("unexpected sample %v for %q, expected %v", s, tc.query, tc.expected)
+			}
+			_, isSelector := expr.(*selectorExpr)
+			if _, ok := s.Labels["__name__"]; ok && !isSelector {
+				t.Errorf("expected the metric name to be dropped by %q, got %v", tc.query, s.Labels)
+			}
+		}
+	}
+}
+
+func TestSeries(t *testing.T) {
+	series := Series([]*dto.MetricFamily{{
+		Name: proto.String("latency_seconds"),
+		Type: dto.MetricType_HISTOGRAM.Enum(),
+		Metric: []*dto.Metric{{Histogram: &dto.Histogram{
+			SampleCount: proto.Uint64(3),
+			SampleSum:   proto.Float64(1.5),
+			Bucket:      []*dto.Bucket{{UpperBound: proto.Float64(0.5), CumulativeCount: proto.Uint64(2)}},
+		}}},
+	}})
+
+	expected := map[string]float64{`latency_seconds_bucket{le="0.5"}`: 2, `latency_seconds_bucket{le="+Inf"}`: 3, "latency_seconds_sum": 1.5, "latency_seconds_count": 3}
+	if len(series) != len(expected) {
+		t.Fatalf("expected %d series, got %v", len(expected), series)
+	}
+	for _, s := range series {
+		key := s.Labels["__name__"]
+		if le, ok := s.Labels["le"]; ok {
+			key += `{le="` + le + `"}`
+		}
+		if v, ok := expected[key]; !ok || v != s.Value {
+			t.Errorf("unexpected series %v", s)
+		}
+	}
+}
+
+func TestParseInvalid(t *testing.T) {
+	for _, s := range []string{``, `sum(`, `sum()`, `sum by job (players)`, `sum by (job) players`, `avg(players) x`, `sum by ("job") (players)`} {
+		if _, err := Parse(s); err == nil {
+			t.Errorf("expected %q to fail, but it did not.", s)
+		}
+	}
+}
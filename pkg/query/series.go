@@ -0,0 +1,85 @@
+package query
+
+import (
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/model"
+	"math"
+	"strconv"
+)
+
+// Series returns the samples of the metric families like Prometheus
+// would scrape them: histograms and summaries are split into their
+// `_bucket` or quantile, `_sum` and `_count` series.
+func Series(mfs []*dto.MetricFamily) []Sample {
+	var result []Sample
+	for _, mf := range mfs {
+		name := mf.GetName()
+		for _, m := range mf.Metric {
+			labels := func(name string, extra ...string) map[string]string {
+				result := make(map[string]string, len(m.Label)+2)
+				for _, lp := range m.Label {
+					result[lp.GetName()] = lp.GetValue()
+				}
+				result[model.MetricNameLabel] = name
+				for i := 0; i+1 < len(extra); i += 2 {
+					result[extra[i]] = extra[i+1]
+				}
+				return result
+			}
+
+			switch mf.GetType() {
+			case dto.MetricType_COUNTER:
+				result = append(result, Sample{Labels: labels(name), Value: m.GetCounter().GetValue()})
+			case dto.MetricType_GAUGE:
+				result = append(result, Sample{Labels: labels(name), Value: m.GetGauge().GetValue()})
+			case dto.MetricType_UNTYPED:
+				result = append(result, Sample{Labels: labels(name), Value: m.GetUntyped().GetValue()})
+			case dto.MetricType_SUMMARY:
+				s := m.GetSummary()
+				for _, q := range s.Quantile {
+					result = append(result, Sample{Labels: labels(name, model.QuantileLabel, formatFloat(q.GetQuantile(), 'g')), Value: q.GetValue()})
+				}
+				result = append(result,
+					Sample{Labels: labels(name + "_sum"), Value: s.GetSampleSum()},
+					Sample{Labels: labels(name + "_count"), Value: float64(s.GetSampleCount())},
+				)
+			case dto.MetricType_HISTOGRAM:
+				h := m.GetHistogram()
+				inf := false
+				for _, b := range h.Bucket {
+					inf = inf || math.IsInf(b.GetUpperBound(), 1)
+					result = append(result, Sample{Labels: labels(name+"_bucket", model.BucketLabel, formatFloat(b.GetUpperBound(), 'g')), Value: float64(b.GetCumulativeCount())})
+				}
+				if !inf {
+					// the +Inf bucket is implicit in the exposition.
+					result = append(result, Sample{Labels: labels(name+"_bucket", model.BucketLabel, "+Inf"), Value: float64(h.GetSampleCount())})
+				}
+				result = append(result,
+					Sample{Labels: labels(name + "_sum"), Value: h.GetSampleSum()},
+					Sample{Labels: labels(name + "_count"), Value: float64(h.GetSampleCount())},
+				)
+			}
+		}
+	}
+	return result
+}
+
+// FormatValue formats the value of a sample like the Prometheus HTTP API.
+func FormatValue(v float64) string {
+	return formatFloat(v, 'f')
+}
+
+// formatFloat formats v with the format of strconv.FormatFloat,
+// except for the special values, which are formatted like in the
+// exposition format.
+func formatFloat(v float64, format byte) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, format, -1, 64)
+}
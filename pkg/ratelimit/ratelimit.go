@@ -0,0 +1,189 @@
+// Package ratelimit implements token bucket rate limits, which
+// are kept separately for every key, e.g. the IP of a client.
+package ratelimit
+
+import (
+	"errors"
+	"fmt"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"math"
+	"sync"
+	"time"
+)
+
+const (
+	// What the buckets of a Limiter are keyed by.
+	ByIP       = "ip"
+	ByIdentity = "identity"
+	ByJob      = "job"
+
+	// How often buckets which are full again are removed.
+	cleanupInterval = time.Minute
+)
+
+// A Rate allows Rate requests per second, with bursts
+// of up to Burst requests.
+type Rate struct {
+	Rate  float64 `yaml:"rate"`
+	Burst int     `yaml:"burst"`
+}
+
+func (r Rate) validate() error {
+	if r.Rate <= 0 {
+		return fmt.Errorf("rate has to be positive, got %v", r.Rate)
+	}
+	if r.Burst < 1 {
+		return fmt.Errorf("burst has to be at least 1, got %d", r.Burst)
+	}
+	return nil
+}
+
+// A Config is the content of the rate limit file.
+//
+// Example:
+//  by: ip
+//  rate: 5
+//  burst: 10
+//  jobs:
+//    lobby:
+//      rate: 50
+//      burst: 100
+type Config struct {
+	// One of ip, identity or job.
+	By   string `yaml:"by"`
+	Rate `yaml:",inline"`
+	// Jobs override the Rate for pushes to groups of the job.
+	Jobs map[string]Rate `yaml:"jobs"`
+}
+
+// LoadConfig reads and validates the rate limit file at path.
+func LoadConfig(path string) (*Config, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &Config{}
+	if err := yaml.UnmarshalStrict(b, c); err != nil {
+		return nil, fmt.Errorf("invalid rate limit config %s: %v", path, err)
+	}
+	if err := c.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid rate limit config %s: %v", path, err)
+	}
+	return c, nil
+}
+
+// Validate checks the config for invalid values.
+func (c *Config) Validate() error {
+	switch c.By {
+	case ByIP, ByIdentity, ByJob:
+	case "":
+		return errors.New("missing by")
+	default:
+		return fmt.Errorf("invalid by %q, expected one of ip, identity or job", c.By)
+	}
+	if err := c.Rate.validate(); err != nil {
+		return err
+	}
+	for job, r := range c.Jobs {
+		if err := r.validate(); err != nil {
+			return fmt.Errorf("job %q: %v", job, err)
+		}
+	}
+	return nil
+}
+
+// A Limiter keeps a token bucket per key.
+type Limiter struct {
+	config *Config
+
+	mu          sync.Mutex
+	buckets     map[string]*bucket
+	lastCleanup time.Time
+	now         func() time.Time
+}
+
+type bucket struct {
+	rate   Rate
+	tokens float64
+	last   time.Time
+}
+
+// New creates a new Limiter from the config.
+func New(c *Config) *Limiter {
+	return &Limiter{
+		config:      c,
+		buckets:     map[string]*bucket{},
+		lastCleanup: time.Now(),
+		now:         time.Now,
+	}
+}
+
+// By returns what the buckets are keyed by.
+func (l *Limiter) By() string {
+	return l.config.By
+}
+
+// HasJob returns true, if the job has its own Rate.
+func (l *Limiter) HasJob(job string) bool {
+	_, ok := l.config.Jobs[job]
+	return ok
+}
+
+// Allow takes a token of the bucket of the key and returns true.
+// If the bucket is empty, it returns false and the duration after
+// which the next token is available. The job selects the Rate.
+func (l *Limiter) Allow(key, job string) (bool, time.Duration) {
+	rate := l.config.Rate
+	if r, ok := l.config.Jobs[job]; ok {
+		// jobs with their own rate get their own buckets too,
+		// so that they do not drain the ones of other jobs.
+		rate = r
+		key = job + "\xff" + key
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	l.cleanup(now)
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{rate: rate, tokens: float64(rate.Burst), last: now}
+		l.buckets[key] = b
+	}
+	b.refill(now)
+
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	wait := (1 - b.tokens) / b.rate.Rate
+	return false, time.Duration(math.Ceil(wait * float64(time.Second)))
+}
+
+func (b *bucket) refill(now time.Time) {
+	elapsed := now.Sub(b.last).Seconds()
+	if elapsed > 0 {
+		b.tokens = math.Min(float64(b.rate.Burst), b.tokens+elapsed*b.rate.Rate)
+		b.last = now
+	}
+}
+
+// cleanup removes the buckets, which are full again, as
+// they behave just like new ones.
+func (l *Limiter) cleanup(now time.Time) {
+	if now.Sub(l.lastCleanup) < cleanupInterval {
+		return
+	}
+	l.lastCleanup = now
+
+	for key, b := range l.buckets {
+		b.refill(now)
+		if b.tokens >= float64(b.rate.Burst) {
+			delete(l.buckets, key)
+		}
+	}
+}
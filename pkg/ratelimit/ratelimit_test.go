@@ -0,0 +1,61 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLimiter(t *testing.T) {
+	l := New(&Config{
+		By:   ByIP,
+		Rate: Rate{Rate: 1, Burst: 2},
+		Jobs: map[string]Rate{"lobby": {Rate: 10, Burst: 5}},
+	})
+	now := time.Unix(0, 0)
+	l.now = func() time.Time { return now }
+
+	for i := 0; i < 2; i++ {
+		if ok, _ := l.Allow("10.0.0.1", "billing"); !ok {
+			t.Fatalf("expected request %d within the burst to be allowed", i)
+		}
+	}
+	ok, retryAfter := l.Allow("10.0.0.1", "billing")
+	if ok {
+		t.Fatalf("expected request exceeding the burst to be throttled")
+	}
+	if retryAfter != time.Second {
+		t.Errorf("wrong retry after, got: %v, expected: %v", retryAfter, time.Second)
+	}
+
+	// other keys and jobs with their own rate have their own buckets.
+	if ok, _ := l.Allow("10.0.0.2", "billing"); !ok {
+		t.Errorf("expected other key to be allowed")
+	}
+	for i := 0; i < 5; i++ {
+		if ok, _ := l.Allow("10.0.0.1", "lobby"); !ok {
+			t.Errorf("expected request %d of job with override to be allowed", i)
+		}
+	}
+
+	now = now.Add(500 * time.Millisecond)
+	if ok, _ := l.Allow("10.0.0.1", "billing"); ok {
+		t.Errorf("expected half a token not to be enough")
+	}
+	now = now.Add(500 * time.Millisecond)
+	if ok, _ := l.Allow("10.0.0.1", "billing"); !ok {
+		t.Errorf("expected refilled token to be allowed")
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	for _, c := range []Config{
+		{Rate: Rate{Rate: 1, Burst: 1}},
+		{By: "host", Rate: Rate{Rate: 1, Burst: 1}},
+		{By: ByJob, Rate: Rate{Rate: 0, Burst: 1}},
+		{By: ByJob, Rate: Rate{Rate: 1, Burst: 1}, Jobs: map[string]Rate{"lobby": {Rate: 1}}},
+	} {
+		if err := c.Validate(); err == nil {
+			t.Errorf("expected %+v to be invalid, but it was not.", c)
+		}
+	}
+}
@@ -0,0 +1,121 @@
+// Package relabel rewrites label sets like the relabel_configs
+// of Prometheus, supporting the most common actions.
+package relabel
+
+import (
+	"errors"
+	"fmt"
+	"github.com/prometheus/common/model"
+	"regexp"
+	"strings"
+)
+
+const (
+	// The actions of a Config.
+	Replace   = "replace"
+	Keep      = "keep"
+	Drop      = "drop"
+	LabelKeep = "labelkeep"
+	LabelDrop = "labeldrop"
+)
+
+// A Config rewrites the labels, in the same way as Prometheus does.
+// Missing fields get the defaults of Prometheus when unmarshalled.
+//
+// Example:
+//  - source_labels: [env]
+//    regex: dev|test
+//    action: drop
+//  - source_labels: [instance]
+//    regex: '(.*):\d+'
+//    target_label: host
+type Config struct {
+	SourceLabels []string `yaml:"source_labels"`
+	Separator    string   `yaml:"separator"`
+	Regex        string   `yaml:"regex"`
+	TargetLabel  string   `yaml:"target_label"`
+	Replacement  string   `yaml:"replacement"`
+	// One of replace, keep, drop, labelkeep or labeldrop.
+	Action string `yaml:"action"`
+
+	// the anchored Regex, set by Validate.
+	regex *regexp.Regexp
+}
+
+// UnmarshalYAML implements yaml.Unmarshaler and sets the defaults.
+func (c *Config) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	*c = Config{Separator: ";", Regex: "(.*)", Replacement: "$1", Action: Replace}
+	type plain Config
+	return unmarshal((*plain)(c))
+}
+
+// Validate checks the config for invalid values. It
+// has to be called, before the config is used.
+func (c *Config) Validate() error {
+	switch c.Action {
+	case Replace:
+		if c.TargetLabel == "" {
+			return errors.New("missing target_label for action replace")
+		}
+		if !model.LabelName(c.TargetLabel).IsValid() || c.TargetLabel == model.MetricNameLabel {
+			return fmt.Errorf("invalid target_label %q", c.TargetLabel)
+		}
+	case Keep, Drop, LabelKeep, LabelDrop:
+	default:
+		return fmt.Errorf("unknown action %q", c.Action)
+	}
+
+	regex, err := regexp.Compile("^(?:" + c.Regex + ")$")
+	if err != nil {
+		return fmt.Errorf("invalid regex %q: %v", c.Regex, err)
+	}
+	c.regex = regex
+	return nil
+}
+
+// Process applies the configs to the labels one after another and
+// returns the result, or false if the labels have been dropped.
+// The labels themselves are not modified.
+func Process(labels map[string]string, configs []*Config) (map[string]string, bool) {
+	result := make(map[string]string, len(labels))
+	for name, value := range labels {
+		result[name] = value
+	}
+
+	for _, c := range configs {
+		values := make([]string, len(c.SourceLabels))
+		for i, name := range c.SourceLabels {
+			values[i] = result[name]
+		}
+		value := strings.Join(values, c.Separator)
+
+		switch c.Action {
+		case Keep:
+			if !c.regex.MatchString(value) {
+				return nil, false
+			}
+		case Drop:
+			if c.regex.MatchString(value) {
+				return nil, false
+			}
+		case Replace:
+			indexes := c.regex.FindStringSubmatchIndex(value)
+			if indexes == nil {
+				continue
+			}
+			// like a missing label, an empty value deletes the label.
+			if r := c.regex.ExpandString(nil, c.Replacement, value, indexes); len(r) > 0 {
+				result[c.TargetLabel] = string(r)
+			} else {
+				delete(result, c.TargetLabel)
+			}
+		case LabelKeep, LabelDrop:
+			for name := range result {
+				if c.regex.MatchString(name) != (c.Action == LabelKeep) {
+					delete(result, name)
+				}
+			}
+		}
+	}
+	return result, true
+}
@@ -0,0 +1,97 @@
+package relabel
+
+import (
+	"gopkg.in/yaml.v2"
+	"reflect"
+	"testing"
+)
+
+func parse(t *testing.T, s string) []*Config {
+	var configs []*Config
+	if err := yaml.UnmarshalStrict([]byte(s), &configs); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range configs {
+		if err := c.Validate(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return configs
+}
+
+func TestProcess(t *testing.T) {
+	configs := parse(t, `
+- source_labels: [env]
+  regex: dev|test
+  action: drop
+- source_labels: [instance]
+  regex: '(.*):\d+'
+  target_label: host
+- source_labels: [zone]
+  regex: ''
+  target_label: zone
+  replacement: unknown
+- regex: tmp_.*
+  action: labeldrop
+`)
+
+	labels := map[string]string{"instance": "lobby-17:8080", "tmp_id": "4", "env": "prod"}
+	result, ok := Process(labels, configs)
+	expected := map[string]string{"instance": "lobby-17:8080", "host": "lobby-17", "zone": "unknown", "env": "prod"}
+	if !ok || !reflect.DeepEqual(result, expected) {
+		t.Errorf("wrong labels, got: %v, expected: %v", result, expected)
+	}
+	if len(labels) != 3 {
+		t.Errorf("labels have been modified: %v", labels)
+	}
+
+	// the regular expressions are anchored.
+	if _, ok := Process(map[string]string{"env": "devops"}, configs); !ok {
+		t.Error("expected devops to be kept")
+	}
+	if _, ok := Process(map[string]string{"env": "dev"}, configs); ok {
+		t.Error("expected dev to be dropped")
+	}
+
+	keep := parse(t, `
+- source_labels: [__name__, job]
+  separator: /
+  regex: players/lobby
+  action: keep
+- regex: __name__|job
+  action: labelkeep
+- source_labels: [job]
+  target_label: job
+  replacement: ''
+`)
+	if _, ok := Process(map[string]string{"__name__": "players", "job": "arena"}, keep); ok {
+		t.Error("expected players of the arena to be dropped")
+	}
+	result, ok = Process(map[string]string{"__name__": "players", "job": "lobby", "map": "castle"}, keep)
+	if expected := map[string]string{"__name__": "players"}; !ok || !reflect.DeepEqual(result, expected) {
+		t.Errorf("wrong labels, got: %v, expected: %v", result, expected)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	for _, s := range []string{
+		"- action: replace",
+		"- target_label: __name__",
+		"- target_label: 0host",
+		"- action: hashmod",
+		"- action: drop\n  regex: '('",
+	} {
+		var configs []*Config
+		if err := yaml.UnmarshalStrict([]byte(s), &configs); err != nil {
+			t.Fatal(err)
+		}
+		if err := configs[0].Validate(); err == nil {
+			t.Errorf("expected error for config: %q", s)
+		}
+	}
+
+	var configs []*Config
+	if err := yaml.UnmarshalStrict([]byte("- modulus: 2"), &configs); err == nil {
+		t.Error("expected error for unknown field")
+	}
+}
@@ -0,0 +1,284 @@
+// Package selector parses Prometheus series selectors like
+// `players{server=~"lobby.*",region!="eu"}` into label matchers.
+package selector
+
+import (
+	"fmt"
+	"github.com/prometheus/common/model"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// MatchType is the operator of a Matcher.
+type MatchType int
+
+const (
+	MatchEqual MatchType = iota
+	MatchNotEqual
+	MatchRegexp
+	MatchNotRegexp
+)
+
+func (t MatchType) String() string {
+	switch t {
+	case MatchEqual:
+		return "="
+	case MatchNotEqual:
+		return "!="
+	case MatchRegexp:
+		return "=~"
+	case MatchNotRegexp:
+		return "!~"
+	}
+	return "?"
+}
+
+// A Matcher matches the value of the label with the Name.
+// Just like in Prometheus, a missing label has the value "".
+type Matcher struct {
+	Type  MatchType
+	Name  string
+	Value string
+
+	re *regexp.Regexp
+}
+
+// NewMatcher creates a new Matcher. Regular expressions
+// are anchored, so they have to match the whole value.
+func NewMatcher(t MatchType, name, value string) (*Matcher, error) {
+	m := &Matcher{Type: t, Name: name, Value: value}
+	if t == MatchRegexp || t == MatchNotRegexp {
+		re, err := regexp.Compile("^(?:" + value + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("invalid regular expression %q: %v", value, err)
+		}
+		m.re = re
+	}
+	return m, nil
+}
+
+// Matches returns true, if the value matches.
+func (m *Matcher) Matches(value string) bool {
+	switch m.Type {
+	case MatchEqual:
+		return value == m.Value
+	case MatchNotEqual:
+		return value != m.Value
+	case MatchRegexp:
+		return m.re.MatchString(value)
+	case MatchNotRegexp:
+		return !m.re.MatchString(value)
+	}
+	return false
+}
+
+func (m *Matcher) String() string {
+	return fmt.Sprintf("%s%s%q", m.Name, m.Type, m.Value)
+}
+
+// MatchLabels returns true, if all matchers match the labels.
+func MatchLabels(matchers []*Matcher, labels map[string]string) bool {
+	for _, m := range matchers {
+		if !m.Matches(labels[m.Name]) {
+			return false
+		}
+	}
+	return true
+}
+
+// Parse parses a series selector. The metric name is optional, if
+// given it is returned as matcher for the `__name__` label.
+// At least one matcher has to be given.
+func Parse(s string) ([]*Matcher, error) {
+	p := &Parser{input: s}
+	matchers, err := p.ParseSelector()
+	if err != nil {
+		return nil, err
+	}
+	p.SkipSpace()
+	if !p.Done() {
+		return nil, p.Errorf("unexpected %q", p.input[p.pos:])
+	}
+	return matchers, nil
+}
+
+// A Parser reads selectors from the input. It is exported,
+// so that other languages containing selectors can reuse it.
+type Parser struct {
+	input string
+	pos   int
+}
+
+// NewParser returns a Parser reading from the input.
+func NewParser(input string) *Parser {
+	return &Parser{input: input}
+}
+
+// Pos returns the current position in the input.
+func (p *Parser) Pos() int {
+	return p.pos
+}
+
+// Done returns true, if the whole input is read.
+func (p *Parser) Done() bool {
+	return p.pos >= len(p.input)
+}
+
+// Peek returns the next byte, or 0 at the end of the input.
+func (p *Parser) Peek() byte {
+	if p.Done() {
+		return 0
+	}
+	return p.input[p.pos]
+}
+
+// Consume skips white space and reads s, if the input continues with it.
+func (p *Parser) Consume(s string) bool {
+	p.SkipSpace()
+	if strings.HasPrefix(p.input[p.pos:], s) {
+		p.pos += len(s)
+		return true
+	}
+	return false
+}
+
+// SkipSpace skips white space.
+func (p *Parser) SkipSpace() {
+	for !p.Done() && strings.IndexByte(" \t\r\n", p.Peek()) >= 0 {
+		p.pos++
+	}
+}
+
+// Errorf returns an error pointing to the current position.
+func (p *Parser) Errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("parse error at position %d: %s", p.pos+1, fmt.Sprintf(format, args...))
+}
+
+// Identifier reads a metric name, which may contain colons.
+// It returns "", if the input does not continue with one.
+func (p *Parser) Identifier() string {
+	p.SkipSpace()
+	start := p.pos
+	for !p.Done() {
+		c := p.Peek()
+		isLetter := c == '_' || c == ':' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+		if !isLetter && !(p.pos > start && c >= '0' && c <= '9') {
+			break
+		}
+		p.pos++
+	}
+	return p.input[start:p.pos]
+}
+
+// ParseSelector reads a selector like `name{label="value"}`.
+func (p *Parser) ParseSelector() ([]*Matcher, error) {
+	var matchers []*Matcher
+
+	start := p.pos
+	if name := p.Identifier(); name != "" {
+		if !model.IsValidMetricName(model.LabelValue(name)) {
+			p.pos = start
+			return nil, p.Errorf("invalid metric name %q", name)
+		}
+		m, _ := NewMatcher(MatchEqual, model.MetricNameLabel, name)
+		matchers = append(matchers, m)
+	}
+
+	if !p.Consume("{") {
+		if len(matchers) == 0 {
+			return nil, p.Errorf("expected metric name or '{'")
+		}
+		return matchers, nil
+	}
+	for {
+		if p.Consume("}") {
+			break
+		}
+		m, err := p.parseMatcher()
+		if err != nil {
+			return nil, err
+		}
+		matchers = append(matchers, m)
+
+		if p.Consume(",") {
+			continue
+		}
+		if !p.Consume("}") {
+			return nil, p.Errorf("expected ',' or '}'")
+		}
+		break
+	}
+
+	if len(matchers) == 0 {
+		return nil, p.Errorf("selector must contain at least one matcher")
+	}
+	return matchers, nil
+}
+
+func (p *Parser) parseMatcher() (*Matcher, error) {
+	name := p.Identifier()
+	if name == "" || !model.LabelName(name).IsValid() {
+		return nil, p.Errorf("expected label name")
+	}
+
+	var t MatchType
+	switch {
+	case p.Consume("=~"):
+		t = MatchRegexp
+	case p.Consume("!~"):
+		t = MatchNotRegexp
+	case p.Consume("!="):
+		t = MatchNotEqual
+	case p.Consume("="):
+		t = MatchEqual
+	default:
+		return nil, p.Errorf("expected one of =, !=, =~ or !~ after %q", name)
+	}
+
+	value, err := p.String()
+	if err != nil {
+		return nil, err
+	}
+	m, err := NewMatcher(t, name, value)
+	if err != nil {
+		return nil, p.Errorf("%v", err)
+	}
+	return m, nil
+}
+
+// String reads a quoted string. Double and single quoted strings
+// support Go escape sequences, backtick quoted ones are raw.
+func (p *Parser) String() (string, error) {
+	p.SkipSpace()
+	quote := p.Peek()
+	if quote != '"' && quote != '\'' && quote != '`' {
+		return "", p.Errorf("expected quoted string")
+	}
+	p.pos++
+
+	var b strings.Builder
+	for {
+		if p.Done() {
+			return "", p.Errorf("unterminated string")
+		}
+		c := p.input[p.pos]
+		switch {
+		case c == quote:
+			p.pos++
+			return b.String(), nil
+		case c == '\\' && quote != '`':
+			r, _, tail, err := strconv.UnquoteChar(p.input[p.pos:], quote)
+			if err != nil {
+				return "", p.Errorf("invalid escape sequence")
+			}
+			b.WriteRune(r)
+			p.pos = len(p.input) - len(tail)
+		default:
+			r, size := utf8.DecodeRuneInString(p.input[p.pos:])
+			b.WriteRune(r)
+			p.pos += size
+		}
+	}
+}
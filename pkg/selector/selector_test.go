@@ -0,0 +1,41 @@
+package selector
+
+import "testing"
+
+func TestParse(t *testing.T) {
+	_, err := Parse(`players{server=~"lobby.*", region!='eu', "x"!~` + "`a|b`" + `,}`)
+	if err == nil {
+		t.Errorf("expected quoted label name to fail, but it did not.")
+	}
+
+	matchers, err := Parse(`players{server=~"lobby.*", region!='eu', shard!~` + "`a|b`" + `,}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{`__name__="players"`, `server=~"lobby.*"`, `region!="eu"`, `shard!~"a|b"`}
+	if len(matchers) != len(expected) {
+		t.Fatalf("wrong number of matchers, got: %v, expected: %v", matchers, expected)
+	}
+	for i, m := range matchers {
+		if m.String() != expected[i] {
+			t.Errorf("wrong matcher, got: %s, expected: %s", m, expected[i])
+		}
+	}
+
+	labels := map[string]string{"__name__": "players", "server": "lobby17", "region": "us"}
+	if !MatchLabels(matchers, labels) {
+		t.Errorf("expected %v to match %v", matchers, labels)
+	}
+	labels["server"] = "xlobby17"
+	if MatchLabels(matchers, labels) {
+		t.Errorf("expected regular expression to be anchored")
+	}
+}
+
+func TestParseInvalid(t *testing.T) {
+	for _, s := range []string{``, `{}`, `{job}`, `{job="a"`, `{job=~"("}`, `{job="a"} x`, `{job=a}`, `{job="a}`} {
+		if _, err := Parse(s); err == nil {
+			t.Errorf("expected %q to fail, but it did not.", s)
+		}
+	}
+}
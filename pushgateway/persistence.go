@@ -0,0 +1,123 @@
+// Package pushgateway imports the persistence file of the Prometheus
+// Pushgateway (`--persistence.file`), so that its groups can be carried
+// over to Thor.
+//
+// Source: github.com/prometheus/pushgateway/storage
+package pushgateway
+
+import (
+	"dev.volix.ops/thor/pkg/slog"
+	"dev.volix.ops/thor/storage"
+	"dev.volix.ops/thor/utils"
+	"encoding/gob"
+	"fmt"
+	"github.com/golang/protobuf/proto"
+	dto "github.com/prometheus/client_model/go"
+	"os"
+	"sort"
+	"time"
+)
+
+// The families the Pushgateway adds to every group. They are not
+// imported, as Thor would never update them again.
+const (
+	pushTimeName        = "push_time_seconds"
+	pushFailureTimeName = "push_failure_time_seconds"
+)
+
+// The following types mirror the ones the Pushgateway encodes with
+// encoding/gob. Only the names and types of the fields have to match.
+
+type groupingKeyToMetricGroup map[string]metricGroup
+
+type metricGroup struct {
+	Labels  map[string]string
+	Metrics map[string]timestampedMetricFamily
+}
+
+type timestampedMetricFamily struct {
+	Timestamp            time.Time
+	GobbableMetricFamily *gobbableMetricFamily
+}
+
+// gobbableMetricFamily is a dto.MetricFamily, which is
+// encoded with protobuf inside of the gob stream.
+type gobbableMetricFamily dto.MetricFamily
+
+func (gmf *gobbableMetricFamily) GobDecode(b []byte) error {
+	return proto.Unmarshal(b, (*dto.MetricFamily)(gmf))
+}
+
+func (gmf *gobbableMetricFamily) GobEncode() ([]byte, error) {
+	return proto.Marshal((*dto.MetricFamily)(gmf))
+}
+
+// ReadPersistenceFile reads the persistence file at path and returns
+// a WriteRequest for every group, sorted by their grouping key. The
+// Timestamp of a request is the time of the last push to the group.
+func ReadPersistenceFile(path string) ([]storage.WriteRequest, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	groups := groupingKeyToMetricGroup{}
+	if err := gob.NewDecoder(f).Decode(&groups); err != nil {
+		return nil, fmt.Errorf("invalid pushgateway persistence file %s: %v", path, err)
+	}
+
+	wrs := make([]storage.WriteRequest, 0, len(groups))
+	for _, group := range groups {
+		if len(group.Labels) == 0 {
+			continue
+		}
+
+		wr := storage.WriteRequest{
+			Labels:         group.Labels,
+			MetricFamilies: make(map[string]*dto.MetricFamily, len(group.Metrics)),
+			Replace:        true,
+		}
+		for name, tmf := range group.Metrics {
+			if name == pushTimeName || name == pushFailureTimeName || tmf.GobbableMetricFamily == nil {
+				continue
+			}
+			wr.MetricFamilies[name] = (*dto.MetricFamily)(tmf.GobbableMetricFamily)
+			if tmf.Timestamp.After(wr.Timestamp) {
+				wr.Timestamp = tmf.Timestamp
+			}
+		}
+		if len(wr.MetricFamilies) == 0 {
+			continue
+		}
+		wrs = append(wrs, wr)
+	}
+
+	sort.Slice(wrs, func(i, j int) bool {
+		return utils.GroupingKeyFor(wrs[i].Labels) < utils.GroupingKeyFor(wrs[j].Labels)
+	})
+	return wrs, nil
+}
+
+// Import reads the persistence file at path and writes its groups
+// into the storage. Every group is checked just like a push, so it
+// is sanitized and groups inconsistent with the already imported
+// ones are skipped. It returns the number of imported groups.
+func Import(ms *storage.MetricStorage, path string) (int, error) {
+	wrs, err := ReadPersistenceFile(path)
+	if err != nil {
+		return 0, err
+	}
+
+	imported := 0
+	for _, wr := range wrs {
+		wr.Done = make(chan error, 1)
+		ms.SubmitWriteRequest(wr)
+		if err := <-wr.Done; err != nil {
+			slog.Error(fmt.Sprintf("skipping pushgateway group %v: %v", wr.Labels, err))
+			continue
+		}
+		imported++
+	}
+	return imported, nil
+}
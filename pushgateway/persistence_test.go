@@ -0,0 +1,120 @@
+package pushgateway
+
+import (
+	"dev.volix.ops/thor/storage"
+	"encoding/gob"
+	"github.com/golang/protobuf/proto"
+	dto "github.com/prometheus/client_model/go"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func gauge(name string, value float64, labels ...string) *gobbableMetricFamily {
+	m := &dto.Metric{Gauge: &dto.Gauge{Value: proto.Float64(value)}}
+	for i := 0; i+1 < len(labels); i += 2 {
+		m.Label = append(m.Label, &dto.LabelPair{Name: proto.String(labels[i]), Value: proto.String(labels[i+1])})
+	}
+	return &gobbableMetricFamily{
+		Name:   proto.String(name),
+		Type:   dto.MetricType_GAUGE.Enum(),
+		Metric: []*dto.Metric{m},
+	}
+}
+
+func writePersistenceFile(t *testing.T, dir string, groups groupingKeyToMetricGroup) string {
+	path := filepath.Join(dir, "persistence")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err := gob.NewEncoder(f).Encode(groups); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestImport(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pushgateway")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	pushed := time.Date(2020, 11, 3, 12, 0, 0, 0, time.UTC)
+	path := writePersistenceFile(t, dir, groupingKeyToMetricGroup{
+		"lobby": {
+			Labels: map[string]string{"job": "lobby"},
+			Metrics: map[string]timestampedMetricFamily{
+				"players":           {Timestamp: pushed, GobbableMetricFamily: gauge("players", 42, "job", "lobby")},
+				"push_time_seconds": {Timestamp: pushed, GobbableMetricFamily: gauge("push_time_seconds", 1604404800, "job", "lobby")},
+			},
+		},
+		"arena": {
+			Labels: map[string]string{"job": "arena", "instance": "arena1"},
+			Metrics: map[string]timestampedMetricFamily{
+				"players": {Timestamp: pushed, GobbableMetricFamily: gauge("players", 7)},
+			},
+		},
+		"billing": {
+			// inconsistent with the other groups, as players is a counter here.
+			Labels: map[string]string{"job": "billing"},
+			Metrics: map[string]timestampedMetricFamily{
+				"players": {Timestamp: pushed, GobbableMetricFamily: &gobbableMetricFamily{
+					Name:   proto.String("players"),
+					Type:   dto.MetricType_COUNTER.Enum(),
+					Metric: []*dto.Metric{{Counter: &dto.Counter{Value: proto.Float64(1)}}},
+				}},
+			},
+		},
+	})
+
+	ms := storage.NewMetricStorage()
+	n, err := Import(ms, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Errorf("expected 2 imported groups, got %d", n)
+	}
+
+	groups := ms.GetMetricGroups()
+	if len(groups) != 2 {
+		t.Fatalf("expected 2 groups, got %v", groups)
+	}
+	for _, group := range groups {
+		if _, ok := group.MetricFamilies["push_time_seconds"]; ok {
+			t.Errorf("push_time_seconds of %v was imported", group.Labels)
+		}
+		if !group.Timestamp.Equal(pushed) {
+			t.Errorf("expected timestamp %v, got %v", pushed, group.Timestamp)
+		}
+		// the grouping labels have to be added by the sanitization.
+		m := group.MetricFamilies["players"].Metric[0]
+		if len(m.Label) != 2 {
+			t.Errorf("expected job and instance label, got %v", m.Label)
+		}
+	}
+}
+
+func TestImportInvalid(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pushgateway")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "persistence")
+	if err := ioutil.WriteFile(path, []byte("not gob"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Import(storage.NewMetricStorage(), path); err == nil {
+		t.Error("expected error for invalid file")
+	}
+	if _, err := Import(storage.NewMetricStorage(), filepath.Join(dir, "missing")); err == nil {
+		t.Error("expected error for missing file")
+	}
+}
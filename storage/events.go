@@ -0,0 +1,230 @@
+package storage
+
+import (
+	"dev.volix.ops/thor/utils"
+	"github.com/golang/protobuf/proto"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	dto "github.com/prometheus/client_model/go"
+	"sort"
+	"time"
+)
+
+var droppedEvents = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "thor_events_dropped_total",
+	Help: "Total number of events dropped, because a subscriber could not keep up.",
+})
+
+// The EventType tells how a group has been changed.
+type EventType string
+
+const (
+	EventPush    EventType = "push"
+	EventReplace EventType = "replace"
+	EventDelete  EventType = "delete"
+	EventExpire  EventType = "expire"
+)
+
+// An Event describes a change of a group by a write request, or
+// its expiry.
+//
+// For pushes and replaces, MetricFamilies contains copies of the
+// written families with their values after the write, i.e. merged
+// with the previous values, unless the subscription is one of
+// SubscribeGroups. For deletes and expiries, DeletedFamilies
+// contains the names of the families, which have been deleted
+// completely or partially.
+//
+// GroupCreated and GroupDeleted are true, if the group has been
+// created or deleted as a whole by the change.
+type Event struct {
+	Type            EventType
+	Labels          map[string]string
+	Time            time.Time
+	MetricFamilies  []*dto.MetricFamily
+	DeletedFamilies []string
+	GroupCreated    bool
+	GroupDeleted    bool
+}
+
+// Subscribe returns a channel receiving an Event for every change of
+// the groups, and a function to cancel the subscription. Events are
+// dropped if the buffer of the channel is full, so that slow subscribers
+// never block writes.
+func (ms *MetricStorage) Subscribe(buffer int) (<-chan Event, func()) {
+	return ms.subscribe(buffer, true)
+}
+
+// SubscribeGroups is the same as Subscribe, but the events do not
+// contain the written families, which would have to be copied
+// for every write otherwise.
+func (ms *MetricStorage) SubscribeGroups(buffer int) (<-chan Event, func()) {
+	return ms.subscribe(buffer, false)
+}
+
+func (ms *MetricStorage) subscribe(buffer int, families bool) (<-chan Event, func()) {
+	ch := make(chan Event, buffer)
+
+	ms.subscribersLock.Lock()
+	defer ms.subscribersLock.Unlock()
+	if ms.subscribers == nil {
+		ms.subscribers = make(map[chan Event]bool)
+	}
+	ms.subscribers[ch] = families
+
+	return ch, func() {
+		ms.subscribersLock.Lock()
+		defer ms.subscribersLock.Unlock()
+		if _, ok := ms.subscribers[ch]; ok {
+			delete(ms.subscribers, ch)
+			close(ch)
+		}
+	}
+}
+
+// subscribed returns true, if there are subscribers.
+func (ms *MetricStorage) subscribed() bool {
+	ms.subscribersLock.Lock()
+	defer ms.subscribersLock.Unlock()
+
+	return len(ms.subscribers) > 0
+}
+
+// subscribedFamilies returns true, if there are
+// subscribers receiving the families.
+func (ms *MetricStorage) subscribedFamilies() bool {
+	ms.subscribersLock.Lock()
+	defer ms.subscribersLock.Unlock()
+
+	for _, families := range ms.subscribers {
+		if families {
+			return true
+		}
+	}
+	return false
+}
+
+// publish sends the event to all subscribers.
+func (ms *MetricStorage) publish(e Event) {
+	ms.subscribersLock.Lock()
+	defer ms.subscribersLock.Unlock()
+
+	groupEvent := e
+	groupEvent.MetricFamilies = nil
+	for ch, families := range ms.subscribers {
+		ev := e
+		if !families {
+			ev = groupEvent
+		}
+		select {
+		case ch <- ev:
+		default:
+			droppedEvents.Inc()
+		}
+	}
+}
+
+// familySizes returns the number of metrics of every family of the group.
+func familySizes(group MetricGroup) map[string]int {
+	sizes := make(map[string]int, len(group.MetricFamilies))
+	for name, mf := range group.MetricFamilies {
+		sizes[name] = len(mf.Metric)
+	}
+	return sizes
+}
+
+// event returns the Event of the write request, which has just been applied
+// to the group with the grouping key. before are the family sizes of the group
+// before and existed tells if it existed. It returns false, if the request did
+// not change anything. The lock has to be held.
+func (ms *MetricStorage) event(wr WriteRequest, groupingKey string, before map[string]int, existed bool) (Event, bool) {
+	e := Event{Labels: wr.Labels, Time: time.Now()}
+	group, exists := ms.metricGroups[groupingKey]
+	e.GroupCreated = !existed && exists
+	e.GroupDeleted = existed && !exists
+
+	if wr.MetricFamilies == nil || wr.isPartialDelete() {
+		e.Type = EventDelete
+		for name, n := range before {
+			if mf, ok := group.MetricFamilies[name]; !ok || len(mf.Metric) < n {
+				e.DeletedFamilies = append(e.DeletedFamilies, name)
+			}
+		}
+		sort.Strings(e.DeletedFamilies)
+		return e, len(e.DeletedFamilies) > 0
+	}
+
+	e.Type = EventPush
+	if wr.Replace {
+		e.Type = EventReplace
+	}
+	if !ms.subscribedFamilies() {
+		return e, true
+	}
+	for name := range wr.MetricFamilies {
+		if mf, ok := group.MetricFamilies[name]; ok {
+			e.MetricFamilies = append(e.MetricFamilies, utils.CopyMetricFamily(mf))
+		}
+	}
+	sort.Slice(e.MetricFamilies, func(i, j int) bool {
+		return e.MetricFamilies[i].GetName() < e.MetricFamilies[j].GetName()
+	})
+	return e, true
+}
+
+// publishDeleted publishes a delete or expiry of the whole group.
+func (ms *MetricStorage) publishDeleted(t EventType, group MetricGroup) {
+	e := Event{Type: t, Labels: group.Labels, Time: time.Now(), GroupDeleted: true}
+	for name := range group.MetricFamilies {
+		e.DeletedFamilies = append(e.DeletedFamilies, name)
+	}
+	sort.Strings(e.DeletedFamilies)
+	ms.publish(e)
+}
+
+// publishSwapped publishes the changes of swapping the groups old for the
+// current ones, e.g. by a restore: a delete of every group which is gone,
+// and a replace of every group which has been created or changed.
+// The lock has to be held.
+func (ms *MetricStorage) publishSwapped(old map[string]MetricGroup) {
+	if !ms.subscribed() {
+		return
+	}
+	for key, group := range old {
+		if _, ok := ms.metricGroups[key]; !ok {
+			ms.publishDeleted(EventDelete, group)
+		}
+	}
+
+	families := ms.subscribedFamilies()
+	for key, group := range ms.metricGroups {
+		prev, existed := old[key]
+		if existed && sameFamilies(prev.MetricFamilies, group.MetricFamilies) {
+			continue
+		}
+
+		e := Event{Type: EventReplace, Labels: group.Labels, Time: time.Now(), GroupCreated: !existed}
+		if families {
+			for _, mf := range group.MetricFamilies {
+				e.MetricFamilies = append(e.MetricFamilies, utils.CopyMetricFamily(mf))
+			}
+			sort.Slice(e.MetricFamilies, func(i, j int) bool {
+				return e.MetricFamilies[i].GetName() < e.MetricFamilies[j].GetName()
+			})
+		}
+		ms.publish(e)
+	}
+}
+
+// sameFamilies returns true, if both have the same families and values.
+func sameFamilies(a, b map[string]*dto.MetricFamily) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for name, mf := range a {
+		if other, ok := b[name]; !ok || !proto.Equal(mf, other) {
+			return false
+		}
+	}
+	return true
+}
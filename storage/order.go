@@ -0,0 +1,446 @@
+package storage
+
+import (
+	"dev.volix.ops/thor/utils"
+	"github.com/golang/protobuf/proto"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/model"
+	"time"
+)
+
+// How long the stamps are kept at most, if an origin does not send any
+// requests. Requests replicated even later may undo the newer ones they
+// are ordered before.
+const stampTTL = time.Hour
+
+// How many requests are applied between the sweeps of the stamps.
+const sweepInterval = 4096
+
+// A stamp orders the writes of different origins, which do not commute,
+// i.e. overwrites of gauges, absolute writes, replaces and deletes: the
+// write with the later time wins, with the origin as tiebreak, so that
+// all replicas keep the same one, no matter in which order they apply
+// them. The times are taken from a hybrid logical clock, see nextStamp.
+//
+// Increments of counters and histograms commute among each other, but
+// not with the other writes. So they are logged with their stamps, until
+// every origin has sent newer requests, and added again to the metrics
+// replaced, deleted or overwritten by an older write applied afterwards.
+type stamp struct {
+	time   time.Time
+	origin string
+}
+
+// before returns true, if s is ordered before o.
+func (s stamp) before(o stamp) bool {
+	if !s.time.Equal(o.time) {
+		return s.time.Before(o.time)
+	}
+	return s.origin < o.origin
+}
+
+// groupStamps are the stamps of a group: removed is the one of its last
+// replace or delete, series the ones of its metrics, by seriesKey.
+type groupStamps struct {
+	labels  map[string]string
+	removed stamp
+	series  map[string]*seriesStamp
+}
+
+// A seriesStamp contains the stamp of the last overwrite or delete of a
+// metric of the family, and its increments afterwards. If labels is nil,
+// it is the stamp of the delete of the whole family instead.
+type seriesStamp struct {
+	stamp
+	family     string
+	labels     []*dto.LabelPair
+	mt         dto.MetricType
+	increments []increment
+}
+
+// An increment of a counter or histogram.
+type increment struct {
+	stamp
+	delta *dto.Metric
+}
+
+// seriesKey returns the key of the metric with the labels in the
+// family, or the key of the whole family if labels is nil.
+func seriesKey(family string, labels []*dto.LabelPair) string {
+	if labels == nil {
+		return family
+	}
+	return family + string(model.SeparatorByte) + utils.GroupingKeyForLabelPair(labels)
+}
+
+// overwrites returns true, if merging a metric of the
+// type overwrites the previous value.
+func overwrites(mt dto.MetricType) bool {
+	return mt == dto.MetricType_GAUGE || mt == dto.MetricType_UNTYPED || mt == dto.MetricType_SUMMARY
+}
+
+// ordered returns true, if the writes are ordered by their stamps,
+// which is the case if replication is enabled.
+func (ms *MetricStorage) ordered() bool {
+	return ms.versions != nil
+}
+
+// nextStamp returns the stamp of the next local request. Its time is
+// after the one of every request applied so far, even if the clock of
+// another origin is ahead. The lock has to be held.
+func (ms *MetricStorage) nextStamp() stamp {
+	// without monotonic clock reading, like the times of the peers.
+	now := time.Now().Round(0)
+	if !ms.clock.Before(now) {
+		now = ms.clock.Add(time.Nanosecond)
+	}
+	ms.clock = now
+	return stamp{time: now, origin: ms.origin}
+}
+
+// observe advances the clock to the stamp of a replicated
+// request. The lock has to be held.
+func (ms *MetricStorage) observe(s stamp) {
+	if ms.clock.Before(s.time) {
+		ms.clock = s.time
+	}
+	if s.origin != ms.origin {
+		ms.seen[s.origin] = s.time
+	}
+}
+
+// order adapts the request with the stamp s to the newer writes of other
+// origins, which have already been applied, so that the result is the
+// same as if it had been applied before them: it is dropped completely,
+// if the group has been replaced, deleted or wiped later, and so are the
+// metrics which have been overwritten or deleted later. Replaces and
+// deletes keep these metrics and the later increments instead, they are
+// turned into replaces with only those. Overwrites of metrics keep their
+// later increments as well. Partial deletes are adapted by keepNewer.
+// It returns false, if nothing is left to apply. The lock has to be held.
+func (ms *MetricStorage) order(wr *WriteRequest, key string, s stamp) bool {
+	gs := ms.stamps[key]
+	if s.before(ms.wiped) || (gs != nil && s.before(gs.removed)) {
+		return false
+	}
+	if gs == nil || wr.isPartialDelete() {
+		return true
+	}
+
+	if wr.MetricFamilies == nil || wr.Replace {
+		whole, deltas := gs.newer(ms.metricGroups[key], s)
+		if len(whole) == 0 && len(deltas) == 0 {
+			return true
+		}
+		if wr.MetricFamilies == nil {
+			wr.MetricFamilies = make(map[string]*dto.MetricFamily, len(whole)+len(deltas))
+		}
+		wr.Replace = true
+		mergeGroups(MetricGroup{MetricFamilies: wr.MetricFamilies}, MetricGroup{MetricFamilies: whole}, true)
+		mergeGroups(MetricGroup{MetricFamilies: wr.MetricFamilies}, MetricGroup{MetricFamilies: deltas}, false)
+		return true
+	}
+
+	n := len(wr.MetricFamilies)
+	for name, mf := range wr.MetricFamilies {
+		if fs, ok := gs.series[seriesKey(name, nil)]; ok && s.before(fs.stamp) {
+			delete(wr.MetricFamilies, name)
+			continue
+		}
+		kept := mf.Metric[:0]
+		for _, m := range mf.Metric {
+			ss, ok := gs.series[seriesKey(name, m.Label)]
+			switch {
+			case !ok:
+			case s.before(ss.stamp):
+				// a newer overwrite contains the increments of older
+				// writes already, or it is meant to discard them.
+				continue
+			case wr.Absolute && !overwrites(mf.GetType()):
+				if delta := ss.sumAfter(s); delta != nil {
+					mergeMetrics(mf.GetType(), m, delta)
+				}
+			}
+			kept = append(kept, m)
+		}
+		mf.Metric = kept
+		if len(kept) == 0 {
+			delete(wr.MetricFamilies, name)
+		}
+	}
+	// a request without any families only updates the timestamp.
+	return len(wr.MetricFamilies) > 0 || n == 0
+}
+
+// keepNewer applies the partial delete with the stamp s to the group
+// with the key, but keeps the metrics overwritten after s and the later
+// increments of the others. The deleted metrics and families are stamped,
+// so that older writes replicated afterwards do not bring them back. The
+// lock has to be held.
+func (ms *MetricStorage) keepNewer(wr WriteRequest, key string, group MetricGroup, s stamp) {
+	gs := ms.groupStamps(key, group.Labels)
+	whole, deltas := gs.newer(group, s)
+	before := make(map[string][]*dto.Metric, len(group.MetricFamilies))
+	for name, mf := range group.MetricFamilies {
+		before[name] = append([]*dto.Metric(nil), mf.Metric...)
+	}
+
+	deleteFromGroup(group, wr.DeleteFamilies, wr.DeleteSeries)
+
+	deleted := map[string]bool{}
+	for name, metrics := range before {
+		remaining := map[string]bool{}
+		if mf, ok := group.MetricFamilies[name]; ok {
+			for _, m := range mf.Metric {
+				remaining[utils.GroupingKeyForLabelPair(m.Label)] = true
+			}
+		}
+		for _, m := range metrics {
+			if !remaining[utils.GroupingKeyForLabelPair(m.Label)] {
+				deleted[seriesKey(name, m.Label)] = true
+			}
+		}
+	}
+	// only the deleted metrics are restored, the
+	// remaining ones contain their increments.
+	for _, families := range []map[string]*dto.MetricFamily{whole, deltas} {
+		for name, mf := range families {
+			kept := mf.Metric[:0]
+			for _, m := range mf.Metric {
+				if deleted[seriesKey(name, m.Label)] {
+					kept = append(kept, m)
+				}
+			}
+			if mf.Metric = kept; len(kept) == 0 {
+				delete(families, name)
+			}
+		}
+	}
+	mergeGroups(group, MetricGroup{MetricFamilies: whole}, true)
+	mergeGroups(group, MetricGroup{MetricFamilies: deltas}, false)
+
+	for _, name := range wr.DeleteFamilies {
+		gs.overwrite(name, nil, s)
+	}
+	for name, metrics := range before {
+		for _, m := range metrics {
+			if deleted[seriesKey(name, m.Label)] {
+				gs.overwrite(name, m.Label, s)
+			}
+		}
+	}
+}
+
+// stampWrite records the stamp s of the request for the whole group, if
+// it replaces or deletes it, or for the metrics it overwrites or increments
+// otherwise. It has to be called before the request is applied, as the
+// metrics are merged in place. The lock has to be held.
+func (ms *MetricStorage) stampWrite(wr WriteRequest, key string, s stamp) {
+	gs := ms.groupStamps(key, wr.Labels)
+	if wr.MetricFamilies == nil || wr.Replace {
+		// the metrics and increments kept by order are newer.
+		gs.removed = s
+		gs.prune(s)
+		return
+	}
+	for name, mf := range wr.MetricFamilies {
+		for _, m := range mf.Metric {
+			if wr.Absolute || overwrites(mf.GetType()) {
+				gs.overwrite(name, m.Label, s)
+				continue
+			}
+			gs.increment(name, m, mf.GetType(), s)
+		}
+	}
+}
+
+// trackApplied tracks the replace or delete of the group with the key,
+// which has been applied directly, and stamps it. The lock has to be held.
+func (ms *MetricStorage) trackApplied(wr WriteRequest, key string) {
+	s := ms.track(wr)
+	if ms.ordered() {
+		ms.stampWrite(wr, key, s)
+	}
+}
+
+// wipeBefore deletes all groups with the stamp s, but keeps the groups
+// replaced after s, the metrics overwritten after s and the increments
+// after s. It returns the number of deleted groups. The lock has to
+// be held.
+func (ms *MetricStorage) wipeBefore(s stamp) int {
+	if ms.wiped.before(s) {
+		ms.wiped = s
+	}
+
+	old := ms.metricGroups
+	ms.metricGroups = make(map[string]MetricGroup)
+	for key, gs := range ms.stamps {
+		if group, ok := old[key]; ok {
+			if s.before(gs.removed) {
+				ms.metricGroups[key] = group
+			} else if whole, deltas := gs.newer(group, s); len(whole) > 0 || len(deltas) > 0 {
+				mergeGroups(MetricGroup{MetricFamilies: whole}, MetricGroup{MetricFamilies: deltas}, false)
+				ms.metricGroups[key] = MetricGroup{Labels: group.Labels, MetricFamilies: whole, Timestamp: group.Timestamp}
+			}
+		}
+		// everything before s is covered by the wipe now.
+		if !s.before(gs.removed) {
+			gs.removed = stamp{}
+		}
+		gs.prune(s)
+		if gs.empty() {
+			delete(ms.stamps, key)
+		}
+	}
+	ms.publishSwapped(old)
+	return len(old) - len(ms.metricGroups)
+}
+
+// sweep removes the stamps, which no request of any origin can be ordered
+// before anymore, as every origin has sent newer requests already. The
+// origins which have not sent any requests for the stampTTL are ignored.
+// The lock has to be held.
+func (ms *MetricStorage) sweep() {
+	horizon := ms.clock.Add(-stampTTL)
+	stable := ms.clock
+	for origin, t := range ms.seen {
+		if t.Before(horizon) {
+			delete(ms.seen, origin)
+		} else if t.Before(stable) {
+			stable = t
+		}
+	}
+	if horizon.Before(stable) {
+		horizon = stable
+	}
+
+	expired := stamp{time: horizon}
+	for key, gs := range ms.stamps {
+		if gs.removed.before(expired) {
+			gs.removed = stamp{}
+		}
+		gs.prune(expired)
+		if gs.empty() {
+			delete(ms.stamps, key)
+		}
+	}
+}
+
+// groupStamps returns the stamps of the group with the key,
+// which are created if there are none. The lock has to be held.
+func (ms *MetricStorage) groupStamps(key string, labels map[string]string) *groupStamps {
+	gs, ok := ms.stamps[key]
+	if !ok {
+		gs = &groupStamps{labels: labels, series: make(map[string]*seriesStamp)}
+		ms.stamps[key] = gs
+	}
+	return gs
+}
+
+// get returns the stamps of the metric with the labels in the family,
+// or of the whole family if labels is nil, which are created if there
+// are none.
+func (gs *groupStamps) get(family string, labels []*dto.LabelPair) *seriesStamp {
+	k := seriesKey(family, labels)
+	ss, ok := gs.series[k]
+	if !ok {
+		ss = &seriesStamp{family: family, labels: labels}
+		gs.series[k] = ss
+	}
+	return ss
+}
+
+// overwrite records the overwrite or delete of the metric with the
+// labels in the family, or of the whole family if labels is nil,
+// unless it has been overwritten later already.
+func (gs *groupStamps) overwrite(family string, labels []*dto.LabelPair, s stamp) {
+	ss := gs.get(family, labels)
+	if s.before(ss.stamp) {
+		return
+	}
+	ss.stamp = s
+	ss.prune(s)
+}
+
+// increment logs the increment m of the metric in the family.
+func (gs *groupStamps) increment(family string, m *dto.Metric, mt dto.MetricType, s stamp) {
+	ss := gs.get(family, m.Label)
+	ss.mt = mt
+	// the metric is merged in place, when it is applied.
+	ss.increments = append(ss.increments, increment{stamp: s, delta: proto.Clone(m).(*dto.Metric)})
+}
+
+// prune removes the stamps and increments, which are not after s.
+func (gs *groupStamps) prune(s stamp) {
+	for k, ss := range gs.series {
+		if !s.before(ss.stamp) {
+			ss.stamp = stamp{}
+		}
+		ss.prune(s)
+		if ss.time.IsZero() && len(ss.increments) == 0 {
+			delete(gs.series, k)
+		}
+	}
+}
+
+func (gs *groupStamps) empty() bool {
+	return gs.removed.time.IsZero() && len(gs.series) == 0
+}
+
+// newer returns the metrics of the group, which have been overwritten
+// after s, and the sums of the increments after s of the other ones,
+// both in families like the ones of the group.
+func (gs *groupStamps) newer(group MetricGroup, s stamp) (whole, deltas map[string]*dto.MetricFamily) {
+	whole, deltas = map[string]*dto.MetricFamily{}, map[string]*dto.MetricFamily{}
+	add := func(families map[string]*dto.MetricFamily, mf *dto.MetricFamily, m *dto.Metric) {
+		f, ok := families[mf.GetName()]
+		if !ok {
+			f = &dto.MetricFamily{Name: mf.Name, Help: mf.Help, Type: mf.Type}
+			families[mf.GetName()] = f
+		}
+		f.Metric = append(f.Metric, m)
+	}
+
+	for name, mf := range group.MetricFamilies {
+		for _, m := range mf.Metric {
+			ss, ok := gs.series[seriesKey(name, m.Label)]
+			if !ok {
+				continue
+			}
+			if s.before(ss.stamp) {
+				add(whole, mf, m)
+			} else if delta := ss.sumAfter(s); delta != nil {
+				add(deltas, mf, delta)
+			}
+		}
+	}
+	return whole, deltas
+}
+
+// sumAfter returns the sum of the increments after s,
+// or nil if there are none.
+func (ss *seriesStamp) sumAfter(s stamp) *dto.Metric {
+	var sum *dto.Metric
+	for _, inc := range ss.increments {
+		if !s.before(inc.stamp) {
+			continue
+		}
+		if sum == nil {
+			sum = proto.Clone(inc.delta).(*dto.Metric)
+			continue
+		}
+		mergeMetrics(ss.mt, sum, inc.delta)
+	}
+	return sum
+}
+
+// prune removes the increments, which are not after s.
+func (ss *seriesStamp) prune(s stamp) {
+	kept := ss.increments[:0]
+	for _, inc := range ss.increments {
+		if s.before(inc.stamp) {
+			kept = append(kept, inc)
+		}
+	}
+	ss.increments = kept
+}
@@ -0,0 +1,372 @@
+package storage
+
+import (
+	"dev.volix.ops/thor/pkg/metricjson"
+	"dev.volix.ops/thor/pkg/slog"
+	"dev.volix.ops/thor/utils"
+	"encoding/json"
+	"fmt"
+	"github.com/golang/protobuf/proto"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"io"
+	"sort"
+	"time"
+)
+
+// Version of the snapshot format, increased on
+// incompatible changes.
+const snapshotVersion = 1
+
+// A Snapshot is the portable JSON representation of all groups
+// of a MetricStorage. The families use the format of metricjson.
+// If replication is enabled, Versions contains the sequence of the
+// last applied request of every origin, and Stamps the stamps needed
+// to order the requests replicated afterwards.
+type Snapshot struct {
+	Version  int               `json:"version"`
+	Created  time.Time         `json:"created"`
+	Groups   []SnapshotGroup   `json:"groups"`
+	Versions map[string]uint64 `json:"versions,omitempty"`
+	Stamps   []SnapshotStamp   `json:"stamps,omitempty"`
+}
+
+// A SnapshotGroup is a MetricGroup in a Snapshot.
+type SnapshotGroup struct {
+	Labels    map[string]string   `json:"labels"`
+	Timestamp time.Time           `json:"timestamp"`
+	Families  []metricjson.Family `json:"families"`
+}
+
+// A SnapshotStamp is the stamp of the last wipe, if Labels is empty,
+// or the one of the last replace or delete of the group, if Family is
+// empty. Otherwise it is the stamp of the last overwrite or delete of
+// the metric of the family with the labels Series, or of the whole
+// family if Series is empty, and the increments of the metric after it.
+type SnapshotStamp struct {
+	Labels     map[string]string   `json:"labels,omitempty"`
+	Family     string              `json:"family,omitempty"`
+	Series     map[string]string   `json:"series,omitempty"`
+	Time       time.Time           `json:"time"`
+	Origin     string              `json:"origin,omitempty"`
+	Increments []SnapshotIncrement `json:"increments,omitempty"`
+}
+
+// A SnapshotIncrement is an increment of a metric, which
+// is the only metric of the family Delta.
+type SnapshotIncrement struct {
+	Time   time.Time         `json:"time"`
+	Origin string            `json:"origin"`
+	Delta  metricjson.Family `json:"delta"`
+}
+
+// WriteSnapshot writes a Snapshot of all groups as JSON.
+func (ms *MetricStorage) WriteSnapshot(w io.Writer) error {
+	// the groups and versions have to be read at once, so that
+	// they match each other.
+	ms.lock.RLock()
+	groups := ms.copyGroups()
+	var versions map[string]uint64
+	var stamps []SnapshotStamp
+	if ms.versions != nil {
+		versions = make(map[string]uint64, len(ms.versions))
+		for origin, sequence := range ms.versions {
+			versions[origin] = sequence
+		}
+		stamps = ms.snapshotStamps()
+	}
+	ms.lock.RUnlock()
+
+	keys := make([]string, 0, len(groups))
+	for key := range groups {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	s := Snapshot{
+		Version:  snapshotVersion,
+		Created:  time.Now(),
+		Groups:   make([]SnapshotGroup, 0, len(groups)),
+		Versions: versions,
+		Stamps:   stamps,
+	}
+	for _, key := range keys {
+		group := groups[key]
+
+		mfs := make([]*dto.MetricFamily, 0, len(group.MetricFamilies))
+		for _, mf := range group.MetricFamilies {
+			mfs = append(mfs, mf)
+		}
+		sort.Slice(mfs, func(i, j int) bool { return mfs[i].GetName() < mfs[j].GetName() })
+
+		s.Groups = append(s.Groups, SnapshotGroup{
+			Labels:    group.Labels,
+			Timestamp: group.Timestamp,
+			Families:  metricjson.FromMetricFamilies(mfs),
+		})
+	}
+	return json.NewEncoder(w).Encode(s)
+}
+
+// snapshotStamps converts the stamps of the storage
+// for a Snapshot. The lock has to be held.
+func (ms *MetricStorage) snapshotStamps() []SnapshotStamp {
+	var result []SnapshotStamp
+	if !ms.wiped.time.IsZero() {
+		result = append(result, SnapshotStamp{Time: ms.wiped.time, Origin: ms.wiped.origin})
+	}
+	for _, gs := range ms.stamps {
+		if !gs.removed.time.IsZero() {
+			result = append(result, SnapshotStamp{Labels: gs.labels, Time: gs.removed.time, Origin: gs.removed.origin})
+		}
+		for _, ss := range gs.series {
+			st := SnapshotStamp{Labels: gs.labels, Family: ss.family, Time: ss.time, Origin: ss.origin}
+			if ss.labels != nil {
+				st.Series = make(map[string]string, len(ss.labels))
+				for _, lp := range ss.labels {
+					st.Series[lp.GetName()] = lp.GetValue()
+				}
+			}
+			for _, inc := range ss.increments {
+				mf := &dto.MetricFamily{Name: proto.String(ss.family), Type: ss.mt.Enum(), Metric: []*dto.Metric{inc.delta}}
+				st.Increments = append(st.Increments, SnapshotIncrement{
+					Time:   inc.time,
+					Origin: inc.origin,
+					Delta:  metricjson.FromMetricFamilies([]*dto.MetricFamily{mf})[0],
+				})
+			}
+			result = append(result, st)
+		}
+	}
+	return result
+}
+
+// A snapshotState is a Snapshot converted back for the storage.
+type snapshotState struct {
+	groups   map[string]MetricGroup
+	versions map[string]uint64
+	stamps   map[string]*groupStamps
+	wiped    stamp
+	// the latest time of the stamps.
+	clock time.Time
+}
+
+// ReadSnapshot reads a Snapshot written by WriteSnapshot
+// and converts it back to groups and versions.
+func ReadSnapshot(r io.Reader) (map[string]MetricGroup, map[string]uint64, error) {
+	state, err := readSnapshot(r)
+	return state.groups, state.versions, err
+}
+
+func readSnapshot(r io.Reader) (snapshotState, error) {
+	var s Snapshot
+	dec := json.NewDecoder(r)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&s); err != nil {
+		return snapshotState{}, fmt.Errorf("invalid snapshot: %w", err)
+	}
+	if s.Version != snapshotVersion {
+		return snapshotState{}, fmt.Errorf("unsupported snapshot version %d, expected %d", s.Version, snapshotVersion)
+	}
+
+	groups := make(map[string]MetricGroup, len(s.Groups))
+	for i, g := range s.Groups {
+		if len(g.Labels) == 0 {
+			return snapshotState{}, fmt.Errorf("groups[%d]: missing labels", i)
+		}
+		key := utils.GroupingKeyFor(g.Labels)
+		if _, ok := groups[key]; ok {
+			return snapshotState{}, fmt.Errorf("groups[%d]: duplicate group %v", i, g.Labels)
+		}
+
+		mfs, err := metricjson.ToMetricFamilies(g.Families)
+		if err != nil {
+			return snapshotState{}, fmt.Errorf("groups[%d].%v", i, err)
+		}
+		for _, mf := range mfs {
+			utils.SanitizeLabels(mf, g.Labels)
+		}
+		groups[key] = MetricGroup{Labels: g.Labels, MetricFamilies: mfs, Timestamp: g.Timestamp}
+	}
+
+	state := snapshotState{groups: groups, versions: s.Versions, stamps: make(map[string]*groupStamps)}
+	for i, st := range s.Stamps {
+		if err := state.addStamp(st); err != nil {
+			return snapshotState{}, fmt.Errorf("stamps[%d].%v", i, err)
+		}
+	}
+	return state, nil
+}
+
+// addStamp converts the stamp back and adds it to the state.
+func (state *snapshotState) addStamp(st SnapshotStamp) error {
+	s := stamp{time: st.Time, origin: st.Origin}
+	state.advance(s)
+	if len(st.Labels) == 0 {
+		state.wiped = s
+		return nil
+	}
+
+	key := utils.GroupingKeyFor(st.Labels)
+	gs, ok := state.stamps[key]
+	if !ok {
+		gs = &groupStamps{labels: st.Labels, series: make(map[string]*seriesStamp)}
+		state.stamps[key] = gs
+	}
+	if st.Family == "" {
+		gs.removed = s
+		return nil
+	}
+
+	var labels []*dto.LabelPair
+	if len(st.Series) > 0 {
+		labels = make([]*dto.LabelPair, 0, len(st.Series))
+		for name, value := range st.Series {
+			labels = append(labels, &dto.LabelPair{Name: proto.String(name), Value: proto.String(value)})
+		}
+		sort.Slice(labels, func(i, j int) bool { return labels[i].GetName() < labels[j].GetName() })
+	}
+	ss := gs.get(st.Family, labels)
+	ss.stamp = s
+	for i, inc := range st.Increments {
+		mfs, err := metricjson.ToMetricFamilies([]metricjson.Family{inc.Delta})
+		if err != nil {
+			return fmt.Errorf("increments[%d].%v", i, err)
+		}
+		mf := mfs[inc.Delta.Name]
+		if inc.Delta.Name != st.Family || len(mf.Metric) != 1 {
+			return fmt.Errorf("increments[%d]: expected one metric of %s", i, st.Family)
+		}
+		ss.mt = mf.GetType()
+		ss.increments = append(ss.increments, increment{stamp: stamp{time: inc.Time, origin: inc.Origin}, delta: mf.Metric[0]})
+		state.advance(stamp{time: inc.Time})
+	}
+	return nil
+}
+
+// advance advances the clock of the state to the stamp.
+func (state *snapshotState) advance(s stamp) {
+	if state.clock.Before(s.time) {
+		state.clock = s.time
+	}
+}
+
+// Restore replaces all groups of the storage with the given ones,
+// e.g. the ones of a snapshot. The groups are rejected, if they
+// can not be gathered consistently. The subscribers receive a delete
+// for every group which is gone and a replace for every other one,
+// which has changed. The restore is replicated as
+// a wipe followed by a replacing write of every group.
+func (ms *MetricStorage) Restore(groups map[string]MetricGroup) error {
+	if err := checkGroups(groups); err != nil {
+		return err
+	}
+	if ms.shared != nil {
+		ms.shared.lock.Lock()
+		defer ms.shared.lock.Unlock()
+
+		for _, group := range groups {
+			if err := ms.shared.check(ms, group.MetricFamilies); err != nil {
+				return err
+			}
+		}
+	}
+
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	old := ms.metricGroups
+	ms.metricGroups = groups
+	ms.publishSwapped(old)
+
+	now := time.Now()
+	s := ms.track(WriteRequest{Wipe: true, Timestamp: now})
+	if ms.ordered() {
+		ms.stamps, ms.wiped = make(map[string]*groupStamps), s
+	}
+	for key, group := range groups {
+		ms.trackApplied(WriteRequest{
+			Labels:         group.Labels,
+			Timestamp:      group.Timestamp,
+			MetricFamilies: group.MetricFamilies,
+			Replace:        true,
+		}, key)
+	}
+	return nil
+}
+
+// Sync is the same as Restore, but for the snapshot of a peer read from
+// r: the groups are not replicated, and if replication is enabled, the
+// versions and stamps of the peer are taken over. The requests of the
+// storage itself, which the peer has not applied yet, are applied again
+// afterwards, so that they are not lost. They are returned by pending,
+// which is called while the storage is locked, as they were passed to
+// the replicate function and in the same order.
+func (ms *MetricStorage) Sync(r io.Reader, pending func() []WriteRequest) error {
+	state, err := readSnapshot(r)
+	if err != nil {
+		return err
+	}
+	if err := checkGroups(state.groups); err != nil {
+		return err
+	}
+
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	old := ms.metricGroups
+	ms.metricGroups = state.groups
+	ms.publishSwapped(old)
+	if !ms.ordered() {
+		return nil
+	}
+
+	own := ms.versions[ms.origin]
+	ms.versions = make(map[string]uint64, len(state.versions)+1)
+	for origin, sequence := range state.versions {
+		ms.versions[origin] = sequence
+	}
+	ms.stamps, ms.wiped = state.stamps, state.wiped
+	if ms.clock.Before(state.clock) {
+		ms.clock = state.clock
+	}
+
+	next := ms.versions[ms.origin] + 1
+	if pending != nil {
+		for _, wr := range pending() {
+			if wr.Sequence < next {
+				continue
+			}
+			if wr.Sequence > next {
+				slog.Error(fmt.Sprintf("lost requests %d to %d of %s while syncing", next, wr.Sequence-1, ms.origin))
+			}
+			next = wr.Sequence + 1
+
+			if wr.MetricFamilies != nil && !wr.isPartialDelete() {
+				if err := ms.typeConflict(wr.MetricFamilies); err != nil {
+					slog.Error(fmt.Sprintf("rejected request %d of %s while syncing: %v", wr.Sequence, ms.origin, err))
+					continue
+				}
+			}
+			ms.process(wr)
+		}
+	}
+	if next <= own {
+		slog.Error(fmt.Sprintf("lost requests %d to %d of %s while syncing", next, own, ms.origin))
+	}
+	// the following requests are numbered after
+	// the ones already sent to the peers.
+	ms.versions[ms.origin] = own
+	return nil
+}
+
+// checkGroups returns an error, if the groups
+// can not be gathered consistently.
+func checkGroups(groups map[string]MetricGroup) error {
+	testMs := &MetricStorage{metricGroups: groups}
+	tg := prometheus.Gatherers{
+		prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+			return testMs.GetMetricFamilies(), nil
+		}),
+	}
+	_, err := tg.Gather()
+	return err
+}
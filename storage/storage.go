@@ -1,11 +1,13 @@
 package storage
 
 import (
+	"dev.volix.ops/thor/pkg/selector"
 	"dev.volix.ops/thor/pkg/slog"
 	"dev.volix.ops/thor/utils"
 	"fmt"
 	"github.com/prometheus/client_golang/prometheus"
 	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/model"
 	"sync"
 	"time"
 )
@@ -23,9 +25,12 @@ import (
 // as it would only be more efficient, if the Labels would be a large
 // map, but it is rather small. And there could be consistency issues
 // if the Labels map change during runtime by accident.
+//
+// Timestamp is the time of the last push to the group.
 type MetricGroup struct {
 	Labels         map[string]string
 	MetricFamilies map[string]*dto.MetricFamily
+	Timestamp      time.Time
 }
 
 // A MetricStorage is the in-memory storage of all metrics pushed
@@ -47,6 +52,30 @@ type MetricStorage struct {
 	lock         sync.RWMutex
 	writeQueue   chan WriteRequest
 	metricGroups map[string]MetricGroup
+
+	// the replication of the storage, see EnableReplication.
+	origin    string
+	versions  map[string]uint64
+	replicate func(WriteRequest)
+
+	// the order of the requests of all origins, see stamp.
+	clock      time.Time
+	seen       map[string]time.Time
+	stamps     map[string]*groupStamps
+	wiped      stamp
+	sinceSweep int
+
+	// forward is set by SetForwarder.
+	forward func(WriteRequest) bool
+
+	// the storages sharing the types of their families,
+	// see Tenants.ShareTypes.
+	shared *sharedTypes
+
+	// the subscribers of the events, see Subscribe, and
+	// whether they receive the families.
+	subscribersLock sync.Mutex
+	subscribers     map[chan Event]bool
 }
 
 // A request to write the containing MetricFamilies to
@@ -57,6 +86,30 @@ type MetricStorage struct {
 // If Replace is true, already existing data similar to
 // the family, i.e. metrics with the same names, will be deleted.
 //
+// If Absolute is true, existing metrics are overwritten when merging
+// instead of accumulating their values, e.g. because the pushed counters
+// are cumulative and already contain all previous values.
+//
+// If DeleteFamilies or DeleteSeries are set, this is a partial delete
+// request: only the families with these names and the metrics matching
+// one of the selectors are deleted from the group, MetricFamilies is
+// ignored. Families and groups left without metrics are deleted as well.
+//
+// If Handoff is true, the group is handed off by an instance, which has
+// held it before: counters and histograms are accumulated as usual, but
+// the other metrics are only added, if the group does not have them yet,
+// as the ones it has are newer.
+//
+// If Wipe is true, all groups of the storage are deleted and everything
+// else but Origin and Sequence is ignored. Wipe requests are only
+// replicated, see MetricStorage.Wipe.
+//
+// If Origin is set, the request has been replicated from the storage
+// with this origin, where it was the request with the given Sequence.
+// Requests which have already been applied are ignored. Stamp is the
+// time of the request, which orders it against the requests of the
+// other origins, see stamp.
+//
 // If Done is nil, this request will not trigger the expensive
 // consistency check.
 type WriteRequest struct {
@@ -64,7 +117,25 @@ type WriteRequest struct {
 	Timestamp      time.Time
 	MetricFamilies map[string]*dto.MetricFamily
 	Replace        bool
+	Absolute       bool
+	Handoff        bool
+	DeleteFamilies []string
+	DeleteSeries   [][]*selector.Matcher
+	Wipe           bool
+	Origin         string
+	Sequence       uint64
+	Stamp          time.Time
 	Done           chan error
+
+	// local is set by SubmitLocalWriteRequest, drain by Drain.
+	local bool
+	drain bool
+}
+
+// isPartialDelete returns true, if the request only
+// deletes some families or metrics of the group.
+func (wr WriteRequest) isPartialDelete() bool {
+	return len(wr.DeleteFamilies) > 0 || len(wr.DeleteSeries) > 0
 }
 
 const (
@@ -94,6 +165,92 @@ func (ms *MetricStorage) SubmitWriteRequest(wr WriteRequest) {
 	ms.writeQueue <- wr
 }
 
+// SubmitLocalWriteRequest is the same as SubmitWriteRequest,
+// but the request is never passed to the forwarder, e.g.
+// because it has been forwarded to this storage already.
+func (ms *MetricStorage) SubmitLocalWriteRequest(wr WriteRequest) {
+	wr.local = true
+	ms.writeQueue <- wr
+}
+
+// Drain waits until the requests submitted before
+// have been applied or passed to the forwarder.
+func (ms *MetricStorage) Drain() {
+	done := make(chan error)
+	ms.writeQueue <- WriteRequest{drain: true, Done: done}
+	<-done
+}
+
+// SetForwarder sets a function, which gets every submitted request
+// in the order of the queue, right before it would be applied. If it
+// returns true, the request has been handled by it, e.g. forwarded to
+// the storage of another instance, and is not applied to this storage.
+// The function must not block. It has to close the Done channel of the
+// requests it handled, after sending an error to it, if there is one.
+// It has to be set before the storage is used.
+func (ms *MetricStorage) SetForwarder(forward func(WriteRequest) bool) {
+	ms.forward = forward
+}
+
+// EnableReplication numbers every request applied to the storage, which
+// has not been replicated itself, and passes it to replicate with origin
+// as Origin. The function is called while the storage is locked, so it
+// must not block nor access the storage. The WriteRequest may only be
+// read until the function returns.
+func (ms *MetricStorage) EnableReplication(origin string, replicate func(WriteRequest)) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+
+	ms.origin = origin
+	ms.replicate = replicate
+	if ms.versions == nil {
+		ms.versions = make(map[string]uint64)
+		ms.seen = make(map[string]time.Time)
+		ms.stamps = make(map[string]*groupStamps)
+	}
+}
+
+// applied returns true, if the request has been replicated
+// and the storage has already applied it before.
+func (ms *MetricStorage) applied(wr WriteRequest) bool {
+	if wr.Origin == "" {
+		return false
+	}
+
+	ms.lock.RLock()
+	defer ms.lock.RUnlock()
+	return wr.Sequence <= ms.versions[wr.Origin]
+}
+
+// Version returns the sequence of the last request of the
+// origin applied to the storage, or 0 if there is none.
+func (ms *MetricStorage) Version(origin string) uint64 {
+	ms.lock.RLock()
+	defer ms.lock.RUnlock()
+	return ms.versions[origin]
+}
+
+// track records the request as applied and replicates it, if it
+// has not been replicated itself, and returns its stamp. The
+// lock has to be held.
+func (ms *MetricStorage) track(wr WriteRequest) stamp {
+	if ms.versions == nil {
+		return stamp{}
+	}
+	if wr.Origin != "" {
+		ms.versions[wr.Origin] = wr.Sequence
+		s := stamp{time: wr.Stamp, origin: wr.Origin}
+		ms.observe(s)
+		return s
+	}
+
+	s := ms.nextStamp()
+	ms.versions[ms.origin]++
+	wr.Origin, wr.Sequence, wr.Stamp = ms.origin, ms.versions[ms.origin], s.time
+	ms.replicate(wr)
+	return s
+}
+
 // Same as GetMetricGroups but it resolves the groups
 // and returns a slice of all metric families.
 func (ms *MetricStorage) GetMetricFamilies() []*dto.MetricFamily {
@@ -115,6 +272,36 @@ func (ms *MetricStorage) GetMetricGroups() map[string]MetricGroup {
 	ms.lock.RLock()
 	defer ms.lock.RUnlock()
 
+	return ms.copyGroups()
+}
+
+// GetGroupMetricFamilies returns a copy of the metric families
+// of the group with the grouping key, or false if there is none.
+func (ms *MetricStorage) GetGroupMetricFamilies(key string) ([]*dto.MetricFamily, bool) {
+	ms.lock.RLock()
+	defer ms.lock.RUnlock()
+
+	group, ok := ms.metricGroups[key]
+	if !ok {
+		return nil, false
+	}
+	result := make([]*dto.MetricFamily, 0, len(group.MetricFamilies))
+	for _, family := range group.MetricFamilies {
+		result = append(result, utils.CopyMetricFamily(family))
+	}
+	return result, true
+}
+
+// GroupCount returns the number of groups.
+func (ms *MetricStorage) GroupCount() int {
+	ms.lock.RLock()
+	defer ms.lock.RUnlock()
+
+	return len(ms.metricGroups)
+}
+
+// copyGroups returns a copy of all groups. The lock has to be held.
+func (ms *MetricStorage) copyGroups() map[string]MetricGroup {
 	groupsCopy := make(map[string]MetricGroup, len(ms.metricGroups))
 	for k, g := range ms.metricGroups {
 		metricsCopy := make(map[string]*dto.MetricFamily, len(g.MetricFamilies))
@@ -122,7 +309,7 @@ func (ms *MetricStorage) GetMetricGroups() map[string]MetricGroup {
 			metricsCopy[n] = utils.CopyMetricFamily(mf)
 		}
 
-		groupsCopy[k] = MetricGroup{Labels: g.Labels, MetricFamilies: metricsCopy}
+		groupsCopy[k] = MetricGroup{Labels: g.Labels, MetricFamilies: metricsCopy, Timestamp: g.Timestamp}
 	}
 	return groupsCopy
 }
@@ -148,14 +335,32 @@ func (ms *MetricStorage) loop() {
 	for {
 		select {
 		case wr := <-ms.writeQueue:
+			if wr.drain {
+				close(wr.Done)
+				continue
+			}
+			if !wr.local && ms.forward != nil && ms.forward(wr) {
+				continue
+			}
+			if ms.applied(wr) {
+				// the request has been replicated more than once,
+				// e.g. because the peer retried to send it.
+				if wr.Done != nil {
+					close(wr.Done)
+				}
+				continue
+			}
+
 			// we do simple consistency checks.
 			// if the done channel of wr is existent, we suppose
 			// that we want to do the heavy check as well.
-			var err error
-			if err = validateConsistency(ms, wr); err == nil {
-				ms.processWriteRequest(wr)
-			} else {
+			err := ms.apply(wr)
+			if err != nil && wr.Done != nil {
 				wr.Done <- err
+			} else if err != nil {
+				// nobody is waiting for the result, so
+				// we can only log the rejection.
+				slog.Debug("rejected write request: ", err)
 			}
 
 			if wr.Done != nil {
@@ -165,6 +370,21 @@ func (ms *MetricStorage) loop() {
 	}
 }
 
+// apply writes the request, if it passes the consistency checks.
+func (ms *MetricStorage) apply(wr WriteRequest) error {
+	if ms.shared != nil {
+		// the check and the write must not interleave with
+		// the ones of the storages sharing the types.
+		ms.shared.lock.Lock()
+		defer ms.shared.lock.Unlock()
+	}
+	if err := validateConsistency(ms, wr); err != nil {
+		return err
+	}
+	ms.processWriteRequest(wr)
+	return nil
+}
+
 // processWriteRequest takes the WriteRequest and stores them in the MetricStorage.
 // If no previous group exist or if WriteRequest.Replace is true, then
 // we simply put the MetricGroup into the storage.
@@ -172,8 +392,65 @@ func (ms *MetricStorage) loop() {
 func (ms *MetricStorage) processWriteRequest(wr WriteRequest) {
 	ms.lock.Lock()
 	defer ms.lock.Unlock()
+	ms.process(wr)
+}
+
+// process is processWriteRequest with the lock held.
+func (ms *MetricStorage) process(wr WriteRequest) {
+	if wr.Wipe {
+		s := ms.track(wr)
+		if ms.ordered() {
+			ms.wipeBefore(s)
+		} else {
+			ms.wipe()
+		}
+		return
+	}
 
 	groupingKey := utils.GroupingKeyFor(wr.Labels)
+	// track the request before it is modified by ordering or merging.
+	s := ms.track(wr)
+	if ms.ordered() {
+		if ms.sinceSweep++; ms.sinceSweep >= sweepInterval {
+			ms.sinceSweep = 0
+			ms.sweep()
+		}
+		if !ms.order(&wr, groupingKey, s) {
+			return
+		}
+		if !wr.isPartialDelete() {
+			ms.stampWrite(wr, groupingKey, s)
+		}
+	}
+	if wr.Handoff {
+		if prev, ok := ms.metricGroups[groupingKey]; ok {
+			skipExisting(prev, wr.MetricFamilies)
+		}
+	}
+	if ms.subscribed() {
+		// the event is published after the request has been applied.
+		prev, existed := ms.metricGroups[groupingKey]
+		before := familySizes(prev)
+		defer func() {
+			if e, ok := ms.event(wr, groupingKey, before, existed); ok {
+				ms.publish(e)
+			}
+		}()
+	}
+
+	if wr.isPartialDelete() {
+		if group, ok := ms.metricGroups[groupingKey]; ok {
+			if ms.ordered() {
+				ms.keepNewer(wr, groupingKey, group, s)
+			} else {
+				deleteFromGroup(group, wr.DeleteFamilies, wr.DeleteSeries)
+			}
+			if len(group.MetricFamilies) == 0 {
+				delete(ms.metricGroups, groupingKey)
+			}
+		}
+		return
+	}
 
 	if wr.MetricFamilies == nil {
 		// if no metric families are given, the body has
@@ -185,6 +462,7 @@ func (ms *MetricStorage) processWriteRequest(wr WriteRequest) {
 	group := MetricGroup{
 		Labels:         wr.Labels,
 		MetricFamilies: wr.MetricFamilies,
+		Timestamp:      wr.Timestamp,
 	}
 
 	prevGroup, ok := ms.metricGroups[groupingKey]
@@ -196,7 +474,35 @@ func (ms *MetricStorage) processWriteRequest(wr WriteRequest) {
 		return
 	}
 	// if not, we merge the groups
-	mergeGroups(prevGroup, group)
+	mergeGroups(prevGroup, group, wr.Absolute)
+	prevGroup.Timestamp = wr.Timestamp
+	ms.metricGroups[groupingKey] = prevGroup
+}
+
+// skipExisting removes the metrics from the families, which are
+// not accumulated and which the group already has.
+func skipExisting(group MetricGroup, families map[string]*dto.MetricFamily) {
+	for name, mf := range families {
+		prev, ok := group.MetricFamilies[name]
+		if !ok || !overwrites(mf.GetType()) {
+			continue
+		}
+
+		existing := make(map[string]bool, len(prev.Metric))
+		for _, m := range prev.Metric {
+			existing[utils.GroupingKeyForLabelPair(m.Label)] = true
+		}
+		kept := mf.Metric[:0]
+		for _, m := range mf.Metric {
+			if !existing[utils.GroupingKeyForLabelPair(m.Label)] {
+				kept = append(kept, m)
+			}
+		}
+		mf.Metric = kept
+		if len(kept) == 0 {
+			delete(families, name)
+		}
+	}
 }
 
 // validateConsistency return if applying the provided WriteRequest will result in
@@ -211,7 +517,7 @@ func (ms *MetricStorage) processWriteRequest(wr WriteRequest) {
 //
 // Source: github.com/prometheus/pushgateway
 func validateConsistency(ms *MetricStorage, wr WriteRequest) error {
-	if wr.MetricFamilies == nil {
+	if wr.MetricFamilies == nil || wr.isPartialDelete() {
 		// Delete request cannot create inconsistencies, and nothing has
 		// to be sanitized.
 		return nil
@@ -219,12 +525,12 @@ func validateConsistency(ms *MetricStorage, wr WriteRequest) error {
 
 	// check for duplicates, but with different types
 	// as we can't merge them anyway.
-	for _, f2 := range wr.MetricFamilies {
-		for _, group := range ms.metricGroups {
-			f1, ok := group.MetricFamilies[*f2.Name]
-			if ok && *f1.Type != *f2.Type {
-				return fmt.Errorf("cannot merge metric '%s': type %s != %s", *f1.Name, f1.Type.String(), f2.Type.String())
-			}
+	if err := ms.checkTypes(wr.MetricFamilies); err != nil {
+		return err
+	}
+	if ms.shared != nil {
+		if err := ms.shared.check(ms, wr.MetricFamilies); err != nil {
+			return err
 		}
 	}
 
@@ -259,13 +565,107 @@ func validateConsistency(ms *MetricStorage, wr WriteRequest) error {
 	return nil
 }
 
+// checkTypes returns an error, if one of the families
+// has another type in one of the groups of the storage.
+func (ms *MetricStorage) checkTypes(mfs map[string]*dto.MetricFamily) error {
+	ms.lock.RLock()
+	defer ms.lock.RUnlock()
+	return ms.typeConflict(mfs)
+}
+
+// typeConflict is checkTypes with the lock held.
+func (ms *MetricStorage) typeConflict(mfs map[string]*dto.MetricFamily) error {
+	for _, f2 := range mfs {
+		for _, group := range ms.metricGroups {
+			f1, ok := group.MetricFamilies[*f2.Name]
+			if ok && *f1.Type != *f2.Type {
+				return fmt.Errorf("cannot merge metric '%s': type %s != %s", *f1.Name, f1.Type.String(), f2.Type.String())
+			}
+		}
+	}
+	return nil
+}
+
+// ValidateWriteRequests returns an error, if applying the requests one
+// after another would result in an inconsistent state. The storage and
+// the requests are not modified, so that they can be checked before the
+// first one is submitted, e.g. if they have to be applied all or none.
+func (ms *MetricStorage) ValidateWriteRequests(wrs []WriteRequest) error {
+	ms.lock.RLock()
+	testMs := &MetricStorage{metricGroups: ms.copyGroups()}
+	ms.lock.RUnlock()
+
+	for _, wr := range wrs {
+		// the families are merged into the ones of the previous
+		// requests, so they are copied to keep the requests intact.
+		if wr.MetricFamilies != nil {
+			families := make(map[string]*dto.MetricFamily, len(wr.MetricFamilies))
+			for name, mf := range wr.MetricFamilies {
+				families[name] = utils.CopyMetricFamily(mf)
+			}
+			wr.MetricFamilies = families
+		}
+		// with Done channel, the full consistency check is done.
+		wr.Done = make(chan error, 1)
+
+		if err := validateConsistency(testMs, wr); err != nil {
+			return err
+		}
+		testMs.processWriteRequest(wr)
+	}
+	return nil
+}
+
+// deleteFromGroup deletes the families with the given names and
+// the metrics matching one of the selectors from the group. The
+// selectors match the labels of the metric, the grouping labels
+// and the name of the family as `__name__`.
+func deleteFromGroup(group MetricGroup, families []string, series [][]*selector.Matcher) {
+	for _, name := range families {
+		delete(group.MetricFamilies, name)
+	}
+	if len(series) == 0 {
+		return
+	}
+
+	for name, mf := range group.MetricFamilies {
+		kept := mf.Metric[:0]
+		for _, m := range mf.Metric {
+			labels := make(map[string]string, len(group.Labels)+len(m.Label)+1)
+			for ln, lv := range group.Labels {
+				labels[ln] = lv
+			}
+			for _, lp := range m.Label {
+				labels[lp.GetName()] = lp.GetValue()
+			}
+			labels[model.MetricNameLabel] = name
+
+			matched := false
+			for _, matchers := range series {
+				if selector.MatchLabels(matchers, labels) {
+					matched = true
+					break
+				}
+			}
+			if !matched {
+				kept = append(kept, m)
+			}
+		}
+		mf.Metric = kept
+
+		if len(mf.Metric) == 0 {
+			delete(group.MetricFamilies, name)
+		}
+	}
+}
+
 // mergeGroups takes two MetricGroup and merge their families
 // together.
 // For that it checks if the name of the family is the same.
 //   1. If not, just add family to group.
 //   2. If, merge the families with mergeFamilies together.
 // g1 is now the merged group.
-func mergeGroups(g1, g2 MetricGroup) {
+func mergeGroups(g1, g2 MetricGroup, absolute bool) {
 	for key, g2Family := range g2.MetricFamilies {
 		g1Family, ok := g1.MetricFamilies[key]
 		if !ok {
@@ -275,7 +675,7 @@ func mergeGroups(g1, g2 MetricGroup) {
 		}
 
 		// element does exist, merge family
-		err := mergeFamilies(g1Family, g2Family)
+		err := mergeFamilies(g1Family, g2Family, absolute)
 		if err != nil {
 			// if we cannot merge the metric, we just skip it
 			slog.Debug(err.Error())
@@ -294,36 +694,42 @@ func mergeGroups(g1, g2 MetricGroup) {
 //   2. Loop through every metric in f2
 //   3. Compare key of metric with f1 metrics
 //     3a. Key does not exist? Put it into f1
-//     3b. Key does exist? Merge content of metrics
+//     3b. Key does exist? Merge content of metrics, or replace the metric
+//         if absolute is true.
 //   4. f1 is now the family with the updated metrics
 //
 // Returns an error if e.g. the family types are not equal.
-func mergeFamilies(f1, f2 *dto.MetricFamily) error {
+func mergeFamilies(f1, f2 *dto.MetricFamily, absolute bool) error {
 	if *f1.Type != *f2.Type {
 		// if types are not equal, we can cancel immediately
 		return fmt.Errorf("cannot merge metric '%s': type %s != %s", *f1.Name, f1.Type.String(), f2.Type.String())
 	}
 
-	// we map a metric grouping key to its metric
+	// we map a metric grouping key to its index
 	// so that we can search faster for duplicates when
 	// comparing with metrics of family f2.
-	mm := make(map[string]*dto.Metric)
-	for _, metric := range f1.Metric {
+	mm := make(map[string]int)
+	for i, metric := range f1.Metric {
 		key := utils.GroupingKeyForLabelPair(metric.Label)
 
-		mm[key] = metric
+		mm[key] = i
 	}
 
 	for _, f2Metric := range f2.Metric {
 		key := utils.GroupingKeyForLabelPair(f2Metric.Label)
 
-		f1Metric, ok := mm[key]
-		if !ok {
+		i, ok := mm[key]
+		switch {
+		case !ok:
 			// metric does not exist, so we add it to the list
+			mm[key] = len(f1.Metric)
 			f1.Metric = append(f1.Metric, f2Metric)
-		} else {
+		case absolute:
+			// the new metric already contains every value
+			f1.Metric[i] = f2Metric
+		default:
 			// otherwise, we merge the metrics together
-			mergeMetrics(*f1.Type, f1Metric, f2Metric)
+			mergeMetrics(*f1.Type, f1.Metric[i], f2Metric)
 		}
 	}
 	return nil
@@ -386,3 +792,95 @@ func mergeBuckets(b1, b2 *[]*dto.Bucket) {
 		}
 	}
 }
+
+// Wipe deletes all groups and returns how many were deleted.
+func (ms *MetricStorage) Wipe() int {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+
+	s := ms.track(WriteRequest{Wipe: true, Timestamp: time.Now()})
+	if ms.ordered() {
+		return ms.wipeBefore(s)
+	}
+	return ms.wipe()
+}
+
+// wipe deletes all groups. The lock has to be held.
+func (ms *MetricStorage) wipe() int {
+	n := len(ms.metricGroups)
+	if ms.subscribed() {
+		for _, group := range ms.metricGroups {
+			ms.publishDeleted(EventDelete, group)
+		}
+	}
+	ms.metricGroups = make(map[string]MetricGroup)
+	return n
+}
+
+// Expire deletes every MetricGroup, which has not been written to for
+// longer than the ttl, and returns the labels of the deleted groups.
+// Groups without Timestamp never expire.
+func (ms *MetricStorage) Expire(ttl time.Duration) []map[string]string {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+
+	now := time.Now()
+	var expired []map[string]string
+	for key, group := range ms.metricGroups {
+		if group.Timestamp.IsZero() || now.Sub(group.Timestamp) < ttl {
+			continue
+		}
+		expired = append(expired, group.Labels)
+		delete(ms.metricGroups, key)
+		ms.trackApplied(WriteRequest{Labels: group.Labels, Timestamp: now}, key)
+		ms.publishDeleted(EventExpire, group)
+	}
+	return expired
+}
+
+// TakeGroups deletes every MetricGroup, whose grouping key matches, and
+// returns the deleted groups, e.g. to move them to another instance.
+func (ms *MetricStorage) TakeGroups(match func(key string) bool) []MetricGroup {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+
+	now := time.Now()
+	var taken []MetricGroup
+	for key, group := range ms.metricGroups {
+		if !match(key) {
+			continue
+		}
+		taken = append(taken, group)
+		delete(ms.metricGroups, key)
+		ms.trackApplied(WriteRequest{Labels: group.Labels, Timestamp: now}, key)
+		ms.publishDeleted(EventDelete, group)
+	}
+	return taken
+}
+
+// DeleteGroups deletes every MetricGroup, whose labels match,
+// and returns the labels of the deleted groups. If dryRun is true,
+// nothing is deleted, but the labels are returned anyway.
+//
+// Deletes can not create inconsistencies, so they are applied
+// directly instead of being queued like a WriteRequest. They
+// are replicated as delete requests of the groups.
+func (ms *MetricStorage) DeleteGroups(match func(labels map[string]string) bool, dryRun bool) []map[string]string {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+
+	now := time.Now()
+	var deleted []map[string]string
+	for key, group := range ms.metricGroups {
+		if !match(group.Labels) {
+			continue
+		}
+		deleted = append(deleted, group.Labels)
+		if !dryRun {
+			delete(ms.metricGroups, key)
+			ms.trackApplied(WriteRequest{Labels: group.Labels, Timestamp: now}, key)
+			ms.publishDeleted(EventDelete, group)
+		}
+	}
+	return deleted
+}
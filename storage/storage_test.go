@@ -1,9 +1,17 @@
 package storage
 
 import (
+	"bytes"
+	"dev.volix.ops/thor/pkg/selector"
+	"dev.volix.ops/thor/utils"
+	"fmt"
 	"github.com/golang/protobuf/proto"
 	dto "github.com/prometheus/client_model/go"
+	"reflect"
+	"sort"
+	"strings"
 	"testing"
+	"time"
 )
 
 func metricTypePtr(val dto.MetricType) *dto.MetricType {
@@ -427,3 +435,701 @@ func TestDelete(t *testing.T) {
 		t.Errorf("metric could not be deleted, found: %d", val)
 	}
 }
+
+func TestMergeAbsoluteCounter(t *testing.T) {
+	ms := &MetricStorage{
+		metricGroups: make(map[string]MetricGroup),
+	}
+
+	counterFamily := func(val float64) map[string]*dto.MetricFamily {
+		return map[string]*dto.MetricFamily{
+			"f1Name": {
+				Name: proto.String("f1Name"),
+				Type: metricTypePtr(dto.MetricType_COUNTER),
+				Metric: []*dto.Metric{
+					{
+						Label: []*dto.LabelPair{},
+						Counter: &dto.Counter{
+							Value: proto.Float64(val),
+						},
+					},
+				},
+			},
+		}
+	}
+
+	labels := map[string]string{"job": "test0"}
+
+	// ==========
+	// test begin
+	// ==========
+
+	ms.processWriteRequest(WriteRequest{Labels: labels, MetricFamilies: counterFamily(3)})
+	ms.processWriteRequest(WriteRequest{Labels: labels, MetricFamilies: counterFamily(4)})
+
+	val := ms.GetMetricFamilies()[0].Metric[0].Counter.Value
+	if *val != 7 {
+		t.Errorf("could not accumulate counter, expected value: %v, got: %v", 7, *val)
+	}
+
+	ms.processWriteRequest(WriteRequest{Labels: labels, MetricFamilies: counterFamily(10), Absolute: true})
+
+	val = ms.GetMetricFamilies()[0].Metric[0].Counter.Value
+	if *val != 10 {
+		t.Errorf("could not overwrite counter, expected value: %v, got: %v", 10, *val)
+	}
+}
+
+func TestTenants(t *testing.T) {
+	tenants := NewTenants(2)
+
+	for _, id := range []string{"net1", "net2"} {
+		ms, err := tenants.Get(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		done := make(chan error, 1)
+		ms.SubmitWriteRequest(WriteRequest{
+			Labels: map[string]string{"job": "lobby"},
+			MetricFamilies: map[string]*dto.MetricFamily{
+				"players": {
+					Name:   proto.String("players"),
+					Type:   metricTypePtr(dto.MetricType_GAUGE),
+					Metric: []*dto.Metric{{Gauge: &dto.Gauge{Value: proto.Float64(1)}}},
+				},
+			},
+			Done: done,
+		})
+		if err := <-done; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := tenants.Get("net3"); err != ErrTooManyTenants {
+		t.Errorf("expected third tenant to fail with %v, got: %v", ErrTooManyTenants, err)
+	}
+	if _, err := tenants.Get("../net"); err == nil {
+		t.Errorf("expected invalid tenant id to fail, but it did not.")
+	}
+
+	mfs := tenants.GetMetricFamilies("tenant")
+	if len(mfs) != 1 || len(mfs[0].Metric) != 2 {
+		t.Fatalf("expected one family with a metric per tenant, got: %v", mfs)
+	}
+	for i, id := range []string{"net1", "net2"} {
+		var tenant string
+		for _, lp := range mfs[0].Metric[i].Label {
+			if lp.GetName() == "tenant" {
+				tenant = lp.GetValue()
+			}
+		}
+		if tenant != id {
+			t.Errorf("wrong tenant label, got: %q, expected: %q", tenant, id)
+		}
+	}
+}
+
+func TestTenantsShareTypes(t *testing.T) {
+	ms := NewMetricStorage()
+	tenants := NewTenants(0)
+	tenants.ShareTypes(ms)
+
+	write := func(ms *MetricStorage, typ dto.MetricType) error {
+		m := &dto.Metric{Gauge: &dto.Gauge{Value: proto.Float64(1)}}
+		if typ == dto.MetricType_COUNTER {
+			m = &dto.Metric{Counter: &dto.Counter{Value: proto.Float64(1)}}
+		}
+		done := make(chan error, 1)
+		ms.SubmitWriteRequest(WriteRequest{
+			Labels: map[string]string{"job": "lobby"},
+			MetricFamilies: map[string]*dto.MetricFamily{
+				"players": {Name: proto.String("players"), Type: metricTypePtr(typ), Metric: []*dto.Metric{m}},
+			},
+			Done: done,
+		})
+		return <-done
+	}
+
+	if err := write(ms, dto.MetricType_COUNTER); err != nil {
+		t.Fatal(err)
+	}
+	tms, err := tenants.Get("net1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := write(tms, dto.MetricType_GAUGE); err == nil {
+		t.Error("expected gauge of the tenant to be rejected, but it was not.")
+	}
+	if err := write(tms, dto.MetricType_COUNTER); err != nil {
+		t.Fatal(err)
+	}
+
+	restored := tms.GetMetricGroups()
+	for _, group := range restored {
+		group.MetricFamilies["players"].Type = metricTypePtr(dto.MetricType_GAUGE)
+		group.MetricFamilies["players"].Metric[0] = &dto.Metric{
+			Label: group.MetricFamilies["players"].Metric[0].Label,
+			Gauge: &dto.Gauge{Value: proto.Float64(1)},
+		}
+	}
+	if err := tms.Restore(restored); err == nil {
+		t.Error("expected restore with a gauge to be rejected, but it was not.")
+	}
+
+	mfs := tenants.GetAllMetricFamilies(ms, "tenant")
+	if len(mfs) != 1 || len(mfs[0].Metric) != 2 {
+		t.Fatalf("expected one family with a metric of each storage, got: %v", mfs)
+	}
+}
+
+func TestPartialDelete(t *testing.T) {
+	ms := NewMetricStorage()
+	labels := map[string]string{"job": "arena"}
+
+	gauge := func(arena string) *dto.Metric {
+		return &dto.Metric{
+			Label: []*dto.LabelPair{{Name: proto.String("map"), Value: proto.String(arena)}},
+			Gauge: &dto.Gauge{Value: proto.Float64(1)},
+		}
+	}
+	done := make(chan error, 1)
+	ms.SubmitWriteRequest(WriteRequest{
+		Labels: labels,
+		MetricFamilies: map[string]*dto.MetricFamily{
+			"arena_players": {
+				Name:   proto.String("arena_players"),
+				Type:   metricTypePtr(dto.MetricType_GAUGE),
+				Metric: []*dto.Metric{gauge("castle"), gauge("desert")},
+			},
+			"arena_obsolete": {
+				Name:   proto.String("arena_obsolete"),
+				Type:   metricTypePtr(dto.MetricType_GAUGE),
+				Metric: []*dto.Metric{gauge("castle")},
+			},
+		},
+		Done: done,
+	})
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	castle, _ := selector.Parse(`{map="castle"}`)
+	done = make(chan error, 1)
+	ms.SubmitWriteRequest(WriteRequest{
+		Labels:         labels,
+		DeleteFamilies: []string{"arena_obsolete"},
+		DeleteSeries:   [][]*selector.Matcher{castle},
+		Done:           done,
+	})
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	group := ms.GetMetricGroups()[utils.GroupingKeyFor(labels)]
+	if len(group.MetricFamilies) != 1 {
+		t.Fatalf("expected only arena_players to remain, got: %v", group.MetricFamilies)
+	}
+	players := group.MetricFamilies["arena_players"]
+	if len(players.Metric) != 1 || utils.GroupingKeyForLabelPair(players.Metric[0].Label) != utils.GroupingKeyFor(map[string]string{"instance": "", "job": "arena", "map": "desert"}) {
+		t.Errorf("expected only the desert series to remain, got: %v", players.Metric)
+	}
+
+	// deleting the last series deletes the whole group.
+	desert, _ := selector.Parse(`arena_players{map="desert"}`)
+	done = make(chan error, 1)
+	ms.SubmitWriteRequest(WriteRequest{Labels: labels, DeleteSeries: [][]*selector.Matcher{desert}, Done: done})
+	<-done
+	if groups := ms.GetMetricGroups(); len(groups) != 0 {
+		t.Errorf("expected empty group to be deleted, got: %v", groups)
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	ms := NewMetricStorage()
+	done := make(chan error, 1)
+	ms.SubmitWriteRequest(WriteRequest{
+		Labels: map[string]string{"job": "arena", "instance": "arena1"},
+		MetricFamilies: map[string]*dto.MetricFamily{
+			"arena_players": {
+				Name: proto.String("arena_players"),
+				Help: proto.String("Players in the arena."),
+				Type: metricTypePtr(dto.MetricType_GAUGE),
+				Metric: []*dto.Metric{{
+					Label: []*dto.LabelPair{{Name: proto.String("map"), Value: proto.String("castle")}},
+					Gauge: &dto.Gauge{Value: proto.Float64(12)},
+				}},
+			},
+		},
+		Done: done,
+	})
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err := ms.WriteSnapshot(&buf); err != nil {
+		t.Fatal(err)
+	}
+	groups, _, err := ReadSnapshot(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	restored := NewMetricStorage()
+	if err := restored.Restore(groups); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(ms.GetMetricFamilies(), restored.GetMetricFamilies()) {
+		t.Errorf("expected %v, got %v", ms.GetMetricFamilies(), restored.GetMetricFamilies())
+	}
+	for key, group := range ms.GetMetricGroups() {
+		if !group.Timestamp.Equal(restored.GetMetricGroups()[key].Timestamp) {
+			t.Errorf("expected timestamp %v, got %v", group.Timestamp, restored.GetMetricGroups()[key].Timestamp)
+		}
+	}
+
+	if n := restored.Wipe(); n != 1 {
+		t.Errorf("expected 1 wiped group, got %d", n)
+	}
+	if len(restored.GetMetricGroups()) != 0 {
+		t.Errorf("expected no groups after wipe, got %v", restored.GetMetricGroups())
+	}
+
+	invalid := []string{
+		`{"version": 2, "groups": []}`,
+		`{"version": 1, "groups": [{"families": []}]}`,
+		`{"version": 1, "groups": [{"labels": {"job": "a"}}, {"labels": {"job": "a"}}]}`,
+		`{"version": 1, "groups": [{"labels": {"job": "a"}, "families": [{"name": "x", "type": "gauge", "metrics": [{}]}]}]}`,
+		`{"version": 1, "unknown": true}`,
+	}
+	for _, s := range invalid {
+		if _, _, err := ReadSnapshot(strings.NewReader(s)); err == nil {
+			t.Errorf("expected error for %s", s)
+		}
+	}
+}
+
+func TestSubscribe(t *testing.T) {
+	ms := NewMetricStorage()
+	events, cancel := ms.Subscribe(10)
+	defer cancel()
+	groupEvents, cancelGroups := ms.SubscribeGroups(10)
+	defer cancelGroups()
+
+	labels := map[string]string{"job": "arena"}
+	submit := func(wr WriteRequest) {
+		wr.Labels = labels
+		wr.Done = make(chan error, 1)
+		ms.SubmitWriteRequest(wr)
+		if err := <-wr.Done; err != nil {
+			t.Fatal(err)
+		}
+	}
+	counter := func(v float64) map[string]*dto.MetricFamily {
+		return map[string]*dto.MetricFamily{
+			"arena_kills_total": {
+				Name:   proto.String("arena_kills_total"),
+				Type:   metricTypePtr(dto.MetricType_COUNTER),
+				Metric: []*dto.Metric{{Counter: &dto.Counter{Value: proto.Float64(v)}}},
+			},
+		}
+	}
+
+	submit(WriteRequest{MetricFamilies: counter(2)})
+	submit(WriteRequest{MetricFamilies: counter(3)})
+	submit(WriteRequest{MetricFamilies: counter(1), Replace: true})
+	submit(WriteRequest{DeleteFamilies: []string{"unknown"}})
+	submit(WriteRequest{})
+
+	expected := []struct {
+		typ   EventType
+		value float64
+	}{{EventPush, 2}, {EventPush, 5}, {EventReplace, 1}, {EventDelete, 0}}
+	for _, exp := range expected {
+		e := <-events
+		if e.Type != exp.typ || e.Labels["job"] != "arena" {
+			t.Fatalf("expected %s event, got %+v", exp.typ, e)
+		}
+		if e.Type == EventDelete {
+			if len(e.DeletedFamilies) != 1 || e.DeletedFamilies[0] != "arena_kills_total" {
+				t.Errorf("expected the deleted family, got %v", e.DeletedFamilies)
+			}
+			continue
+		}
+		if len(e.MetricFamilies) != 1 || e.MetricFamilies[0].Metric[0].Counter.GetValue() != exp.value {
+			t.Errorf("expected value %v after %s, got %v", exp.value, e.Type, e.MetricFamilies)
+		}
+	}
+	// the delete of an unknown family did not change anything.
+	select {
+	case e := <-events:
+		t.Errorf("unexpected event %+v", e)
+	default:
+	}
+
+	cancel()
+	if _, ok := <-events; ok {
+		t.Error("expected the channel to be closed after cancel")
+	}
+
+	// the group events are the same, but without families.
+	submit(WriteRequest{MetricFamilies: counter(1)})
+	for _, typ := range []EventType{EventPush, EventPush, EventReplace, EventDelete, EventPush} {
+		e := <-groupEvents
+		if e.Type != typ || e.Labels["job"] != "arena" || e.MetricFamilies != nil {
+			t.Errorf("expected %s event without families, got %+v", typ, e)
+		}
+	}
+}
+
+func TestRestoreEvents(t *testing.T) {
+	ms := NewMetricStorage()
+	group := func(job string, v float64) MetricGroup {
+		return MetricGroup{
+			Labels: map[string]string{"job": job},
+			MetricFamilies: map[string]*dto.MetricFamily{
+				"players": {
+					Name:   proto.String("players"),
+					Type:   metricTypePtr(dto.MetricType_GAUGE),
+					Metric: []*dto.Metric{{
+						Label: []*dto.LabelPair{
+							{Name: proto.String("instance"), Value: proto.String("")},
+							{Name: proto.String("job"), Value: proto.String(job)},
+						},
+						Gauge: &dto.Gauge{Value: proto.Float64(v)},
+					}},
+				},
+			},
+		}
+	}
+	groups := func(groups ...MetricGroup) map[string]MetricGroup {
+		result := make(map[string]MetricGroup, len(groups))
+		for _, g := range groups {
+			result[utils.GroupingKeyFor(g.Labels)] = g
+		}
+		return result
+	}
+	if err := ms.Restore(groups(group("lobby", 1), group("arena", 1), group("proxy", 1))); err != nil {
+		t.Fatal(err)
+	}
+
+	events, cancel := ms.Subscribe(10)
+	defer cancel()
+	peer := NewMetricStorage()
+	if err := peer.Restore(groups(group("lobby", 1), group("arena", 2), group("hub", 1))); err != nil {
+		t.Fatal(err)
+	}
+	var snapshot bytes.Buffer
+	if err := peer.WriteSnapshot(&snapshot); err != nil {
+		t.Fatal(err)
+	}
+	if err := ms.Sync(&snapshot, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// the unchanged lobby has no event.
+	expected := map[string]Event{
+		"proxy": {Type: EventDelete, GroupDeleted: true},
+		"arena": {Type: EventReplace},
+		"hub":   {Type: EventReplace, GroupCreated: true},
+	}
+	for range expected {
+		e := <-events
+		exp, ok := expected[e.Labels["job"]]
+		if !ok || e.Type != exp.Type || e.GroupCreated != exp.GroupCreated || e.GroupDeleted != exp.GroupDeleted {
+			t.Errorf("unexpected event %+v", e)
+			continue
+		}
+		if e.Type == EventReplace && (len(e.MetricFamilies) != 1 || e.MetricFamilies[0].Metric[0].Gauge.GetValue() == 0) {
+			t.Errorf("expected the restored families, got %v", e.MetricFamilies)
+		}
+	}
+	select {
+	case e := <-events:
+		t.Errorf("unexpected event %+v", e)
+	default:
+	}
+}
+
+func TestExpire(t *testing.T) {
+	ms := NewMetricStorage()
+	events, cancel := ms.Subscribe(10)
+	defer cancel()
+	var replicated []WriteRequest
+	ms.EnableReplication("thor-0", func(wr WriteRequest) { replicated = append(replicated, wr) })
+
+	for i, age := range []time.Duration{time.Hour, time.Second} {
+		done := make(chan error, 1)
+		ms.SubmitWriteRequest(WriteRequest{
+			Labels:    map[string]string{"job": "arena", "instance": fmt.Sprint(i)},
+			Timestamp: time.Now().Add(-age),
+			MetricFamilies: map[string]*dto.MetricFamily{
+				"arena_players": {
+					Name:   proto.String("arena_players"),
+					Type:   metricTypePtr(dto.MetricType_GAUGE),
+					Metric: []*dto.Metric{{Gauge: &dto.Gauge{Value: proto.Float64(1)}}},
+				},
+			},
+			Done: done,
+		})
+		if err := <-done; err != nil {
+			t.Fatal(err)
+		}
+		if e := <-events; !e.GroupCreated {
+			t.Errorf("expected the group to be created, got %+v", e)
+		}
+	}
+
+	expired := ms.Expire(time.Minute)
+	if len(expired) != 1 || expired[0]["instance"] != "0" {
+		t.Errorf("expected the old group to expire, got %v", expired)
+	}
+	if e := <-events; e.Type != EventExpire || !e.GroupDeleted || e.Labels["instance"] != "0" {
+		t.Errorf("expected expire event, got %+v", e)
+	}
+	if n := ms.GroupCount(); n != 1 {
+		t.Errorf("expected 1 group left, got %d", n)
+	}
+
+	// the expiry is replicated as delete of the group.
+	if len(replicated) != 3 || replicated[2].MetricFamilies != nil || replicated[2].Labels["instance"] != "0" || replicated[2].Sequence != 3 {
+		t.Errorf("expected replicated delete, got %+v", replicated)
+	}
+}
+
+func TestValidateWriteRequests(t *testing.T) {
+	ms := &MetricStorage{
+		metricGroups: make(map[string]MetricGroup),
+	}
+	family := func(mt dto.MetricType, val float64) map[string]*dto.MetricFamily {
+		m := &dto.Metric{Gauge: &dto.Gauge{Value: proto.Float64(val)}}
+		if mt == dto.MetricType_COUNTER {
+			m = &dto.Metric{Counter: &dto.Counter{Value: proto.Float64(val)}}
+		}
+		return map[string]*dto.MetricFamily{
+			"players": {Name: proto.String("players"), Type: metricTypePtr(mt), Metric: []*dto.Metric{m}},
+		}
+	}
+
+	first := WriteRequest{Labels: map[string]string{"job": "lobby"}, MetricFamilies: family(dto.MetricType_COUNTER, 3)}
+	second := WriteRequest{Labels: map[string]string{"job": "lobby"}, MetricFamilies: family(dto.MetricType_COUNTER, 4)}
+	if err := ms.ValidateWriteRequests([]WriteRequest{first, second}); err != nil {
+		t.Fatalf("expected requests to be valid, got: %v", err)
+	}
+	if v := first.MetricFamilies["players"].Metric[0].Counter.GetValue(); v != 3 {
+		t.Errorf("expected requests not to be modified, got value %v", v)
+	}
+	if n := ms.GroupCount(); n != 0 {
+		t.Errorf("expected storage not to be modified, got %d groups", n)
+	}
+
+	// the second request conflicts with the first one only.
+	conflicting := WriteRequest{Labels: map[string]string{"job": "arena"}, MetricFamilies: family(dto.MetricType_GAUGE, 1)}
+	if err := ms.ValidateWriteRequests([]WriteRequest{first, conflicting}); err == nil {
+		t.Error("expected conflicting requests to be rejected")
+	}
+}
+
+// replica is a storage with replication enabled,
+// which records the requests it replicates.
+type replica struct {
+	ms  *MetricStorage
+	out []WriteRequest
+}
+
+func newReplica(origin string) *replica {
+	r := &replica{ms: NewSimpleMetricStorage()}
+	r.ms.EnableReplication(origin, func(wr WriteRequest) {
+		// the families are merged in place afterwards.
+		if wr.MetricFamilies != nil {
+			families := make(map[string]*dto.MetricFamily, len(wr.MetricFamilies))
+			for name, mf := range wr.MetricFamilies {
+				families[name] = utils.CopyMetricFamily(mf)
+			}
+			wr.MetricFamilies = families
+		}
+		r.out = append(r.out, wr)
+	})
+	return r
+}
+
+// receive applies the requests replicated by the other replica.
+func (r *replica) receive(t *testing.T, other *replica) {
+	for _, wr := range other.out {
+		if r.ms.applied(wr) {
+			continue
+		}
+		if err := r.ms.apply(wr); err != nil {
+			t.Fatal(err)
+		}
+	}
+	other.out = nil
+}
+
+// dumpMetrics returns the metrics of the storage in a stable order.
+func dumpMetrics(ms *MetricStorage) string {
+	var lines []string
+	for _, mf := range ms.GetMetricFamilies() {
+		for _, m := range mf.Metric {
+			lines = append(lines, mf.GetName()+" "+proto.CompactTextString(m))
+		}
+	}
+	sort.Strings(lines)
+	return strings.Join(lines, "\n")
+}
+
+func TestOrderConverges(t *testing.T) {
+	labels := map[string]string{"job": "lobby"}
+	metric := func(mt dto.MetricType, server string, v float64) *dto.Metric {
+		m := &dto.Metric{Label: []*dto.LabelPair{{Name: proto.String("server"), Value: proto.String(server)}}}
+		if mt == dto.MetricType_COUNTER {
+			m.Counter = &dto.Counter{Value: proto.Float64(v)}
+		} else {
+			m.Gauge = &dto.Gauge{Value: proto.Float64(v)}
+		}
+		return m
+	}
+	write := func(mt dto.MetricType, name string, v float64, modify func(*WriteRequest)) func(*MetricStorage) error {
+		return func(ms *MetricStorage) error {
+			wr := WriteRequest{
+				Labels: labels,
+				MetricFamilies: map[string]*dto.MetricFamily{
+					name: {Name: proto.String(name), Type: metricTypePtr(mt), Metric: []*dto.Metric{metric(mt, "lobby1", v)}},
+				},
+			}
+			if modify != nil {
+				modify(&wr)
+			}
+			return ms.apply(wr)
+		}
+	}
+	gauge := func(v float64) func(*MetricStorage) error {
+		return write(dto.MetricType_GAUGE, "players", v, nil)
+	}
+	increment := func(v float64) func(*MetricStorage) error {
+		return write(dto.MetricType_COUNTER, "logins_total", v, nil)
+	}
+	replace := write(dto.MetricType_COUNTER, "logins_total", 5, func(wr *WriteRequest) { wr.Replace = true })
+	absolute := write(dto.MetricType_COUNTER, "logins_total", 10, func(wr *WriteRequest) { wr.Absolute = true })
+	remove := func(ms *MetricStorage) error {
+		return ms.apply(WriteRequest{Labels: labels})
+	}
+	partial := func(ms *MetricStorage) error {
+		players, _ := selector.Parse(`players{server="lobby1"}`)
+		return ms.apply(WriteRequest{Labels: labels, DeleteSeries: [][]*selector.Matcher{players}})
+	}
+	wipe := func(ms *MetricStorage) error {
+		ms.Wipe()
+		return nil
+	}
+	setup := func(ms *MetricStorage) error {
+		if err := gauge(1)(ms); err != nil {
+			return err
+		}
+		return increment(1)(ms)
+	}
+
+	tests := []struct {
+		name          string
+		first, second func(*MetricStorage) error
+	}{
+		{"gauges", gauge(2), gauge(3)},
+		{"replace and increment", replace, increment(2)},
+		{"delete and increment", remove, increment(2)},
+		{"delete and gauge", remove, gauge(2)},
+		{"absolute and increment", absolute, increment(2)},
+		{"wipe and increment", wipe, increment(2)},
+		{"wipe and gauge", wipe, gauge(2)},
+		{"partial delete and gauge", partial, gauge(2)},
+		{"partial delete and increment", partial, increment(2)},
+	}
+	for _, test := range tests {
+		for _, swapped := range []bool{false, true} {
+			first, second := test.first, test.second
+			if swapped {
+				first, second = second, first
+			}
+
+			// the expected result is the one of applying
+			// both writes in the order of their stamps.
+			expected := NewSimpleMetricStorage()
+			for _, write := range []func(*MetricStorage) error{setup, first, second} {
+				if err := write(expected); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			// every replica applies its own write before the one of
+			// the other replica, so they apply them in opposite orders.
+			a, b := newReplica("a"), newReplica("b")
+			if err := setup(a.ms); err != nil {
+				t.Fatal(err)
+			}
+			b.receive(t, a)
+			if err := first(a.ms); err != nil {
+				t.Fatal(err)
+			}
+			if err := second(b.ms); err != nil {
+				t.Fatal(err)
+			}
+			a.receive(t, b)
+			b.receive(t, a)
+
+			exp := dumpMetrics(expected)
+			if got := dumpMetrics(a.ms); got != exp {
+				t.Errorf("%s (swapped %v): expected\n%s\ngot on a\n%s", test.name, swapped, exp, got)
+			}
+			if got := dumpMetrics(b.ms); got != exp {
+				t.Errorf("%s (swapped %v): expected\n%s\ngot on b\n%s", test.name, swapped, exp, got)
+			}
+		}
+	}
+}
+
+func TestSyncReplaysPending(t *testing.T) {
+	peer := newReplica("peer")
+	r := newReplica("a")
+	counter := func(v float64) WriteRequest {
+		return WriteRequest{
+			Labels: map[string]string{"job": "lobby"},
+			MetricFamilies: map[string]*dto.MetricFamily{
+				"logins_total": {
+					Name:   proto.String("logins_total"),
+					Type:   metricTypePtr(dto.MetricType_COUNTER),
+					Metric: []*dto.Metric{{Counter: &dto.Counter{Value: proto.Float64(v)}}},
+				},
+			},
+		}
+	}
+	if err := peer.ms.apply(counter(2)); err != nil {
+		t.Fatal(err)
+	}
+	r.receive(t, peer)
+
+	// the peer has applied the first request of a only,
+	// the second one is still pending.
+	for _, v := range []float64{1, 4} {
+		if err := r.ms.apply(counter(v)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	pending := r.out
+	peer.receive(t, &replica{out: pending[:1]})
+
+	var snapshot bytes.Buffer
+	if err := peer.ms.WriteSnapshot(&snapshot); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.ms.Sync(&snapshot, func() []WriteRequest { return pending }); err != nil {
+		t.Fatal(err)
+	}
+	if v := r.ms.GetMetricFamilies()[0].Metric[0].Counter.GetValue(); v != 7 {
+		t.Errorf("expected the pending request to be applied again, got counter %v", v)
+	}
+	if v := r.ms.Version("a"); v != 2 {
+		t.Errorf("expected own version 2, got %d", v)
+	}
+	if v := r.ms.Version("peer"); v != 1 {
+		t.Errorf("expected version 1 of the peer, got %d", v)
+	}
+}
@@ -0,0 +1,229 @@
+package storage
+
+import (
+	"dev.volix.ops/thor/pkg/slog"
+	"errors"
+	"fmt"
+	"github.com/golang/protobuf/proto"
+	dto "github.com/prometheus/client_model/go"
+	"regexp"
+	"sort"
+	"sync"
+)
+
+// TenantIDRE matches valid tenant IDs.
+var TenantIDRE = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]{0,63}$`)
+
+// ErrTooManyTenants is returned, if a new tenant would
+// exceed the maximum number of tenants.
+var ErrTooManyTenants = errors.New("too many tenants")
+
+// Tenants holds an isolated MetricStorage for every tenant.
+// The storages are created with the first write of a tenant.
+type Tenants struct {
+	lock     sync.RWMutex
+	storages map[string]*MetricStorage
+	max      int
+	onCreate []func(id string, ms *MetricStorage)
+
+	// set by ShareTypes.
+	shared *sharedTypes
+}
+
+// sharedTypes keeps the types of the families consistent
+// between storages, whose families are exposed together.
+type sharedTypes struct {
+	// serializes the writes to all storages, so that two of them
+	// can not add a family with different types at the same time.
+	lock     sync.Mutex
+	storages func() []*MetricStorage
+}
+
+// check returns an error, if one of the families has
+// another type in one of the storages other than ms.
+func (st *sharedTypes) check(ms *MetricStorage, mfs map[string]*dto.MetricFamily) error {
+	for _, other := range st.storages() {
+		if other == ms {
+			continue
+		}
+		if err := other.checkTypes(mfs); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// NewTenants creates a new set of tenants. A max
+// of 0 allows an unlimited number of tenants.
+func NewTenants(max int) *Tenants {
+	return &Tenants{
+		storages: make(map[string]*MetricStorage),
+		max:      max,
+	}
+}
+
+// Get returns the MetricStorage of the tenant, it is created
+// if the tenant does not exist yet.
+func (t *Tenants) Get(id string) (*MetricStorage, error) {
+	if ms, ok := t.Lookup(id); ok {
+		return ms, nil
+	}
+	if !TenantIDRE.MatchString(id) {
+		return nil, fmt.Errorf("invalid tenant id %q", id)
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	// another request could have created it in the meantime.
+	if ms, ok := t.storages[id]; ok {
+		return ms, nil
+	}
+	if t.max > 0 && len(t.storages) >= t.max {
+		return nil, ErrTooManyTenants
+	}
+
+	slog.Info("creating storage for tenant ", id)
+	ms := NewMetricStorage()
+	ms.shared = t.shared
+	for _, f := range t.onCreate {
+		f(id, ms)
+	}
+	t.storages[id] = ms
+	return ms, nil
+}
+
+// OnCreate adds a function, which is called for every new storage
+// before it is used, e.g. to enable its replication. It must not
+// access the Tenants.
+func (t *Tenants) OnCreate(f func(id string, ms *MetricStorage)) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.onCreate = append(t.onCreate, f)
+}
+
+// ShareTypes rejects writes to ms, e.g. the default storage, and to
+// the storages of the tenants, if one of the families has another type
+// than in one of the other storages. This keeps the families consistent,
+// when they are exposed together with GetAllMetricFamilies, so that one
+// tenant can not break it for everyone. It has to be called before
+// the storages are used.
+func (t *Tenants) ShareTypes(ms *MetricStorage) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.shared = &sharedTypes{storages: func() []*MetricStorage {
+		t.lock.RLock()
+		defer t.lock.RUnlock()
+
+		storages := make([]*MetricStorage, 0, len(t.storages)+1)
+		storages = append(storages, ms)
+		for _, tms := range t.storages {
+			storages = append(storages, tms)
+		}
+		return storages
+	}}
+	ms.shared = t.shared
+	for _, tms := range t.storages {
+		tms.shared = t.shared
+	}
+}
+
+// Lookup returns the MetricStorage of the tenant,
+// but without creating it.
+func (t *Tenants) Lookup(id string) (*MetricStorage, bool) {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+
+	ms, ok := t.storages[id]
+	return ms, ok
+}
+
+// IDs returns the sorted IDs of all tenants.
+func (t *Tenants) IDs() []string {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+
+	ids := make([]string, 0, len(t.storages))
+	for id := range t.storages {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// GetMetricFamilies returns the metric families of all tenants,
+// where every metric has the ID of its tenant as label with
+// the given name. Families with the same name are merged, but
+// if their types differ, only the first one is returned.
+func (t *Tenants) GetMetricFamilies(label string) []*dto.MetricFamily {
+	return t.mergeMetricFamilies(nil, label)
+}
+
+// GetAllMetricFamilies is the same as GetMetricFamilies, but the
+// families of ms, e.g. the default storage, are returned as well,
+// without label. Unlike with prometheus.Gatherers, families with
+// another type are skipped and the help of the first one is kept,
+// instead of failing the whole gathering.
+func (t *Tenants) GetAllMetricFamilies(ms *MetricStorage, label string) []*dto.MetricFamily {
+	return t.mergeMetricFamilies(ms, label)
+}
+
+// mergeMetricFamilies merges the families of ms, if not
+// nil, and the ones of the tenants with their label.
+func (t *Tenants) mergeMetricFamilies(ms *MetricStorage, label string) []*dto.MetricFamily {
+	families := map[string]*dto.MetricFamily{}
+	var names []string
+
+	if ms != nil {
+		for _, mf := range ms.GetMetricFamilies() {
+			families[mf.GetName()] = mf
+			names = append(names, mf.GetName())
+		}
+	}
+	for _, id := range t.IDs() {
+		tms, ok := t.Lookup(id)
+		if !ok {
+			continue
+		}
+
+		for _, mf := range tms.GetMetricFamilies() {
+			for _, m := range mf.Metric {
+				setLabel(m, label, id)
+			}
+
+			prev, ok := families[mf.GetName()]
+			if !ok {
+				families[mf.GetName()] = mf
+				names = append(names, mf.GetName())
+				continue
+			}
+			if prev.GetType() != mf.GetType() {
+				slog.Debug(fmt.Sprintf("skipping %s of tenant %s, it has type %s instead of %s",
+					mf.GetName(), id, mf.GetType(), prev.GetType()))
+				continue
+			}
+			prev.Metric = append(prev.Metric, mf.Metric...)
+		}
+	}
+
+	sort.Strings(names)
+	result := make([]*dto.MetricFamily, 0, len(names))
+	for _, name := range names {
+		result = append(result, families[name])
+	}
+	return result
+}
+
+// setLabel sets the label of the metric, an existing
+// label with the same name is overwritten.
+func setLabel(m *dto.Metric, name, value string) {
+	for _, lp := range m.Label {
+		if lp.GetName() == name {
+			lp.Value = proto.String(value)
+			return
+		}
+	}
+	m.Label = append(m.Label, &dto.LabelPair{Name: proto.String(name), Value: proto.String(value)})
+}
@@ -199,3 +199,41 @@ func (s LabelPairs) Swap(i, j int) {
 func (s LabelPairs) Less(i, j int) bool {
 	return s[i].GetName() < s[j].GetName()
 }
+
+// SanitizeMetricName replaces every character which is not allowed
+// in a Prometheus metric name with an underscore. If the name starts
+// with a digit, an underscore is prepended.
+//
+// This is used for metrics from foreign protocols (e.g. Graphite paths),
+// which do not follow the Prometheus naming rules.
+func SanitizeMetricName(name string) string {
+	return sanitizeName(name, true)
+}
+
+// SanitizeLabelName works just like SanitizeMetricName, but for label
+// names, which do not allow colons.
+func SanitizeLabelName(name string) string {
+	return sanitizeName(name, false)
+}
+
+func sanitizeName(name string, allowColon bool) string {
+	if name == "" {
+		return "_"
+	}
+
+	sb := strings.Builder{}
+	for i, r := range name {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r == '_', allowColon && r == ':':
+			sb.WriteRune(r)
+		case r >= '0' && r <= '9':
+			if i == 0 {
+				sb.WriteByte('_')
+			}
+			sb.WriteRune(r)
+		default:
+			sb.WriteByte('_')
+		}
+	}
+	return sb.String()
+}
@@ -183,3 +183,21 @@ func TestLabelPairs_Less(t *testing.T) {
 		t.Errorf("expected 'a' to be first after sorting, got: %s", *labelPairs[0].Name)
 	}
 }
+
+func TestSanitizeMetricName(t *testing.T) {
+	tests := map[string]string{
+		"servers.lobby17.players": "servers_lobby17_players",
+		"17players":               "_17players",
+		"http:requests-total":     "http:requests_total",
+		"":                        "_",
+	}
+	for in, expected := range tests {
+		if out := SanitizeMetricName(in); out != expected {
+			t.Errorf("could not sanitize metric name %q, got: %s, expected: %s", in, out, expected)
+		}
+	}
+
+	if out := SanitizeLabelName("a:b"); out != "a_b" {
+		t.Errorf("could not sanitize label name, got: %s, expected: %s", out, "a_b")
+	}
+}
@@ -0,0 +1,238 @@
+package web
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"golang.org/x/crypto/bcrypt"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// A RouteClass groups routes which require the same permissions.
+type RouteClass string
+
+const (
+	RoutePush   RouteClass = "push"
+	RouteDelete RouteClass = "delete"
+	RouteScrape RouteClass = "scrape"
+	RouteAdmin  RouteClass = "admin"
+	// RouteCluster is used by the peers of a cluster.
+	RouteCluster RouteClass = "cluster"
+
+	// AnyIdentity allows every authenticated identity
+	// to access a route class.
+	AnyIdentity = "*"
+)
+
+func (c RouteClass) valid() bool {
+	switch c {
+	case RoutePush, RouteDelete, RouteScrape, RouteAdmin, RouteCluster:
+		return true
+	}
+	return false
+}
+
+var authFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "thor_http_auth_failures_total",
+	Help: "Total number of requests rejected by authentication or authorization.",
+}, []string{"route", "reason"})
+
+type identityKey struct{}
+
+// Identity returns the identity of the authenticated client,
+// set by the Authenticator. It returns false for anonymous requests.
+func Identity(ctx context.Context) (string, bool) {
+	identity, ok := ctx.Value(identityKey{}).(string)
+	return identity, ok
+}
+
+// WithIdentity returns a copy of the context carrying the identity.
+func WithIdentity(ctx context.Context, identity string) context.Context {
+	return context.WithValue(ctx, identityKey{}, identity)
+}
+
+// An Authenticator authenticates requests with the users and tokens
+// of the Config and checks if they may access the route class.
+// Clients can authenticate with HTTP basic auth, a bearer token
+// or a verified client certificate, whose subject is the identity.
+// Certificates with the name of a user or token identity as subject
+// are rejected.
+type Authenticator struct {
+	// the users, tokens and route auth, replaced by Update.
+	credentialsMu sync.RWMutex
+	credentials   credentials
+
+	// bcrypt is slow on purpose, so successful
+	// logins are cached by the hash of the credentials.
+	mu    sync.Mutex
+	cache map[[sha256.Size]byte]bool
+}
+
+// NewAuthenticator creates a new Authenticator from the config.
+// If c is nil, every request is allowed.
+func NewAuthenticator(c *Config) *Authenticator {
+	a := &Authenticator{cache: map[[sha256.Size]byte]bool{}}
+	a.Update(c)
+	return a
+}
+
+type credentials struct {
+	users     map[string]string
+	tokens    map[string]string
+	routeAuth map[RouteClass][]string
+}
+
+// Update replaces the users, tokens and route auth with the ones
+// of the config, e.g. after reloading it. If c is nil, every
+// request is allowed.
+func (a *Authenticator) Update(c *Config) {
+	var creds credentials
+	if c != nil {
+		creds = credentials{users: c.BasicAuthUsers, tokens: c.BearerTokens, routeAuth: c.RouteAuth}
+	}
+
+	a.credentialsMu.Lock()
+	defer a.credentialsMu.Unlock()
+	a.credentials = creds
+}
+
+// Protect wraps the handler, so that only identities allowed to access
+// the route class reach it. Requests without valid credentials are
+// rejected with http.StatusUnauthorized, the ones of identities which
+// are not allowed with http.StatusForbidden.
+func (a *Authenticator) Protect(class RouteClass, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		a.credentialsMu.RLock()
+		creds := a.credentials
+		a.credentialsMu.RUnlock()
+
+		identity, authenticated, ok := a.authenticate(creds, r)
+		if !ok {
+			authFailures.WithLabelValues(string(class), "invalid_credentials").Inc()
+			unauthorized(creds, w)
+			return
+		}
+		if authenticated {
+			r = r.WithContext(WithIdentity(r.Context(), identity))
+		}
+
+		allowed, restricted := creds.routeAuth[class]
+		if !restricted {
+			h(w, r)
+			return
+		}
+		if !authenticated {
+			authFailures.WithLabelValues(string(class), "missing_credentials").Inc()
+			unauthorized(creds, w)
+			return
+		}
+		for _, id := range allowed {
+			if id == AnyIdentity || id == identity {
+				h(w, r)
+				return
+			}
+		}
+		authFailures.WithLabelValues(string(class), "forbidden").Inc()
+		http.Error(w, "forbidden", http.StatusForbidden)
+	}
+}
+
+// authenticate returns the identity of the request and if it is
+// authenticated at all. ok is false, if invalid credentials are sent.
+func (a *Authenticator) authenticate(creds credentials, r *http.Request) (identity string, authenticated bool, ok bool) {
+	if user, password, hasBasic := r.BasicAuth(); hasBasic {
+		if !a.checkPassword(creds, user, password) {
+			return "", false, false
+		}
+		return user, true, true
+	}
+
+	if auth := r.Header.Get("Authorization"); auth != "" {
+		// InfluxDB clients send their tokens with the Token scheme.
+		scheme, token := auth, ""
+		if i := strings.IndexByte(auth, ' '); i >= 0 {
+			scheme, token = auth[:i], strings.TrimSpace(auth[i+1:])
+		}
+		if token == "" || !(strings.EqualFold(scheme, "Bearer") || strings.EqualFold(scheme, "Token")) {
+			return "", false, false
+		}
+		identity, found := checkToken(creds, token)
+		return identity, found, found
+	}
+
+	if subject, verified := ClientSubject(r); verified {
+		// any certificate of the client CA could otherwise
+		// claim the identity of a user or a token.
+		if _, isUser := creds.users[subject]; isUser {
+			return "", false, false
+		}
+		if _, isToken := creds.tokens[subject]; isToken {
+			return "", false, false
+		}
+		return subject, true, true
+	}
+	return "", false, true
+}
+
+func (a *Authenticator) checkPassword(creds credentials, user, password string) bool {
+	hash, found := creds.users[user]
+	if !found {
+		// compare anyway, so that the time of the response
+		// does not reveal which users exist.
+		_ = bcrypt.CompareHashAndPassword(unknownUserHash(), []byte(password))
+		return false
+	}
+
+	key := sha256.Sum256([]byte(user + ":" + hash + ":" + password))
+	a.mu.Lock()
+	cached := a.cache[key]
+	a.mu.Unlock()
+	if cached {
+		return true
+	}
+
+	if bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) != nil {
+		return false
+	}
+	a.mu.Lock()
+	a.cache[key] = true
+	a.mu.Unlock()
+	return true
+}
+
+var (
+	unknownUserHashOnce  sync.Once
+	unknownUserHashValue []byte
+)
+
+// unknownUserHash returns the bcrypt hash compared for unknown users,
+// with the cost recommended for the hashes of the users.
+func unknownUserHash() []byte {
+	unknownUserHashOnce.Do(func() {
+		unknownUserHashValue, _ = bcrypt.GenerateFromPassword([]byte("unknown"), bcrypt.DefaultCost)
+	})
+	return unknownUserHashValue
+}
+
+func checkToken(creds credentials, token string) (string, bool) {
+	for identity, t := range creds.tokens {
+		if subtle.ConstantTimeCompare([]byte(t), []byte(token)) == 1 {
+			return identity, true
+		}
+	}
+	return "", false
+}
+
+func unauthorized(creds credentials, w http.ResponseWriter) {
+	if len(creds.users) > 0 {
+		w.Header().Add("WWW-Authenticate", `Basic realm="thor"`)
+	}
+	if len(creds.tokens) > 0 {
+		w.Header().Add("WWW-Authenticate", `Bearer realm="thor"`)
+	}
+	http.Error(w, "unauthorized", http.StatusUnauthorized)
+}
@@ -0,0 +1,256 @@
+// Package web configures the HTTP server of thor with a web config file,
+// similar to the one of the Prometheus exporter-toolkit.
+package web
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/bcrypt"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"path/filepath"
+)
+
+// A Config is the content of the web config file.
+//
+// Example:
+//  tls_server_config:
+//    cert_file: thor.crt
+//    key_file: thor.key
+//    client_auth_type: RequireAndVerifyClientCert
+//    client_ca_file: ca.crt
+//    min_version: TLS12
+//    cipher_suites:
+//    - TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384
+//    - TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384
+//  basic_auth_users:
+//    lobby: $2y$10$...
+//  bearer_tokens:
+//    ci: 2b5f3a...
+//  route_auth:
+//    push: [lobby, ci]
+//    delete: [ci]
+//    admin: [ci]
+//  authorization:
+//  - identity: lobby
+//    match: '{job=~"lobby.*"}'
+//    methods: [POST, PUT]
+//  - identity: ci
+type Config struct {
+	TLSConfig TLSServerConfig `yaml:"tls_server_config"`
+
+	// BasicAuthUsers maps user names to bcrypt hashes of their passwords.
+	BasicAuthUsers map[string]string `yaml:"basic_auth_users"`
+	// BearerTokens maps identities to their tokens.
+	BearerTokens map[string]string `yaml:"bearer_tokens"`
+	// RouteAuth maps route classes to the identities allowed to
+	// access them. `*` allows every authenticated identity.
+	// Route classes which are missing can be accessed by anyone.
+	RouteAuth map[RouteClass][]string `yaml:"route_auth"`
+	// Authorization restricts the groups identities can write to.
+	Authorization Policies `yaml:"authorization"`
+}
+
+// TLSServerConfig enables TLS, if CertFile and KeyFile are set.
+// The certificate, key and client CA files are reloaded
+// as soon as they change.
+type TLSServerConfig struct {
+	CertFile   string `yaml:"cert_file"`
+	KeyFile    string `yaml:"key_file"`
+	ClientAuth string `yaml:"client_auth_type"`
+	ClientCAs  string `yaml:"client_ca_file"`
+
+	MinVersion               TLSVersion `yaml:"min_version"`
+	CipherSuites             []Cipher   `yaml:"cipher_suites"`
+	PreferServerCipherSuites bool       `yaml:"prefer_server_cipher_suites"`
+}
+
+// VerifiesClients returns true, if client certificates are verified,
+// so that their subject can be used as identity.
+func (c *TLSServerConfig) VerifiesClients() bool {
+	return c.Enabled() && c.ClientCAs != ""
+}
+
+// Enabled returns true, if TLS is configured.
+func (c *TLSServerConfig) Enabled() bool {
+	return c.CertFile != "" || c.KeyFile != ""
+}
+
+// LoadConfig reads and validates the web config file at the given path.
+// Relative paths inside the file are resolved relative to the file itself.
+func LoadConfig(path string) (*Config, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &Config{}
+	if err := yaml.UnmarshalStrict(b, c); err != nil {
+		return nil, fmt.Errorf("invalid web config %s: %v", path, err)
+	}
+	c.TLSConfig.resolvePaths(filepath.Dir(path))
+
+	if err := c.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid web config %s: %v", path, err)
+	}
+	return c, nil
+}
+
+// Validate checks the config for missing or invalid values.
+func (c *Config) Validate() error {
+	if err := c.validateTLS(); err != nil {
+		return err
+	}
+	return c.validateAuth()
+}
+
+func (c *Config) validateAuth() error {
+	for user, hash := range c.BasicAuthUsers {
+		if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+			return fmt.Errorf("invalid bcrypt hash for user %q: %v", user, err)
+		}
+	}
+	for identity, token := range c.BearerTokens {
+		if token == "" {
+			return fmt.Errorf("empty bearer token for %q", identity)
+		}
+		if _, ok := c.BasicAuthUsers[identity]; ok {
+			return fmt.Errorf("identity %q is used for a user and a bearer token", identity)
+		}
+	}
+	for class, identities := range c.RouteAuth {
+		if !class.valid() {
+			return fmt.Errorf("unknown route class %q in route_auth", class)
+		}
+		for _, identity := range identities {
+			if identity == AnyIdentity {
+				continue
+			}
+			_, isUser := c.BasicAuthUsers[identity]
+			_, isToken := c.BearerTokens[identity]
+			if !isUser && !isToken && !c.TLSConfig.VerifiesClients() {
+				return fmt.Errorf("unknown identity %q in route_auth of %s", identity, class)
+			}
+		}
+	}
+	for i := range c.Authorization {
+		if err := c.Authorization[i].compile(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *Config) validateTLS() error {
+	tc := &c.TLSConfig
+	if !tc.Enabled() {
+		if tc.ClientCAs != "" || tc.ClientAuth != "" {
+			return errors.New("client certificates require cert_file and key_file")
+		}
+		return nil
+	}
+	if tc.CertFile == "" {
+		return errors.New("missing cert_file")
+	}
+	if tc.KeyFile == "" {
+		return errors.New("missing key_file")
+	}
+
+	clientAuth, err := parseClientAuth(tc.ClientAuth)
+	if err != nil {
+		return err
+	}
+	if tc.ClientCAs != "" && clientAuth == tls.NoClientCert {
+		return errors.New("client_ca_file requires a client_auth_type verifying certificates")
+	}
+	if tc.ClientCAs == "" && (clientAuth == tls.VerifyClientCertIfGiven || clientAuth == tls.RequireAndVerifyClientCert) {
+		return fmt.Errorf("client_auth_type %s requires a client_ca_file", tc.ClientAuth)
+	}
+	return nil
+}
+
+func (c *TLSServerConfig) resolvePaths(dir string) {
+	for _, p := range []*string{&c.CertFile, &c.KeyFile, &c.ClientCAs} {
+		if *p != "" && !filepath.IsAbs(*p) {
+			*p = filepath.Join(dir, *p)
+		}
+	}
+}
+
+// parseClientAuth returns the tls.ClientAuthType with the given name.
+// The names are the same as the ones of the constants in crypto/tls.
+func parseClientAuth(s string) (tls.ClientAuthType, error) {
+	switch s {
+	case "", "NoClientCert":
+		return tls.NoClientCert, nil
+	case "RequestClientCert":
+		return tls.RequestClientCert, nil
+	case "RequireAnyClientCert", "RequireClientCert":
+		return tls.RequireAnyClientCert, nil
+	case "VerifyClientCertIfGiven":
+		return tls.VerifyClientCertIfGiven, nil
+	case "RequireAndVerifyClientCert":
+		return tls.RequireAndVerifyClientCert, nil
+	}
+	return tls.NoClientCert, fmt.Errorf("invalid client_auth_type %q", s)
+}
+
+// TLSVersion is a TLS version, given by its name, e.g. TLS12.
+type TLSVersion uint16
+
+var tlsVersions = map[string]uint16{
+	"TLS13": tls.VersionTLS13,
+	"TLS12": tls.VersionTLS12,
+	"TLS11": tls.VersionTLS11,
+	"TLS10": tls.VersionTLS10,
+}
+
+func (v *TLSVersion) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	if err := unmarshal(&s); err != nil {
+		return err
+	}
+	version, ok := tlsVersions[s]
+	if !ok {
+		return fmt.Errorf("unknown TLS version %q", s)
+	}
+	*v = TLSVersion(version)
+	return nil
+}
+
+// Cipher is a TLS cipher suite, given by its name as
+// defined in crypto/tls, e.g. TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256.
+type Cipher uint16
+
+// cipherSuites contains the secure cipher suites of crypto/tls,
+// the TLS 1.3 ones can not be configured though.
+var cipherSuites = map[string]uint16{
+	"TLS_RSA_WITH_AES_128_CBC_SHA":                  tls.TLS_RSA_WITH_AES_128_CBC_SHA,
+	"TLS_RSA_WITH_AES_256_CBC_SHA":                  tls.TLS_RSA_WITH_AES_256_CBC_SHA,
+	"TLS_RSA_WITH_AES_128_GCM_SHA256":               tls.TLS_RSA_WITH_AES_128_GCM_SHA256,
+	"TLS_RSA_WITH_AES_256_GCM_SHA384":               tls.TLS_RSA_WITH_AES_256_GCM_SHA384,
+	"TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA":          tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA,
+	"TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA":          tls.TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA,
+	"TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA":            tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA,
+	"TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA":            tls.TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA,
+	"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256":         tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+	"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256":       tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+	"TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384":         tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+	"TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384":       tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+	"TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256":   tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305,
+	"TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256": tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305,
+}
+
+func (c *Cipher) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	if err := unmarshal(&s); err != nil {
+		return err
+	}
+	cipher, ok := cipherSuites[s]
+	if !ok {
+		return fmt.Errorf("unknown cipher suite %q", s)
+	}
+	*c = Cipher(cipher)
+	return nil
+}
@@ -0,0 +1,108 @@
+package web
+
+import (
+	"dev.volix.ops/thor/pkg/selector"
+	"dev.volix.ops/thor/pkg/slog"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// A Policy allows an identity to write to the groups, whose grouping
+// labels match the selector, with the given methods.
+//
+// Example:
+//  identity: lobby
+//  match: '{job=~"lobby.*"}'
+//  methods: [POST, PUT]
+type Policy struct {
+	// Identity as set by the Authenticator, `*` matches every
+	// identity, including anonymous requests.
+	Identity string `yaml:"identity"`
+	// Selector the grouping labels have to match.
+	Match string `yaml:"match"`
+	// Allowed methods out of POST, PUT and DELETE.
+	// All of them are allowed, if empty.
+	Methods []string `yaml:"methods"`
+
+	matchers []*selector.Matcher
+}
+
+var policyMethods = map[string]bool{
+	http.MethodPost:   true,
+	http.MethodPut:    true,
+	http.MethodDelete: true,
+}
+
+func (p *Policy) compile() error {
+	if p.Identity == "" {
+		return errors.New("policy without identity")
+	}
+	if p.Match != "" {
+		matchers, err := selector.Parse(p.Match)
+		if err != nil {
+			return fmt.Errorf("invalid match of policy for %q: %v", p.Identity, err)
+		}
+		p.matchers = matchers
+	}
+	for i, m := range p.Methods {
+		m = strings.ToUpper(m)
+		if !policyMethods[m] {
+			return fmt.Errorf("invalid method %q in policy for %q", m, p.Identity)
+		}
+		p.Methods[i] = m
+	}
+	return nil
+}
+
+func (p *Policy) allows(identity, method string, labels map[string]string) bool {
+	if p.Identity != AnyIdentity && p.Identity != identity {
+		return false
+	}
+	if len(p.Methods) > 0 {
+		allowed := false
+		for _, m := range p.Methods {
+			allowed = allowed || m == method
+		}
+		if !allowed {
+			return false
+		}
+	}
+	return selector.MatchLabels(p.matchers, labels)
+}
+
+// Policies authorize writes to groups. A write is allowed, if
+// at least one Policy allows it. Without any policies, every
+// write is allowed.
+type Policies []Policy
+
+// ErrForbidden is returned for writes which are not allowed.
+var ErrForbidden = errors.New("forbidden by authorization policy")
+
+// Authorize returns ErrForbidden, if the identity of the request
+// is not allowed to write to the group with the labels.
+// Denied requests are logged with their identity.
+func (ps Policies) Authorize(r *http.Request, labels map[string]string) error {
+	if len(ps) == 0 {
+		return nil
+	}
+
+	identity, _ := Identity(r.Context())
+	for i := range ps {
+		if ps[i].allows(identity, r.Method, labels) {
+			return nil
+		}
+	}
+
+	if identity == "" {
+		identity = "anonymous"
+	}
+	class := RoutePush
+	if r.Method == http.MethodDelete {
+		class = RouteDelete
+	}
+	authFailures.WithLabelValues(string(class), "policy").Inc()
+	slog.Error(fmt.Sprintf("denied %s of %s to group %v (%s)", r.Method, identity, labels, r.RemoteAddr))
+	return ErrForbidden
+}
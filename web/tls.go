@@ -0,0 +1,238 @@
+package web
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"dev.volix.ops/thor/pkg/slog"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// configureTLS sets the TLS config of the server and returns true,
+// if the web config enables TLS.
+func configureTLS(server *http.Server, c *Config) (bool, error) {
+	if c == nil || !c.TLSConfig.Enabled() {
+		return false, nil
+	}
+
+	// load the certificates once, so that invalid
+	// files are reported right on startup.
+	reloader := &tlsReloader{config: c.TLSConfig}
+	if _, err := reloader.getConfig(nil); err != nil {
+		return false, err
+	}
+	server.TLSConfig = &tls.Config{GetConfigForClient: reloader.getConfig}
+	return true, nil
+}
+
+// Listeners serve a server on a set of addresses, which can be
+// changed while it is running, e.g. after reloading the config.
+type Listeners struct {
+	server *http.Server
+	tls    bool
+	errs   chan error
+
+	mu        sync.Mutex
+	listeners map[string]net.Listener
+}
+
+// NewListeners prepares to serve the server with the web config. If c
+// is nil or does not enable TLS, plain HTTP is served. The addresses
+// are set with Update.
+func NewListeners(server *http.Server, c *Config) (*Listeners, error) {
+	useTLS, err := configureTLS(server, c)
+	if err != nil {
+		return nil, err
+	}
+	return &Listeners{
+		server:    server,
+		tls:       useTLS,
+		errs:      make(chan error, 1),
+		listeners: map[string]net.Listener{},
+	}, nil
+}
+
+// Update starts to listen on the addresses, which are not listened on
+// yet, and closes the listeners of the others. Connections accepted
+// before are kept open. If listening on an address fails, the first
+// error is returned, but the other addresses are still updated.
+func (ls *Listeners) Update(addresses []string) error {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+
+	keep := make(map[string]bool, len(addresses))
+	for _, addr := range addresses {
+		keep[addr] = true
+	}
+	for addr, l := range ls.listeners {
+		if !keep[addr] {
+			delete(ls.listeners, addr)
+			_ = l.Close()
+			slog.Info("stopped listening on ", addr)
+		}
+	}
+
+	var firstErr error
+	for _, addr := range addresses {
+		if _, ok := ls.listeners[addr]; ok {
+			continue
+		}
+		l, err := net.Listen("tcp", addr)
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		ls.listeners[addr] = l
+		go ls.serve(addr, l)
+		slog.Info("listening on ", addr)
+	}
+	return firstErr
+}
+
+// serve serves the server on the listener, until it fails
+// or is closed by Update.
+func (ls *Listeners) serve(addr string, l net.Listener) {
+	var err error
+	if ls.tls {
+		err = ls.server.ServeTLS(l, "", "")
+	} else {
+		err = ls.server.Serve(l)
+	}
+
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	if ls.listeners[addr] != l {
+		// closed by Update.
+		return
+	}
+	delete(ls.listeners, addr)
+	select {
+	case ls.errs <- err:
+	default:
+	}
+}
+
+// Wait blocks until serving on one of the addresses
+// fails, but not if it is closed by Update.
+func (ls *Listeners) Wait() error {
+	return <-ls.errs
+}
+
+// ClientSubject returns the common name of the subject of the
+// verified client certificate, which can be used to identify the
+// client. It returns false, if the client did not present one.
+func ClientSubject(r *http.Request) (string, bool) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return "", false
+	}
+	return r.TLS.VerifiedChains[0][0].Subject.CommonName, true
+}
+
+// tlsReloader creates the tls.Config for every handshake and reloads
+// the certificate, key and client CAs as soon as one of them is modified.
+type tlsReloader struct {
+	config TLSServerConfig
+
+	mu       sync.Mutex
+	modTimes map[string]time.Time
+	current  *tls.Config
+}
+
+func (t *tlsReloader) getConfig(_ *tls.ClientHelloInfo) (*tls.Config, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	modTimes, err := t.modTimesOfFiles()
+	if err != nil {
+		if t.current != nil {
+			// keep serving with the old certificate, the files
+			// could be in the middle of being replaced.
+			return t.current, nil
+		}
+		return nil, err
+	}
+	if t.current != nil && sameModTimes(t.modTimes, modTimes) {
+		return t.current, nil
+	}
+
+	c, err := t.load()
+	if err != nil {
+		if t.current != nil {
+			slog.Error("failed to reload tls config, keeping the old one: ", err)
+			return t.current, nil
+		}
+		return nil, err
+	}
+	t.current = c
+	t.modTimes = modTimes
+	return c, nil
+}
+
+// load creates a new tls.Config from the files.
+func (t *tlsReloader) load() (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(t.config.CertFile, t.config.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load certificate: %v", err)
+	}
+
+	c := &tls.Config{
+		Certificates:             []tls.Certificate{cert},
+		MinVersion:               tls.VersionTLS12,
+		PreferServerCipherSuites: t.config.PreferServerCipherSuites,
+	}
+	if t.config.MinVersion != 0 {
+		c.MinVersion = uint16(t.config.MinVersion)
+	}
+	for _, cs := range t.config.CipherSuites {
+		c.CipherSuites = append(c.CipherSuites, uint16(cs))
+	}
+
+	// already validated by LoadConfig.
+	c.ClientAuth, _ = parseClientAuth(t.config.ClientAuth)
+	if t.config.ClientCAs != "" {
+		b, err := ioutil.ReadFile(t.config.ClientCAs)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client CAs: %v", err)
+		}
+		c.ClientCAs = x509.NewCertPool()
+		if !c.ClientCAs.AppendCertsFromPEM(b) {
+			return nil, errors.New("failed to load client CAs: no certificate found")
+		}
+	}
+	return c, nil
+}
+
+func (t *tlsReloader) modTimesOfFiles() (map[string]time.Time, error) {
+	modTimes := map[string]time.Time{}
+	for _, p := range []string{t.config.CertFile, t.config.KeyFile, t.config.ClientCAs} {
+		if p == "" {
+			continue
+		}
+		fi, err := os.Stat(p)
+		if err != nil {
+			return nil, err
+		}
+		modTimes[p] = fi.ModTime()
+	}
+	return modTimes, nil
+}
+
+func sameModTimes(m1, m2 map[string]time.Time) bool {
+	if len(m1) != len(m2) {
+		return false
+	}
+	for p, t1 := range m1 {
+		if t2, ok := m2[p]; !ok || !t1.Equal(t2) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,428 @@
+package web
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"golang.org/x/crypto/bcrypt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeCert creates a certificate signed by parent (or self-signed if
+// parent is nil) and writes it with its key to dir/<name>.crt and .key.
+func writeCert(t *testing.T, dir, name string, serial int64, isCA bool, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(serial),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  isCA,
+	}
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certPem := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPem := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+	if err := ioutil.WriteFile(filepath.Join(dir, name+".crt"), certPem, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, name+".key"), keyPem, 0600); err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return cert, key
+}
+
+func TestLoadConfigInvalid(t *testing.T) {
+	dir, err := ioutil.TempDir("", "thor-web")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tests := map[string]string{
+		"missing key":     "tls_server_config:\n  cert_file: thor.crt\n",
+		"unknown version": "tls_server_config:\n  cert_file: thor.crt\n  key_file: thor.key\n  min_version: TLS9\n",
+		"unknown cipher":  "tls_server_config:\n  cert_file: thor.crt\n  key_file: thor.key\n  cipher_suites: [TLS_NULL]\n",
+		"missing ca":      "tls_server_config:\n  cert_file: thor.crt\n  key_file: thor.key\n  client_auth_type: RequireAndVerifyClientCert\n",
+		"unknown field":   "tls_config:\n  cert_file: thor.crt\n",
+	}
+	for name, content := range tests {
+		path := filepath.Join(dir, "web.yml")
+		if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := LoadConfig(path); err == nil {
+			t.Errorf("%s: expected config to be invalid, but it was not.", name)
+		}
+	}
+}
+
+func TestServeMutualTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "thor-web")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ca, caKey := writeCert(t, dir, "ca", 1, true, nil, nil)
+	serverCert, _ := writeCert(t, dir, "thor", 2, false, ca, caKey)
+	writeCert(t, dir, "lobby", 3, false, ca, caKey)
+
+	config := `tls_server_config:
+  cert_file: thor.crt
+  key_file: thor.key
+  client_auth_type: RequireAndVerifyClientCert
+  client_ca_file: ca.crt
+  min_version: TLS12
+`
+	configPath := filepath.Join(dir, "web.yml")
+	if err := ioutil.WriteFile(configPath, []byte(config), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		subject, _ := ClientSubject(r)
+		_, _ = io.WriteString(w, subject)
+	})}
+	c, err := LoadConfig(configPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ls, err := NewListeners(server, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := freeAddr(t)
+	if err := ls.Update([]string{addr}); err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+	clientCert, err := tls.LoadX509KeyPair(filepath.Join(dir, "lobby.crt"), filepath.Join(dir, "lobby.key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	get := func(certs []tls.Certificate) (*http.Response, error) {
+		client := &http.Client{Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{RootCAs: roots, Certificates: certs},
+		}}
+		return client.Get("https://" + addr)
+	}
+
+	if _, err := get(nil); err == nil {
+		t.Errorf("expected request without client certificate to fail, but it did not.")
+	}
+
+	resp, err := get([]tls.Certificate{clientCert})
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "lobby" {
+		t.Errorf("wrong client subject, got: %q, expected: %q", body, "lobby")
+	}
+	if !resp.TLS.PeerCertificates[0].Equal(serverCert) {
+		t.Errorf("unexpected server certificate")
+	}
+
+	// replace the certificate, it has to be picked up
+	// without restarting the server.
+	newCert, _ := writeCert(t, dir, "thor", 4, false, ca, caKey)
+	future := time.Now().Add(time.Minute)
+	for _, f := range []string{"thor.crt", "thor.key"} {
+		if err := os.Chtimes(filepath.Join(dir, f), future, future); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	resp, err = get([]tls.Certificate{clientCert})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if !resp.TLS.PeerCertificates[0].Equal(newCert) {
+		t.Errorf("expected reloaded server certificate, got serial %v", resp.TLS.PeerCertificates[0].SerialNumber)
+	}
+}
+
+// freeAddr returns an address, which can be listened on.
+func freeAddr(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().String()
+}
+
+func TestListeners(t *testing.T) {
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, "thor")
+	})}
+	defer server.Close()
+	ls, err := NewListeners(server, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// new connections, as the accepted ones are kept open.
+	client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+	get := func(addr string) error {
+		resp, err := client.Get("http://" + addr)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		return nil
+	}
+
+	a1, a2 := freeAddr(t), freeAddr(t)
+	if err := ls.Update([]string{a1, a2}); err != nil {
+		t.Fatal(err)
+	}
+	for _, addr := range []string{a1, a2} {
+		if err := get(addr); err != nil {
+			t.Errorf("expected to be served on %s: %v", addr, err)
+		}
+	}
+
+	// the removed address is closed, the other one is kept.
+	if err := ls.Update([]string{a2, "127.0.0.1:-1"}); err == nil {
+		t.Error("expected error for invalid address")
+	}
+	if err := get(a1); err == nil {
+		t.Errorf("expected %s to be closed", a1)
+	}
+	if err := get(a2); err != nil {
+		t.Errorf("expected to be served on %s: %v", a2, err)
+	}
+
+	select {
+	case err := <-ls.errs:
+		t.Errorf("unexpected error of a closed listener: %v", err)
+	default:
+	}
+}
+
+func TestAuthenticator(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("hunter2"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &Config{
+		BasicAuthUsers: map[string]string{"lobby": string(hash)},
+		BearerTokens:   map[string]string{"ci": "s3cr3t"},
+		RouteAuth: map[RouteClass][]string{
+			RoutePush:   {AnyIdentity},
+			RouteDelete: {"ci"},
+		},
+	}
+	if err := c.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	auth := NewAuthenticator(c)
+
+	var identity string
+	h := func(w http.ResponseWriter, r *http.Request) {
+		identity, _ = Identity(r.Context())
+	}
+
+	tests := []struct {
+		name     string
+		class    RouteClass
+		user     string
+		password string
+		token    string
+		status   int
+		identity string
+	}{
+		{name: "anonymous scrape", class: RouteScrape, status: http.StatusOK},
+		{name: "anonymous push", class: RoutePush, status: http.StatusUnauthorized},
+		{name: "basic push", class: RoutePush, user: "lobby", password: "hunter2", status: http.StatusOK, identity: "lobby"},
+		{name: "wrong password", class: RoutePush, user: "lobby", password: "hunter3", status: http.StatusUnauthorized},
+		{name: "wrong password on open route", class: RouteScrape, user: "lobby", password: "hunter3", status: http.StatusUnauthorized},
+		{name: "basic delete", class: RouteDelete, user: "lobby", password: "hunter2", status: http.StatusForbidden},
+		{name: "token delete", class: RouteDelete, token: "s3cr3t", status: http.StatusOK, identity: "ci"},
+		{name: "wrong token", class: RouteDelete, token: "guessed", status: http.StatusUnauthorized},
+	}
+	for _, test := range tests {
+		identity = ""
+		req, _ := http.NewRequest("POST", "/metrics/job/lobby", nil)
+		if test.user != "" {
+			req.SetBasicAuth(test.user, test.password)
+		}
+		if test.token != "" {
+			req.Header.Set("Authorization", "Bearer "+test.token)
+		}
+
+		rr := httptest.NewRecorder()
+		auth.Protect(test.class, h).ServeHTTP(rr, req)
+
+		if rr.Code != test.status {
+			t.Errorf("%s: wrong status code, got: %v, expected: %v", test.name, rr.Code, test.status)
+		}
+		if identity != test.identity {
+			t.Errorf("%s: wrong identity, got: %q, expected: %q", test.name, identity, test.identity)
+		}
+	}
+}
+
+func TestAuthenticatorCertificates(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("hunter2"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth := NewAuthenticator(&Config{
+		BasicAuthUsers: map[string]string{"lobby": string(hash)},
+		BearerTokens:   map[string]string{"ci": "s3cr3t"},
+		RouteAuth:      map[RouteClass][]string{RouteAdmin: {AnyIdentity}},
+	})
+
+	var identity string
+	h := auth.Protect(RouteAdmin, func(w http.ResponseWriter, r *http.Request) {
+		identity, _ = Identity(r.Context())
+	})
+	for subject, status := range map[string]int{
+		"arena": http.StatusOK,
+		// certificates must not claim the identity of a user or token.
+		"lobby": http.StatusUnauthorized,
+		"ci":    http.StatusUnauthorized,
+	} {
+		identity = ""
+		req, _ := http.NewRequest("POST", "/api/v1/admin/wipe", nil)
+		req.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{
+			{Subject: pkix.Name{CommonName: subject}},
+		}}}
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, req)
+
+		if rr.Code != status {
+			t.Errorf("%s: wrong status code, got: %v, expected: %v", subject, rr.Code, status)
+		}
+		if status == http.StatusOK && identity != subject {
+			t.Errorf("%s: wrong identity, got: %q", subject, identity)
+		}
+	}
+
+	// unknown users are compared with a valid hash as well.
+	if _, err := bcrypt.Cost(unknownUserHash()); err != nil {
+		t.Errorf("invalid hash for unknown users: %v", err)
+	}
+	req, _ := http.NewRequest("POST", "/api/v1/admin/wipe", nil)
+	req.SetBasicAuth("nobody", "hunter2")
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, req)
+	if rr.Code != http.StatusUnauthorized {
+		t.Errorf("wrong status code for unknown user, got: %v, expected: %v", rr.Code, http.StatusUnauthorized)
+	}
+}
+
+func TestAuthenticatorUpdate(t *testing.T) {
+	auth := NewAuthenticator(nil)
+	h := auth.Protect(RouteAdmin, func(w http.ResponseWriter, r *http.Request) {})
+	request := func(token string) int {
+		req, _ := http.NewRequest("POST", "/-/reload", nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, req)
+		return rr.Code
+	}
+
+	if status := request(""); status != http.StatusOK {
+		t.Errorf("wrong status code without config, got: %v, expected: %v", status, http.StatusOK)
+	}
+
+	// the already wrapped handlers use the new config.
+	auth.Update(&Config{
+		BearerTokens: map[string]string{"ci": "s3cr3t"},
+		RouteAuth:    map[RouteClass][]string{RouteAdmin: {"ci"}},
+	})
+	if status := request(""); status != http.StatusUnauthorized {
+		t.Errorf("wrong status code after update, got: %v, expected: %v", status, http.StatusUnauthorized)
+	}
+	if status := request("s3cr3t"); status != http.StatusOK {
+		t.Errorf("wrong status code with token, got: %v, expected: %v", status, http.StatusOK)
+	}
+
+	auth.Update(nil)
+	if status := request(""); status != http.StatusOK {
+		t.Errorf("wrong status code after removing the config, got: %v, expected: %v", status, http.StatusOK)
+	}
+}
+
+func TestPolicies(t *testing.T) {
+	c := &Config{Authorization: Policies{
+		{Identity: "lobby", Match: `{job=~"lobby.*"}`, Methods: []string{"post", "PUT"}},
+		{Identity: "ci"},
+	}}
+	if err := c.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		identity string
+		method   string
+		job      string
+		allowed  bool
+	}{
+		{identity: "lobby", method: "POST", job: "lobby-eu", allowed: true},
+		{identity: "lobby", method: "PUT", job: "lobby", allowed: true},
+		{identity: "lobby", method: "DELETE", job: "lobby", allowed: false},
+		{identity: "lobby", method: "POST", job: "billing", allowed: false},
+		{identity: "ci", method: "DELETE", job: "billing", allowed: true},
+		{identity: "", method: "POST", job: "lobby", allowed: false},
+	}
+	for _, test := range tests {
+		req, _ := http.NewRequest(test.method, "/metrics/job/"+test.job, nil)
+		if test.identity != "" {
+			req = req.WithContext(WithIdentity(req.Context(), test.identity))
+		}
+
+		err := c.Authorization.Authorize(req, map[string]string{"job": test.job})
+		if allowed := err == nil; allowed != test.allowed {
+			t.Errorf("%s %s of %q: got allowed=%v, expected: %v", test.method, test.job, test.identity, allowed, test.allowed)
+		}
+	}
+
+	invalid := &Config{Authorization: Policies{{Identity: "lobby", Methods: []string{"GET"}}}}
+	if err := invalid.Validate(); err == nil {
+		t.Errorf("expected policy with method GET to be invalid, but it was not.")
+	}
+}
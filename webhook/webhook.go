@@ -0,0 +1,360 @@
+package webhook
+
+import (
+	"bytes"
+	"dev.volix.ops/thor/pkg/selector"
+	"dev.volix.ops/thor/pkg/slog"
+	"dev.volix.ops/thor/storage"
+	"encoding/json"
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"gopkg.in/yaml.v2"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+const (
+	// The types of the events sent to the webhooks.
+	EventCreate = "create"
+	EventUpdate = "update"
+	EventDelete = "delete"
+	EventExpire = "expire"
+
+	// How many events are buffered for every storage, before they are
+	// dispatched, and for every webhook, before they are delivered.
+	eventBuffer = 1000
+	queueLength = 1000
+
+	defaultTimeout    = 5 * time.Second
+	defaultMaxRetries = 5
+	maxBackoff        = time.Minute
+)
+
+// The backoff before the first retry, doubled for every further one.
+var minBackoff = time.Second
+
+var (
+	deliveryErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "thor_webhook_errors_total",
+		Help: "Total number of failed webhook deliveries, including retries.",
+	}, []string{"url"})
+	droppedEvents = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "thor_webhook_dropped_total",
+		Help: "Total number of events not delivered to a webhook, because its queue was full or all retries failed.",
+	}, []string{"url"})
+)
+
+// A Config is the content of the webhook file.
+//
+// Example:
+//  webhooks:
+//  - url: https://bot.example.com/thor
+//    events: [create, delete, expire]
+//    match: ['{job="lobby"}']
+//    bearer_token: secret
+type Config struct {
+	Webhooks []Webhook `yaml:"webhooks"`
+}
+
+// A Webhook receives the events of the groups matching one of the
+// Match selectors, all if there are none. Events is a subset of
+// create, update, delete and expire, all if empty. Failed deliveries
+// are retried up to MaxRetries times with exponential backoff.
+type Webhook struct {
+	URL         string        `yaml:"url"`
+	Events      []string      `yaml:"events"`
+	Match       []string      `yaml:"match"`
+	BearerToken string        `yaml:"bearer_token"`
+	Timeout     time.Duration `yaml:"timeout"`
+	MaxRetries  *int          `yaml:"max_retries"`
+}
+
+// A Payload is the JSON body sent to the webhooks. Reason is the
+// kind of the write causing the event: push, replace, delete or expire.
+type Payload struct {
+	Event  string            `json:"event"`
+	Reason string            `json:"reason"`
+	Tenant string            `json:"tenant,omitempty"`
+	Labels map[string]string `json:"labels"`
+	Time   time.Time         `json:"time"`
+}
+
+// LoadConfig reads the webhook file at the given path.
+func LoadConfig(path string) (*Config, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var cfg Config
+	if err := yaml.UnmarshalStrict(b, &cfg); err != nil {
+		return nil, fmt.Errorf("invalid webhook file %s: %v", path, err)
+	}
+	return &cfg, nil
+}
+
+// A Dispatcher sends the events of the watched storages to the webhooks.
+// The events are queued for every webhook and delivered in the background,
+// so that writes are never blocked by slow webhooks. Events are dropped
+// if a queue is full. The storages are only subscribed to, while there
+// are webhooks.
+type Dispatcher struct {
+	mu    sync.RWMutex
+	hooks []*hook
+
+	// the watched storages and the cancel functions
+	// of their subscriptions by tenant.
+	storages map[string]*storage.MetricStorage
+	cancels  map[string]func()
+}
+
+type hook struct {
+	Webhook
+	client      *http.Client
+	events      map[string]bool
+	matcherSets [][]*selector.Matcher
+	maxRetries  int
+	minBackoff  time.Duration
+	queue       chan Payload
+}
+
+// NewDispatcher validates the webhooks of the config and starts to deliver
+// the events to them.
+func NewDispatcher(cfg Config) (*Dispatcher, error) {
+	d := &Dispatcher{
+		storages: map[string]*storage.MetricStorage{},
+		cancels:  map[string]func(){},
+	}
+	if err := d.SetWebhooks(cfg.Webhooks); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// Validate checks the webhooks for invalid values.
+func Validate(webhooks []Webhook) error {
+	_, err := newHooks(webhooks)
+	return err
+}
+
+// SetWebhooks validates the webhooks and replaces the current ones with
+// them, e.g. after reloading the config. The events already queued for
+// the current webhooks are still delivered. Without webhooks, the
+// subscriptions of the watched storages are cancelled.
+func (d *Dispatcher) SetWebhooks(webhooks []Webhook) error {
+	hooks, err := newHooks(webhooks)
+	if err != nil {
+		return err
+	}
+	for _, h := range hooks {
+		go h.run()
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, h := range d.hooks {
+		close(h.queue)
+	}
+	d.hooks = hooks
+
+	for tenant, ms := range d.storages {
+		_, subscribed := d.cancels[tenant]
+		switch {
+		case len(hooks) > 0 && !subscribed:
+			d.subscribe(tenant, ms)
+		case len(hooks) == 0 && subscribed:
+			d.cancels[tenant]()
+			delete(d.cancels, tenant)
+		}
+	}
+	return nil
+}
+
+func newHooks(webhooks []Webhook) ([]*hook, error) {
+	var hooks []*hook
+	for i, w := range webhooks {
+		u, err := url.Parse(w.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("invalid url %q of webhook %d", w.URL, i)
+		}
+
+		h := &hook{
+			Webhook:    w,
+			client:     &http.Client{Timeout: w.Timeout},
+			events:     map[string]bool{},
+			maxRetries: defaultMaxRetries,
+			minBackoff: minBackoff,
+			queue:      make(chan Payload, queueLength),
+		}
+		if w.Timeout <= 0 {
+			h.client.Timeout = defaultTimeout
+		}
+		if w.MaxRetries != nil {
+			if *w.MaxRetries < 0 {
+				return nil, fmt.Errorf("negative max_retries of webhook %s", w.URL)
+			}
+			h.maxRetries = *w.MaxRetries
+		}
+		for _, e := range w.Events {
+			switch e {
+			case EventCreate, EventUpdate, EventDelete, EventExpire:
+				h.events[e] = true
+			default:
+				return nil, fmt.Errorf("unknown event %q of webhook %s", e, w.URL)
+			}
+		}
+		for _, m := range w.Match {
+			matchers, err := selector.Parse(m)
+			if err != nil {
+				return nil, fmt.Errorf("invalid match %q of webhook %s: %v", m, w.URL, err)
+			}
+			h.matcherSets = append(h.matcherSets, matchers)
+		}
+		hooks = append(hooks, h)
+	}
+	return hooks, nil
+}
+
+// Watch sends the events of the storage of the tenant, which
+// is empty for the default storage, to the webhooks.
+func (d *Dispatcher) Watch(tenant string, ms *storage.MetricStorage) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if cancel, ok := d.cancels[tenant]; ok {
+		cancel()
+		delete(d.cancels, tenant)
+	}
+	d.storages[tenant] = ms
+	if len(d.hooks) > 0 {
+		d.subscribe(tenant, ms)
+	}
+}
+
+// subscribe dispatches the events of the storage until the
+// subscription is cancelled. The lock has to be held.
+func (d *Dispatcher) subscribe(tenant string, ms *storage.MetricStorage) {
+	// the payloads only need the labels of the groups.
+	events, cancel := ms.SubscribeGroups(eventBuffer)
+	d.cancels[tenant] = cancel
+	go func() {
+		for e := range events {
+			p := payloadFor(tenant, e)
+
+			// the queues are only closed while holding the write lock.
+			d.mu.RLock()
+			for _, h := range d.hooks {
+				h.enqueue(p)
+			}
+			d.mu.RUnlock()
+		}
+	}()
+}
+
+// payloadFor returns the Payload of the event.
+func payloadFor(tenant string, e storage.Event) Payload {
+	p := Payload{Reason: string(e.Type), Tenant: tenant, Labels: e.Labels, Time: e.Time}
+	switch {
+	case e.GroupCreated:
+		p.Event = EventCreate
+	case e.GroupDeleted && e.Type == storage.EventExpire:
+		p.Event = EventExpire
+	case e.GroupDeleted:
+		p.Event = EventDelete
+	default:
+		// pushes to existing groups and deletes of some of their series.
+		p.Event = EventUpdate
+	}
+	return p
+}
+
+// enqueue queues the payload, if the webhook is interested in it.
+func (h *hook) enqueue(p Payload) {
+	if len(h.events) > 0 && !h.events[p.Event] {
+		return
+	}
+	if len(h.matcherSets) > 0 && !matchAny(h.matcherSets, p.Labels) {
+		return
+	}
+	select {
+	case h.queue <- p:
+	default:
+		droppedEvents.WithLabelValues(h.URL).Inc()
+		slog.Debug("webhook queue is full, dropping event for ", h.URL)
+	}
+}
+
+// run delivers the queued payloads one after another.
+func (h *hook) run() {
+	for p := range h.queue {
+		h.deliver(p)
+	}
+}
+
+// deliver sends the payload and retries with exponential
+// backoff, until it succeeds or the retries are exhausted.
+func (h *hook) deliver(p Payload) {
+	body, err := json.Marshal(p)
+	if err != nil {
+		slog.Error("failed to encode webhook payload: ", err)
+		return
+	}
+
+	backoff := h.minBackoff
+	for attempt := 0; ; attempt++ {
+		err := h.send(body)
+		if err == nil {
+			return
+		}
+		deliveryErrors.WithLabelValues(h.URL).Inc()
+		if attempt >= h.maxRetries {
+			droppedEvents.WithLabelValues(h.URL).Inc()
+			slog.Error(fmt.Sprintf("giving up webhook %s after %d attempts: %v", h.URL, attempt+1, err))
+			return
+		}
+		slog.Debug(fmt.Sprintf("webhook %s failed, retrying in %s: %v", h.URL, backoff, err))
+
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+func (h *hook) send(body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, h.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if h.BearerToken != "" {
+		req.Header.Set("Authorization", "Bearer "+h.BearerToken)
+	}
+
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	// drain the body, so that the connection can be reused.
+	_, _ = io.Copy(ioutil.Discard, resp.Body)
+
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
+
+// matchAny returns true, if one of the matcher sets matches the labels.
+func matchAny(matcherSets [][]*selector.Matcher, labels map[string]string) bool {
+	for _, matchers := range matcherSets {
+		if selector.MatchLabels(matchers, labels) {
+			return true
+		}
+	}
+	return false
+}
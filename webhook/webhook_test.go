@@ -0,0 +1,147 @@
+package webhook
+
+import (
+	"dev.volix.ops/thor/storage"
+	"encoding/json"
+	"github.com/golang/protobuf/proto"
+	dto "github.com/prometheus/client_model/go"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func testFamilies() map[string]*dto.MetricFamily {
+	return map[string]*dto.MetricFamily{
+		"players": {
+			Name:   proto.String("players"),
+			Type:   dto.MetricType_GAUGE.Enum(),
+			Metric: []*dto.Metric{{Gauge: &dto.Gauge{Value: proto.Float64(1)}}},
+		},
+	}
+}
+
+func TestDispatcher(t *testing.T) {
+	minBackoff = time.Millisecond
+
+	var mu sync.Mutex
+	var received []Payload
+	failures := 1
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		if failures > 0 {
+			// the first delivery fails and is retried.
+			failures--
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		var p Payload
+		if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+			t.Error(err)
+		}
+		received = append(received, p)
+	}))
+	defer server.Close()
+
+	d, err := NewDispatcher(Config{Webhooks: []Webhook{{
+		URL:         server.URL,
+		Events:      []string{EventCreate, EventDelete, EventExpire},
+		Match:       []string{`{job="lobby"}`},
+		BearerToken: "secret",
+	}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ms := storage.NewMetricStorage()
+	d.Watch("net1", ms)
+
+	for _, job := range []string{"lobby", "billing", "lobby"} {
+		// the second push to the lobby is an update, which is not sent.
+		done := make(chan error, 1)
+		ms.SubmitWriteRequest(storage.WriteRequest{
+			Labels:         map[string]string{"job": job},
+			Timestamp:      time.Now().Add(-time.Hour),
+			MetricFamilies: testFamilies(),
+			Done:           done,
+		})
+		if err := <-done; err != nil {
+			t.Fatal(err)
+		}
+	}
+	ms.Expire(time.Minute)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		mu.Lock()
+		n := len(received)
+		mu.Unlock()
+		if n >= 2 || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(received) != 2 {
+		t.Fatalf("expected 2 payloads, got %+v", received)
+	}
+	for i, event := range []string{EventCreate, EventExpire} {
+		p := received[i]
+		if p.Event != event || p.Tenant != "net1" || p.Labels["job"] != "lobby" {
+			t.Errorf("expected %s of the lobby, got %+v", event, p)
+		}
+	}
+	if received[0].Reason != "push" || received[1].Reason != "expire" {
+		t.Errorf("unexpected reasons %q and %q", received[0].Reason, received[1].Reason)
+	}
+}
+
+func TestDispatcherSubscriptions(t *testing.T) {
+	d, err := NewDispatcher(Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ms := storage.NewMetricStorage()
+	d.Watch("", ms)
+	d.Watch("net1", storage.NewMetricStorage())
+
+	// the storages are only subscribed to, while there are webhooks.
+	if len(d.cancels) != 0 {
+		t.Errorf("expected no subscriptions without webhooks, got %d", len(d.cancels))
+	}
+	if err := d.SetWebhooks([]Webhook{{URL: "http://localhost/thor"}}); err != nil {
+		t.Fatal(err)
+	}
+	if len(d.cancels) != 2 {
+		t.Errorf("expected 2 subscriptions, got %d", len(d.cancels))
+	}
+	d.Watch("net1", storage.NewMetricStorage())
+	if len(d.cancels) != 2 {
+		t.Errorf("expected 2 subscriptions after watching a storage again, got %d", len(d.cancels))
+	}
+	if err := d.SetWebhooks(nil); err != nil {
+		t.Fatal(err)
+	}
+	if len(d.cancels) != 0 {
+		t.Errorf("expected subscriptions to be cancelled, got %d", len(d.cancels))
+	}
+}
+
+func TestInvalidConfig(t *testing.T) {
+	for _, w := range []Webhook{
+		{URL: "ftp://bot"},
+		{URL: "http://bot", Events: []string{"created"}},
+		{URL: "http://bot", Match: []string{"{job="}},
+	} {
+		if _, err := NewDispatcher(Config{Webhooks: []Webhook{w}}); err == nil {
+			t.Errorf("expected error for %+v", w)
+		}
+	}
+}